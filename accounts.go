@@ -0,0 +1,196 @@
+package main
+
+// Serving several Google Drive accounts from one mount point.
+//
+// Each account is mounted in a directory named after its label, beneath a
+// synthetic root directory. The inodes of every account's DriveDB start from
+// 1, so to keep them unique across the mount, the top accountBits bits of each
+// NodeID handed to the kernel hold the account's number (its index in the
+// labels, plus one), and the remaining bits hold the inode in that account's
+// DriveDB. Account number 0 is reserved for the synthetic root, which is
+// NodeID 1, as the kernel requires.
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"syscall"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fuseutil"
+)
+
+const (
+	accountBits  = 8 // allows up to 255 accounts
+	accountShift = 64 - accountBits
+)
+
+// multiConn dispatches requests from the kernel to the serveConn of the
+// account they concern, and serves the synthetic root directory itself.
+type multiConn struct {
+	conn     *fuse.Conn
+	uid      uint32
+	gid      uint32
+	accounts map[string]*serveConn // by label
+	byNumber []*serveConn          // index is the account number - 1
+}
+
+func newMultiConn(conn *fuse.Conn, uid, gid uint32, accounts map[string]*serveConn) *multiConn {
+	m := &multiConn{
+		conn:     conn,
+		uid:      uid,
+		gid:      gid,
+		accounts: accounts,
+		byNumber: make([]*serveConn, len(accounts)),
+	}
+	for _, sc := range accounts {
+		m.byNumber[sc.account-1] = sc
+	}
+	return m
+}
+
+// Serve receives Requests from the kernel and dispatches them.
+func (m *multiConn) Serve() error {
+	for {
+		req, err := m.conn.ReadRequest()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+
+		fuse.Debug(fmt.Sprintf("%+v", req))
+		go m.serve(req)
+	}
+	return nil
+}
+
+func (m *multiConn) serve(req fuse.Request) {
+	n := uint64(req.Hdr().Node) >> accountShift
+	if n == 0 {
+		m.serveRoot(req)
+		return
+	}
+	if n > uint64(len(m.byNumber)) {
+		req.RespondError(fuse.ESTALE)
+		return
+	}
+	sc := m.byNumber[n-1]
+	if r, ok := req.(*fuse.RenameRequest); ok && uint64(r.NewDir)>>accountShift != n {
+		// Files can't be moved between accounts, so ask the caller to copy.
+		req.RespondError(fuse.Errno(syscall.EXDEV))
+		return
+	}
+	sc.serve(req)
+}
+
+// serveRoot answers requests about the synthetic root directory, whose
+// children are the root directories of each account.
+func (m *multiConn) serveRoot(req fuse.Request) {
+	switch req := req.(type) {
+	default:
+		fuse.Debug(fmt.Sprintf("ENOSYS: %+v", req))
+		req.RespondError(fuse.ENOSYS)
+
+	case *fuse.InitRequest:
+		resp := fuse.InitResponse{MaxWrite: 128 * 1024,
+			Flags: fuse.InitBigWrites & fuse.InitAsyncRead,
+		}
+		req.Respond(&resp)
+
+	case *fuse.StatfsRequest:
+		var numfiles uint64
+		resp := &fuse.StatfsResponse{Bsize: blockSize}
+		for _, sc := range m.byNumber {
+			if files, folders, err := sc.db.Counts(); err == nil {
+				numfiles += uint64(files + folders)
+			}
+			// The size is the sum of the accounts' limited quotas.
+			if used, total, err := sc.db.Quota(); err == nil && total > 0 {
+				resp.Blocks += uint64(total) / uint64(blockSize)
+				if used < total {
+					resp.Bfree += uint64(total-used) / uint64(blockSize)
+				}
+			}
+		}
+		resp.Files = numfiles
+		resp.Bavail = resp.Bfree
+		req.Respond(resp)
+
+	case *fuse.GetattrRequest:
+		req.Respond(&fuse.GetattrResponse{Attr: m.rootAttr()})
+
+	case *fuse.LookupRequest:
+		sc, ok := m.accounts[req.Name]
+		if !ok {
+			req.RespondError(fuse.ENOENT)
+			return
+		}
+		f, err := sc.db.FileByInode(1)
+		if err != nil {
+			fuse.Debug(fmt.Sprintf("FileByInode(1) of %v: %v", req.Name, err))
+			req.RespondError(fuse.EIO)
+			return
+		}
+		req.Respond(&fuse.LookupResponse{
+			Node:       sc.global(1),
+			EntryValid: *driveMetadataLatency,
+			Attr:       sc.attrFromFile(*f),
+		})
+
+	case *fuse.ForgetRequest:
+		req.Respond()
+
+	case *fuse.OpenRequest:
+		if !req.Dir {
+			req.RespondError(fuse.EPERM)
+			return
+		}
+		req.Respond(&fuse.OpenResponse{})
+
+	case *fuse.ReadRequest:
+		if !req.Dir {
+			req.RespondError(fuse.EPERM)
+			return
+		}
+		labels := make([]string, 0, len(m.accounts))
+		for label := range m.accounts {
+			labels = append(labels, label)
+		}
+		sort.Strings(labels)
+		var data []byte
+		for _, label := range labels {
+			inode := uint64(m.accounts[label].global(1))
+			data = fuse.AppendDirent(data, fuse.Dirent{Inode: inode, Name: label, Type: fuse.DT_Dir})
+		}
+		resp := &fuse.ReadResponse{Data: make([]byte, 0, req.Size)}
+		fuseutil.HandleRead(req, resp, data)
+		req.Respond(resp)
+
+	case *fuse.ReleaseRequest:
+		req.Respond()
+
+	case *fuse.DestroyRequest:
+		req.Respond()
+
+	// The set of accounts is fixed when the filesystem is mounted.
+	case *fuse.CreateRequest, *fuse.MkdirRequest, *fuse.RemoveRequest, *fuse.RenameRequest, *fuse.SetattrRequest:
+		req.RespondError(fuse.EPERM)
+	}
+}
+
+func (m *multiConn) rootAttr() fuse.Attr {
+	return fuse.Attr{
+		Valid: *driveMetadataLatency,
+		Inode: 1,
+		Atime: startup,
+		Mtime: startup,
+		Ctime: startup,
+		Uid:   m.uid,
+		Gid:   m.gid,
+		Mode:  os.ModeDir | 0755,
+		Nlink: uint32(2 + len(m.accounts)),
+	}
+}
@@ -0,0 +1,122 @@
+package drive_db
+
+// When files were last opened is recorded, for a "Recently Opened" view.
+// Recording happens off the read path, on its own goroutine, and each file's
+// time is rewritten at most once per accessThrottle, so that a file being
+// read doesn't cost a db write per read.
+
+import (
+	"time"
+
+	gdrive "code.google.com/p/google-api-go-client/drive/v2"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const (
+	// accessThrottle is how long after a file's access time is recorded
+	// that further accesses to it are ignored.
+	accessThrottle = time.Minute
+	// accessQueueSize is the number of accesses which may wait to be
+	// recorded before further ones are dropped.
+	accessQueueSize = 1000
+)
+
+// accessTimeKey is the key of the time fileId was last accessed.
+func accessTimeKey(fileId string) []byte {
+	return []byte("atm:" + fileId)
+}
+
+// accessKey is the key of fileId in the index by access time.
+func accessKey(t time.Time, fileId string) []byte {
+	return []byte("acc:" + t.UTC().Format(modTimeFormat) + ":" + fileId)
+}
+
+// RecordAccess notes that inode has been accessed, e.g. opened, without
+// waiting for it to be written. Accesses are dropped if they can't be
+// recorded as fast as they're made.
+func (d *DriveDB) RecordAccess(inode uint64) {
+	if d.opts.ReadOnly {
+		return
+	}
+	select {
+	case d.accessq <- inode:
+	default:
+	}
+}
+
+// recordAccesses writes the accesses queued by RecordAccess, skipping those
+// of files recorded within accessThrottle, until the db is closed.
+func (d *DriveDB) recordAccesses() {
+	recorded := make(map[uint64]time.Time)
+	for {
+		var inode uint64
+		select {
+		case inode = <-d.accessq:
+		case <-d.ctx.Done():
+			return
+		}
+		now := time.Now()
+		if now.Sub(recorded[inode]) < accessThrottle {
+			continue
+		}
+		if len(recorded) >= accessQueueSize {
+			for i, t := range recorded {
+				if now.Sub(t) >= accessThrottle {
+					delete(recorded, i)
+				}
+			}
+		}
+		recorded[inode] = now
+		fileId, err := d.FileIdForInode(inode)
+		if err != nil {
+			continue
+		}
+		if err := d.writeAccess(fileId, now); err != nil {
+			debug.Printf("could not record access to %v: %v", fileId, err)
+		}
+	}
+}
+
+// writeAccess records that fileId was accessed at t.
+func (d *DriveDB) writeAccess(fileId string, t time.Time) error {
+	bytes, err := d.encode(t.UnixNano())
+	if err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	d.forgetAccess(batch, fileId)
+	batch.Put(accessTimeKey(fileId), bytes)
+	batch.Put(accessKey(t, fileId), nil)
+	return d.db.Write(batch, nil)
+}
+
+// forgetAccess adds to batch the removal of fileId's access time.
+func (d *DriveDB) forgetAccess(batch *leveldb.Batch, fileId string) {
+	var nanos int64
+	if err := d.get(accessTimeKey(fileId), &nanos); err != nil {
+		return
+	}
+	batch.Delete(accessTimeKey(fileId))
+	batch.Delete(accessKey(time.Unix(0, nanos), fileId))
+}
+
+// RecentlyAccessed returns up to limit files, most recently accessed first.
+func (d *DriveDB) RecentlyAccessed(limit int) ([]*gdrive.File, error) {
+	prefix := "acc:"
+	iter, err := d.newIterator(util.BytesPrefix([]byte(prefix)))
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for ok := iter.Last(); ok && len(ids) < limit; ok = iter.Prev() {
+		// acc:<time>:<fileId>; the time has colons of its own.
+		key := string(iter.Key())
+		ids = append(ids, key[len(prefix)+len(modTimeFormat)+1:])
+	}
+	d.releaseIterator(iter)
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	return d.filesByIds(ids)
+}
@@ -0,0 +1,68 @@
+package drive_db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecordAccess(t *testing.T) {
+	fd := newFakeDrive()
+	for _, id := range []string{"a", "b", "c"} {
+		fd.file(id, id+".txt", id)
+	}
+	d := newTestDB(t, fd, nil)
+	inode := func(id string) uint64 {
+		t.Helper()
+		inode, err := d.InodeForFileId(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return inode
+	}
+	// accessed waits for the access time of fileId to be recorded, and
+	// returns it.
+	accessed := func(fileId string) int64 {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			var nanos int64
+			if err := d.get(accessTimeKey(fileId), &nanos); err == nil {
+				return nanos
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("access to %s not recorded after 10s", fileId)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	d.RecordAccess(inode("a"))
+	first := accessed("a")
+	time.Sleep(time.Millisecond)
+	d.RecordAccess(inode("a"))
+	// Accesses are recorded in turn, so once b's is, a's second has been
+	// dealt with.
+	d.RecordAccess(inode("b"))
+	accessed("b")
+	if again := accessed("a"); again != first {
+		t.Errorf("a second access to a, just after the first, was written")
+	}
+	time.Sleep(time.Millisecond)
+	d.RecordAccess(inode("c"))
+	accessed("c")
+
+	files, err := d.RecentlyAccessed(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, f := range files {
+		ids = append(ids, f.Id)
+	}
+	if len(ids) != 3 || ids[0] != "c" || ids[1] != "b" || ids[2] != "a" {
+		t.Errorf("RecentlyAccessed(10) = %v, want [c b a]", ids)
+	}
+	if files, err := d.RecentlyAccessed(1); err != nil || len(files) != 1 || files[0].Id != "c" {
+		t.Errorf("RecentlyAccessed(1) = %v, %v, want [c]", files, err)
+	}
+}
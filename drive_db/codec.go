@@ -0,0 +1,135 @@
+package drive_db
+
+// Values in the db are encoded by a Codec, chosen when the db is created.
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+)
+
+// A Codec encodes the values stored in the db.
+type Codec interface {
+	// Name identifies the codec; it is recorded in the db, so it must not
+	// change.
+	Name() string
+	Encode(item interface{}) ([]byte, error)
+	Decode(data []byte, item interface{}) error
+}
+
+var (
+	// JSONCodec encodes values as JSON. It is the default, and the only
+	// codec of dbs which predate codecs.
+	JSONCodec Codec = jsonCodec{}
+	// GobCodec encodes values with encoding/gob. As each value is decoded
+	// on its own, each carries the description of its type, which is
+	// bigger than the value: BenchmarkCodec measures a file's metadata as
+	// about three times the size of its JSON, and several times slower to
+	// encode and decode, so gob only pays for values much larger than
+	// their types.
+	GobCodec Codec = gobCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "json" }
+
+func (jsonCodec) Encode(item interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	err := enc.Encode(item)
+	return buf.Bytes(), err
+}
+
+func (jsonCodec) Decode(data []byte, item interface{}) error {
+	dec := json.NewDecoder(bytes.NewBuffer(data))
+	return dec.Decode(item)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string { return "gob" }
+
+func (gobCodec) Encode(item interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(item)
+	return buf.Bytes(), err
+}
+
+func (gobCodec) Decode(data []byte, item interface{}) error {
+	return gob.NewDecoder(bytes.NewBuffer(data)).Decode(item)
+}
+
+// codecByName returns the codec of the given name, or JSONCodec if there's
+// no such codec.
+func codecByName(name string) Codec {
+	for _, c := range []Codec{JSONCodec, GobCodec} {
+		if c.Name() == name {
+			return c
+		}
+	}
+	log.Printf("unknown codec %q, using %s", name, JSONCodec.Name())
+	return JSONCodec
+}
+
+// compressedMarker begins values compressed with zlib. Neither JSON nor gob
+// encodings can begin with it, so compressed and uncompressed values can be
+// told apart, and --drivedb.compress can be changed at will.
+const compressedMarker = 0
+
+// compressThreshold is the size below which values aren't worth compressing.
+const compressThreshold = 256
+
+// compress returns data compressed and marked as such, if that makes it
+// smaller, and otherwise data unchanged. Whether that makes the db smaller,
+// given leveldb's own compression, is for BenchmarkCompress to say.
+func compress(data []byte) []byte {
+	if len(data) < compressThreshold {
+		return data
+	}
+	var buf bytes.Buffer
+	buf.WriteByte(compressedMarker)
+	w := zlib.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return data
+	}
+	if err := w.Close(); err != nil || buf.Len() >= len(data) {
+		return data
+	}
+	return buf.Bytes()
+}
+
+// uncompress reverses compress, returning unmarked data unchanged.
+func uncompress(data []byte) ([]byte, error) {
+	if len(data) == 0 || data[0] != compressedMarker {
+		return data, nil
+	}
+	r, err := zlib.NewReader(bytes.NewReader(data[1:]))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// checkCodec records the db's codec in its schema if the db is new, and
+// otherwise checks it's the one the db was written with.
+func (d *DriveDB) checkCodec(fresh bool) error {
+	name := d.opts.Codec.Name()
+	s, found, err := d.readSchema()
+	switch {
+	case err != nil:
+		return err
+	case !found && fresh:
+		// It's laid out as this version already, so needn't be migrated.
+		return d.setSchemaVersion(schemaVersion)
+	}
+	if s.Codec != name {
+		return fmt.Errorf("db was written with the %s codec, not %s; remove it to change codec", s.Codec, name)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package drive_db
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	gdrive "code.google.com/p/google-api-go-client/drive/v2"
+)
+
+// benchFile returns metadata like that of a typical file in the db.
+func benchFile() *gdrive.File {
+	owner := &gdrive.User{
+		DisplayName:  "Some User",
+		EmailAddress: "some.user@example.com",
+		Kind:         "drive#user",
+		PermissionId: "01234567890123456789",
+	}
+	return &gdrive.File{
+		AlternateLink:         "https://docs.google.com/file/d/0B1a2b3c4d5e6f7g8h9i0jKLMNOP/edit?usp=drivesdk",
+		Copyable:              true,
+		CreatedDate:           "2014-03-02T11:22:33.444Z",
+		DownloadUrl:           "https://doc-0s-4k-docs.googleusercontent.com/docs/securesc/abcdefghijklmnop/0B1a2b3c4d5e6f7g8h9i0jKLMNOP?e=download&gd=true",
+		Editable:              true,
+		Etag:                  `"a1B2c3D4e5F6g7H8i9J0kLmNoPq/MTM5MzE2OTQ5ODk5Mg"`,
+		FileExtension:         "pdf",
+		FileSize:              1234567,
+		HeadRevisionId:        "0B1a2b3c4d5e6f7g8h9i0jKLMNOPQRSTUVWXyz",
+		IconLink:              "https://ssl.gstatic.com/docs/doclist/images/icon_10_pdf_list.png",
+		Id:                    "0B1a2b3c4d5e6f7g8h9i0jKLMNOP",
+		Kind:                  "drive#file",
+		Labels:                &gdrive.FileLabels{Viewed: true},
+		LastModifyingUser:     owner,
+		LastModifyingUserName: owner.DisplayName,
+		LastViewedByMeDate:    "2014-03-03T09:08:07.654Z",
+		Md5Checksum:           "0123456789abcdef0123456789abcdef",
+		MimeType:              "application/pdf",
+		ModifiedByMeDate:      "2014-03-02T11:22:33.444Z",
+		ModifiedDate:          "2014-03-02T11:22:33.444Z",
+		OriginalFilename:      "Quarterly report.pdf",
+		OwnerNames:            []string{owner.DisplayName},
+		Owners:                []*gdrive.User{owner},
+		Parents: []*gdrive.ParentReference{{
+			Id:         "0B1a2b3c4d5e6f7gPARENTxyz",
+			Kind:       "drive#parentReference",
+			ParentLink: "https://www.googleapis.com/drive/v2/files/0B1a2b3c4d5e6f7gPARENTxyz",
+			SelfLink:   "https://www.googleapis.com/drive/v2/files/0B1a2b3c4d5e6f7g8h9i0jKLMNOP/parents/0B1a2b3c4d5e6f7gPARENTxyz",
+		}},
+		QuotaBytesUsed: 1234567,
+		SelfLink:       "https://www.googleapis.com/drive/v2/files/0B1a2b3c4d5e6f7g8h9i0jKLMNOP",
+		Title:          "Quarterly report.pdf",
+		WebContentLink: "https://docs.google.com/uc?id=0B1a2b3c4d5e6f7g8h9i0jKLMNOP&export=download",
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	for _, c := range []Codec{JSONCodec, GobCodec} {
+		want := benchFile()
+		data, err := c.Encode(want)
+		if err != nil {
+			t.Fatalf("%s: Encode: %v", c.Name(), err)
+		}
+		var got gdrive.File
+		if err := c.Decode(data, &got); err != nil {
+			t.Fatalf("%s: Decode: %v", c.Name(), err)
+		}
+		if !reflect.DeepEqual(&got, want) {
+			t.Errorf("%s: decoded %+v, want %+v", c.Name(), got, *want)
+		}
+		if codecByName(c.Name()) != c {
+			t.Errorf("codecByName(%q) = %v", c.Name(), codecByName(c.Name()))
+		}
+	}
+}
+
+func TestCheckCodec(t *testing.T) {
+	d := newTestDB(t, newFakeDrive(), nil)
+	// The codec is changed under it, so it mustn't be writing.
+	waitPolled(t, d)
+	if s, found, err := d.readSchema(); err != nil || !found || s != (schema{schemaVersion, "json"}) {
+		t.Fatalf("new db's schema = %+v, %v, %v, want version %d, json", s, found, err, schemaVersion)
+	}
+	if err := d.checkCodec(false); err != nil {
+		t.Errorf("checkCodec with the db's own codec: %v", err)
+	}
+	d.opts.Codec = GobCodec
+	if err := d.checkCodec(false); err == nil {
+		t.Errorf("checkCodec of a json db with the gob codec succeeded")
+	}
+
+	// A db which predates codecs recorded only its version, and was written
+	// as JSON.
+	data, _ := JSONCodec.Encode(schemaVersion)
+	if err := d.db.Put(schemaKey(), data, nil); err != nil {
+		t.Fatal(err)
+	}
+	if s, _, err := d.readSchema(); err != nil || s != (schema{schemaVersion, "json"}) {
+		t.Errorf("schema of a db which predates codecs = %+v, %v, want version %d, json", s, err, schemaVersion)
+	}
+	if err := d.checkCodec(false); err == nil {
+		t.Errorf("checkCodec of a db which predates codecs with the gob codec succeeded")
+	}
+	d.opts.Codec = JSONCodec
+	if err := d.checkCodec(false); err != nil {
+		t.Errorf("checkCodec of a db which predates codecs with the json codec: %v", err)
+	}
+}
+
+// BenchmarkCodec measures the time to encode and decode a file's metadata
+// with each codec, and the size it's encoded to, which is most of the db's
+// size.
+func BenchmarkCodec(b *testing.B) {
+	f := benchFile()
+	for _, c := range []Codec{JSONCodec, GobCodec} {
+		data, err := c.Encode(f)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(c.Name()+"/encode", func(b *testing.B) {
+			b.ReportMetric(float64(len(data)), "bytes/value")
+			for i := 0; i < b.N; i++ {
+				c.Encode(f)
+			}
+		})
+		b.Run(c.Name()+"/decode", func(b *testing.B) {
+			b.ReportMetric(float64(len(data)), "bytes/value")
+			for i := 0; i < b.N; i++ {
+				var f gdrive.File
+				if err := c.Decode(data, &f); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkCompress measures the size of the db, once compacted, per file
+// stored, with and without --drivedb.compress. leveldb compresses its blocks
+// itself, so only a db on disk says whether the flag is worth setting.
+func BenchmarkCompress(b *testing.B) {
+	const batch = 100
+	defer func(c bool) { *compressValues = c }(*compressValues)
+	for _, c := range []bool{false, true} {
+		b.Run(fmt.Sprintf("compress=%v", c), func(b *testing.B) {
+			*compressValues = c
+			d := newTestDB(b, newFakeDrive(), nil)
+			files := make([]*gdrive.File, batch)
+			for n := 0; n < b.N; n++ {
+				for i := range files {
+					f := benchFile()
+					f.Id = fmt.Sprintf("%s-%d-%d", f.Id, n, i)
+					f.Title = fmt.Sprintf("%d %s", i, f.Title)
+					f.Parents[0].Id = "root"
+					files[i] = f
+				}
+				apply(b, d, files...)
+			}
+			if err := d.Compact(); err != nil {
+				b.Fatal(err)
+			}
+			size, err := d.dbSize()
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportMetric(float64(size)/float64(b.N*batch), "bytes/file")
+		})
+	}
+}
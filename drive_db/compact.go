@@ -0,0 +1,77 @@
+package drive_db
+
+// leveldb reclaims the space of deleted and overwritten records as it
+// compacts, which it only does as it's written to. With heavy churn the db
+// can grow well beyond its live data, so it can also be compacted on demand
+// or periodically.
+
+import (
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Compact compacts the whole db. It waits until no iterators or snapshots
+// are open, so as not to slow a listing or scan, though they may be opened
+// while it runs.
+func (d *DriveDB) Compact() error {
+	if d.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	d.Lock()
+	for !d.closed && d.itersOpen > 0 {
+		d.itersIdle.Wait()
+	}
+	closed := d.closed
+	d.Unlock()
+	if closed {
+		return ErrClosed
+	}
+	before, err := d.dbSize()
+	if err != nil {
+		return err
+	}
+	if err := d.db.CompactRange(util.Range{}); err != nil {
+		return err
+	}
+	after, err := d.dbSize()
+	if err != nil {
+		return err
+	}
+	d.Lock()
+	if before > after {
+		d.reclaimed += before - after
+	}
+	d.Unlock()
+	d.opts.Logger.Debugf("compacted db from %d to %d bytes", before, after)
+	return nil
+}
+
+// compactPeriodically is a background goroutine which compacts the db every
+// opts.CompactInterval, until it's closed.
+func (d *DriveDB) compactPeriodically() {
+	for {
+		select {
+		case <-time.After(d.opts.CompactInterval):
+		case <-d.ctx.Done():
+			return
+		}
+		switch err := d.Compact(); err {
+		case nil:
+		case ErrClosed:
+			return
+		default:
+			d.opts.Logger.Errorf("error compacting db: %v", err)
+		}
+	}
+}
+
+// dbSize returns the approximate size of the leveldb on disk.
+func (d *DriveDB) dbSize() (int64, error) {
+	// All our keys are printable, so this range spans the whole db.
+	sizes, err := d.db.SizeOf([]util.Range{{Start: nil, Limit: []byte{0xff}}})
+	if err != nil {
+		return 0, err
+	}
+	return sizes.Sum(), nil
+}
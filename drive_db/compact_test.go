@@ -0,0 +1,60 @@
+package drive_db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCompactWaitsForIterators(t *testing.T) {
+	fd := newFakeDrive()
+	fd.file("a", "a.txt", "a")
+	d := newTestDB(t, fd, nil)
+
+	s, err := d.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- d.Compact() }()
+	select {
+	case err := <-done:
+		t.Fatalf("Compact returned %v with a snapshot open", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// It goes as soon as the snapshot's released.
+	released := time.Now()
+	s.Release()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wait := time.Since(released); wait > 500*time.Millisecond {
+			t.Errorf("Compact waited %v after the snapshot was released", wait)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Compact didn't return once the snapshot was released")
+	}
+
+	// A Compact left waiting is ended by Close.
+	iter, err := d.newIterator(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { done <- d.Compact() }()
+	time.Sleep(10 * time.Millisecond)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		d.releaseIterator(iter)
+	}()
+	d.Close()
+	select {
+	case err := <-done:
+		if err != nil && err != ErrClosed {
+			t.Errorf("Compact during Close: %v, want nil or ErrClosed", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Compact didn't return once the db was closed")
+	}
+}
@@ -0,0 +1,89 @@
+package drive_db
+
+// Running counts of the files and folders in the db, so statfs needn't scan
+// it. They're kept in memory, and written with each batch which changes them,
+// so the stored counts are those of the files written. They can still drift,
+// e.g. if a batch isn't written, or a batch adds the same new file twice;
+// --drivedb.recount recomputes them at startup.
+
+import (
+	"errors"
+	"flag"
+
+	gdrive "code.google.com/p/google-api-go-client/drive/v2"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+var recount = flag.Bool("drivedb.recount", false, "recompute the counts of files and folders at startup, in case they've drifted")
+
+// fileCounts counts the files in the db, including the special folders.
+type fileCounts struct {
+	Files   int64
+	Folders int64
+}
+
+func countsKey() []byte {
+	return internalKey("counts")
+}
+
+// add adds n of f to the counts. f may be nil.
+func (c *fileCounts) add(f *gdrive.File, n int64) {
+	switch {
+	case f == nil:
+	case f.MimeType == driveFolderMimeType:
+		c.Folders += n
+	default:
+		c.Files += n
+	}
+}
+
+// loadCounts reads the stored counts, computing them if there are none or
+// --drivedb.recount is set. Those of a read only db aren't stored.
+func (d *DriveDB) loadCounts() error {
+	d.countmu.Lock()
+	defer d.countmu.Unlock()
+	err := d.get(countsKey(), &d.counts)
+	if err == nil && !*recount {
+		return nil
+	}
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	d.counts = fileCounts{}
+	err = d.scan("fid:", func(key, value []byte) {
+		var f gdrive.File
+		if err := d.decode(value, &f); err == nil {
+			d.counts.add(&f, 1)
+		}
+	})
+	if err != nil || d.opts.ReadOnly {
+		return err
+	}
+	bytes, err := d.encode(d.counts)
+	if err != nil {
+		return err
+	}
+	return d.db.Put(countsKey(), bytes, nil)
+}
+
+// recount adds to batch the counts after a file changes from of to f. of is
+// nil for a new file, and f for a removed one.
+func (d *DriveDB) recount(batch *leveldb.Batch, of, f *gdrive.File) {
+	d.countmu.Lock()
+	defer d.countmu.Unlock()
+	d.counts.add(of, -1)
+	d.counts.add(f, 1)
+	if bytes, err := d.encode(d.counts); err == nil {
+		batch.Put(countsKey(), bytes)
+	}
+}
+
+// Counts returns the number of files, and of folders, in the db.
+func (d *DriveDB) Counts() (files, folders int64, err error) {
+	if d.isClosed() {
+		return 0, 0, ErrClosed
+	}
+	d.countmu.Lock()
+	defer d.countmu.Unlock()
+	return d.counts.Files, d.counts.Folders, nil
+}
@@ -0,0 +1,68 @@
+package drive_db
+
+import (
+	"testing"
+
+	gdrive "code.google.com/p/google-api-go-client/drive/v2"
+)
+
+func TestCounts(t *testing.T) {
+	fd := newFakeDrive()
+	d := newTestDB(t, fd, nil)
+	files, folders, err := d.Counts()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts := func(what string, wantFiles, wantFolders int64) {
+		t.Helper()
+		f, dirs, err := d.Counts()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f != files+wantFiles || dirs != folders+wantFolders {
+			t.Errorf("after %s, Counts() = %d files, %d folders, want %d, %d", what, f, dirs, files+wantFiles, folders+wantFolders)
+		}
+	}
+	fd.folder("dir", "dir")
+	fd.file("a", "a.txt", "a", "dir")
+	fd.file("b", "b.txt", "b")
+	resync(t, d, fd)
+	counts("creating two files and a folder", 2, 1)
+
+	fd.update("b", func(f *gdrive.File) { f.Title = "renamed.txt" })
+	resync(t, d, fd)
+	counts("renaming a file", 2, 1)
+
+	fd.remove("b")
+	resync(t, d, fd)
+	counts("removing a file", 1, 1)
+	fd.remove("dir")
+	resync(t, d, fd)
+	counts("removing a folder", 1, 0)
+
+	// The counts are stored, and recomputed if they've drifted.
+	wantFiles, wantFolders, _ := d.Counts()
+	d.counts = fileCounts{Files: 1000}
+	bytes, err := d.encode(d.counts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.db.Put(countsKey(), bytes, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.loadCounts(); err != nil {
+		t.Fatal(err)
+	}
+	if f, _, _ := d.Counts(); f != 1000 {
+		t.Errorf("loadCounts read %d files, want the stored 1000", f)
+	}
+	defer func(r bool) { *recount = r }(*recount)
+	*recount = true
+	if err := d.loadCounts(); err != nil {
+		t.Fatal(err)
+	}
+	if f, dirs, _ := d.Counts(); f != wantFiles || dirs != wantFolders {
+		t.Errorf("with --drivedb.recount, Counts() = %d, %d, want %d, %d", f, dirs, wantFiles, wantFolders)
+	}
+}
@@ -0,0 +1,1235 @@
+package drive_db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gdrive "code.google.com/p/google-api-go-client/drive/v2"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+func TestInodesForFileIds(t *testing.T) {
+	fd := newFakeDrive()
+	fd.file("a", "a.txt", "a")
+	d := newTestDB(t, fd, nil)
+
+	a, err := d.InodeForFileId("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inodes, err := d.InodesForFileIds([]string{"b", "a", "root", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inodes[1] != a || inodes[2] != 1 || inodes[0] != inodes[3] || inodes[0] == a {
+		t.Errorf("InodesForFileIds(b, a, root, b) = %v, want [b %d 1 b]", inodes, a)
+	}
+	if id, err := d.FileIdForInode(inodes[0]); err != nil || id != "b" {
+		t.Errorf("FileIdForInode(%d) = %q, %v, want b", inodes[0], id, err)
+	}
+}
+
+func TestInodesForFileIdsWriteFailure(t *testing.T) {
+	d := newTestDB(t, newFakeDrive(), nil)
+	d.Pause()
+	waitPolled(t, d)
+	d.Lock()
+	last := d.cpt.LastInode
+	d.Unlock()
+
+	// The inodes allocated are given back if they can't be recorded.
+	d.db.Close()
+	if _, err := d.InodesForFileIds([]string{"a", "b"}); err == nil {
+		t.Fatal("InodesForFileIds succeeded with the db closed")
+	}
+	d.Lock()
+	if d.cpt.LastInode != last {
+		t.Errorf("last inode %d after failing to record the mappings, want %d", d.cpt.LastInode, last)
+	}
+	d.Unlock()
+
+	// As is InodeForFileId's.
+	if _, err := d.InodeForFileId("c"); err == nil {
+		t.Fatal("InodeForFileId succeeded with the db closed")
+	}
+	d.Lock()
+	defer d.Unlock()
+	if d.cpt.LastInode != last {
+		t.Errorf("last inode %d after failing to record the mapping of one file, want %d", d.cpt.LastInode, last)
+	}
+}
+
+func TestInodesForFileIdsRepairsReverseMapping(t *testing.T) {
+	fd := newFakeDrive()
+	fd.file("a", "a.txt", "a")
+	d := newTestDB(t, fd, nil)
+
+	a, err := d.InodeForFileId("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.db.Delete(inodeToFileIdKey(a), nil); err != nil {
+		t.Fatal(err)
+	}
+	inodes, err := d.InodesForFileIds([]string{"a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inodes[0] != a {
+		t.Errorf("InodesForFileIds(a) = %v, want [%d]", inodes, a)
+	}
+	if id, err := d.FileIdForInode(a); err != nil || id != "a" {
+		t.Errorf("FileIdForInode(%d) = %q, %v, want a", a, id, err)
+	}
+}
+
+func TestInodeCacheSize(t *testing.T) {
+	fd := newFakeDrive()
+	for _, id := range []string{"a", "b", "c"} {
+		fd.file(id, id+".txt", id)
+	}
+	d := newTestDB(t, fd, &DriveDBOptions{InodeCacheSize: 2})
+	d.InvalidateCache()
+
+	inodes, err := d.InodesForFileIds([]string{"a", "b", "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, inode := range inodes {
+		if _, err := d.FileByInode(inode); err != nil {
+			t.Fatal(err)
+		}
+		if want := i + 1; want <= 2 && d.lruCache.Len() != want {
+			t.Errorf("after %d reads, %d entries cached, want %d", i+1, d.lruCache.Len(), want)
+		}
+	}
+	if n := d.lruCache.Len(); n != 2 {
+		t.Errorf("%d entries cached, want 2", n)
+	}
+	if _, _, evictions := d.lruCache.Stats(); evictions != 1 {
+		t.Errorf("%d evictions, want 1", evictions)
+	}
+	// a was the least recently used, so was evicted.
+	if _, ok := d.lruCache.Get(inodes[0]); ok {
+		t.Errorf("a still cached")
+	}
+}
+
+func TestMultipleParents(t *testing.T) {
+	fd := newFakeDrive()
+	fd.folder("x", "x")
+	fd.folder("y", "y")
+	fd.file("f", "f.txt", "f", "x", "y")
+	d := newTestDB(t, fd, nil)
+
+	for _, parent := range []string{"x", "y"} {
+		ids, err := d.ChildFileIds(parent)
+		if err != nil || len(ids) != 1 || ids[0] != "f" {
+			t.Errorf("ChildFileIds(%s) = %v, %v, want [f]", parent, ids, err)
+		}
+	}
+	if err := d.RemoveParentRef("f", "x"); err != nil {
+		t.Fatal(err)
+	}
+	if ids, err := d.ChildFileIds("x"); err != nil || len(ids) != 0 {
+		t.Errorf("after detaching from x, ChildFileIds(x) = %v, %v, want none", ids, err)
+	}
+	if ids, err := d.ChildFileIds("y"); err != nil || len(ids) != 1 {
+		t.Errorf("after detaching from x, ChildFileIds(y) = %v, %v, want [f]", ids, err)
+	}
+}
+
+func TestParentFileIds(t *testing.T) {
+	fd := newFakeDrive()
+	fd.folder("x", "x")
+	fd.file("f", "f.txt", "f", "x", "root", "nowhere")
+	fd.file("lost", "lost.txt", "l", "nowhere")
+	d := newTestDB(t, fd, nil)
+
+	// Parents not in the db are left out.
+	ids, err := d.ParentFileIds("f")
+	if err != nil || !reflect.DeepEqual(ids, []string{"x", "root"}) {
+		t.Fatalf("ParentFileIds(f) = %v, %v, want [x root]", ids, err)
+	}
+	if d.IsRoot(ids[0]) || !d.IsRoot(ids[1]) {
+		t.Errorf("IsRoot(x), IsRoot(root) = %v, %v, want false, true", d.IsRoot(ids[0]), d.IsRoot(ids[1]))
+	}
+	if err := d.RemoveParentRef("f", "x"); err != nil {
+		t.Fatal(err)
+	}
+	if ids, err := d.ParentFileIds("f"); err != nil || !reflect.DeepEqual(ids, []string{"root"}) {
+		t.Errorf("after detaching from x, ParentFileIds(f) = %v, %v, want [root]", ids, err)
+	}
+	if ids, err := d.ParentFileIds("lost"); err != nil || !reflect.DeepEqual(ids, []string{orphanFileId}) {
+		t.Errorf("ParentFileIds(lost) = %v, %v, want the orphans folder", ids, err)
+	}
+	if _, err := d.ParentFileIds("gone"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("ParentFileIds of a missing file = %v, want ErrNotFound", err)
+	}
+}
+
+func TestPathForInode(t *testing.T) {
+	d := newTestDB(t, newFakeDrive(), nil)
+	apply(t, d,
+		testFolder("a", "a"),
+		testFolder("b", "b", "a"),
+		testFolder("c", "c", "b"),
+		testFile("f", "f.txt", "c", "z"),
+		testFolder("z", "z"),
+		// A cycle, which only one of has a way out of.
+		testFolder("c1", "c1", "c2", "root"),
+		testFolder("c2", "c2", "c1"),
+		testFolder("l1", "l1", "l2"),
+		testFolder("l2", "l2", "l1"),
+	)
+	path := func(id string) (string, []string, error) {
+		t.Helper()
+		inode, err := d.InodeForFileId(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := d.PathForInode(inode)
+		if err != nil {
+			return "", nil, err
+		}
+		paths, err := d.PathsForInode(inode)
+		return p, paths, err
+	}
+
+	for id, want := range map[string][]string{
+		"c":    {"/a/b/c"},
+		"f":    {"/a/b/c/f.txt", "/z/f.txt"}, // the first in lexical order
+		"root": {"/"},
+		"c2":   {"/c1/c2"},
+	} {
+		if p, paths, err := path(id); err != nil || p != want[0] || !reflect.DeepEqual(paths, want) {
+			t.Errorf("PathForInode(%v), PathsForInode = %q, %q, %v, want %q, %q", id, p, paths, err, want[0], want)
+		}
+	}
+	if _, _, err := path("l1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("PathForInode of a folder in a cycle = %v, want ErrNotFound", err)
+	}
+}
+
+func TestUpdateFileWithoutBatch(t *testing.T) {
+	dir := t.TempDir()
+	d := openTestDB(t, newFakeDrive(), dir, nil)
+	if _, err := d.UpdateFile(nil, testFile("u", "u.txt")); err != nil {
+		t.Fatalf("UpdateFile(nil, u): %v", err)
+	}
+	if f, err := d.FileById("u"); err != nil || f.Title != "u.txt" {
+		t.Errorf("FileById(u) = %v, %v, want u.txt", f, err)
+	}
+	ids, err := d.ChildFileIds("root")
+	found := false
+	for _, id := range ids {
+		found = found || id == "u"
+	}
+	if err != nil || !found {
+		t.Errorf("ChildFileIds(root) = %v, %v, want u among them", ids, err)
+	}
+
+	// It's written to the db, not just cached.
+	d.Close()
+	d = openTestDB(t, newFakeDrive(), dir, &DriveDBOptions{ReadOnly: true})
+	if f, err := d.FileById("u"); err != nil || f.Title != "u.txt" {
+		t.Errorf("FileById(u) = %v, %v after reopening, want u.txt", f, err)
+	}
+}
+
+func TestFileByPath(t *testing.T) {
+	fd := newFakeDrive()
+	fd.folder("x", "x")
+	fd.file("f", "f.txt", "f", "x")
+	fd.file("d1", "dup.txt", "1", "x")
+	fd.file("d2", "dup.txt", "2", "x")
+	d := newTestDB(t, fd, nil)
+
+	for _, p := range []string{"x/f.txt", "/x/f.txt", "x//f.txt/"} {
+		if f, err := d.FileByPath(p); err != nil || f.Id != "f" {
+			t.Errorf("FileByPath(%q) = %v, %v, want f", p, f, err)
+		}
+	}
+	if f, err := d.FileByPath("/"); err != nil || f.Id != "root" {
+		t.Errorf("FileByPath(/) = %v, %v, want root", f, err)
+	}
+	if _, err := d.FileByPath("x/nope/f.txt"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("FileByPath(x/nope/f.txt) error = %v, want ErrNotFound", err)
+	}
+	_, err := d.FileByPath("x/dup.txt")
+	var aerr *ErrAmbiguousPath
+	if !errors.As(err, &aerr) {
+		t.Fatalf("FileByPath(x/dup.txt) error = %v, want ErrAmbiguousPath", err)
+	}
+	sort.Strings(aerr.FileIds)
+	if aerr.Path != "/x/dup.txt" || !reflect.DeepEqual(aerr.FileIds, []string{"d1", "d2"}) {
+		t.Errorf("ErrAmbiguousPath = %+v, want /x/dup.txt of [d1 d2]", aerr)
+	}
+	// Each is found by the name it's listed by.
+	if f, err := d.FileByPath("x/dup.txt (2)"); err != nil || f.Id != "d2" {
+		t.Errorf("FileByPath(x/dup.txt (2)) = %v, %v, want d2", f, err)
+	}
+	if _, err := d.FileByPath("x/dup.txt (3)"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("FileByPath(x/dup.txt (3)) error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestProcessChangeCheckpointsAfterWrite(t *testing.T) {
+	fd := newFakeDrive()
+	d := newTestDB(t, fd, nil)
+	last := d.lastChangeId()
+
+	apply(t, d, testFile("a", "a.txt"))
+	if got := d.lastChangeId(); got != last+1 {
+		t.Fatalf("after one change, lastChangeId = %d, want %d", got, last+1)
+	}
+	var cpt CheckPoint
+	if err := d.get(internalKey("checkpoint"), &cpt); err != nil || cpt.LastChangeID != last+1 {
+		t.Errorf("committed checkpoint = %+v, %v, want LastChangeID %d", cpt, err, last+1)
+	}
+
+	// A change which can't be committed leaves the checkpoint where it was.
+	d.db.Close()
+	if err := d.processChange(changeList(d, testFile("b", "b.txt"))); err == nil {
+		t.Fatal("processChange with the db closed succeeded")
+	}
+	if got := d.lastChangeId(); got != last+1 {
+		t.Errorf("after a failed write, lastChangeId = %d, want %d", got, last+1)
+	}
+}
+
+// BenchmarkProcessChange applies a ChangeList of 10,000 new files to an empty
+// db, committing changeBatchSize changes at a time, and one at a time.
+func BenchmarkProcessChange(b *testing.B) {
+	for _, size := range []int{changeBatchSize, 1} {
+		b.Run(fmt.Sprintf("batch=%d", size), func(b *testing.B) {
+			defer func(old int) { changeBatchSize = old }(changeBatchSize)
+			changeBatchSize = size
+			for n := 0; n < b.N; n++ {
+				b.StopTimer()
+				d := newTestDB(b, newFakeDrive(), nil)
+				files := make([]*gdrive.File, 10000)
+				for i := range files {
+					files[i] = testFile(fmt.Sprintf("file%05d", i), fmt.Sprintf("file %d.txt", i))
+				}
+				c := changeList(d, files...)
+				b.StartTimer()
+				if err := d.processChange(c); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestWalkSubtree(t *testing.T) {
+	fd := newFakeDrive()
+	// A diamond: top holds a and b, which both hold c, which holds d and,
+	// pathologically, top.
+	fd.folder("top", "top")
+	fd.folder("a", "a", "top")
+	fd.folder("b", "b", "top")
+	fd.add(&gdrive.File{Id: "c", Title: "c", MimeType: driveFolderMimeType}, "a", "b")
+	fd.file("d", "d.txt", "d", "c")
+	fd.update("top", func(f *gdrive.File) {
+		f.Parents = append(f.Parents, &gdrive.ParentReference{Id: "c"})
+	})
+	d := newTestDB(t, fd, nil)
+
+	visits := make(map[string]int)
+	err := d.WalkSubtree("top", func(f *gdrive.File, depth int) error {
+		visits[f.Id]++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{"top": 1, "a": 1, "b": 1, "c": 1, "d": 1}
+	if !reflect.DeepEqual(visits, want) {
+		t.Errorf("visits = %v, want %v", visits, want)
+	}
+
+	stop := errors.New("stop")
+	var n int
+	err = d.WalkSubtree("top", func(f *gdrive.File, depth int) error {
+		n++
+		if f.Id == "a" {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || n != 2 {
+		t.Errorf("walk stopped at a returned %v after %d visits, want stop after 2", err, n)
+	}
+}
+
+func TestSyncStatus(t *testing.T) {
+	fd := newFakeDrive()
+	d := newTestDB(t, fd, nil)
+	start, _, _ := d.SyncStatus()
+
+	c := changeList(d, testFile("a", "a.txt"), testFile("b", "b.txt"))
+	c.LargestChangeId = start + 4
+	if err := d.processChange(c); err != nil {
+		t.Fatal(err)
+	}
+	if processed, total, synced := d.SyncStatus(); processed != start+2 || total != start+4 || synced {
+		t.Errorf("SyncStatus() = %d, %d, %v, want %d, %d, false", processed, total, synced, start+2, start+4)
+	}
+	apply(t, d, testFile("c", "c.txt"), testFile("d", "d.txt"))
+	if processed, total, synced := d.SyncStatus(); processed != start+4 || total != start+4 || !synced {
+		t.Errorf("SyncStatus() = %d, %d, %v, want %d, %d, true", processed, total, synced, start+4, start+4)
+	}
+}
+
+func TestWaitUntilSyncedRacingSyncs(t *testing.T) {
+	d := newTestDB(t, newFakeDrive(), nil)
+	d.Pause()
+	waitPolled(t, d)
+
+	for i := 0; i < 100; i++ {
+		// Fall behind, then catch up while waiters come and go.
+		c := changeList(d, testFile(fmt.Sprintf("a%d", i), "a.txt"))
+		c.LargestChangeId++
+		if err := d.processChange(c); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		errs := make(chan error, 8)
+		for w := 0; w < cap(errs); w++ {
+			go func() { errs <- d.WaitUntilSyncedContext(ctx) }()
+		}
+		if err := d.processChange(changeList(d, testFile(fmt.Sprintf("b%d", i), "b.txt"))); err != nil {
+			t.Fatal(err)
+		}
+		for w := 0; w < cap(errs); w++ {
+			if err := <-errs; err != nil {
+				t.Fatalf("round %d: WaitUntilSyncedContext = %v, want nil", i, err)
+			}
+		}
+		cancel()
+	}
+}
+
+func TestWaitUntilSyncedCancelled(t *testing.T) {
+	d := newTestDB(t, newFakeDrive(), nil)
+	d.Pause()
+	waitPolled(t, d)
+	c := changeList(d, testFile("a", "a.txt"))
+	c.LargestChangeId++
+	if err := d.processChange(c); err != nil {
+		t.Fatal(err)
+	}
+
+	// Behind Drive, and not syncing, it only returns as ctx is done.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- d.WaitUntilSyncedContext(ctx) }()
+	select {
+	case err := <-done:
+		t.Fatalf("WaitUntilSyncedContext = %v before ctx was cancelled", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("WaitUntilSyncedContext = %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("WaitUntilSyncedContext didn't return once ctx was cancelled")
+	}
+
+	// Already cancelled, it returns at once.
+	if err := d.WaitUntilSyncedContext(ctx); err != context.Canceled {
+		t.Errorf("WaitUntilSyncedContext of a cancelled ctx = %v, want context.Canceled", err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	fd := newFakeDrive()
+	fd.file("a", "a.txt", "a")
+	d := newTestDB(t, fd, nil)
+	d.InvalidateCache()
+	inode, err := d.InodeForFileId("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := d.Stats()
+	for i := 0; i < 3; i++ {
+		if _, err := d.FileByInode(inode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := d.Stats()
+	if hits, misses := s.CacheHits-before.CacheHits, s.CacheMisses-before.CacheMisses; hits != 2 || misses != 1 {
+		t.Errorf("3 reads of one inode made %d hits and %d misses, want 2 and 1", hits, misses)
+	}
+	if s.CacheEntries != 1 {
+		t.Errorf("CacheEntries = %d, want 1", s.CacheEntries)
+	}
+	if s.Changes == 0 {
+		t.Errorf("Changes = 0 after the initial sync")
+	}
+}
+
+func TestChildrenWithUniqueNames(t *testing.T) {
+	fd := newFakeDrive()
+	fd.folder("x", "x")
+	fd.file("c3", "dup.txt", "3", "x")
+	fd.file("c1", "dup.txt", "1", "x")
+	fd.file("c2", "dup.txt", "2", "x")
+	fd.file("o", "other", "o", "x")
+	d := newTestDB(t, fd, nil)
+
+	names, err := d.ChildrenWithUniqueNames("x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for name, f := range names {
+		got[name] = f.Id
+	}
+	want := map[string]string{"dup.txt": "c1", "dup.txt (2)": "c2", "dup.txt (3)": "c3", "other": "o"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ChildrenWithUniqueNames(x) = %v, want %v", got, want)
+	}
+}
+
+// BenchmarkReadFiledata reads a 1MB file through the data cache: warm, with
+// the file cached by a previous read, and cold, with it dropped before each.
+// Only cold reads should download.
+func BenchmarkReadFiledata(b *testing.B) {
+	const size = 1 << 20
+	fd := newFakeDrive()
+	fd.file("f", "f.bin", strings.Repeat("x", size))
+	d := newTestDB(b, fd, nil)
+
+	for _, warm := range []bool{true, false} {
+		b.Run(fmt.Sprintf("warm=%v", warm), func(b *testing.B) {
+			if _, err := d.ReadFiledata("f", 0, size, size); err != nil {
+				b.Fatal(err)
+			}
+			downloads := fd.count("download")
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				if !warm {
+					d.clearDataCache("f")
+				}
+				if _, err := d.ReadFiledata("f", 0, size, size); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(fd.count("download")-downloads)/float64(b.N), "downloads/op")
+		})
+	}
+}
+
+func TestAllFileIdsPage(t *testing.T) {
+	fd := newFakeDrive()
+	for i := 1; i <= 10; i++ {
+		id := fmt.Sprintf("f%02d", i)
+		fd.file(id, id, id)
+	}
+	d := newTestDB(t, fd, nil)
+	all, err := d.AllFileIds()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var paged []string
+	var after string
+	for pages := 0; ; pages++ {
+		ids, next, err := d.AllFileIdsPage(after, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paged = append(paged, ids...)
+		if next == "" {
+			break
+		}
+		if len(ids) != 3 || next != ids[2] {
+			t.Fatalf("page after %q = %v, next %q, want 3 ids, next the last", after, ids, next)
+		}
+		after = next
+		if pages == 0 {
+			// Removing the cursor, and adding files before and after
+			// it, neither repeats nor skips the others.
+			if err := d.RemoveFileById(after, nil); err != nil {
+				t.Fatal(err)
+			}
+			for _, id := range []string{"f00", "f99"} {
+				if _, err := d.UpdateFile(nil, testFile(id, id)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	var want []string
+	for _, id := range append(all, "f99") {
+		if id != "f00" {
+			want = append(want, id)
+		}
+	}
+	sort.Strings(want)
+	if !reflect.DeepEqual(paged, want) {
+		t.Errorf("paged through %v, want %v", paged, want)
+	}
+}
+
+func TestInvalidateCache(t *testing.T) {
+	fd := newFakeDrive()
+	fd.file("a", "a.txt", "a")
+	d := newTestDB(t, fd, nil)
+	inode, err := d.InodeForFileId("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f, err := d.FileByInode(inode); err != nil || f.Title != "a.txt" {
+		t.Fatalf("FileByInode(a) = %v, %v", f, err)
+	}
+
+	// Changed behind the db's back, e.g. by a repair, the cached File is
+	// stale.
+	f := fd.get("a")
+	f.Title = "renamed.txt"
+	data, err := d.encode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.db.Put(fileKey("a"), data, nil); err != nil {
+		t.Fatal(err)
+	}
+	if f, err := d.FileByInode(inode); err != nil || f.Title != "a.txt" {
+		t.Fatalf("before InvalidateCache, FileByInode(a) = %v, %v, want the cached a.txt", f, err)
+	}
+	d.InvalidateCache()
+	if n := d.lruCache.Len(); n != 0 {
+		t.Errorf("after InvalidateCache, %d Files are cached", n)
+	}
+	if f, err := d.FileByInode(inode); err != nil || f.Title != "renamed.txt" {
+		t.Errorf("after InvalidateCache, FileByInode(a) = %v, %v, want renamed.txt", f, err)
+	}
+}
+
+func TestChildInodes(t *testing.T) {
+	fd := newFakeDrive()
+	fd.folder("dir", "dir")
+	fd.file("x", "x.txt", "x", "dir")
+	fd.folder("sub", "sub", "dir")
+	d := newTestDB(t, fd, nil)
+	inode, err := d.InodeForFileId("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(when string) {
+		t.Helper()
+		d.InvalidateCache()
+		cold, err := d.ChildInodes(inode)
+		if err != nil {
+			t.Fatalf("%s, ChildInodes(dir): %v", when, err)
+		}
+		f, err := d.FileByInode(inode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		warm, err := d.ChildInodes(inode)
+		if err != nil {
+			t.Fatalf("%s, ChildInodes(dir): %v", when, err)
+		}
+		if !reflect.DeepEqual(cold, f.Children) || !reflect.DeepEqual(warm, f.Children) {
+			t.Errorf("%s, ChildInodes(dir) = %v cold, %v warm, want %v", when, cold, warm, f.Children)
+		}
+		// The caller's copy is its own.
+		warm[0] = 0
+		if again, _ := d.ChildInodes(inode); again[0] == 0 {
+			t.Errorf("%s, changing ChildInodes' result changed the cached File", when)
+		}
+	}
+	check("at first")
+	fd.file("y", "y.txt", "y", "dir")
+	resync(t, d, fd)
+	check("after adding a child")
+
+	if _, err := d.ChildInodes(1 << 40); !errors.Is(err, ErrNotFound) {
+		t.Errorf("ChildInodes of a missing inode = %v, want ErrNotFound", err)
+	}
+}
+
+func TestFreshDownloadUrlCoalesces(t *testing.T) {
+	const n = 10
+	fd := newFakeDrive()
+	fd.file("f", "f.txt", "f")
+	d := newTestDB(t, fd, nil)
+
+	// Hold the first fetch until every caller is waiting on it.
+	release := make(chan struct{})
+	fd.setBefore(func(op string, req *http.Request) error {
+		if op == "files.get" {
+			<-release
+		}
+		return nil
+	})
+	gets := fd.count("files.get")
+	var started, done sync.WaitGroup
+	urls := make([]string, n)
+	for i := range urls {
+		started.Add(1)
+		done.Add(1)
+		go func(i int) {
+			defer done.Done()
+			started.Done()
+			url, err := d.FreshDownloadUrl("f")
+			if err != nil {
+				t.Error(err)
+			}
+			urls[i] = url
+		}(i)
+	}
+	started.Wait()
+	time.Sleep(50 * time.Millisecond) // for them to reach the fetch
+	close(release)
+	done.Wait()
+
+	if got := fd.count("files.get") - gets; got != 1 {
+		t.Errorf("%d concurrent FreshDownloadUrls made %d files.get calls, want 1", n, got)
+	}
+	for _, url := range urls {
+		if url == "" || url != urls[0] {
+			t.Errorf("FreshDownloadUrls returned %q, want them all the same", urls)
+			break
+		}
+	}
+	if url, err := d.downloadUrl("f", false); err != nil || url != urls[0] {
+		t.Errorf("after FreshDownloadUrl, the cached url is %q, %v, want the fresh %q", url, err, urls[0])
+	}
+}
+
+func TestReadOnlyMakesNoAPICalls(t *testing.T) {
+	fd := newFakeDrive()
+	fd.folder("dir", "dir")
+	fd.file("a", "a.txt", "a", "dir")
+	dir := t.TempDir()
+	d := openTestDB(t, fd, dir, nil)
+	d.Close()
+
+	calls := fd.total()
+	// Drive being down mustn't matter either.
+	fd.failNext("about.get", 500, 500, 500, 500, 500, 500, 500, 500)
+	ro := openTestDB(t, fd, dir, &DriveDBOptions{ReadOnly: true})
+	if f, err := ro.FileByPath("/dir/a.txt"); err != nil || f.Id != "a" {
+		t.Errorf("ReadOnly FileByPath(/dir/a.txt) = %v, %v, want a", f, err)
+	}
+	if n := fd.total() - calls; n != 0 {
+		t.Errorf("opening and querying a ReadOnly db made %d API calls, want none", n)
+	}
+}
+
+func TestFreshDownloadUrlRetries(t *testing.T) {
+	fd := newFakeDrive()
+	fd.file("f", "f.txt", "f")
+	fd.add(&gdrive.File{Id: "doc", Title: "doc", MimeType: "application/vnd.google-apps.document"})
+	d := newTestDB(t, fd, nil)
+
+	// A transient failure is retried.
+	fd.failNext("files.get", 503)
+	url, err := d.FreshDownloadUrl("f")
+	if err != nil || url == "" {
+		t.Fatalf("FreshDownloadUrl after a 503 = %q, %v, want a url", url, err)
+	}
+	if cached, err := d.downloadUrl("f", false); err != nil || cached != url {
+		t.Errorf("the cached url is %q, %v, want %q", cached, err, url)
+	}
+
+	// Drive having no url is an error, and nothing is cached, until it has
+	// one.
+	if url, err := d.FreshDownloadUrl("doc"); err == nil {
+		t.Errorf("FreshDownloadUrl(doc) = %q, want an error", url)
+	}
+	if found, _ := d.db.Has(downloadUrlKey("doc"), nil); found {
+		t.Errorf("an empty url was cached")
+	}
+	fd.update("doc", func(f *gdrive.File) { f.MimeType = "application/pdf" })
+	if url, err := d.FreshDownloadUrl("doc"); err != nil || url == "" {
+		t.Errorf("FreshDownloadUrl(doc) = %q, %v once Drive has a url, want it", url, err)
+	}
+	if found, _ := d.db.Has(downloadUrlKey("doc"), nil); !found {
+		t.Errorf("the url Drive then had wasn't cached")
+	}
+}
+
+func TestFreshDownloadUrlContextCancelled(t *testing.T) {
+	fd := newFakeDrive()
+	fd.file("f", "f.txt", "f")
+	d := newTestDB(t, fd, nil)
+	d.Pause()
+	waitPolled(t, d)
+
+	// Drive hangs until the request is given up on.
+	started := make(chan struct{})
+	aborted := make(chan error, 1)
+	fd.setBefore(func(op string, req *http.Request) error {
+		if op != "files.get" {
+			return nil
+		}
+		close(started)
+		select {
+		case <-req.Context().Done():
+			aborted <- req.Context().Err()
+			return req.Context().Err()
+		case <-time.After(10 * time.Second):
+			return nil
+		}
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := d.FreshDownloadUrlContext(ctx, "f")
+		done <- err
+	}()
+	<-started
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("FreshDownloadUrlContext = %v once ctx was cancelled, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("FreshDownloadUrlContext didn't return once ctx was cancelled")
+	}
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Errorf("the request to Drive wasn't aborted")
+	}
+	if n := fd.count("files.get"); n != 1 {
+		t.Errorf("made %d files.get requests, want 1: a cancelled one isn't retried", n)
+	}
+}
+
+func TestRefreshUnchangedKeepsFreshUrl(t *testing.T) {
+	fd := newFakeDrive()
+	fd.file("f", "f.txt", "f")
+	d := newTestDB(t, fd, nil)
+	inode, err := d.InodeForFileId("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached, err := d.FileByInode(inode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	synced, err := d.downloadUrl("f", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Unchanged, so the cached File is kept, but the url which came with
+	// it replaces the one from the sync.
+	f, err := d.Refresh("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f != cached {
+		t.Errorf("Refresh of an unchanged file rewrote it")
+	}
+	url, err := d.downloadUrl("f", false)
+	if err != nil || url == synced || !strings.HasPrefix(url, "https://fake.invalid/download/f?") {
+		t.Errorf("after Refresh, the cached url is %q, %v, want a fresh one, not %q", url, err, synced)
+	}
+
+	// Changed, it's rewritten.
+	fd.update("f", func(f *gdrive.File) { f.Title = "g.txt" })
+	if f, err := d.Refresh("f"); err != nil || f.Title != "g.txt" {
+		t.Errorf("Refresh of a changed file = %v, %v, want g.txt", f, err)
+	}
+}
+
+func TestDownloadUrlPersisted(t *testing.T) {
+	fd := newFakeDrive()
+	fd.file("f", "f.txt", "content")
+	dir := t.TempDir()
+	d := openTestDB(t, fd, dir, nil)
+	url, err := d.FreshDownloadUrl("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+
+	read := func(what string) {
+		t.Helper()
+		inode, err := d.InodeForFileId("f")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := d.FileByInode(inode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := d.OpenRange(f, 0, 0)
+		if err != nil {
+			t.Fatalf("%s, OpenRange(f): %v", what, err)
+		}
+		r.Close()
+	}
+
+	// Still valid after a restart, the url is used without asking Drive.
+	d = openTestDB(t, fd, dir, nil)
+	if cached, err := d.downloadUrl("f", false); err != nil || cached != url {
+		t.Errorf("after reopening, the cached url is %q, %v, want %q", cached, err, url)
+	}
+	before := fd.count("files.get")
+	read("after reopening")
+	if n := fd.count("files.get") - before; n != 0 {
+		t.Errorf("reading with a persisted url made %d files.get requests, want none", n)
+	}
+
+	// Once it's expired, a new one is fetched.
+	expired, err := d.encode(DownloadURL{URL: url, When: time.Now().Add(-downloadUrlLifetime).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.db.Put(downloadUrlKey("f"), expired, nil); err != nil {
+		t.Fatal(err)
+	}
+	read("with an expired url")
+	if n := fd.count("files.get") - before; n != 1 {
+		t.Errorf("reading with an expired url made %d files.get requests, want 1", n)
+	}
+}
+
+func TestMoveDownloadUrls(t *testing.T) {
+	fd := newFakeDrive()
+	fd.file("f", "f.txt", "content")
+	d := newTestDB(t, fd, nil)
+	url, err := d.FreshDownloadUrl("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Before schema version 7, the url was cached under url:.
+	data, err := d.db.Get(downloadUrlKey("f"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.db.Put([]byte("url:f"), data, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.db.Delete(downloadUrlKey("f"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.moveDownloadUrls(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.db.Get([]byte("url:f"), nil); err == nil {
+		t.Errorf("url:f is still in the db")
+	}
+	before := fd.count("files.get")
+	if cached, err := d.downloadUrl("f", false); err != nil || cached != url {
+		t.Errorf("after moving, the cached url is %q, %v, want %q", cached, err, url)
+	}
+	if n := fd.count("files.get") - before; n != 0 {
+		t.Errorf("a moved url made %d files.get requests, want none", n)
+	}
+}
+
+func TestRepeatedChangesCollapse(t *testing.T) {
+	d := newTestDB(t, newFakeDrive(), nil)
+	apply(t, d, testFile("f", "one.txt"))
+	events := d.Subscribe()
+
+	// Three updates to one file, in one list, are written as the last.
+	l := changeList(d, testFile("f", "two.txt"), testFile("f", "three.txt"), testFile("f", "four.txt"))
+	if err := d.processChange(l); err != nil {
+		t.Fatal(err)
+	}
+	if f, err := d.FileById("f"); err != nil || f.Title != "four.txt" {
+		t.Errorf("after three updates, FileById(f) = %v, %v, want four.txt", f, err)
+	}
+	if id := d.lastChangeId(); id != l.LargestChangeId {
+		t.Errorf("after three updates, last change %d, want %d", id, l.LargestChangeId)
+	}
+	var writes int
+	for len(events) > 0 {
+		if c := <-events; c.FileId == "f" {
+			writes++
+		}
+	}
+	if writes != 1 {
+		t.Errorf("three updates to a file in one list wrote it %d times, want once", writes)
+	}
+}
+
+func TestKeepHidden(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		fd := newFakeDrive()
+		fd.file("h", "hidden.dat", "h")
+		fd.update("h", func(f *gdrive.File) { f.Labels.Hidden = true })
+		fd.file("later", "later.dat", "l")
+		fd.file("trashed", "trashed.dat", "t")
+		d := newTestDB(t, fd, &DriveDBOptions{KeepHidden: keep})
+
+		// A file becoming hidden is treated as one arriving hidden.
+		fd.update("later", func(f *gdrive.File) { f.Labels.Hidden = true })
+		// Hidden or not, a trashed file is dropped.
+		fd.update("trashed", func(f *gdrive.File) { f.Labels.Hidden, f.Labels.Trashed = true, true })
+		resync(t, d, fd)
+
+		for _, id := range []string{"h", "later"} {
+			f, err := d.FileById(id)
+			switch {
+			case keep && err != nil:
+				t.Errorf("KeepHidden: FileById(%s): %v", id, err)
+			case keep && !f.Labels.Hidden:
+				t.Errorf("KeepHidden: %s isn't Hidden", id)
+			case !keep && err == nil:
+				t.Errorf("without KeepHidden, hidden %s is in the db", id)
+			}
+		}
+		if _, err := d.FileById("trashed"); err == nil {
+			t.Errorf("KeepHidden %v: a hidden, trashed file is in the db", keep)
+		}
+	}
+}
+
+// BenchmarkInitialSync measures an initial sync of 50,000 changes, fetching
+// pages of them one at a time and in parallel. Each page of changes is
+// delayed by pageLatency, standing in for Drive's.
+func BenchmarkInitialSync(b *testing.B) {
+	const (
+		files       = 50000
+		pageLatency = 50 * time.Millisecond
+	)
+	fd := newFakeDrive()
+	for i := 0; i < files; i++ {
+		fd.add(&gdrive.File{Id: fmt.Sprintf("f%d", i), Title: fmt.Sprintf("%d.txt", i), MimeType: "text/plain"})
+	}
+	fd.setBefore(func(op string, req *http.Request) error {
+		if op == "changes.list" {
+			time.Sleep(pageLatency)
+		}
+		return nil
+	})
+	for _, fetchers := range []int{1, 4, 8} {
+		b.Run(fmt.Sprintf("fetchers=%d", fetchers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				d := newTestDB(b, fd, &DriveDBOptions{SyncFetchers: fetchers, Logger: quietLogger{testLogger{b}}})
+				if id := d.lastChangeId(); id != fd.lastId {
+					b.Fatalf("synced to change %d, want %d", id, fd.lastId)
+				}
+				d.Close()
+			}
+		})
+	}
+}
+
+// quietLogger is a testLogger which drops the progress a long sync logs.
+type quietLogger struct{ testLogger }
+
+func (quietLogger) Infof(format string, args ...interface{}) {}
+
+func TestPinnedInodeIsNotEvicted(t *testing.T) {
+	const size = 4
+	fd := newFakeDrive()
+	for i := 0; i < 3*size; i++ {
+		fd.file(fmt.Sprintf("f%d", i), fmt.Sprintf("%d.txt", i), "x")
+	}
+	d := newTestDB(t, fd, &DriveDBOptions{InodeCacheSize: size})
+	inode := func(id string) uint64 {
+		t.Helper()
+		inode, err := d.InodeForFileId(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return inode
+	}
+	fill := func() {
+		t.Helper()
+		for i := 1; i < 3*size; i++ {
+			if _, err := d.FileByInode(inode(fmt.Sprintf("f%d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	pinned := inode("f0")
+	d.Pin(pinned)
+	d.Pin(pinned)
+	want, err := d.FileByInode(pinned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fill()
+	if f, ok := d.lruCache.Get(pinned); !ok || f != want {
+		t.Errorf("a pinned inode was evicted from a full cache")
+	}
+	if n := d.lruCache.Len(); n != size {
+		t.Errorf("cache of %d, with one pinned, holds %d", size, n)
+	}
+
+	// It's evicted once unpinned as often as pinned.
+	d.Unpin(pinned)
+	fill()
+	if _, ok := d.lruCache.Get(pinned); !ok {
+		t.Errorf("an inode pinned twice and unpinned once was evicted")
+	}
+	d.Unpin(pinned)
+	fill()
+	if _, ok := d.lruCache.Get(pinned); ok {
+		t.Errorf("an unpinned inode wasn't evicted from a full cache")
+	}
+}
+
+// dbGoroutines returns the number of goroutines started by DriveDB.run, of
+// any db.
+func dbGoroutines() int {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	return strings.Count(string(buf), "drive_db.(*DriveDB).run.func1(")
+}
+
+func TestCloseStopsGoroutines(t *testing.T) {
+	before := dbGoroutines()
+	fd := newFakeDrive()
+	fd.file("f", "f.txt", "f")
+	d := newTestDB(t, fd, nil)
+	if n := dbGoroutines(); n <= before {
+		t.Fatalf("an open db has %d goroutines, want more than the %d before", n, before)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := d.CloseWithContext(ctx); err != nil {
+		t.Fatalf("CloseWithContext: %v", err)
+	}
+	// Close returns once each has called running.Done, which may be just
+	// before it returns.
+	deadline := time.Now().Add(time.Second)
+	for n := dbGoroutines(); n != before; n = dbGoroutines() {
+		if time.Now().After(deadline) {
+			t.Fatalf("after Close, %d of the db's goroutines are running, want %d", n, before)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestReopenServesRefresh(t *testing.T) {
+	fd := newFakeDrive()
+	dir := t.TempDir()
+	d := openTestDB(t, fd, dir, nil)
+	refresh := func() int {
+		w := httptest.NewRecorder()
+		d.opts.Mux.ServeHTTP(w, httptest.NewRequest("GET", d.accountPath("/refresh"), nil))
+		return w.Code
+	}
+	d.Close()
+	if code := refresh(); code != http.StatusNotFound {
+		t.Errorf("refreshing a closed db: %v, want %v", code, http.StatusNotFound)
+	}
+
+	// Reopened, the db serves it again.
+	d = openTestDB(t, fd, dir, &DriveDBOptions{Mux: d.opts.Mux})
+	fd.file("f", "f.txt", "f")
+	if code := refresh(); code != http.StatusOK {
+		t.Fatalf("refreshing a reopened db: %v, want %v", code, http.StatusOK)
+	}
+	waitFor(t, "reading the change refreshed", func() bool { return d.hasFile("f") })
+}
+
+func TestAccountPaths(t *testing.T) {
+	fd := newFakeDrive()
+	dir := t.TempDir()
+	for _, c := range []struct {
+		account              string
+		meta, cache, refresh string
+	}{
+		{"", "db/meta", "cache", "/refresh"},
+		{"a", "db/a/meta", "cache/a", "/refresh/a"},
+	} {
+		d := openTestDB(t, fd, dir, &DriveDBOptions{Account: c.account})
+		if _, err := os.Stat(path.Join(dir, c.meta)); err != nil || d.dbpath != path.Join(dir, c.meta) {
+			t.Errorf("Account %q: the db is in %s, want %s", c.account, d.dbpath, c.meta)
+		}
+		if d.data != path.Join(dir, c.cache) {
+			t.Errorf("Account %q: the cache is in %s, want %s", c.account, d.data, c.cache)
+		}
+		if got := d.accountPath("/refresh"); got != c.refresh {
+			t.Errorf("Account %q: refresh handler at %s, want %s", c.account, got, c.refresh)
+		}
+	}
+}
+
+func TestLevelDBOptions(t *testing.T) {
+	// Unset, leveldb's defaults are kept.
+	o := levelDBOptions(DriveDBOptions{})
+	if got := o.GetBlockCacheCapacity(); got != opt.DefaultBlockCacheCapacity {
+		t.Errorf("default block cache = %d, want leveldb's, %d", got, opt.DefaultBlockCacheCapacity)
+	}
+	if got := o.GetWriteBuffer(); got != opt.DefaultWriteBuffer {
+		t.Errorf("default write buffer = %d, want leveldb's, %d", got, opt.DefaultWriteBuffer)
+	}
+	if got := o.GetCompactionTableSize(0); got != opt.DefaultCompactionTableSize {
+		t.Errorf("default table size = %d, want leveldb's, %d", got, opt.DefaultCompactionTableSize)
+	}
+
+	// A db opened with its own sizes is usable.
+	fd := newFakeDrive()
+	fd.file("a", "a.txt", "a")
+	custom := &DriveDBOptions{BlockCacheCapacity: 1 << 20, WriteBuffer: 1 << 20, CompactionTableSize: 1 << 20}
+	d := newTestDB(t, fd, custom)
+	o = levelDBOptions(d.opts)
+	if o.GetBlockCacheCapacity() != 1<<20 || o.GetWriteBuffer() != 1<<20 || o.GetCompactionTableSize(0) != 1<<20 {
+		t.Errorf("leveldb options %+v, want the sizes given", o)
+	}
+	if f, err := d.FileByPath("/a.txt"); err != nil || f.Id != "a" {
+		t.Errorf("FileByPath(/a.txt) = %v, %v, want a", f, err)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	fd := newFakeDrive()
+	fd.used = 12345
+	dir := t.TempDir()
+	d := openTestDB(t, fd, dir, nil)
+	waitPolled(t, d)
+	if used, total, err := d.Quota(); err != nil || used != 12345 || total != 1<<30 {
+		t.Errorf("Quota() = %d, %d, %v, want 12345, %d", used, total, err, 1<<30)
+	}
+
+	// It's refreshed by a poll which finds changes.
+	fd.mu.Lock()
+	fd.used = 23456
+	fd.mu.Unlock()
+	fd.file("f", "f.txt", "f")
+	resync(t, d, fd)
+	if used, _, err := d.Quota(); err != nil || used != 23456 {
+		t.Errorf("after a change, Quota() = %d, %v, want 23456 used", used, err)
+	}
+
+	// It's kept in the db.
+	d.Close()
+	d = openTestDB(t, fd, dir, &DriveDBOptions{ReadOnly: true})
+	if used, total, err := d.Quota(); err != nil || used != 23456 || total != 1<<30 {
+		t.Errorf("after reopening, Quota() = %d, %d, %v, want 23456, %d", used, total, err, 1<<30)
+	}
+}
@@ -0,0 +1,137 @@
+package drive_db
+
+// A db can be dumped to a single file, and restored from it elsewhere, to
+// move the synced metadata between machines without syncing from scratch.
+//
+// A dump is the line "drive_db dump", a JSON dumpHeader line, then each key
+// and value in key order, each preceded by its length as a uvarint. The data
+// cache isn't included, as its blocks live outside the db.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+const (
+	dumpMagic   = "drive_db dump\n"
+	dumpVersion = 1
+)
+
+// dumpHeader describes the dump which follows it.
+type dumpHeader struct {
+	Version int    // of the dump format
+	Schema  int    // of the dumped db
+	Codec   string // of the dumped db's values
+}
+
+// ExportSnapshot writes a dump of the db, as it is now, to w. A db dumps the
+// same way each time, so dumps can be compared.
+func (d *DriveDB) ExportSnapshot(w io.Writer) error {
+	s, err := d.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer s.Release()
+
+	bw := bufio.NewWriter(w)
+	header, err := JSONCodec.Encode(dumpHeader{dumpVersion, schemaVersion, d.opts.Codec.Name()})
+	if err != nil {
+		return err
+	}
+	bw.WriteString(dumpMagic)
+	bw.Write(header) // the JSON encoder ends it with a newline
+
+	var buf [binary.MaxVarintLen64]byte
+	put := func(b []byte) {
+		n := binary.PutUvarint(buf[:], uint64(len(b)))
+		bw.Write(buf[:n])
+		bw.Write(b)
+	}
+	iter := s.snap.NewIterator(nil, nil)
+	for iter.Next() {
+		if bytes.HasPrefix(iter.Key(), []byte("cky:")) {
+			continue
+		}
+		put(iter.Key())
+		put(iter.Value())
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// ImportSnapshot restores a dump written by ExportSnapshot, as the db of
+// account (or "") in dbPath, for NewDriveDB to open. There must be no db
+// there already. A dump of an older schema is migrated when it's opened.
+func ImportSnapshot(r io.Reader, dbPath, account string) error {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(dumpMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != dumpMagic {
+		return fmt.Errorf("not a drive_db dump")
+	}
+	line, err := br.ReadBytes('\n')
+	if err != nil {
+		return fmt.Errorf("reading dump header: %v", err)
+	}
+	var header dumpHeader
+	if err := JSONCodec.Decode(line, &header); err != nil {
+		return fmt.Errorf("reading dump header: %v", err)
+	}
+	if header.Version != dumpVersion {
+		return fmt.Errorf("dump format version %d, but only %d is understood", header.Version, dumpVersion)
+	}
+	if header.Schema > schemaVersion {
+		return fmt.Errorf("dump has schema version %d, newer than %d which this version understands", header.Schema, schemaVersion)
+	}
+
+	ldbPath := metaPath(dbPath, account)
+	if err := os.MkdirAll(ldbPath, 0700); err != nil {
+		return fmt.Errorf("could not create directory %q", ldbPath)
+	}
+	db, err := leveldb.OpenFile(ldbPath, &opt.Options{ErrorIfExist: true})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	get := func() ([]byte, error) {
+		n, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, n)
+		_, err = io.ReadFull(br, b)
+		return b, err
+	}
+	batch := new(leveldb.Batch)
+	for {
+		key, err := get()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading dump: %v", err)
+		}
+		value, err := get()
+		if err != nil {
+			return fmt.Errorf("reading dump: %v", err)
+		}
+		batch.Put(key, value)
+		if batch.Len() >= 1000 {
+			if err := db.Write(batch, nil); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	return db.Write(batch, nil)
+}
@@ -0,0 +1,55 @@
+package drive_db
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestExportImportSnapshot(t *testing.T) {
+	fd := newFakeDrive()
+	fd.folder("dir", "dir")
+	fd.file("a", "a.txt", "a", "dir")
+	fd.file("b", "b.txt", "b")
+	d := newTestDB(t, fd, nil)
+	var dump bytes.Buffer
+	if err := d.ExportSnapshot(&dump); err != nil {
+		t.Fatal(err)
+	}
+	inode, err := d.InodeForFileId("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	const account = "imported"
+	if err := ImportSnapshot(bytes.NewReader(dump.Bytes()), dir+"/db", account); err != nil {
+		t.Fatal(err)
+	}
+	if err := ImportSnapshot(bytes.NewReader(dump.Bytes()), dir+"/db", account); err == nil {
+		t.Errorf("importing over an existing db succeeded")
+	}
+	calls := fd.total()
+	imported := openTestDB(t, fd, dir, &DriveDBOptions{Account: account, ReadOnly: true})
+	f, err := imported.FileByPath("/dir/a.txt")
+	if err != nil || f.Id != "a" || f.Inode != inode {
+		t.Errorf("imported FileByPath(/dir/a.txt) = %+v, %v, want a, inode %d", f, err, inode)
+	}
+	if n := fd.total() - calls; n != 0 {
+		t.Errorf("the imported db made %d API calls", n)
+	}
+
+	// The same db dumps the same way.
+	var again bytes.Buffer
+	if err := imported.ExportSnapshot(&again); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dump.Bytes(), again.Bytes()) {
+		t.Errorf("the imported db dumps differently: %d bytes, want %d", again.Len(), dump.Len())
+	}
+
+	for _, bad := range []string{"", "not a dump", dumpMagic + "{\"Version\":999}\n"} {
+		if err := ImportSnapshot(bytes.NewReader([]byte(bad)), t.TempDir(), ""); err == nil {
+			t.Errorf("importing %q succeeded", bad)
+		}
+	}
+}
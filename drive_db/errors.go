@@ -0,0 +1,58 @@
+package drive_db
+
+// The package's errors wrap their causes, so callers can test for the kind
+// of failure with errors.Is, e.g. errors.Is(err, ErrNotFound), and still get
+// at the underlying error, e.g. a *googleapi.Error, with errors.As.
+
+import (
+	"errors"
+
+	"code.google.com/p/google-api-go-client/googleapi"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// kindError is an error of one of the package's kinds, e.g. ErrNotFound,
+// caused by another.
+type kindError struct {
+	kind  error
+	cause error
+}
+
+func (e *kindError) Error() string {
+	return e.kind.Error() + ": " + e.cause.Error()
+}
+
+func (e *kindError) Unwrap() error {
+	return e.cause
+}
+
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+// wrapError returns cause as an error of the given kind.
+func wrapError(kind, cause error) error {
+	return &kindError{kind: kind, cause: cause}
+}
+
+// dbError translates an error from leveldb: a missing key is ErrNotFound.
+func dbError(err error) error {
+	if err == leveldb.ErrNotFound {
+		return wrapError(ErrNotFound, err)
+	}
+	return err
+}
+
+// apiError translates the error from a failed Drive API call which won't be
+// retried: ErrAuth if our credentials were rejected, ErrRateLimited if we've
+// exceeded our quota of requests.
+func apiError(err error) error {
+	var gerr *googleapi.Error
+	switch {
+	case errors.As(err, &gerr) && (gerr.Code == 429 || gerr.Code == 403 && isRateLimit(gerr)):
+		return wrapError(ErrRateLimited, err)
+	case classifyError(err) == errAuth:
+		return wrapError(ErrAuth, err)
+	}
+	return err
+}
@@ -0,0 +1,65 @@
+package drive_db
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"code.google.com/p/google-api-go-client/googleapi"
+)
+
+func TestErrorKinds(t *testing.T) {
+	fd := newFakeDrive()
+	fd.file("f", "f.txt", "f")
+	dir := t.TempDir()
+	d := openTestDB(t, fd, dir, &DriveDBOptions{SyncRetries: 1})
+	errs := d.Errors()
+
+	var missing struct{}
+	_, byId := d.FileById("nope")
+	_, byInode := d.FileByInode(1 << 40)
+	_, idForInode := d.FileIdForInode(1 << 40)
+	fd.failNext("files.get", http.StatusUnauthorized)
+	_, auth := d.FreshDownloadUrl("f")
+	fd.failNext("files.get", http.StatusTooManyRequests, http.StatusTooManyRequests)
+	_, limited := d.FreshDownloadUrl("f")
+	fd.file("g", "g.txt", "g")
+	fd.forgetChanges()
+	d.readChanges()
+	var tooOld error
+	for len(errs) > 0 {
+		if err := <-errs; errors.Is(err, ErrChangeHistoryTooOld) {
+			tooOld = err
+		}
+	}
+	d.Close()
+	_, closed := d.FileById("f")
+	ro := openTestDB(t, fd, dir, &DriveDBOptions{ReadOnly: true})
+	_, readOnly := ro.UpdateFile(nil, testFile("r", "r.txt"))
+
+	for _, tc := range []struct {
+		what string
+		err  error
+		want error
+		api  bool // whether it wraps Drive's *googleapi.Error
+	}{
+		{"get once closed", d.get(fileIdToInodeKey("f"), &missing), ErrClosed, false},
+		{"get of a missing key", ro.get(fileIdToInodeKey("nope"), &missing), ErrNotFound, false},
+		{"FileById of a missing file", byId, ErrNotFound, false},
+		{"FileByInode of a missing inode", byInode, ErrNotFound, false},
+		{"FileIdForInode of a missing inode", idForInode, ErrNotFound, false},
+		{"FileById once closed", closed, ErrClosed, false},
+		{"UpdateFile of a ReadOnly db", readOnly, ErrReadOnly, false},
+		{"a request Drive refuses our credentials for", auth, ErrAuth, true},
+		{"a request Drive keeps rate limiting", limited, ErrRateLimited, true},
+		{"listing changes Drive has forgotten", tooOld, ErrChangeHistoryTooOld, true},
+	} {
+		if !errors.Is(tc.err, tc.want) {
+			t.Errorf("%s: %v, want %v", tc.what, tc.err, tc.want)
+		}
+		var gerr *googleapi.Error
+		if tc.api && !errors.As(tc.err, &gerr) {
+			t.Errorf("%s: %v doesn't wrap Drive's error", tc.what, tc.err)
+		}
+	}
+}
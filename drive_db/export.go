@@ -0,0 +1,348 @@
+package drive_db
+
+// Native Google Docs, Sheets, Slides, etc. have no downloadUrl; their content
+// is only available by exporting it to some other format, using one of the
+// file's exportLinks.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const googleAppsMimePrefix = "application/vnd.google-apps."
+
+// DefaultExportTypes maps the MIME type of each native Google file type to the
+// MIME type it is exported as, when neither the caller nor the db's
+// ExportPolicy asks for a specific one.
+var DefaultExportTypes = ExportPolicy{
+	"application/vnd.google-apps.document":     "application/pdf",
+	"application/vnd.google-apps.spreadsheet":  "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	"application/vnd.google-apps.presentation": "application/pdf",
+	"application/vnd.google-apps.drawing":      "image/png",
+}
+
+// ExportTypesByName maps short names of common export types, e.g. as a user
+// might give them in an xattr, to their MIME types.
+var ExportTypesByName = map[string]string{
+	"csv":  "text/csv",
+	"docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	"html": "text/html",
+	"jpeg": "image/jpeg",
+	"odp":  "application/vnd.oasis.opendocument.presentation",
+	"ods":  "application/x-vnd.oasis.opendocument.spreadsheet",
+	"odt":  "application/vnd.oasis.opendocument.text",
+	"pdf":  "application/pdf",
+	"png":  "image/png",
+	"pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	"rtf":  "application/rtf",
+	"svg":  "image/svg+xml",
+	"txt":  "text/plain",
+	"xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+}
+
+// ExportExtensions maps export MIME types to the file extension appended to
+// the names of native Google files exported as them, so that other programs
+// know what they contain. DriveDBOptions.ExportExtensions overrides them for
+// a db.
+var ExportExtensions = map[string]string{
+	"application/pdf": ".pdf",
+	"application/rtf": ".rtf",
+	"application/vnd.oasis.opendocument.presentation":                           ".odp",
+	"application/vnd.oasis.opendocument.text":                                   ".odt",
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation": ".pptx",
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":         ".xlsx",
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document":   ".docx",
+	"application/x-vnd.oasis.opendocument.spreadsheet":                          ".ods",
+	"image/jpeg":    ".jpg",
+	"image/png":     ".png",
+	"image/svg+xml": ".svg",
+	"text/csv":      ".csv",
+	"text/html":     ".html",
+	"text/plain":    ".txt",
+}
+
+// ExportExtension returns the extension, per ExportExtensions, of a file of
+// type driveMime exported as exportMime, or as the default for driveMime if
+// exportMime is empty. It returns "" if driveMime isn't a native Google file
+// type, or the export type has no known extension.
+func ExportExtension(driveMime, exportMime string) string {
+	return exportExtension(driveMime, exportMime, nil, nil)
+}
+
+// exportExtension is ExportExtension, with the default export type chosen by
+// policy, and the extensions in overrides taking precedence.
+func exportExtension(driveMime, exportMime string, policy ExportPolicy, overrides map[string]string) string {
+	if !strings.HasPrefix(driveMime, googleAppsMimePrefix) {
+		return ""
+	}
+	if exportMime == "" {
+		exportMime = policy.exportType(driveMime)
+	}
+	if exportMime == "" {
+		return ""
+	}
+	if ext, ok := overrides[exportMime]; ok {
+		return ext
+	}
+	return ExportExtensions[exportMime]
+}
+
+// nameWithExtension splits the name of f, as listed in a folder, into its
+// title and the extension appended to it, if it's a native Google file
+// exported as format, or as the default for its type if format is empty. The
+// extension is left off if the title already ends with it.
+func (d *DriveDB) nameWithExtension(f *File, format string) (title, ext string) {
+	if !f.IsNative() {
+		return f.Title, ""
+	}
+	ext = exportExtension(f.MimeType, format, d.opts.ExportPolicy, d.opts.ExportExtensions)
+	if strings.HasSuffix(strings.ToLower(f.Title), strings.ToLower(ext)) {
+		return f.Title, ""
+	}
+	return f.Title, ext
+}
+
+// DisplayName returns the name f is listed by in a folder: its title, with
+// the extension of its export appended if it's a native Google file. Names
+// shared by several files in a folder are further disambiguated by
+// ChildrenWithUniqueNames.
+func (d *DriveDB) DisplayName(f *File) string {
+	title, ext := d.nameWithExtension(f, d.ExportFormat(f.Id))
+	return title + ext
+}
+
+// TitleForName returns the title a native Google file f is given when it's
+// renamed to name, which is name without f's export extension, if it has
+// it.
+func (d *DriveDB) TitleForName(f *File, name string) string {
+	if !f.IsNative() {
+		return name
+	}
+	ext := exportExtension(f.MimeType, d.ExportFormat(f.Id), d.opts.ExportPolicy, d.opts.ExportExtensions)
+	if ext != "" && strings.HasSuffix(strings.ToLower(name), strings.ToLower(ext)) {
+		return name[:len(name)-len(ext)]
+	}
+	return name
+}
+
+// EstimatedExportSizes maps the MIME type of each native Google file type to
+// the size reported for a file of that type until it's first exported. They
+// are rough averages, so that tools adding up sizes don't take such files to
+// be empty.
+var EstimatedExportSizes = map[string]int64{
+	"application/vnd.google-apps.document":     100 << 10,
+	"application/vnd.google-apps.spreadsheet":  50 << 10,
+	"application/vnd.google-apps.presentation": 1 << 20,
+	"application/vnd.google-apps.drawing":      50 << 10,
+}
+
+// exportSizeKey is the key of the size of fileId's last export.
+func exportSizeKey(fileId string) []byte {
+	return []byte("esz:" + fileId)
+}
+
+// exportFormatKey is the key of the export type chosen for fileId.
+func exportFormatKey(fileId string) []byte {
+	return []byte("exp:" + fileId)
+}
+
+// IsNative reports whether f is a native Google file, whose content must be
+// exported rather than downloaded.
+func (f *File) IsNative() bool {
+	return strings.HasPrefix(f.MimeType, googleAppsMimePrefix) && f.MimeType != driveFolderMimeType && f.MimeType != driveShortcutMimeType
+}
+
+// SetExportFormat chooses the MIME type f is exported as, in place of the
+// default for its type. An empty mimeType restores the default. Like its
+// inode, the choice is kept if the file is removed, in case it reappears.
+func (d *DriveDB) SetExportFormat(fileId, mimeType string) error {
+	if d.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	var err error
+	if mimeType == "" {
+		err = d.db.Delete(exportFormatKey(fileId), nil)
+	} else {
+		err = d.db.Put(exportFormatKey(fileId), []byte(mimeType), nil)
+	}
+	if err != nil {
+		return err
+	}
+	// Any cached export, and its size, are of the old type.
+	d.forgetExport(fileId)
+	d.db.Delete(exportSizeKey(fileId), nil)
+	d.FlushCachedInodeForFileId(fileId)
+	return nil
+}
+
+// ExportFormat returns the MIME type chosen for fileId by SetExportFormat, or
+// "" if none has been.
+func (d *DriveDB) ExportFormat(fileId string) string {
+	mimeType, err := d.db.Get(exportFormatKey(fileId), nil)
+	if err != nil {
+		return ""
+	}
+	return string(mimeType)
+}
+
+// EstimatedSize returns the size of f's content in bytes, if it's not native,
+// and otherwise the size of its last export, or failing that the estimate for
+// its type in EstimatedExportSizes.
+func (f *File) EstimatedSize() int64 {
+	switch {
+	case !f.IsNative():
+		return f.Size()
+	case f.ExportSize > 0:
+		return f.ExportSize
+	}
+	return EstimatedExportSizes[f.MimeType]
+}
+
+// ExportUrl returns the URL from which f can be downloaded as mimeType.
+// If mimeType is empty, the type chosen by SetExportFormat is used, or failing
+// that the DefaultExportType for f's MIME type.
+func (d *DriveDB) ExportUrl(f *File, mimeType string) (string, error) {
+	if mimeType == "" {
+		mimeType = d.ExportFormat(f.Id)
+	}
+	if mimeType == "" {
+		mimeType = d.DefaultExportType(f.MimeType)
+		if mimeType == "" {
+			return "", fmt.Errorf("no default export type for %q (%v)", f.Title, f.MimeType)
+		}
+	}
+	if url, ok := f.ExportLinks[mimeType]; ok {
+		return url, nil
+	}
+	var available []string
+	for t := range f.ExportLinks {
+		available = append(available, t)
+	}
+	sort.Strings(available)
+	return "", fmt.Errorf("%q cannot be exported as %v, available types: [%v]", f.Title, mimeType, strings.Join(available, ", "))
+}
+
+// ReadExport reads a segment of the chosen or default export of a native Google file.
+// Export links don't honor Range requests, so the whole export is fetched on
+// the first read and kept in the data cache for subsequent reads.
+func (d *DriveDB) ReadExport(f *File, offset, size int64) ([]byte, error) {
+	d.Lock()
+	exportSize, ok := d.exportSizes[f.Id]
+	d.Unlock()
+	if ok {
+		if offset >= exportSize {
+			return nil, nil
+		}
+		if offset+size > exportSize {
+			size = exportSize - offset
+		}
+		data, err := d.readCachedRange(f.Id, offset, size)
+		if err == nil {
+			return data, nil
+		}
+		debug.Printf("export of %v not cached: %v", f.Id, err)
+	}
+
+	v, err := d.sf.Do("export:"+f.Id, func() (interface{}, error) {
+		return d.fetchExport(f)
+	})
+	if err != nil {
+		return nil, err
+	}
+	data := v.([]byte)
+	if offset >= int64(len(data)) {
+		return nil, nil
+	}
+	end := offset + size
+	if end > int64(len(data)) {
+		end = int64(len(data))
+	}
+	return data[offset:end], nil
+}
+
+// fetchExport downloads the chosen or default export of f, and stores it in
+// the data cache. Its size is kept in the db, as f's ExportSize.
+func (d *DriveDB) fetchExport(f *File) ([]byte, error) {
+	url, err := d.ExportUrl(f, "")
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	debug.Printf("exporting %v from %v", f.Id, url)
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("client.Do: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("fetchExport: for %s got HTTP status %v, want 200: %v", f.Id, resp.StatusCode, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("ioutil.ReadAll: %v", err)
+	}
+	if err := d.storeExportSize(f.Id, int64(len(data))); err != nil {
+		log.Printf("failed to store the export size of %v: %v", f.Id, err)
+	}
+	if err := d.writeChunks(f.Id, 0, data); err != nil {
+		log.Printf("failed to cache export of %v: %v", f.Id, err)
+		return data, nil
+	}
+	d.Lock()
+	d.exportSizes[f.Id] = int64(len(data))
+	d.Unlock()
+	return data, nil
+}
+
+// storeExportSize records the size of fileId's latest export.
+func (d *DriveDB) storeExportSize(fileId string, size int64) error {
+	if d.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	bytes, err := d.encode(size)
+	if err != nil {
+		return err
+	}
+	if err := d.db.Put(exportSizeKey(fileId), bytes, nil); err != nil {
+		return err
+	}
+	d.FlushCachedInodeForFileId(fileId)
+	return nil
+}
+
+// forgetExport drops the record of a cached export, so the next read of it
+// fetches it from Drive again.
+func (d *DriveDB) forgetExport(fileId string) {
+	d.Lock()
+	delete(d.exportSizes, fileId)
+	d.Unlock()
+}
+
+// readCachedRange reads a segment of a file from the data cache only.
+func (d *DriveDB) readCachedRange(fileId string, offset, size int64) ([]byte, error) {
+	var ret []byte
+	chunk0, chunkN := d.chunkNumbers(offset, size)
+	for chunk := chunk0; chunk <= chunkN; chunk++ {
+		data, err := d.readCacheBlock(fileId, chunk)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, data...)
+	}
+	low := offset - chunk0*(*driveCacheChunk)
+	if low > int64(len(ret)) {
+		return nil, fmt.Errorf("tried to read past end of cached data: fileId: %s, offset:%d, size:%d", fileId, offset, size)
+	}
+	high := low + size
+	if high > int64(len(ret)) {
+		high = int64(len(ret))
+	}
+	return ret[low:high], nil
+}
@@ -0,0 +1,121 @@
+package drive_db
+
+// The type each kind of native Google file is exported as can be chosen for
+// a db, e.g. Sheets as CSV rather than XLSX, with an ExportPolicy. It's
+// checked when the db is opened, so that a type Drive can't export to is
+// reported then, rather than by every read of a file.
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ExportPolicy maps the MIME types of native Google file types to the MIME
+// types they're exported as, unless SetExportFormat chooses another for a
+// file. Types it doesn't map are exported as in DefaultExportTypes.
+type ExportPolicy map[string]string
+
+// ExportFormats maps the MIME type of each native Google file type to the
+// MIME types Drive can export it as.
+var ExportFormats = map[string][]string{
+	"application/vnd.google-apps.document": {
+		"application/pdf",
+		"application/rtf",
+		"application/vnd.oasis.opendocument.text",
+		"application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+		"text/html",
+		"text/plain",
+	},
+	"application/vnd.google-apps.spreadsheet": {
+		"application/pdf",
+		"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+		"application/x-vnd.oasis.opendocument.spreadsheet",
+		"text/csv",
+	},
+	"application/vnd.google-apps.presentation": {
+		"application/pdf",
+		"application/vnd.oasis.opendocument.presentation",
+		"application/vnd.openxmlformats-officedocument.presentationml.presentation",
+		"text/plain",
+	},
+	"application/vnd.google-apps.drawing": {
+		"application/pdf",
+		"image/jpeg",
+		"image/png",
+		"image/svg+xml",
+	},
+}
+
+// exportType returns the MIME type files of type driveMime are exported as
+// by p, or "" if there's none.
+func (p ExportPolicy) exportType(driveMime string) string {
+	if t, ok := p[driveMime]; ok {
+		return t
+	}
+	return DefaultExportTypes[driveMime]
+}
+
+// Validate checks that Drive can export each type in p as the type p maps it
+// to, per ExportFormats, and otherwise reports the first, in order of MIME
+// type, that it can't.
+func (p ExportPolicy) Validate() error {
+	natives := make([]string, 0, len(p))
+	for native := range p {
+		natives = append(natives, native)
+	}
+	sort.Strings(natives)
+	for _, native := range natives {
+		formats, ok := ExportFormats[native]
+		if !ok {
+			return fmt.Errorf("export policy: %q is not an exportable native Google file type", native)
+		}
+		exportable := false
+		for _, f := range formats {
+			exportable = exportable || f == p[native]
+		}
+		if !exportable {
+			return fmt.Errorf("export policy: %v can't be exported as %q, only as one of: %v", native, p[native], strings.Join(formats, ", "))
+		}
+	}
+	return nil
+}
+
+// ParseExportPolicy parses a comma separated list of native=export pairs,
+// e.g. "document=txt,spreadsheet=csv", into a validated ExportPolicy. Each
+// native type may be given by its MIME type, or by its name after
+// "application/vnd.google-apps.", and each export type by its MIME type or
+// one of the names in ExportTypesByName.
+func ParseExportPolicy(s string) (ExportPolicy, error) {
+	p := make(ExportPolicy)
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("export policy: %q is not of the form native=export", pair)
+		}
+		native := strings.TrimSpace(kv[0])
+		if !strings.Contains(native, "/") {
+			native = googleAppsMimePrefix + native
+		}
+		export := strings.TrimSpace(kv[1])
+		if t, ok := ExportTypesByName[strings.ToLower(export)]; ok {
+			export = t
+		}
+		p[native] = export
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// DefaultExportType returns the MIME type files of type driveMime are
+// exported as, unless SetExportFormat chooses another: per the db's
+// ExportPolicy, or failing that DefaultExportTypes. It returns "" if
+// driveMime isn't an exportable type.
+func (d *DriveDB) DefaultExportType(driveMime string) string {
+	return d.opts.ExportPolicy.exportType(driveMime)
+}
@@ -0,0 +1,78 @@
+package drive_db
+
+import (
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseExportPolicy(t *testing.T) {
+	p, err := ParseExportPolicy("document=txt, spreadsheet=text/csv,")
+	want := ExportPolicy{
+		"application/vnd.google-apps.document":    "text/plain",
+		"application/vnd.google-apps.spreadsheet": "text/csv",
+	}
+	if err != nil || !reflect.DeepEqual(p, want) {
+		t.Errorf("ParseExportPolicy = %v, %v, want %v", p, err, want)
+	}
+
+	for _, s := range []string{
+		"document",            // not a pair
+		"document=mp3",        // not an export type
+		"document=csv",        // not one Docs can be exported as
+		"form=pdf",            // not exportable
+		"application/pdf=txt", // not native
+	} {
+		if p, err := ParseExportPolicy(s); err == nil {
+			t.Errorf("ParseExportPolicy(%q) = %v, want an error", s, p)
+		}
+	}
+	if err := (ExportPolicy{"application/vnd.google-apps.drawing": "text/plain"}).Validate(); err == nil || !strings.Contains(err.Error(), "image/png") {
+		t.Errorf("Validate of a drawing as text = %v, want an error listing the types it can be", err)
+	}
+}
+
+func TestExportPolicy(t *testing.T) {
+	fd := newFakeDrive()
+	fd.doc("doc", "doc", "d")
+	fd.doc("chosen", "chosen", "c")
+
+	// A policy Drive can't follow is refused as the db is opened.
+	dir := t.TempDir()
+	bad := &DriveDBOptions{ExportPolicy: ExportPolicy{"application/vnd.google-apps.document": "image/png"}}
+	if _, err := NewDriveDB(fd.client(), path.Join(dir, "db"), path.Join(dir, "cache"), time.Hour, "root", bad); err == nil {
+		t.Fatalf("NewDriveDB with an invalid ExportPolicy succeeded")
+	}
+
+	url := func(d *DriveDB, id string) string {
+		t.Helper()
+		inode, err := d.InodeForFileId(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := d.FileByInode(inode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := d.ExportUrl(f, "")
+		if err != nil {
+			t.Fatalf("ExportUrl(%v): %v", id, err)
+		}
+		return u
+	}
+	d := newTestDB(t, fd, nil)
+	if u := url(d, "doc"); !strings.Contains(u, "application%2Fpdf") {
+		t.Errorf("without a policy, a Doc's export url is %v, want its PDF export", u)
+	}
+	d = newTestDB(t, fd, &DriveDBOptions{ExportPolicy: ExportPolicy{"application/vnd.google-apps.document": "text/plain"}})
+	if err := d.SetExportFormat("chosen", "application/pdf"); err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[string]string{"doc": "text%2Fplain", "chosen": "application%2Fpdf"} {
+		if u := url(d, id); !strings.Contains(u, want) {
+			t.Errorf("with the policy, %v's export url is %v, want its %v export", id, u, want)
+		}
+	}
+}
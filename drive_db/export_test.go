@@ -0,0 +1,170 @@
+package drive_db
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestEstimatedSize(t *testing.T) {
+	fd := newFakeDrive()
+	fd.doc("doc", "doc", "some text")
+	fd.file("bin", "bin.dat", "binary")
+	d := newTestDB(t, fd, nil)
+
+	file := func(id string) *File {
+		t.Helper()
+		inode, err := d.InodeForFileId(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := d.FileByInode(inode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	if size := file("bin").EstimatedSize(); size != int64(len("binary")) {
+		t.Errorf("EstimatedSize of a binary file = %d, want its size, %d", size, len("binary"))
+	}
+
+	// Until it's exported, a Doc's size is the estimate for its type.
+	want := EstimatedExportSizes["application/vnd.google-apps.document"]
+	if size := file("doc").EstimatedSize(); size != want {
+		t.Errorf("EstimatedSize of a Doc never exported = %d, want %d", size, want)
+	}
+	data, err := d.ReadExport(file("doc"), 0, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "application/pdf:some text" {
+		t.Fatalf("ReadExport(doc) = %q, want its PDF export", data)
+	}
+	// Thereafter, it's the size of the export, which is kept.
+	if size := file("doc").EstimatedSize(); size != int64(len(data)) {
+		t.Errorf("EstimatedSize of an exported Doc = %d, want %d", size, len(data))
+	}
+	d.lruCache.Clear()
+	if size := file("doc").EstimatedSize(); size != int64(len(data)) {
+		t.Errorf("EstimatedSize of an exported Doc, uncached = %d, want %d", size, len(data))
+	}
+}
+
+func TestExportExtension(t *testing.T) {
+	for _, tc := range []struct{ driveMime, exportMime, want string }{
+		// The defaults for each native type.
+		{"application/vnd.google-apps.document", "", ".pdf"},
+		{"application/vnd.google-apps.spreadsheet", "", ".xlsx"},
+		{"application/vnd.google-apps.presentation", "", ".pdf"},
+		{"application/vnd.google-apps.drawing", "", ".png"},
+		// Chosen export types.
+		{"application/vnd.google-apps.document", "application/vnd.openxmlformats-officedocument.wordprocessingml.document", ".docx"},
+		{"application/vnd.google-apps.presentation", "application/vnd.openxmlformats-officedocument.presentationml.presentation", ".pptx"},
+		{"application/vnd.google-apps.spreadsheet", "text/csv", ".csv"},
+		{"application/vnd.google-apps.drawing", "image/svg+xml", ".svg"},
+		{"application/vnd.google-apps.document", "application/x-unknown", ""},
+		// Files which aren't exported.
+		{"application/pdf", "", ""},
+		{"application/vnd.google-apps.form", "", ""},
+	} {
+		if got := ExportExtension(tc.driveMime, tc.exportMime); got != tc.want {
+			t.Errorf("ExportExtension(%q, %q) = %q, want %q", tc.driveMime, tc.exportMime, got, tc.want)
+		}
+	}
+}
+
+func TestExportedNames(t *testing.T) {
+	fd := newFakeDrive()
+	fd.doc("d1", "notes", "1")
+	fd.doc("d2", "notes", "2")
+	fd.doc("pdf", "report.pdf", "r")
+	d := newTestDB(t, fd, &DriveDBOptions{
+		ExportExtensions: map[string]string{"text/plain": ".text"},
+	})
+
+	children, err := d.ChildrenWithUniqueNames(d.rootId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for name, f := range children {
+		if f.Id != orphanFileId {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if want := []string{"notes (2).pdf", "notes.pdf", "report.pdf"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("ChildrenWithUniqueNames(root) = %v, want %v", names, want)
+	}
+	// Each is found by the name it's listed by, or its title if that's
+	// its own.
+	for p, want := range map[string]string{
+		"/notes (2).pdf": "d2",
+		"/report.pdf":    "pdf",
+	} {
+		if f, err := d.FileByPath(p); err != nil || f.Id != want {
+			t.Errorf("FileByPath(%q) = %v, %v, want %s", p, f, err, want)
+		}
+	}
+
+	// An override applies to the db it's given to.
+	if err := d.SetExportFormat("pdf", "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := d.FileByPath("/report.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := d.DisplayName(f); name != "report.pdf.text" {
+		t.Errorf("DisplayName of a Doc exported as text = %q, want report.pdf.text", name)
+	}
+}
+
+func TestSetExportFormat(t *testing.T) {
+	fd := newFakeDrive()
+	fd.doc("doc", "doc", "text")
+	dir := t.TempDir()
+	d := openTestDB(t, fd, dir, nil)
+
+	// read checks that the Doc is named name, and exported as mimeType.
+	read := func(when, name, mimeType string) {
+		t.Helper()
+		f, err := d.FileByPath(name)
+		if err != nil {
+			t.Fatalf("%s, FileByPath(%s): %v", when, name, err)
+		}
+		data, err := d.ReadExport(f, 0, 1<<20)
+		if err != nil || !strings.HasPrefix(string(data), mimeType+":") {
+			t.Errorf("%s, ReadExport(doc) = %q, %v, want its %s export", when, data, err, mimeType)
+		}
+	}
+	if err := d.SetExportFormat("doc", "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	read("once chosen", "/doc.txt", "text/plain")
+
+	// The choice is kept in the db, so it outlives a restart.
+	d.Close()
+	d = openTestDB(t, fd, dir, nil)
+	if got := d.ExportFormat("doc"); got != "text/plain" {
+		t.Errorf("after reopening, ExportFormat(doc) = %q, want text/plain", got)
+	}
+	read("after reopening", "/doc.txt", "text/plain")
+
+	// Cleared, the default applies again, also after a restart.
+	if err := d.SetExportFormat("doc", ""); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+	d = openTestDB(t, fd, dir, &DriveDBOptions{ReadOnly: true})
+	if got := d.ExportFormat("doc"); got != "" {
+		t.Errorf("after clearing it and reopening, ExportFormat(doc) = %q, want none", got)
+	}
+	if _, err := d.FileByPath("/doc.pdf"); err != nil {
+		t.Errorf("after clearing it and reopening, FileByPath(/doc.pdf): %v", err)
+	}
+	if err := d.SetExportFormat("doc", "text/plain"); err != ErrReadOnly {
+		t.Errorf("SetExportFormat of a ReadOnly db = %v, want ErrReadOnly", err)
+	}
+}
@@ -0,0 +1,882 @@
+package drive_db
+
+// An in-memory Drive, serving the parts of the v2 API the db uses, so that
+// tests can sync a DriveDB with it.
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gdrive "code.google.com/p/google-api-go-client/drive/v2"
+)
+
+// fakeDrive is an http.RoundTripper serving a Drive from memory. Every change
+// to its files is added to its change list, as Drive does.
+type fakeDrive struct {
+	mu        sync.Mutex
+	files     map[string]*gdrive.File
+	content   map[string][]byte
+	targets   map[string]string // shortcut fileId to its target's
+	revisions map[string][]*gdrive.Revision
+	changes   []*gdrive.Change
+	lastId    int64                  // of the last change
+	oldest    int64                  // the first change still listed; those before are forgotten
+	ids       int                    // files inserted
+	urls      int                    // download urls handed out
+	thumbs    map[string]string      // fileId to its latest thumbnail link; older ones are refused
+	sessions  map[string]*fakeUpload // resumable uploads in progress
+	calls     map[string]int         // op to the number of requests for it
+	failures  map[string][]int       // op to the statuses its next requests fail with
+	cuts      map[string][]int       // op to the lengths its next responses fail after
+	queries   []string               // q of each files.list
+	pageSize  int                    // files per files.list page; 0 for all of them
+	drives    map[string]string      // Team Drive id, that of its root folder, to its name
+	used      int64                  // bytes of storage the user has used
+	user      gdrive.User
+
+	// before, if set, is called before each request is served. If it
+	// returns an error, the request fails with it.
+	before func(op string, req *http.Request) error
+}
+
+// fakeUpload is a resumable upload, of the content received so far.
+type fakeUpload struct {
+	fileId  string
+	content []byte
+}
+
+func newFakeDrive() *fakeDrive {
+	fd := &fakeDrive{
+		files:     make(map[string]*gdrive.File),
+		content:   make(map[string][]byte),
+		targets:   make(map[string]string),
+		revisions: make(map[string][]*gdrive.Revision),
+		sessions:  make(map[string]*fakeUpload),
+		calls:     make(map[string]int),
+		failures:  make(map[string][]int),
+		cuts:      make(map[string][]int),
+		drives:    make(map[string]string),
+		thumbs:    make(map[string]string),
+		user:      gdrive.User{PermissionId: "me", EmailAddress: "me@example.com"},
+	}
+	// A db is only synced once it has seen a change, so start with one.
+	fd.lastId++
+	fd.changes = append(fd.changes, &gdrive.Change{Id: fd.lastId, FileId: "never-synced", Deleted: true})
+	return fd
+}
+
+// client returns a client whose requests, to any URL, are served by fd.
+func (fd *fakeDrive) client() *http.Client {
+	return &http.Client{Transport: fd}
+}
+
+// folder adds a folder titled title to parents, "root" if there are none.
+func (fd *fakeDrive) folder(id, title string, parents ...string) *gdrive.File {
+	return fd.add(&gdrive.File{Id: id, Title: title, MimeType: driveFolderMimeType}, parents...)
+}
+
+// file adds a file titled title to parents, "root" if there are none, with
+// content as its contents.
+func (fd *fakeDrive) file(id, title, content string, parents ...string) *gdrive.File {
+	fd.add(&gdrive.File{Id: id, Title: title, MimeType: "text/plain"}, parents...)
+	fd.setContent(id, []byte(content))
+	return fd.get(id)
+}
+
+// doc adds a Google Doc, exportable as PDF or plain text, to parents and
+// returns a copy of it. Its exports are content, prefixed with the type.
+func (fd *fakeDrive) doc(id, title, content string, parents ...string) *gdrive.File {
+	links := make(map[string]string)
+	for _, t := range []string{"application/pdf", "text/plain"} {
+		links[t] = fmt.Sprintf("https://fake.invalid/export/%s?mimeType=%s", id, url.QueryEscape(t))
+	}
+	fd.mu.Lock()
+	fd.content[id] = []byte(content) // native files have no size or md5
+	fd.mu.Unlock()
+	return fd.add(&gdrive.File{Id: id, Title: title, MimeType: "application/vnd.google-apps.document", ExportLinks: links}, parents...)
+}
+
+// shortcut adds a shortcut to target to parents, and returns a copy of it.
+func (fd *fakeDrive) shortcut(id, title, target string, parents ...string) *gdrive.File {
+	fd.mu.Lock()
+	fd.targets[id] = target
+	fd.mu.Unlock()
+	return fd.add(&gdrive.File{Id: id, Title: title, MimeType: driveShortcutMimeType}, parents...)
+}
+
+// add adds f to parents, "root" if there are none, and returns a copy of it.
+func (fd *fakeDrive) add(f *gdrive.File, parents ...string) *gdrive.File {
+	if len(parents) == 0 {
+		parents = []string{"root"}
+	}
+	for _, p := range parents {
+		f.Parents = append(f.Parents, &gdrive.ParentReference{Id: p})
+	}
+	if f.Labels == nil {
+		f.Labels = &gdrive.FileLabels{}
+	}
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	fd.files[f.Id] = f
+	fd.changed(f.Id)
+	return copyFile(f)
+}
+
+// update applies fn to the file fileId, and returns a copy of the result.
+func (fd *fakeDrive) update(fileId string, fn func(f *gdrive.File)) *gdrive.File {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	f := fd.files[fileId]
+	fn(f)
+	fd.changed(fileId)
+	return copyFile(f)
+}
+
+// remove deletes the file fileId.
+func (fd *fakeDrive) remove(fileId string) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	delete(fd.files, fileId)
+	delete(fd.content, fileId)
+	fd.changed(fileId)
+}
+
+// teamDrive adds a Team Drive named name, whose root folder is id.
+func (fd *fakeDrive) teamDrive(id, name string) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	fd.drives[id] = name
+}
+
+// removeTeamDrive takes the Team Drive id away from the user, removing the
+// files in it, as they can no longer reach them.
+func (fd *fakeDrive) removeTeamDrive(id string) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	var ids []string
+	for fileId, f := range fd.files {
+		if fd.inTeamDrive(f) {
+			ids = append(ids, fileId)
+		}
+	}
+	sort.Strings(ids)
+	delete(fd.drives, id)
+	for _, fileId := range ids {
+		delete(fd.files, fileId)
+		delete(fd.content, fileId)
+		fd.changed(fileId)
+	}
+}
+
+// inTeamDrive reports whether f is in one of the Team Drives.
+func (fd *fakeDrive) inTeamDrive(f *gdrive.File) bool {
+	seen := make(map[string]bool)
+	parents := f.Parents
+	for len(parents) > 0 {
+		p := parents[0].Id
+		parents = parents[1:]
+		if _, ok := fd.drives[p]; ok {
+			return true
+		}
+		if pf, ok := fd.files[p]; ok && !seen[p] {
+			seen[p] = true
+			parents = append(parents, pf.Parents...)
+		}
+	}
+	return false
+}
+
+// teamDriveItems reports whether the request q asks for the files in Team
+// Drives, which Drive otherwise leaves out.
+func teamDriveItems(q map[string][]string) bool {
+	return first(q["supportsTeamDrives"]) == "true" && first(q["includeTeamDriveItems"]) == "true"
+}
+
+// setContent replaces the contents of the file fileId.
+func (fd *fakeDrive) setContent(fileId string, content []byte) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	fd.setContentLocked(fileId, content)
+	fd.changed(fileId)
+}
+
+func (fd *fakeDrive) setContentLocked(fileId string, content []byte) {
+	f := fd.files[fileId]
+	fd.content[fileId] = content
+	f.FileSize = int64(len(content))
+	f.Md5Checksum = fmt.Sprintf("%x", md5.Sum(content))
+}
+
+// get returns a copy of the file fileId, or nil if there's none.
+func (fd *fakeDrive) get(fileId string) *gdrive.File {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	return fd.getLocked(fileId)
+}
+
+func (fd *fakeDrive) getLocked(fileId string) *gdrive.File {
+	f, ok := fd.files[fileId]
+	if !ok {
+		return nil
+	}
+	c := copyFile(f)
+	if f.MimeType != driveFolderMimeType && !strings.HasPrefix(f.MimeType, "application/vnd.google-apps.") {
+		// Download urls expire, so each is different.
+		fd.urls++
+		c.DownloadUrl = fmt.Sprintf("https://fake.invalid/download/%s?url=%d", fileId, fd.urls)
+		c.ThumbnailLink = fmt.Sprintf("https://fake.invalid/thumbnail/%s?url=%d", fileId, fd.urls)
+		fd.thumbs[fileId] = c.ThumbnailLink
+	}
+	return c
+}
+
+// changed records a change to fileId, and bumps its version and etag.
+func (fd *fakeDrive) changed(fileId string) {
+	fd.lastId++
+	c := &gdrive.Change{Id: fd.lastId, FileId: fileId}
+	if f, ok := fd.files[fileId]; ok {
+		f.Version++
+		f.Etag = fmt.Sprintf("%q", fmt.Sprintf("%s/%d", fileId, f.Version))
+		f.ModifiedDate = time.Unix(1400000000+fd.lastId, 0).UTC().Format(time.RFC3339)
+		c.File = fd.getLocked(fileId)
+	} else {
+		c.Deleted = true
+	}
+	fd.changes = append(fd.changes, c)
+}
+
+// setBefore sets the hook called before each request is served.
+func (fd *fakeDrive) setBefore(before func(op string, req *http.Request) error) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	fd.before = before
+}
+
+// failNext makes the next requests for op fail with the HTTP statuses codes.
+func (fd *fakeDrive) failNext(op string, codes ...int) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	fd.failures[op] = append(fd.failures[op], codes...)
+}
+
+// cutNext makes the bodies of the next responses to op fail, as if the
+// connection broke, after each of lengths bytes.
+func (fd *fakeDrive) cutNext(op string, lengths ...int) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	fd.cuts[op] = append(fd.cuts[op], lengths...)
+}
+
+// forgetChanges forgets the changes made so far, as Drive does those older
+// than it keeps, so listing changes from before now fails.
+func (fd *fakeDrive) forgetChanges() {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	fd.oldest = fd.lastId + 1
+}
+
+// count returns the number of requests made for op.
+func (fd *fakeDrive) count(op string) int {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	return fd.calls[op]
+}
+
+// total returns the number of requests made for all ops.
+func (fd *fakeDrive) total() int {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	n := 0
+	for _, c := range fd.calls {
+		n += c
+	}
+	return n
+}
+
+func copyFile(f *gdrive.File) *gdrive.File {
+	c := *f
+	c.Parents = append([]*gdrive.ParentReference(nil), f.Parents...)
+	if f.Labels != nil {
+		l := *f.Labels
+		c.Labels = &l
+	}
+	return &c
+}
+
+// fakeOp names the API call req makes.
+func fakeOp(req *http.Request) string {
+	p := req.URL.Path
+	switch {
+	case strings.HasPrefix(p, "/download/"):
+		return "download"
+	case strings.HasPrefix(p, "/export/"):
+		return "export"
+	case strings.HasPrefix(p, "/thumbnail/"):
+		return "thumbnail"
+	case strings.HasPrefix(p, "/upload/"):
+		return "files.upload"
+	case p == "/drive/v2/about":
+		return "about.get"
+	case p == "/drive/v2/teamdrives":
+		return "teamdrives.list"
+	case p == "/drive/v2/changes":
+		return "changes.list"
+	case p == "/drive/v2/changes/startPageToken":
+		return "changes.getStartPageToken"
+	case p == "/drive/v2/files" && req.Method == "POST":
+		return "files.insert"
+	case p == "/drive/v2/files":
+		return "files.list"
+	case p == "/drive/v2/files/trash":
+		return "files.emptyTrash"
+	case strings.HasSuffix(p, "/untrash"):
+		return "files.untrash"
+	case strings.HasSuffix(p, "/trash"):
+		return "files.trash"
+	case strings.Contains(p, "/revisions"):
+		return "revisions." + map[bool]string{true: "list", false: "get"}[strings.HasSuffix(p, "/revisions")]
+	}
+	switch req.Method {
+	case "PATCH":
+		return "files.patch"
+	}
+	return "files.get"
+}
+
+func (fd *fakeDrive) RoundTrip(req *http.Request) (*http.Response, error) {
+	op := fakeOp(req)
+	fd.mu.Lock()
+	fd.calls[op]++
+	before := fd.before
+	fd.mu.Unlock()
+	if before != nil {
+		if err := before(op, req); err != nil {
+			return nil, err
+		}
+	}
+	w := httptest.NewRecorder()
+	fd.serve(op, w, req)
+	resp := w.Result()
+	resp.Request = req
+	fd.mu.Lock()
+	if cuts := fd.cuts[op]; len(cuts) > 0 {
+		fd.cuts[op] = cuts[1:]
+		resp.Body = &cutBody{resp.Body, cuts[0]}
+	}
+	fd.mu.Unlock()
+	return resp, nil
+}
+
+// cutBody is a response body which fails after left more bytes, returning
+// the error with the last of them.
+type cutBody struct {
+	io.ReadCloser
+	left int
+}
+
+func (b *cutBody) Read(p []byte) (int, error) {
+	if len(p) > b.left {
+		p = p[:b.left]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.left -= n
+	if b.left == 0 {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+var fileIdPath = regexp.MustCompile(`^/(?:upload/)?drive/v2/files/([^/]+)`)
+
+func (fd *fakeDrive) serve(op string, w http.ResponseWriter, req *http.Request) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	if codes := fd.failures[op]; len(codes) > 0 {
+		fd.failures[op] = codes[1:]
+		fakeError(w, codes[0], "backendError")
+		return
+	}
+	var fileId string
+	if m := fileIdPath.FindStringSubmatch(req.URL.Path); m != nil {
+		fileId = m[1]
+	}
+	q := req.URL.Query()
+	switch op {
+	case "about.get":
+		fakeReply(w, &gdrive.About{
+			RootFolderId:    "root",
+			LargestChangeId: fd.lastId,
+			QuotaBytesUsed:  fd.used,
+			QuotaBytesTotal: 1 << 30,
+			User:            &fd.user,
+		})
+	case "changes.list":
+		fd.listChanges(w, q)
+	case "teamdrives.list":
+		var drives []map[string]string
+		for id, name := range fd.drives {
+			drives = append(drives, map[string]string{"id": id, "name": name})
+		}
+		fakeReply(w, map[string]interface{}{"items": drives})
+	case "changes.getStartPageToken":
+		fakeReply(w, map[string]string{"startPageToken": strconv.FormatInt(fd.lastId+1, 10)})
+	case "files.list":
+		fd.listFiles(w, q)
+	case "files.get":
+		f := fd.getLocked(fileId)
+		if f == nil {
+			fakeError(w, 404, "notFound")
+			return
+		}
+		if target, ok := fd.targets[fileId]; ok {
+			data, _ := json.Marshal(f)
+			var m map[string]interface{}
+			json.Unmarshal(data, &m)
+			m["shortcutDetails"] = map[string]string{"targetId": target}
+			fakeReply(w, m)
+			return
+		}
+		fakeReply(w, f)
+	case "files.insert":
+		var f gdrive.File
+		json.NewDecoder(req.Body).Decode(&f)
+		fd.ids++
+		f.Id = fmt.Sprintf("inserted%d", fd.ids)
+		if f.Labels == nil {
+			f.Labels = &gdrive.FileLabels{}
+		}
+		fd.files[f.Id] = &f
+		fd.changed(f.Id)
+		fakeReply(w, fd.getLocked(f.Id))
+	case "files.patch":
+		fd.patch(w, req, fileId)
+	case "files.trash", "files.untrash":
+		f := fd.files[fileId]
+		if f == nil {
+			fakeError(w, 404, "notFound")
+			return
+		}
+		f.Labels.Trashed = op == "files.trash"
+		fd.changed(fileId)
+		fakeReply(w, fd.getLocked(fileId))
+	case "files.emptyTrash":
+		for id, f := range fd.files {
+			if f.Labels.Trashed {
+				delete(fd.files, id)
+				delete(fd.content, id)
+				fd.changed(id)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "files.upload":
+		fd.upload(w, req, fileId)
+	case "download":
+		content, ok := fd.content[path.Base(req.URL.Path)]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(content))
+	case "thumbnail":
+		id := path.Base(req.URL.Path)
+		if fd.thumbs[id] != "https://fake.invalid"+req.URL.RequestURI() {
+			fakeError(w, 403, "forbidden") // expired
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("thumbnail of " + id))
+	case "export":
+		content, ok := fd.content[path.Base(req.URL.Path)]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Write([]byte(q.Get("mimeType") + ":"))
+		w.Write(content)
+	case "revisions.list":
+		fakeReply(w, &gdrive.RevisionList{Items: fd.revisions[fileId]})
+	case "revisions.get":
+		for _, r := range fd.revisions[fileId] {
+			if r.Id == path.Base(req.URL.Path) {
+				fakeReply(w, r)
+				return
+			}
+		}
+		fakeError(w, 404, "notFound")
+	default:
+		fakeError(w, 400, "unsupported: "+op)
+	}
+}
+
+// listChanges serves a page of changes: those from the startChangeId, or the
+// pageToken, which is the id of the next change to list. The last page has the
+// start page token of the changes to come. Changes to the files in Team Drives
+// are only listed if they're asked for.
+func (fd *fakeDrive) listChanges(w http.ResponseWriter, q map[string][]string) {
+	start, _ := strconv.ParseInt(first(q["startChangeId"]), 10, 64)
+	if start > 0 && start < fd.oldest {
+		fakeError(w, http.StatusBadRequest, "Invalid startChangeId")
+		return
+	}
+	if token := first(q["pageToken"]); token != "" {
+		start, _ = strconv.ParseInt(token, 10, 64)
+		if start < fd.oldest {
+			fakeError(w, http.StatusBadRequest, "Invalid pageToken")
+			return
+		}
+	}
+	max, _ := strconv.Atoi(first(q["maxResults"]))
+	if max <= 0 {
+		max = 100
+	}
+	l := &gdrive.ChangeList{}
+	for _, c := range fd.changes {
+		if c.File != nil && !teamDriveItems(q) && fd.inTeamDrive(c.File) {
+			continue
+		}
+		l.LargestChangeId = c.Id
+	}
+	for _, c := range fd.changes {
+		if c.Id < start || c.File != nil && !teamDriveItems(q) && fd.inTeamDrive(c.File) {
+			continue
+		}
+		if len(l.Items) == max {
+			l.NextPageToken = strconv.FormatInt(c.Id, 10)
+			break
+		}
+		l.Items = append(l.Items, c)
+	}
+	page := struct {
+		*gdrive.ChangeList
+		NewStartPageToken string `json:"newStartPageToken,omitempty"`
+	}{ChangeList: l}
+	if l.NextPageToken == "" {
+		page.NewStartPageToken = strconv.FormatInt(fd.lastId+1, 10)
+	}
+	fakeReply(w, page)
+}
+
+var inParents = regexp.MustCompile(`'([^']+)' in parents`)
+
+// listFiles serves a page of the files matching q, which may select a
+// folder's children, and the untrashed files. Other queries match every
+// file. The pageToken is the fileId of the first file of the page. The files
+// in Team Drives are only listed if they're asked for.
+func (fd *fakeDrive) listFiles(w http.ResponseWriter, q map[string][]string) {
+	query := first(q["q"])
+	fd.queries = append(fd.queries, query)
+	var ids []string
+	for id := range fd.files {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	start := first(q["pageToken"])
+	l := &gdrive.FileList{}
+	for _, id := range ids {
+		f := fd.files[id]
+		if id < start {
+			continue
+		}
+		if m := inParents.FindStringSubmatch(query); m != nil && !hasParent(f, m[1]) {
+			continue
+		}
+		if strings.Contains(query, "trashed = false") && f.Labels.Trashed {
+			continue
+		}
+		if !teamDriveItems(q) && fd.inTeamDrive(f) {
+			continue
+		}
+		if fd.pageSize > 0 && len(l.Items) == fd.pageSize {
+			l.NextPageToken = id
+			break
+		}
+		l.Items = append(l.Items, fd.getLocked(id))
+	}
+	fakeReply(w, l)
+}
+
+func hasParent(f *gdrive.File, parentId string) bool {
+	for _, p := range f.Parents {
+		if p.Id == parentId {
+			return true
+		}
+	}
+	return false
+}
+
+// patch applies the fields of the request's body, and the addParents and
+// removeParents parameters, to the file fileId.
+func (fd *fakeDrive) patch(w http.ResponseWriter, req *http.Request, fileId string) {
+	f := fd.files[fileId]
+	if f == nil {
+		fakeError(w, 404, "notFound")
+		return
+	}
+	var p struct {
+		Title  string
+		Labels *struct{ Starred, Trashed *bool }
+	}
+	json.NewDecoder(req.Body).Decode(&p)
+	if p.Title != "" {
+		f.Title = p.Title
+	}
+	if p.Labels != nil && p.Labels.Starred != nil {
+		f.Labels.Starred = *p.Labels.Starred
+	}
+	if p.Labels != nil && p.Labels.Trashed != nil {
+		f.Labels.Trashed = *p.Labels.Trashed
+	}
+	q := req.URL.Query()
+	for _, id := range strings.Split(first(q["removeParents"]), ",") {
+		for i, pr := range f.Parents {
+			if pr.Id == id {
+				f.Parents = append(f.Parents[:i:i], f.Parents[i+1:]...)
+				break
+			}
+		}
+	}
+	for _, id := range strings.Split(first(q["addParents"]), ",") {
+		if id != "" && !hasParent(f, id) {
+			f.Parents = append(f.Parents, &gdrive.ParentReference{Id: id})
+		}
+	}
+	fd.changed(fileId)
+	fakeReply(w, fd.getLocked(fileId))
+}
+
+var contentRange = regexp.MustCompile(`^bytes (?:(\d+)-(\d+)|\*)/(\d+|\*)$`)
+
+// upload serves the resumable upload protocol: a session is started with a
+// request whose uploadType is resumable, then the content is sent to the
+// session's url, in one or more chunks, each with a Content-Range. Until the
+// last has been received, they're answered with 308 and the Range received.
+func (fd *fakeDrive) upload(w http.ResponseWriter, req *http.Request, fileId string) {
+	q := req.URL.Query()
+	if first(q["uploadType"]) != "resumable" {
+		fakeError(w, 400, "only resumable uploads are supported")
+		return
+	}
+	sid := first(q["upload_id"])
+	if sid == "" {
+		if fd.files[fileId] == nil {
+			fakeError(w, 404, "notFound")
+			return
+		}
+		sid = strconv.Itoa(len(fd.sessions) + 1)
+		fd.sessions[sid] = &fakeUpload{fileId: fileId}
+		w.Header().Set("Location", fmt.Sprintf("https://www.googleapis.com/upload/drive/v2/files/%s?uploadType=resumable&upload_id=%s", fileId, sid))
+		return
+	}
+	u := fd.sessions[sid]
+	if u == nil {
+		fakeError(w, 404, "notFound")
+		return
+	}
+	var body []byte
+	if req.Body != nil {
+		body, _ = ioutil.ReadAll(req.Body)
+	}
+	m := contentRange.FindStringSubmatch(req.Header.Get("Content-Range"))
+	if m == nil {
+		fakeError(w, 400, "bad Content-Range")
+		return
+	}
+	if m[1] != "" {
+		start, _ := strconv.Atoi(m[1])
+		if start > len(u.content) {
+			fakeError(w, 400, "Content-Range skips bytes")
+			return
+		}
+		u.content = append(u.content[:start], body...)
+	}
+	if total, err := strconv.Atoi(m[3]); err != nil || total != len(u.content) {
+		if len(u.content) > 0 {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(u.content)-1))
+		}
+		w.WriteHeader(308)
+		return
+	}
+	f := fd.files[u.fileId]
+	if f == nil {
+		fakeError(w, 404, "notFound")
+		return
+	}
+	delete(fd.sessions, sid)
+	fd.setContentLocked(u.fileId, u.content)
+	fd.changed(u.fileId)
+	fakeReply(w, fd.getLocked(u.fileId))
+}
+
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func fakeReply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// fakeError replies with an error as Drive does, with reason as the reason of
+// its only error.
+func fakeError(w http.ResponseWriter, code int, reason string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, `{"error": {"errors": [{"reason": %q, "message": %q}], "code": %d, "message": %q}}`, reason, reason, code, reason)
+}
+
+// newTestDB opens a DriveDB in a temporary directory, syncing from fd, and
+// waits for it to sync. opts may be nil. It's closed when the test ends.
+func newTestDB(t testing.TB, fd *fakeDrive, opts *DriveDBOptions) *DriveDB {
+	t.Helper()
+	return openTestDB(t, fd, t.TempDir(), opts)
+}
+
+// openTestDB is newTestDB, with the db in dir, so it can be opened again
+// there. Its handlers are served on a mux of its own, unless opts has one.
+func openTestDB(t testing.TB, fd *fakeDrive, dir string, opts *DriveDBOptions) *DriveDB {
+	t.Helper()
+	var o DriveDBOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.Mux == nil {
+		o.Mux = http.NewServeMux()
+	}
+	if o.SyncRetryDelay == 0 {
+		o.SyncRetryDelay = time.Millisecond
+	}
+	if o.APIQPS == 0 {
+		o.APIQPS = -1
+	}
+	if o.Logger == nil {
+		o.Logger = testLogger{t}
+	}
+	d, err := NewDriveDB(fd.client(), path.Join(dir, "db"), path.Join(dir, "cache"), time.Hour, "root", &o)
+	if err != nil {
+		t.Fatalf("NewDriveDB: %v", err)
+	}
+	t.Cleanup(d.Close)
+	if !o.ReadOnly {
+		waitSynced(t, d)
+	}
+	return d
+}
+
+// waitSynced waits for d to apply every change it's read, failing the test
+// if that takes too long.
+func waitSynced(t testing.TB, d *DriveDB) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := d.WaitUntilSyncedContext(ctx); err != nil {
+		t.Fatalf("WaitUntilSynced: %v", err)
+	}
+}
+
+// waitFor waits for cond to hold, failing the test, as what, if it doesn't
+// within 10s.
+func waitFor(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s not done after 10s", what)
+		}
+	}
+}
+
+// waitPolled waits for d's first poll to finish, which may still be running
+// once d is synced, as it fetches the quota after applying the changes.
+func waitPolled(t testing.TB, d *DriveDB) {
+	t.Helper()
+	waitFor(t, "the first poll", d.haveQuota)
+}
+
+// resync reads the changes made in fd since d last synced, and waits for
+// them to be applied, and d to be synced.
+func resync(t testing.TB, d *DriveDB, fd *fakeDrive) {
+	t.Helper()
+	d.readChanges()
+	fd.mu.Lock()
+	last := fd.lastId
+	fd.mu.Unlock()
+	deadline := time.Now().Add(10 * time.Second)
+	for d.lastChangeId() < last {
+		if time.Now().After(deadline) {
+			t.Fatalf("changes up to %d not applied after 10s; applied %d", last, d.lastChangeId())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// Folders they brought into scope may still be being filled.
+	waitSynced(t, d)
+}
+
+// testLogger logs to the test, so only the logs of failed tests are shown.
+type testLogger struct {
+	t testing.TB
+}
+
+func (l testLogger) Debugf(format string, args ...interface{}) {}
+func (l testLogger) Infof(format string, args ...interface{})  { l.t.Logf(format, args...) }
+func (l testLogger) Warnf(format string, args ...interface{})  { l.t.Logf(format, args...) }
+func (l testLogger) Errorf(format string, args ...interface{}) { l.t.Logf(format, args...) }
+
+// changeList returns a ChangeList of a change to each of files, with ids
+// following from those d has applied, and the largest change id of the last.
+func changeList(d *DriveDB, files ...*gdrive.File) *gdrive.ChangeList {
+	id := d.lastChangeId()
+	l := &gdrive.ChangeList{}
+	for _, f := range files {
+		id++
+		l.Items = append(l.Items, &gdrive.Change{Id: id, FileId: f.Id, File: f})
+	}
+	l.LargestChangeId = id
+	return l
+}
+
+// apply applies a change to each of files to d, failing the test if that
+// fails.
+func apply(t testing.TB, d *DriveDB, files ...*gdrive.File) {
+	t.Helper()
+	if err := d.processChange(changeList(d, files...)); err != nil {
+		t.Fatalf("processChange: %v", err)
+	}
+}
+
+// testFile returns a file titled title in parents, "root" if there are none.
+func testFile(id, title string, parents ...string) *gdrive.File {
+	if len(parents) == 0 {
+		parents = []string{"root"}
+	}
+	f := &gdrive.File{Id: id, Title: title, MimeType: "text/plain", Labels: &gdrive.FileLabels{}}
+	for _, p := range parents {
+		f.Parents = append(f.Parents, &gdrive.ParentReference{Id: p})
+	}
+	return f
+}
+
+// testFolder returns a folder titled title in parents, "root" if there are
+// none.
+func testFolder(id, title string, parents ...string) *gdrive.File {
+	f := testFile(id, title, parents...)
+	f.MimeType = driveFolderMimeType
+	return f
+}
@@ -0,0 +1,105 @@
+package drive_db
+
+// Accessors for the attributes of a File which need Drive's quirks smoothed
+// over, e.g. for stat.
+
+import (
+	"time"
+
+	gdrive "code.google.com/p/google-api-go-client/drive/v2"
+)
+
+// ModTime returns when f was last modified, or the zero time if Drive
+// didn't say.
+func (f *File) ModTime() time.Time {
+	var t time.Time
+	if err := t.UnmarshalText([]byte(f.ModifiedDate)); err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// Size returns the size of f's content in bytes. Folders and native Google
+// files have none; the latter's size is only known once exported.
+func (f *File) Size() int64 {
+	if f.IsDir() || f.IsNative() {
+		return 0
+	}
+	return f.FileSize
+}
+
+// IsDir reports whether f is a folder.
+func (f *File) IsDir() bool {
+	return f.MimeType == driveFolderMimeType
+}
+
+// Writable reports whether we may change f's content and metadata, i.e.
+// we're its owner or a writer. Files without a UserPermission, such as the
+// synthetic folders, are taken to be writable, leaving it to Drive to refuse.
+func (f *File) Writable() bool {
+	if f.UserPermission == nil {
+		return true
+	}
+	switch f.UserPermission.Role {
+	case "owner", "writer":
+		return true
+	}
+	return false
+}
+
+// Hidden reports whether Drive marks f as hidden. Only files kept by the
+// KeepHidden option can be.
+func (f *File) Hidden() bool {
+	return f.Labels != nil && f.Labels.Hidden
+}
+
+// dropHidden reports whether f is hidden, and so not kept in the db unless
+// opts.KeepHidden is set.
+func (d *DriveDB) dropHidden(f *gdrive.File) bool {
+	return !d.opts.KeepHidden && f.Labels != nil && f.Labels.Hidden
+}
+
+// OwnedByMe reports whether the authenticated user is one of f's owners.
+func (f *File) OwnedByMe() bool {
+	for _, o := range f.Owners {
+		if o.IsAuthenticatedUser {
+			return true
+		}
+	}
+	return false
+}
+
+// editorPaths maps native Google file types to their editor's path on
+// docs.google.com, for files Drive gives no alternateLink.
+var editorPaths = map[string]string{
+	"application/vnd.google-apps.document":     "document",
+	"application/vnd.google-apps.spreadsheet":  "spreadsheets",
+	"application/vnd.google-apps.presentation": "presentation",
+	"application/vnd.google-apps.drawing":      "drawings",
+}
+
+// WebViewURL returns the link which opens f in a browser: for native Google
+// files, in its editor, and otherwise in Drive's viewer. It returns "" for
+// files which have none, such as the synthetic folders.
+func (f *File) WebViewURL() string {
+	if f.File == nil {
+		return ""
+	}
+	if f.AlternateLink != "" {
+		return f.AlternateLink
+	}
+	if p, ok := editorPaths[f.MimeType]; ok && f.Id != "" {
+		return "https://docs.google.com/" + p + "/d/" + f.Id + "/edit"
+	}
+	return ""
+}
+
+// WebViewURL returns the link which opens the file at inode in a browser, as
+// File.WebViewURL does.
+func (d *DriveDB) WebViewURL(inode uint64) (string, error) {
+	f, err := d.FileByInode(inode)
+	if err != nil {
+		return "", err
+	}
+	return f.WebViewURL(), nil
+}
@@ -0,0 +1,52 @@
+package drive_db
+
+import (
+	"github.com/asjoyner/fuse_gdrive/lru"
+)
+
+// fileCache is an LRU cache of *Files by inode. It wraps lru.Cache so that
+// nothing but a *File can be cached under an inode, which is all FileByInode
+// expects to find.
+type fileCache struct {
+	c *lru.Cache
+}
+
+func newFileCache(maxEntries int) *fileCache {
+	return &fileCache{lru.New(maxEntries)}
+}
+
+func (c *fileCache) Add(inode uint64, f *File) {
+	c.c.Add(inode, f)
+}
+
+func (c *fileCache) Get(inode uint64) (*File, bool) {
+	f, ok := c.c.Get(inode)
+	if !ok {
+		return nil, false
+	}
+	return f.(*File), true
+}
+
+func (c *fileCache) Remove(inode uint64) {
+	c.c.Remove(inode)
+}
+
+func (c *fileCache) Pin(inode uint64) {
+	c.c.Pin(inode)
+}
+
+func (c *fileCache) Unpin(inode uint64) {
+	c.c.Unpin(inode)
+}
+
+func (c *fileCache) Clear() {
+	c.c.Clear()
+}
+
+func (c *fileCache) Len() int {
+	return c.c.Len()
+}
+
+func (c *fileCache) Stats() (hits, misses, evictions int64) {
+	return c.c.Stats()
+}
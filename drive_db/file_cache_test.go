@@ -0,0 +1,43 @@
+package drive_db
+
+import (
+	"testing"
+
+	gdrive "code.google.com/p/google-api-go-client/drive/v2"
+)
+
+func TestFileCache(t *testing.T) {
+	c := newFileCache(1)
+	f1 := &File{File: &gdrive.File{Id: "one"}, Inode: 1}
+	f2 := &File{File: &gdrive.File{Id: "two"}, Inode: 2}
+
+	if f, ok := c.Get(1); ok || f != nil {
+		t.Errorf("Get(1) of an empty cache = %v, %v, want nil, false", f, ok)
+	}
+	c.Pin(1)
+	c.Add(1, f1)
+	c.Add(2, f2) // evicted in place of the pinned 1
+	if f, ok := c.Get(1); !ok || f != f1 {
+		t.Errorf("Get(1) = %v, %v, want %v, true", f, ok, f1)
+	}
+	if _, ok := c.Get(2); ok {
+		t.Errorf("2 was kept over the pinned 1")
+	}
+	c.Unpin(1)
+	c.Add(2, f2)
+	if f, ok := c.Get(2); !ok || f != f2 {
+		t.Errorf("Get(2) = %v, %v, want %v, true", f, ok, f2)
+	}
+	c.Remove(2)
+	if got := c.Len(); got != 0 {
+		t.Errorf("Len() after Remove = %d, want 0", got)
+	}
+	if hits, misses, evictions := c.Stats(); hits != 2 || misses != 2 || evictions != 2 {
+		t.Errorf("Stats() = %d, %d, %d, want 2, 2, 2", hits, misses, evictions)
+	}
+	c.Add(1, f1)
+	c.Clear()
+	if _, ok := c.Get(1); ok {
+		t.Errorf("1 was found after Clear")
+	}
+}
@@ -0,0 +1,126 @@
+package drive_db
+
+import (
+	"testing"
+	"time"
+
+	gdrive "code.google.com/p/google-api-go-client/drive/v2"
+)
+
+func TestFileAttributes(t *testing.T) {
+	fd := newFakeDrive()
+	fd.folder("dir", "dir")
+	fd.file("bin", "bin.dat", "binary")
+	fd.doc("doc", "doc", "text")
+	// Whatever size Drive gives a Doc isn't that of its export.
+	fd.update("doc", func(f *gdrive.File) { f.FileSize = 1024 })
+	d := newTestDB(t, fd, nil)
+
+	for _, tc := range []struct {
+		id    string
+		size  int64
+		isDir bool
+	}{
+		{"dir", 0, true},
+		{"bin", int64(len("binary")), false},
+		{"doc", 0, false}, // its size is only known once exported
+	} {
+		inode, err := d.InodeForFileId(tc.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := d.FileByInode(inode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, _ := time.Parse(time.RFC3339, fd.get(tc.id).ModifiedDate)
+		if got := f.ModTime(); !got.Equal(want) || got.IsZero() {
+			t.Errorf("%v: ModTime() = %v, want %v", tc.id, got, want)
+		}
+		if got := f.Size(); got != tc.size {
+			t.Errorf("%v: Size() = %d, want %d", tc.id, got, tc.size)
+		}
+		if got := f.IsDir(); got != tc.isDir {
+			t.Errorf("%v: IsDir() = %v, want %v", tc.id, got, tc.isDir)
+		}
+	}
+
+	// Drive not saying when it was modified is the zero time.
+	if got := (&File{File: &gdrive.File{}}).ModTime(); !got.IsZero() {
+		t.Errorf("ModTime() of a file with no ModifiedDate = %v, want the zero time", got)
+	}
+}
+
+func TestWritable(t *testing.T) {
+	fd := newFakeDrive()
+	role := func(id, role string, mine bool) {
+		fd.add(&gdrive.File{
+			Id:             id,
+			Title:          id,
+			MimeType:       "text/plain",
+			UserPermission: &gdrive.Permission{Role: role},
+			Owners:         []*gdrive.User{{DisplayName: "someone", IsAuthenticatedUser: mine}},
+		})
+	}
+	role("reader", "reader", false)
+	role("commenter", "commenter", false)
+	role("writer", "writer", false)
+	role("owner", "owner", true)
+	fd.file("unknown", "unknown", "u") // no UserPermission
+	d := newTestDB(t, fd, nil)
+
+	for _, tc := range []struct {
+		id              string
+		writable, owned bool
+	}{
+		{"reader", false, false},
+		{"commenter", false, false},
+		{"writer", true, false},
+		{"owner", true, true},
+		{"unknown", true, false}, // left to Drive to refuse
+		{orphanFileId, true, false},
+	} {
+		inode, err := d.InodeForFileId(tc.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := d.FileByInode(inode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := f.Writable(); got != tc.writable {
+			t.Errorf("%v: Writable() = %v, want %v", tc.id, got, tc.writable)
+		}
+		if got := f.OwnedByMe(); got != tc.owned {
+			t.Errorf("%v: OwnedByMe() = %v, want %v", tc.id, got, tc.owned)
+		}
+	}
+}
+
+func TestWebViewURL(t *testing.T) {
+	fd := newFakeDrive()
+	fd.doc("doc", "doc", "d")
+	fd.add(&gdrive.File{Id: "linked", Title: "linked", MimeType: "application/vnd.google-apps.spreadsheet", AlternateLink: "https://docs.google.com/spreadsheets/d/linked/edit?usp=drivesdk"})
+	fd.add(&gdrive.File{Id: "bin", Title: "bin.jpg", MimeType: "image/jpeg", AlternateLink: "https://drive.google.com/file/d/bin/view?usp=drivesdk"})
+	fd.file("bare", "bare.txt", "b")
+	d := newTestDB(t, fd, nil)
+
+	for id, want := range map[string]string{
+		"doc":        "https://docs.google.com/document/d/doc/edit",
+		"linked":     "https://docs.google.com/spreadsheets/d/linked/edit?usp=drivesdk",
+		"bin":        "https://drive.google.com/file/d/bin/view?usp=drivesdk",
+		"bare":       "",
+		orphanFileId: "",
+	} {
+		inode, err := d.InodeForFileId(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := d.WebViewURL(inode); err != nil || got != want {
+			t.Errorf("WebViewURL(%v) = %q, %v, want %q", id, got, err, want)
+		}
+	}
+	if _, err := d.WebViewURL(1 << 40); err == nil {
+		t.Errorf("WebViewURL of a missing inode succeeded")
+	}
+}
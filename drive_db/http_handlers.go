@@ -1,10 +1,14 @@
 package drive_db
 
 import (
+	"crypto/subtle"
+	"encoding/base64"
 	"fmt"
+	"log"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/kr/pretty"
 	"github.com/syndtr/goleveldb/leveldb/util"
@@ -15,6 +19,7 @@ var driveDBLinks string = `<a href=fileids>FileIDs</a><br>
 <a href=inodes>Inodes</a><br>
 <a href=downloadurls>Download Urls</a><br>
 <a href=tree>Tree</a><br>
+<a href=stats>Stats</a><br>
 `
 
 func (d *DriveDB) fileIdsHandler(w http.ResponseWriter, req *http.Request) {
@@ -39,6 +44,10 @@ func (d *DriveDB) checkpointHandler(w http.ResponseWriter, req *http.Request) {
 	fmt.Fprintf(w, "Checkpoint: %+v\n", cpt)
 }
 
+func (d *DriveDB) statsHandler(w http.ResponseWriter, req *http.Request) {
+	fmt.Fprintf(w, "%# v\n", pretty.Formatter(d.Stats()))
+}
+
 func (d *DriveDB) inodesHandler(w http.ResponseWriter, req *http.Request) {
 	var cpt CheckPoint
 	err := d.get(internalKey("checkpoint"), &cpt)
@@ -115,29 +124,115 @@ func (d *DriveDB) flushInodeHandler(w http.ResponseWriter, req *http.Request) {
 
 // downloadUrlsHandler shows the cache of downloadUrls with their expiry time
 func (d *DriveDB) downloadUrlsHandler(w http.ResponseWriter, req *http.Request) {
-	// We can't Close() until all iterators are released.
-	// TODO: this can still be racy with Close(), fix that.
 	var url DownloadURL
-	d.iters.Add(1)
-	iter := d.db.NewIterator(util.BytesPrefix(downloadUrlKey("")), nil)
+	iter, err := d.newIterator(util.BytesPrefix(downloadUrlKey("")))
+	if err != nil {
+		fmt.Fprintf(w, "Failed to list download urls: %v", err)
+		return
+	}
 	for iter.Next() {
-		decode(iter.Value(), &url)
+		d.decode(iter.Value(), &url)
 		fmt.Fprintf(w, "%v: %+v\n", deKey(string(iter.Key())), url)
 	}
-	iter.Release()
-	d.iters.Done()
+	d.releaseIterator(iter)
+}
+
+// debugHandlesOnce guards serving the debug handlers on
+// --drivedb.debugaddr, which only one db can do.
+var debugHandlesOnce sync.Once
+
+// startDebugHandles registers the debug handlers on opts.DebugMux, or if
+// that's nil, serves them on --drivedb.debugaddr. They're never registered
+// on http.DefaultServeMux, where they'd be served with the oauth handlers.
+func (d *DriveDB) startDebugHandles() {
+	if d.opts.DebugMux != nil {
+		registerDebugHandles(d, d.opts.DebugMux)
+		return
+	}
+	// Only the first db opened gets them.
+	debugHandlesOnce.Do(func() {
+		mux := http.NewServeMux()
+		registerDebugHandles(d, mux)
+		log.Printf("serving drive_db debug handlers on http://%s/drivedb/", *debugAddr)
+		go func() {
+			log.Printf("drive_db debug handlers: %v", http.ListenAndServe(*debugAddr, mux))
+		}()
+	})
 }
 
-func registerDebugHandles(d DriveDB) {
-	http.HandleFunc("/drivedb/fileids", d.fileIdsHandler)
-	http.HandleFunc("/drivedb/checkpoint", d.checkpointHandler)
-	http.HandleFunc("/drivedb/inodes", d.inodesHandler)
-	http.HandleFunc("/drivedb/fileid/", d.fileIdHandler)
-	http.HandleFunc("/drivedb/fileinode/", d.fileInodeHandler)
-	http.HandleFunc("/drivedb/downloadurls/", d.downloadUrlsHandler)
-	http.HandleFunc("/drivedb/flushinode/", d.flushInodeHandler)
+func registerDebugHandles(d *DriveDB, mux *http.ServeMux) {
+	handle := func(path string, h http.HandlerFunc) {
+		mux.Handle(path, requireDebugAuth(h))
+	}
+	handle("/drivedb/fileids", d.fileIdsHandler)
+	handle("/drivedb/checkpoint", d.checkpointHandler)
+	handle("/drivedb/inodes", d.inodesHandler)
+	handle("/drivedb/stats", d.statsHandler)
+	handle("/drivedb/fileid/", d.fileIdHandler)
+	handle("/drivedb/fileinode/", d.fileInodeHandler)
+	handle("/drivedb/downloadurls/", d.downloadUrlsHandler)
+	handle("/drivedb/flushinode/", d.flushInodeHandler)
 	// TODO: Implement /tree printing of FS
-	http.HandleFunc("/drivedb/", func(w http.ResponseWriter, r *http.Request) {
+	handle("/drivedb/", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, driveDBLinks)
 	})
 }
+
+// checkDebugAuth returns an error if the debug handlers' credentials are
+// incomplete: a user without a password would let anyone in who knew, or
+// guessed, the user.
+func checkDebugAuth() error {
+	if *debugUser != "" && *debugPassword == "" {
+		return fmt.Errorf("--drivedb.debuguser needs a --drivedb.debugpassword")
+	}
+	return nil
+}
+
+// requireDebugAuth wraps h to require the credentials set by
+// --drivedb.debugtoken, as a bearer token, or --drivedb.debuguser and
+// --drivedb.debugpassword, with basic auth. Either will do, if both are set;
+// if neither is, h is returned as it is.
+func requireDebugAuth(h http.Handler) http.Handler {
+	if *debugToken == "" && *debugUser == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if debugAuthorized(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if *debugUser != "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="drive_db"`)
+		} else {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="drive_db"`)
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+}
+
+func debugAuthorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if *debugToken != "" && strings.HasPrefix(auth, "Bearer ") {
+		return secureEqual(auth[len("Bearer "):], *debugToken)
+	}
+	if *debugUser != "" && *debugPassword != "" && strings.HasPrefix(auth, "Basic ") {
+		creds, err := base64.StdEncoding.DecodeString(auth[len("Basic "):])
+		if err != nil {
+			return false
+		}
+		user, password := string(creds), ""
+		if i := strings.Index(user, ":"); i >= 0 {
+			user, password = user[:i], user[i+1:]
+		}
+		// Both compared, so the time taken doesn't tell which was wrong.
+		userOk := secureEqual(user, *debugUser)
+		passwordOk := secureEqual(password, *debugPassword)
+		return userOk && passwordOk
+	}
+	return false
+}
+
+// secureEqual compares a and b in time independent of where they differ.
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
@@ -0,0 +1,146 @@
+package drive_db
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	gdrive "code.google.com/p/google-api-go-client/drive/v2"
+)
+
+// setFlag sets the string flag p to v until the test ends.
+func setFlag(t *testing.T, p *string, v string) {
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+func TestDebugAuth(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	status := func(h http.Handler, setAuth func(r *http.Request)) int {
+		r := httptest.NewRequest("GET", "/drivedb/stats", nil)
+		if setAuth != nil {
+			setAuth(r)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	basic := func(user, password string) func(r *http.Request) {
+		return func(r *http.Request) { r.SetBasicAuth(user, password) }
+	}
+	bearer := func(token string) func(r *http.Request) {
+		return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+	}
+
+	if err := checkDebugAuth(); err != nil {
+		t.Errorf("checkDebugAuth without credentials: %v", err)
+	}
+	if got := status(requireDebugAuth(ok), nil); got != http.StatusOK {
+		t.Errorf("without credentials configured, status %d, want 200", got)
+	}
+
+	setFlag(t, debugUser, "admin")
+	setFlag(t, debugPassword, "secret")
+	h := requireDebugAuth(ok)
+	for _, c := range []struct {
+		auth func(r *http.Request)
+		want int
+	}{
+		{nil, http.StatusUnauthorized},
+		{basic("admin", "secret"), http.StatusOK},
+		{basic("admin", "wrong"), http.StatusUnauthorized},
+		{basic("other", "secret"), http.StatusUnauthorized},
+		{basic("admin", ""), http.StatusUnauthorized},
+		{bearer("secret"), http.StatusUnauthorized},
+	} {
+		if got := status(h, c.auth); got != c.want {
+			t.Errorf("basic auth: status %d, want %d", got, c.want)
+		}
+	}
+
+	setFlag(t, debugToken, "token")
+	h = requireDebugAuth(ok)
+	if got := status(h, bearer("token")); got != http.StatusOK {
+		t.Errorf("with the bearer token, status %d, want 200", got)
+	}
+	if got := status(h, bearer("wrong")); got != http.StatusUnauthorized {
+		t.Errorf("with the wrong bearer token, status %d, want 401", got)
+	}
+
+	// A user without a password is refused, rather than letting in anyone
+	// with no password.
+	setFlag(t, debugToken, "")
+	setFlag(t, debugPassword, "")
+	if err := checkDebugAuth(); err == nil {
+		t.Errorf("checkDebugAuth of a user without a password succeeded")
+	}
+	if got := status(requireDebugAuth(ok), basic("admin", "")); got != http.StatusUnauthorized {
+		t.Errorf("with an empty password configured, status %d, want 401", got)
+	}
+}
+
+func TestDebugHandlersSeeChanges(t *testing.T) {
+	fd := newFakeDrive()
+	fd.file("a", "a.txt", "a")
+	d := newTestDB(t, fd, nil)
+	mux := http.NewServeMux()
+	registerDebugHandles(d, mux)
+	get := func(path string) string {
+		t.Helper()
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s: status %d", path, w.Code)
+		}
+		return w.Body.String()
+	}
+	if body := get("/drivedb/fileid/a"); !strings.Contains(body, "a.txt") {
+		t.Fatalf("/drivedb/fileid/a shows\n%s\nwant a.txt", body)
+	}
+
+	// The handlers serve the live db, not what it was when they were
+	// registered.
+	fd.update("a", func(f *gdrive.File) { f.Title = "renamed.txt" })
+	fd.file("b", "b.txt", "b")
+	resync(t, d, fd)
+	if body := get("/drivedb/fileid/a"); !strings.Contains(body, "renamed.txt") {
+		t.Errorf("after a rename, /drivedb/fileid/a shows\n%s\nwant renamed.txt", body)
+	}
+	if body := get("/drivedb/fileids"); !strings.Contains(body, "\nb\n") {
+		t.Errorf("after adding b, /drivedb/fileids shows\n%s\nwant b", body)
+	}
+	if body := get("/drivedb/checkpoint"); !strings.Contains(body, fmt.Sprintf("LastChangeID:%d ", fd.lastId)) {
+		t.Errorf("/drivedb/checkpoint shows\n%s\nwant LastChangeID:%d", body, fd.lastId)
+	}
+}
+
+func TestDebugHandlersFlag(t *testing.T) {
+	registered := func(mux *http.ServeMux) bool {
+		_, pattern := mux.Handler(httptest.NewRequest("GET", "/drivedb/stats", nil))
+		return pattern != ""
+	}
+
+	// Off, as by default, they're registered nowhere.
+	mux := http.NewServeMux()
+	newTestDB(t, newFakeDrive(), &DriveDBOptions{DebugMux: mux})
+	if registered(mux) {
+		t.Errorf("the debug handlers are registered on DebugMux without --drivedb.debughandlers")
+	}
+	if registered(http.DefaultServeMux) {
+		t.Errorf("the debug handlers are registered on http.DefaultServeMux")
+	}
+
+	defer func(old bool) { *debugHandlers = old }(*debugHandlers)
+	*debugHandlers = true
+	mux = http.NewServeMux()
+	newTestDB(t, newFakeDrive(), &DriveDBOptions{DebugMux: mux})
+	if !registered(mux) {
+		t.Errorf("the debug handlers aren't registered on DebugMux with --drivedb.debughandlers")
+	}
+	if registered(http.DefaultServeMux) {
+		t.Errorf("the debug handlers are registered on http.DefaultServeMux")
+	}
+}
@@ -0,0 +1,224 @@
+package drive_db
+
+// Secondary indexes over the files in the db, kept in step with the files by
+// UpdateFile and RemoveFileById. Index entries are keys only, ending in the
+// fileId they refer to.
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	gdrive "code.google.com/p/google-api-go-client/drive/v2"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+func md5KeyPrefix(md5 string) []byte {
+	return []byte("md5:" + md5 + ":")
+}
+
+func md5Key(md5, fileId string) []byte {
+	return append(md5KeyPrefix(md5), fileId...)
+}
+
+// modTimeFormat is RFC 3339 in UTC, with a fixed number of fractional
+// digits, so that times sort as their keys do.
+const modTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+// modKey is the key of fileId in the index by modification time. An empty or
+// unparseable modifiedDate is taken as the zero time.
+func modKey(modifiedDate, fileId string) []byte {
+	t, _ := time.Parse(time.RFC3339Nano, modifiedDate)
+	return []byte("mod:" + t.UTC().Format(modTimeFormat) + ":" + fileId)
+}
+
+// Bounds on the title index, so a pathological title can't bloat the db.
+// Words past maxTitleWords aren't indexed, and longer words are indexed by
+// their first maxTitleWordBytes, which is as far as a search can match them.
+const (
+	maxTitleWords     = 32
+	maxTitleWordBytes = 64
+)
+
+func titleKey(word, fileId string) []byte {
+	return []byte("ttl:" + word + ":" + fileId)
+}
+
+// titleWords splits title into its distinct words, which are runs of letters
+// and digits, lower cased. ToLower isn't full Unicode case folding, but
+// handles accented letters, e.g. "É" to "é", so titles match as they do in
+// Drive's own search. Accents themselves are significant.
+func titleWords(title string) []string {
+	var words []string
+	seen := make(map[string]bool)
+	fields := strings.FieldsFunc(strings.ToLower(title), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	for _, w := range fields {
+		if len(words) == maxTitleWords {
+			break
+		}
+		if len(w) > maxTitleWordBytes {
+			// Cut at a rune boundary.
+			n := maxTitleWordBytes
+			for n > 0 && !utf8.RuneStart(w[n]) {
+				n--
+			}
+			w = w[:n]
+		}
+		if !seen[w] {
+			seen[w] = true
+			words = append(words, w)
+		}
+	}
+	return words
+}
+
+// indexKeys returns the index entries of f. Folders and Google docs have no
+// md5, so aren't in the md5 index, and only starred files are in the starred
+// index.
+func indexKeys(f *gdrive.File) [][]byte {
+	keys := [][]byte{modKey(f.ModifiedDate, f.Id)}
+	for _, w := range titleWords(f.Title) {
+		keys = append(keys, titleKey(w, f.Id))
+	}
+	if f.Md5Checksum != "" {
+		keys = append(keys, md5Key(f.Md5Checksum, f.Id))
+	}
+	if starred(f) {
+		keys = append(keys, starKey(f.Id))
+	}
+	return keys
+}
+
+// reindex adds to batch the changes to the indexes for a file changing from
+// of to f. of is nil for a new file, and f for a removed one.
+func reindex(batch *leveldb.Batch, of, f *gdrive.File) {
+	if of != nil {
+		for _, key := range indexKeys(of) {
+			batch.Delete(key)
+		}
+	}
+	if f != nil {
+		// Puts after the Deletes, so entries of f which were of's stay.
+		for _, key := range indexKeys(f) {
+			batch.Put(key, nil)
+		}
+	}
+}
+
+// indexedFileIds returns the fileIds of the index entries beginning with prefix.
+func (d *DriveDB) indexedFileIds(prefix []byte) ([]string, error) {
+	var ids []string
+	err := d.scan(string(prefix), func(key, value []byte) {
+		ids = append(ids, string(key[len(prefix):]))
+	})
+	return ids, err
+}
+
+// FileIdsByMd5 returns the fileIds of the files whose contents have the given
+// md5 checksum, as reported by Drive.
+func (d *DriveDB) FileIdsByMd5(md5 string) ([]string, error) {
+	return d.indexedFileIds(md5KeyPrefix(md5))
+}
+
+// RecentlyModified returns up to limit files, most recently modified first.
+func (d *DriveDB) RecentlyModified(limit int) ([]*gdrive.File, error) {
+	prefix := "mod:"
+	iter, err := d.newIterator(util.BytesPrefix([]byte(prefix)))
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for ok := iter.Last(); ok && len(ids) < limit; ok = iter.Prev() {
+		// mod:<time>:<fileId>; the time has colons of its own.
+		key := string(iter.Key())
+		ids = append(ids, key[len(prefix)+len(modTimeFormat)+1:])
+	}
+	d.releaseIterator(iter)
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	return d.filesByIds(ids)
+}
+
+// SearchTitles returns the files with a word in their title beginning with
+// each word of substr, ignoring case, e.g. "ann rep" finds "Annual Report".
+func (d *DriveDB) SearchTitles(substr string) ([]*gdrive.File, error) {
+	words := titleWords(substr)
+	if len(words) == 0 {
+		return nil, nil
+	}
+	var matches map[string]bool
+	for _, w := range words {
+		prefix := "ttl:" + w
+		found := make(map[string]bool)
+		err := d.scan(prefix, func(key, value []byte) {
+			// ttl:<word>:<fileId>; words have no colons.
+			ref := string(key[len("ttl:"):])
+			id := ref[strings.Index(ref, ":")+1:]
+			if matches == nil || matches[id] {
+				found[id] = true
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		matches = found
+		if len(matches) == 0 {
+			return nil, nil
+		}
+	}
+	ids := make([]string, 0, len(matches))
+	for id := range matches {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return d.filesByIds(ids)
+}
+
+// filesByIds returns the files of ids, in the same order.
+func (d *DriveDB) filesByIds(ids []string) ([]*gdrive.File, error) {
+	files := make([]*gdrive.File, 0, len(ids))
+	for _, id := range ids {
+		f, err := d.FileById(id)
+		if err != nil {
+			return nil, fmt.Errorf("unknown fileId %v: %v", id, err)
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// reindexAll writes the index entries of every file in the db, for dbs
+// written before an index existed.
+func (d *DriveDB) reindexAll() error {
+	iter, err := d.newIterator(util.BytesPrefix(fileKey("")))
+	if err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	for iter.Next() {
+		var f gdrive.File
+		if err := d.decode(iter.Value(), &f); err != nil {
+			continue // undecodable files aren't indexed
+		}
+		reindex(batch, nil, &f)
+		if batch.Len() >= 1000 {
+			if err := d.db.Write(batch, nil); err != nil {
+				d.releaseIterator(iter)
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	d.releaseIterator(iter)
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	return d.db.Write(batch, nil)
+}
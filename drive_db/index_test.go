@@ -0,0 +1,143 @@
+package drive_db
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	gdrive "code.google.com/p/google-api-go-client/drive/v2"
+)
+
+func TestFileIdsByMd5(t *testing.T) {
+	fd := newFakeDrive()
+	fd.file("a", "a.txt", "same")
+	fd.file("b", "b.txt", "same")
+	fd.file("c", "c.txt", "other")
+	fd.folder("dir", "dir")
+	d := newTestDB(t, fd, nil)
+
+	md5 := func(md5 string, want ...string) {
+		t.Helper()
+		ids, err := d.FileIdsByMd5(md5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(ids)
+		if len(ids) == 0 && len(want) == 0 {
+			return
+		}
+		if !reflect.DeepEqual(ids, want) {
+			t.Errorf("FileIdsByMd5(%q) = %v, want %v", md5, ids, want)
+		}
+	}
+	same, other := fd.get("a").Md5Checksum, fd.get("c").Md5Checksum
+	md5(same, "a", "b")
+	md5(other, "c")
+	md5("")
+
+	// Indexes are backfilled from the files.
+	if err := d.db.Delete(md5Key(same, "a"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.reindexAll(); err != nil {
+		t.Fatal(err)
+	}
+	md5(same, "a", "b")
+
+	// A change of content moves a file, and a removal drops it.
+	fd.setContent("a", []byte("other"))
+	fd.remove("b")
+	resync(t, d, fd)
+	md5(same)
+	md5(other, "a", "c")
+}
+
+func TestRecentlyModified(t *testing.T) {
+	d := newTestDB(t, newFakeDrive(), nil)
+	dated := func(id, date string) *gdrive.File {
+		f := testFile(id, id)
+		f.ModifiedDate = date
+		return f
+	}
+	// Out of order, and with differing precisions and zones.
+	apply(t, d,
+		dated("m2", "2014-03-02T10:00:00.5Z"),
+		dated("none", ""),
+		dated("m4", "2014-03-02T12:00:00+01:00"), // 11:00 UTC
+		dated("m1", "2014-03-01T23:59:59.999Z"),
+		dated("m3", "2014-03-02T10:00:00.75Z"),
+	)
+	// An update moves a file.
+	apply(t, d, dated("m1", "2014-03-03T00:00:00Z"))
+
+	recent := func(limit int) []string {
+		t.Helper()
+		files, err := d.RecentlyModified(limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, f := range files {
+			ids = append(ids, f.Id)
+		}
+		return ids
+	}
+	if ids, want := recent(3), []string{"m1", "m4", "m3"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("RecentlyModified(3) = %v, want %v", ids, want)
+	}
+	// Files without a date are the oldest, as if modified at the zero time.
+	ids := recent(100)
+	if ids[len(ids)-1] != "none" {
+		t.Errorf("RecentlyModified(100) = %v, want none last", ids)
+	}
+	if want := []string{"m1", "m4", "m3", "m2"}; !reflect.DeepEqual(ids[:4], want) {
+		t.Errorf("RecentlyModified(100) = %v, want it to begin %v", ids, want)
+	}
+}
+
+func TestSearchTitles(t *testing.T) {
+	d := newTestDB(t, newFakeDrive(), nil)
+	apply(t, d,
+		testFile("report", "Annual Report 2014.pdf"),
+		testFile("minutes", "Annual general meeting: minutes.doc"),
+		testFile("cafe", "Café receipts"),
+		testFile("CAFE", "CAFÉ MENU"),
+		testFile("plain", "cafe menu"),
+		testFile("greek", "ΣΟΦΙΑ notes"),
+	)
+
+	search := func(substr string, want ...string) {
+		t.Helper()
+		files, err := d.SearchTitles(substr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, f := range files {
+			ids = append(ids, f.Id)
+		}
+		sort.Strings(want)
+		if !reflect.DeepEqual(ids, want) {
+			t.Errorf("SearchTitles(%q) = %v, want %v", substr, ids, want)
+		}
+	}
+	// Every word must begin a word of the title, in any order and case.
+	search("annual", "minutes", "report")
+	search("ann rep", "report")
+	search("REPORT annual", "report")
+	search("annual report minutes")
+	search("port")
+	search("2014 pdf", "report")
+	// Accented letters are lower cased, but are distinct from unaccented.
+	search("café", "CAFE", "cafe")
+	search("CAFÉ menu", "CAFE")
+	search("cafe", "plain")
+	search("σοφ", "greek")
+	search("")
+	search(" :: ")
+
+	// A rename reindexes a file.
+	apply(t, d, testFile("report", "Annual Summary.pdf"))
+	search("report")
+	search("annual summary", "report")
+}
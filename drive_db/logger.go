@@ -0,0 +1,38 @@
+package drive_db
+
+// Where the messages of the sync go. Embedders can route them into their own
+// logging with DriveDBOptions.Logger.
+
+import (
+	"log"
+)
+
+// Logger receives a DriveDB's log messages, by level. Its methods take
+// fmt.Printf style arguments, and may be called from several goroutines at
+// once.
+type Logger interface {
+	Debugf(format string, args ...interface{}) // detail, only of interest when debugging
+	Infof(format string, args ...interface{})  // progress, e.g. of a sync
+	Warnf(format string, args ...interface{})  // failures which are recovered from, e.g. by retrying
+	Errorf(format string, args ...interface{}) // failures which stop the db syncing
+}
+
+// stdLogger is the default Logger, which writes to the standard logger,
+// only writing Debugf messages with --drivedb.debug.
+type stdLogger struct{}
+
+func (stdLogger) Debugf(format string, args ...interface{}) {
+	debug.Printf(format, args...)
+}
+
+func (stdLogger) Infof(format string, args ...interface{}) {
+	log.Printf(format, args...)
+}
+
+func (stdLogger) Warnf(format string, args ...interface{}) {
+	log.Printf(format, args...)
+}
+
+func (stdLogger) Errorf(format string, args ...interface{}) {
+	log.Printf(format, args...)
+}
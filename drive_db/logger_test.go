@@ -0,0 +1,67 @@
+package drive_db
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordLogger records the messages logged at each level.
+type recordLogger struct {
+	mu   sync.Mutex
+	logs map[string][]string
+}
+
+func (l *recordLogger) log(level, format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.logs[level] = append(l.logs[level], fmt.Sprintf(format, args...))
+}
+
+func (l *recordLogger) Debugf(format string, args ...interface{}) { l.log("debug", format, args...) }
+func (l *recordLogger) Infof(format string, args ...interface{})  { l.log("info", format, args...) }
+func (l *recordLogger) Warnf(format string, args ...interface{})  { l.log("warn", format, args...) }
+func (l *recordLogger) Errorf(format string, args ...interface{}) { l.log("error", format, args...) }
+
+// logged reports whether a message containing s was logged at level.
+func (l *recordLogger) logged(level, s string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, msg := range l.logs[level] {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLogger(t *testing.T) {
+	fd := newFakeDrive()
+	fd.file("f", "f.txt", "f")
+	l := &recordLogger{logs: make(map[string][]string)}
+	d := newTestDB(t, fd, &DriveDBOptions{Logger: l, SyncRetries: 1})
+	d.Pause()
+	waitPolled(t, d)
+
+	// A failure retried is a warning; one which stops the sync, an error.
+	fd.failNext("changes.list", http.StatusServiceUnavailable)
+	d.readChanges()
+	fd.failNext("changes.list", http.StatusUnauthorized)
+	d.readChanges()
+
+	for _, tc := range []struct{ level, msg string }{
+		{"debug", "Querying Google Drive for changes"},
+		{"info", "processing"},
+		{"warn", "changes.list failed"},
+		{"error", "401"},
+	} {
+		if !l.logged(tc.level, tc.msg) {
+			t.Errorf("no %s message of %q", tc.level, tc.msg)
+		}
+	}
+	if l.logged("error", "503") {
+		t.Errorf("a failure which was retried was logged as an error")
+	}
+}
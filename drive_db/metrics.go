@@ -0,0 +1,142 @@
+package drive_db
+
+// Metrics of a DriveDB, for graphing its health over time, published as
+// expvar variables and in the Prometheus text format. Both are opt-in, as
+// expvar names must be unique to the process.
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// apiCalls counts API calls by method and resource, e.g. "GET files".
+type apiCalls struct {
+	mu     sync.Mutex
+	counts map[string]int64 // guarded by mu
+}
+
+func (c *apiCalls) add(req *http.Request) {
+	// Paths are /drive/v2/<resource>/..., or /upload/drive/v2/<resource>/...
+	resource := "unknown"
+	parts := strings.Split(req.URL.Path, "/")
+	for i, p := range parts {
+		if p == "v2" && i+1 < len(parts) {
+			resource = parts[i+1]
+			break
+		}
+	}
+	c.mu.Lock()
+	if c.counts == nil {
+		c.counts = make(map[string]int64)
+	}
+	c.counts[req.Method+" "+resource]++
+	c.mu.Unlock()
+}
+
+func (c *apiCalls) snapshot() map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m := make(map[string]int64, len(c.counts))
+	for k, v := range c.counts {
+		m[k] = v
+	}
+	return m
+}
+
+// countingTransport counts the requests it makes in calls.
+type countingTransport struct {
+	rt    http.RoundTripper
+	calls *apiCalls
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.calls.add(req)
+	return t.rt.RoundTrip(req)
+}
+
+// Metrics is a snapshot of the counters of a DriveDB.
+type Metrics struct {
+	ChangesProcessed int64            // changes committed since startup
+	APICalls         map[string]int64 // API calls made since startup, by method and resource
+	CacheHitRate     float64          // of the inode cache, from 0 to 1
+	SyncLagSeconds   float64          // since we last caught up with Drive; -1 if never
+	URLRefreshes     int64            // download urls fetched since startup
+}
+
+// Metrics returns the current values of the db's counters.
+func (d *DriveDB) Metrics() Metrics {
+	var m Metrics
+	hits, misses, _ := d.lruCache.Stats()
+	if hits+misses > 0 {
+		m.CacheHitRate = float64(hits) / float64(hits+misses)
+	}
+	d.Lock()
+	m.ChangesProcessed = d.processed
+	lastSync := d.lastSync
+	d.Unlock()
+	m.SyncLagSeconds = -1
+	if !lastSync.IsZero() {
+		m.SyncLagSeconds = time.Since(lastSync).Seconds()
+	}
+	m.APICalls = d.apiCalls.snapshot()
+	m.URLRefreshes = atomic.LoadInt64(&d.urlRefreshes)
+	return m
+}
+
+// PublishMetrics publishes the db's Metrics as the expvar variable name,
+// which must not already be in use.
+func (d *DriveDB) PublishMetrics(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} { return d.Metrics() }))
+}
+
+// WriteMetrics writes the db's Metrics in the Prometheus text format, with an
+// account label if the db is one of several accounts'. The # TYPE lines are
+// left to the caller, so the metrics of several dbs can be written together;
+// see MetricTypes.
+func (d *DriveDB) WriteMetrics(w io.Writer) {
+	m := d.Metrics()
+	labels := func(extra string) string {
+		var l []string
+		if d.opts.Account != "" {
+			l = append(l, fmt.Sprintf("account=%q", d.opts.Account))
+		}
+		if extra != "" {
+			l = append(l, extra)
+		}
+		if len(l) == 0 {
+			return ""
+		}
+		return "{" + strings.Join(l, ",") + "}"
+	}
+	fmt.Fprintf(w, "drivedb_changes_processed_total%s %d\n", labels(""), m.ChangesProcessed)
+	calls := make([]string, 0, len(m.APICalls))
+	for c := range m.APICalls {
+		calls = append(calls, c)
+	}
+	sort.Strings(calls)
+	for _, c := range calls {
+		method, resource := c, ""
+		if i := strings.Index(c, " "); i >= 0 {
+			method, resource = c[:i], c[i+1:]
+		}
+		fmt.Fprintf(w, "drivedb_api_calls_total%s %d\n", labels(fmt.Sprintf("method=%q,resource=%q", method, resource)), m.APICalls[c])
+	}
+	fmt.Fprintf(w, "drivedb_inode_cache_hit_ratio%s %g\n", labels(""), m.CacheHitRate)
+	fmt.Fprintf(w, "drivedb_sync_lag_seconds%s %g\n", labels(""), m.SyncLagSeconds)
+	fmt.Fprintf(w, "drivedb_download_url_refreshes_total%s %d\n", labels(""), m.URLRefreshes)
+}
+
+// MetricTypes is the # TYPE lines of the metrics written by WriteMetrics.
+const MetricTypes = `# TYPE drivedb_changes_processed_total counter
+# TYPE drivedb_api_calls_total counter
+# TYPE drivedb_inode_cache_hit_ratio gauge
+# TYPE drivedb_sync_lag_seconds gauge
+# TYPE drivedb_download_url_refreshes_total counter
+`
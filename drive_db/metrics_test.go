@@ -0,0 +1,67 @@
+package drive_db
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+var publishedMetrics int64
+
+func TestPublishMetrics(t *testing.T) {
+	fd := newFakeDrive()
+	fd.file("a", "a.txt", "a")
+	d := newTestDB(t, fd, &DriveDBOptions{Account: "a"})
+	// expvar variables can't be unpublished, so each run needs a new name.
+	name := fmt.Sprintf("drivedb_test%d", atomic.AddInt64(&publishedMetrics, 1))
+	d.PublishMetrics(name)
+
+	if _, err := d.FreshDownloadUrl("a"); err != nil {
+		t.Fatal(err)
+	}
+	inode, err := d.InodeForFileId("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.FileByInode(inode)
+	d.FileByInode(inode)
+
+	// Scraped as a monitoring system would.
+	w := httptest.NewRecorder()
+	expvar.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/debug/vars", nil))
+	var vars map[string]json.RawMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &vars); err != nil {
+		t.Fatalf("decoding /debug/vars: %v", err)
+	}
+	var m Metrics
+	if err := json.Unmarshal(vars[name], &m); err != nil {
+		t.Fatalf("decoding %s %s: %v", name, vars[name], err)
+	}
+	if m.ChangesProcessed < 1 {
+		t.Errorf("ChangesProcessed = %d, want the initial sync's", m.ChangesProcessed)
+	}
+	if m.APICalls["GET about"] < 1 || m.APICalls["GET changes"] < 1 || m.APICalls["GET files"] < 1 {
+		t.Errorf("APICalls = %v, want about, changes and files calls", m.APICalls)
+	}
+	if m.URLRefreshes != 1 {
+		t.Errorf("URLRefreshes = %d, want 1", m.URLRefreshes)
+	}
+	if m.CacheHitRate <= 0 || m.CacheHitRate > 1 {
+		t.Errorf("CacheHitRate = %v, want a hit", m.CacheHitRate)
+	}
+	if m.SyncLagSeconds < 0 {
+		t.Errorf("SyncLagSeconds = %v, though the db has synced", m.SyncLagSeconds)
+	}
+
+	var buf bytes.Buffer
+	d.WriteMetrics(&buf)
+	want := `drivedb_download_url_refreshes_total{account="` + d.opts.Account + `"} 1`
+	if !strings.Contains(buf.String(), want) {
+		t.Errorf("WriteMetrics wrote\n%s\nwant a line %s", buf.String(), want)
+	}
+}
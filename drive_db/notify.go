@@ -0,0 +1,213 @@
+package drive_db
+
+// Subscribers are told about each change the sync goroutine applies, so they
+// can invalidate anything they've cached about the inodes involved.
+
+import (
+	"context"
+	"sync/atomic"
+
+	gdrive "code.google.com/p/google-api-go-client/drive/v2"
+)
+
+// subscriberBuffer is the number of events a subscriber may fall behind by
+// before further events are dropped.
+const subscriberBuffer = 1000
+
+// ChangeKind describes what happened to the file in an InodeChange.
+type ChangeKind int
+
+const (
+	Created ChangeKind = iota
+	Updated
+	Deleted
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case Created:
+		return "Created"
+	case Updated:
+		return "Updated"
+	case Deleted:
+		return "Deleted"
+	}
+	return "Unknown"
+}
+
+// InodeChange describes a change to a file, after it has been committed to the db.
+type InodeChange struct {
+	Inode  uint64
+	FileId string
+	Kind   ChangeKind
+
+	// ContentChanged is set on an Updated file whose content may have
+	// changed, rather than only its metadata, e.g. by a rename, a move or
+	// starring it, so data cached of it must be dropped.
+	ContentChanged bool
+}
+
+// Subscribe returns a channel on which all subsequent changes to the db are
+// published, until it's passed to Unsubscribe or the db is closed, which
+// close it. A subscriber which falls behind misses events rather than
+// blocking the sync; see DroppedChanges.
+func (d *DriveDB) Subscribe() <-chan InodeChange {
+	c := make(chan InodeChange, subscriberBuffer)
+	d.Lock()
+	defer d.Unlock()
+	if d.closed {
+		close(c)
+		return c
+	}
+	d.subscribers = append(d.subscribers, c)
+	return c
+}
+
+// Unsubscribe stops publishing changes on c, a channel from Subscribe, and
+// closes it.
+func (d *DriveDB) Unsubscribe(c <-chan InodeChange) {
+	d.Lock()
+	defer d.Unlock()
+	for i, s := range d.subscribers {
+		if s == c {
+			d.subscribers = append(d.subscribers[:i], d.subscribers[i+1:]...)
+			close(s)
+			return
+		}
+	}
+}
+
+// closeSubscribers closes the subscribers' channels, as the db is closed.
+// The caller must hold the lock.
+func (d *DriveDB) closeSubscribers() {
+	for _, s := range d.subscribers {
+		close(s)
+	}
+	d.subscribers = nil
+}
+
+// DroppedChanges returns the number of events that could not be delivered
+// to subscribers because their channel was full.
+func (d *DriveDB) DroppedChanges() int64 {
+	return atomic.LoadInt64(&d.dropped)
+}
+
+// WaitForChange blocks until the next change to inode is committed to the
+// db, e.g. Drive finishing processing an upload. Changes to the children of a
+// folder count as changes to the folder. It returns ctx.Err() if ctx is done
+// first, or ErrClosed if the db is closed.
+func (d *DriveDB) WaitForChange(ctx context.Context, inode uint64) error {
+	c := make(chan struct{})
+	d.Lock()
+	if d.waiters == nil {
+		d.waiters = make(map[uint64][]chan struct{})
+	}
+	d.waiters[inode] = append(d.waiters[inode], c)
+	d.Unlock()
+
+	select {
+	case <-c:
+		return nil
+	case <-ctx.Done():
+		d.stopWaiting(inode, c)
+		return ctx.Err()
+	case <-d.ctx.Done():
+		d.stopWaiting(inode, c)
+		return ErrClosed
+	}
+}
+
+// stopWaiting removes c from the waiters for inode, unless it has already
+// been woken.
+func (d *DriveDB) stopWaiting(inode uint64, c chan struct{}) {
+	d.Lock()
+	defer d.Unlock()
+	waiters := d.waiters[inode]
+	for i, w := range waiters {
+		if w == c {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(d.waiters, inode)
+	} else {
+		d.waiters[inode] = waiters
+	}
+}
+
+// publish sends changes to all subscribers, without blocking, and wakes
+// those waiting for changes to their inodes. It holds the lock throughout, so
+// that no subscriber's channel is closed meanwhile.
+func (d *DriveDB) publish(changes []InodeChange) {
+	d.Lock()
+	defer d.Unlock()
+	for _, c := range changes {
+		for _, w := range d.waiters[c.Inode] {
+			close(w)
+		}
+		delete(d.waiters, c.Inode)
+	}
+	for _, s := range d.subscribers {
+		for _, c := range changes {
+			select {
+			case s <- c:
+			default:
+				atomic.AddInt64(&d.dropped, 1)
+			}
+		}
+	}
+}
+
+// inodeChanges describes the effect of applying change c to the file at inode,
+// which was previously of (or nil, if it was unknown): the file itself, plus
+// each of its old and new parents, whose children have changed. Parents not in
+// the db aren't given inodes; the orphans folder, where the file is listed
+// instead, changes in their place.
+func (d *DriveDB) inodeChanges(inode uint64, c *gdrive.Change, of *gdrive.File, deleted bool) []InodeChange {
+	change := InodeChange{Inode: inode, FileId: c.FileId, Kind: Updated}
+	parents := make(map[string]bool)
+	if of == nil {
+		change.Kind = Created
+	} else {
+		for _, pr := range of.Parents {
+			parents[pr.Id] = true
+		}
+	}
+	if deleted {
+		change.Kind = Deleted
+	} else {
+		for _, pr := range c.File.Parents {
+			parents[pr.Id] = true
+		}
+		change.ContentChanged = of != nil && contentChanged(of, c.File)
+	}
+	// The starred folder lists starred files, so changes as they do.
+	if d.opts.ShowStarred && (starred(of) || !deleted && starred(c.File)) {
+		parents[starredFileId] = true
+	}
+	changes := []InodeChange{change}
+	for pId := range parents {
+		if _, special := d.specialInode(pId); !special && !d.hasFile(pId) {
+			parents[orphanFileId] = true
+		}
+	}
+	for pId := range parents {
+		if _, special := d.specialInode(pId); !special && !d.hasFile(pId) {
+			continue
+		}
+		pInode, err := d.InodeForFileId(pId)
+		if err != nil {
+			continue
+		}
+		changes = append(changes, InodeChange{Inode: pInode, FileId: pId, Kind: Updated})
+	}
+	return changes
+}
+
+// contentChanged reports whether f may have different content to of, the
+// same file as it was before. Files without an md5, e.g. native Docs, are
+// taken to have changed, as there's no telling.
+func contentChanged(of, f *gdrive.File) bool {
+	return f.Md5Checksum == "" || of.Md5Checksum != f.Md5Checksum
+}
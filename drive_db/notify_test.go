@@ -0,0 +1,171 @@
+package drive_db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	gdrive "code.google.com/p/google-api-go-client/drive/v2"
+)
+
+func TestWaitForChange(t *testing.T) {
+	fd := newFakeDrive()
+	fd.folder("d1", "d1")
+	fd.folder("d2", "d2")
+	fd.file("a", "a.txt", "a", "d1")
+	fd.file("b", "b.txt", "b", "d2")
+	d := newTestDB(t, fd, nil)
+	inode := func(id string) uint64 {
+		t.Helper()
+		inode, err := d.InodeForFileId(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return inode
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wait := func(id string) chan error {
+		done := make(chan error, 1)
+		go func(inode uint64) { done <- d.WaitForChange(ctx, inode) }(inode(id))
+		return done
+	}
+	a, b, d1, d2 := wait("a"), wait("b"), wait("d1"), wait("d2")
+	// Let them start waiting.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		d.Lock()
+		n := len(d.waiters)
+		d.Unlock()
+		if n == 4 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of 4 waiters waiting after 10s", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// A change to a wakes it and its folder, and no others.
+	fd.setContent("a", []byte("changed"))
+	resync(t, d, fd)
+	for what, c := range map[string]chan error{"a": a, "its folder": d1} {
+		select {
+		case err := <-c:
+			if err != nil {
+				t.Errorf("waiting for %s: %v", what, err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("a change to a didn't wake the waiter for %s", what)
+		}
+	}
+	select {
+	case err := <-b:
+		t.Errorf("a change to a woke the waiter for b: %v", err)
+	case err := <-d2:
+		t.Errorf("a change to a woke the waiter for another folder: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The others wait on until their context is done.
+	cancel()
+	for _, c := range []chan error{b, d2} {
+		if err := <-c; err != context.Canceled {
+			t.Errorf("waiting with a canceled context = %v, want %v", err, context.Canceled)
+		}
+	}
+	d.Lock()
+	n := len(d.waiters)
+	d.Unlock()
+	if n != 0 {
+		t.Errorf("%d inodes still have waiters after they've all returned", n)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	d := newTestDB(t, newFakeDrive(), nil)
+	changes, other := d.Subscribe(), d.Subscribe()
+
+	// A file whose parent isn't in the db changes the orphans folder,
+	// without the parent being given an inode.
+	apply(t, d, testFile("lost", "lost.txt", "nowhere"))
+	inode, err := d.InodeForFileId("lost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[uint64]ChangeKind)
+	for len(changes) > 0 {
+		c := <-changes
+		got[c.Inode] = c.Kind
+	}
+	if kind, ok := got[inode]; !ok || kind != Created {
+		t.Errorf("changes %v, want lost, %d, Created", got, inode)
+	}
+	if kind, ok := got[orphanInode]; !ok || kind != Updated {
+		t.Errorf("changes %v, want the orphans folder, %d, Updated", got, orphanInode)
+	}
+	if len(got) != 2 {
+		t.Errorf("changes %v, want only lost and the orphans folder", got)
+	}
+	var parent uint64
+	if err := d.get(fileIdToInodeKey("nowhere"), &parent); err == nil {
+		t.Errorf("a parent not in the db was given inode %d", parent)
+	}
+
+	// Unsubscribing, and closing the db, close the channels.
+	d.Unsubscribe(changes)
+	apply(t, d, testFile("more", "more.txt"))
+	for range changes {
+		t.Errorf("a change was published after unsubscribing")
+	}
+	d.Close()
+	for range other {
+	}
+	if _, ok := <-d.Subscribe(); ok {
+		t.Errorf("subscribing to a closed db published a change")
+	}
+}
+
+func TestContentChanged(t *testing.T) {
+	d := newTestDB(t, newFakeDrive(), nil)
+	file := func(title, md5 string, parents ...string) *gdrive.File {
+		f := testFile("f", title, parents...)
+		f.Md5Checksum = md5
+		return f
+	}
+	apply(t, d, testFolder("dir", "dir"), file("f.txt", "m1"))
+	inode, err := d.InodeForFileId("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := d.Subscribe()
+
+	starred := file("f.txt", "m1")
+	starred.Labels.Starred = true
+	for _, tc := range []struct {
+		what string
+		f    *gdrive.File
+		want bool
+	}{
+		{"renaming", file("g.txt", "m1"), false},
+		{"starring", starred, false},
+		{"moving", file("g.txt", "m1", "dir"), false},
+		{"changing the md5", file("g.txt", "m2", "dir"), true},
+		{"losing the md5", file("g.txt", "", "dir"), true},
+	} {
+		apply(t, d, tc.f)
+		found := false
+		for len(changes) > 0 {
+			if c := <-changes; c.Inode == inode {
+				found = true
+				if c.Kind != Updated || c.ContentChanged != tc.want {
+					t.Errorf("after %s, change %+v, want Updated with ContentChanged %v", tc.what, c, tc.want)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("%s published no change to the file", tc.what)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package drive_db
+
+// Files none of whose parents are in the db, e.g. those in the appDataFolder
+// or shared with the user from a folder they can't see, would be unreachable
+// from the root. They are given an extra parent ref to the synthetic
+// ".Orphaned" folder instead.
+
+import (
+	"time"
+
+	gdrive "code.google.com/p/google-api-go-client/drive/v2"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+const (
+	// orphanFileId is the fileId of the synthetic orphans folder. Like
+	// trashFileId, it contains a colon so can't collide with a real one.
+	orphanFileId = "drive_db:orphaned"
+	orphanInode  = 3
+	orphanTitle  = ".Orphaned"
+)
+
+// createOrphans synthesizes the orphans folder in the root.
+func (d *DriveDB) createOrphans() error {
+	launch, _ := time.Unix(1335225600, 0).MarshalText()
+	file := &gdrive.File{
+		Id:                 orphanFileId,
+		Title:              orphanTitle,
+		MimeType:           driveFolderMimeType,
+		LastViewedByMeDate: string(launch),
+		ModifiedDate:       string(launch),
+		CreatedDate:        string(launch),
+		Parents:            []*gdrive.ParentReference{&gdrive.ParentReference{Id: d.rootId}},
+	}
+	_, err := d.UpdateFile(nil, file)
+	return err
+}
+
+// hasParentIn reports whether any of f's parents is a file for which has
+// returns true.
+func hasParentIn(f *gdrive.File, has func(fileId string) bool) bool {
+	for _, pr := range f.Parents {
+		if has(pr.Id) {
+			return true
+		}
+	}
+	return false
+}
+
+// adoptOrphan adds to batch a parent ref from the orphans folder to f, if
+// none of f's parents is a file for which has returns true, and otherwise
+// removes any such ref, reporting whether it added one. A parent may yet
+// arrive later, so ChildFileIds ignores refs to files which turn out to have
+// a parent after all.
+func (d *DriveDB) adoptOrphan(batch *leveldb.Batch, f *gdrive.File, has func(fileId string) bool) bool {
+	key := childKey(orphanFileId + ":" + f.Id)
+	if _, special := d.specialInode(f.Id); special || hasParentIn(f, has) {
+		batch.Delete(key)
+		return false
+	}
+	batch.Put(key, nil)
+	return true
+}
+
+// adoptBatchOrphans adds to batch the parent refs from the orphans folder of
+// the files it leaves without a parent, and drops those of the files it
+// finds one, for a batch which updates the files updated, adds those added,
+// and removes those removed. UpdateFile and RemoveFileById can only go by the
+// files already in the db, which a parent removed or added earlier in the
+// same batch still is, or isn't yet. The cached paths of files moving into or
+// out of the orphans folder are invalidated.
+func (d *DriveDB) adoptBatchOrphans(batch *leveldb.Batch, updated map[string]*gdrive.File, added, removed map[string]bool) error {
+	has := func(fileId string) bool {
+		return !removed[fileId] && (added[fileId] || d.hasFile(fileId))
+	}
+	adopt := func(f *gdrive.File) {
+		was, _ := d.db.Has(childKey(orphanFileId+":"+f.Id), nil)
+		if d.adoptOrphan(batch, f, has) != was && d.opts.CachePaths {
+			d.invalidateTree(batch, f.Id)
+		}
+	}
+	for _, f := range updated {
+		adopt(f)
+	}
+	for fileId := range removed {
+		batch.Delete(childKey(orphanFileId + ":" + fileId))
+		// Its children, as they were before the batch.
+		prefix := childKeyPrefix(fileId)
+		var kids []string
+		err := d.scan(string(prefix), func(key, value []byte) {
+			kids = append(kids, string(key[len(prefix):]))
+		})
+		if err != nil {
+			return err
+		}
+		for _, id := range kids {
+			if f, err := d.FileById(id); err == nil && !removed[id] && updated[id] == nil {
+				adopt(f)
+			}
+		}
+	}
+	return nil
+}
+
+// adopted reports whether fileId, a child of the orphans folder, has since
+// been found a parent.
+func (d *DriveDB) adopted(fileId string) bool {
+	f, err := d.FileById(fileId)
+	return err == nil && hasParentIn(f, d.hasFile)
+}
+
+// adoptAllOrphans adds the parent refs from the orphans folder for dbs
+// written before it existed.
+func (d *DriveDB) adoptAllOrphans() error {
+	batch := new(leveldb.Batch)
+	err := d.scan("fid:", func(key, value []byte) {
+		var f gdrive.File
+		if err := d.decode(value, &f); err == nil {
+			d.adoptOrphan(batch, &f, d.hasFile)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return d.db.Write(batch, nil)
+}
@@ -0,0 +1,125 @@
+package drive_db
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	gdrive "code.google.com/p/google-api-go-client/drive/v2"
+)
+
+// orphans returns the fileIds in the orphans folder, sorted.
+func orphans(t *testing.T, d *DriveDB) string {
+	t.Helper()
+	ids, err := d.ChildFileIds(orphanFileId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, " ")
+}
+
+// removal returns a change removing fileId.
+func removal(id int64, fileId string) *gdrive.Change {
+	return &gdrive.Change{Id: id, FileId: fileId, Deleted: true}
+}
+
+func TestOrphans(t *testing.T) {
+	fd := newFakeDrive()
+	fd.file("lost", "lost.txt", "x", "appdata")
+	fd.folder("dir", "dir")
+	fd.file("kid", "kid.txt", "x", "dir")
+	fd.file("both", "both.txt", "x", "dir", "root")
+	d := newTestDB(t, fd, nil)
+
+	// A file whose only parent isn't in the db is reachable as an orphan.
+	if got := orphans(t, d); got != "lost" {
+		t.Fatalf("orphans = %q, want lost", got)
+	}
+	inode, err := d.InodeForFileId("lost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, err := d.PathForInode(inode); err != nil || p != "/"+orphanTitle+"/lost.txt" {
+		t.Errorf("PathForInode(lost) = %q, %v, want /%s/lost.txt", p, err, orphanTitle)
+	}
+
+	// So is one with no parents at all.
+	fd.mu.Lock()
+	fd.files["none"] = &gdrive.File{Id: "none", Title: "none.txt", MimeType: "text/plain", Labels: &gdrive.FileLabels{}}
+	fd.changed("none")
+	fd.mu.Unlock()
+	resync(t, d, fd)
+	if got := orphans(t, d); got != "lost none" {
+		t.Errorf("after adding a file with no parents, orphans = %q, want lost none", got)
+	}
+	if f, err := d.FileByPath(orphanTitle + "/none.txt"); err != nil || f.Id != "none" {
+		t.Errorf("FileByPath(%s/none.txt) = %v, %v, want none", orphanTitle, f, err)
+	}
+	fd.remove("none")
+	resync(t, d, fd)
+
+	// Removing a folder orphans those of its children with no other parent,
+	// though nothing changed about them.
+	fd.remove("dir")
+	resync(t, d, fd)
+	if got := orphans(t, d); got != "kid lost" {
+		t.Errorf("after removing their parent, orphans = %q, want kid lost", got)
+	}
+
+	// A parent arriving adopts them again.
+	fd.folder("appdata", "appdata")
+	resync(t, d, fd)
+	if got := orphans(t, d); got != "kid" {
+		t.Errorf("after adding a parent, orphans = %q, want kid", got)
+	}
+}
+
+func TestOrphansInOneBatch(t *testing.T) {
+	d := newTestDB(t, newFakeDrive(), nil)
+	apply(t, d,
+		testFolder("p1", "p1"),
+		testFolder("p2", "p2"),
+		testFile("both", "both.txt", "p1", "p2"),
+	)
+
+	// Removing both parents of a file at once orphans it, though each
+	// removal alone wouldn't have.
+	id := d.lastChangeId()
+	if err := d.processChange(&gdrive.ChangeList{
+		Items:           []*gdrive.Change{removal(id+1, "p1"), removal(id+2, "p2")},
+		LargestChangeId: id + 2,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got := orphans(t, d); got != "both" {
+		t.Errorf("after removing both parents, orphans = %q, want both", got)
+	}
+
+	// A file whose parent is removed after it's added, in the same batch, is
+	// orphaned, as is one added after its parent's removal.
+	apply(t, d, testFolder("p3", "p3"))
+	id = d.lastChangeId()
+	if err := d.processChange(&gdrive.ChangeList{
+		Items: []*gdrive.Change{
+			{Id: id + 1, FileId: "before", File: testFile("before", "before.txt", "p3")},
+			removal(id+2, "p3"),
+			{Id: id + 3, FileId: "after", File: testFile("after", "after.txt", "p3")},
+		},
+		LargestChangeId: id + 3,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got := orphans(t, d); got != "after before both" {
+		t.Errorf("after removing a parent in the batch adding its children, orphans = %q, want after before both", got)
+	}
+
+	// A file added before its parent, in the same batch, isn't orphaned.
+	apply(t, d, testFile("early", "early.txt", "late"), testFolder("late", "late"))
+	if got := orphans(t, d); got != "after before both" {
+		t.Errorf("after adding a file before its parent, orphans = %q, want after before both", got)
+	}
+	if _, err := d.db.Get(childKey(orphanFileId+":early"), nil); err == nil {
+		t.Errorf("a file added before its parent has an orphan ref")
+	}
+}
@@ -0,0 +1,52 @@
+package drive_db
+
+// The db records whose Drive it mirrors, so that pointing it at another
+// account's Drive doesn't mix the two.
+
+import (
+	"errors"
+	"fmt"
+)
+
+// owner identifies the Drive account a db was synced from.
+type owner struct {
+	PermissionId string // stable, unlike the email address
+	EmailAddress string // for messages
+}
+
+func ownerKey() []byte {
+	return internalKey("owner")
+}
+
+// checkOwner records the account the db is synced from if it's new, and
+// otherwise checks it's the same one. A db of another account is resynced
+// from scratch if opts.AllowAccountMismatch is set, and otherwise refused.
+// If Drive can't be asked who we are, the check waits for the next start.
+func (d *DriveDB) checkOwner() error {
+	about, err := d.service.About.Get().Do()
+	if err != nil || about.User == nil {
+		d.opts.Logger.Warnf("could not check the owner of the db: %v", err)
+		return nil
+	}
+	current := owner{about.User.PermissionId, about.User.EmailAddress}
+	var stored owner
+	switch err := d.get(ownerKey(), &stored); {
+	case errors.Is(err, ErrNotFound):
+	case err != nil:
+		return err
+	case stored.PermissionId == current.PermissionId:
+		return nil
+	case !d.opts.AllowAccountMismatch:
+		return fmt.Errorf("db %s was synced from the Drive of %s, not %s; remove it to sync %s", d.dbpath, stored.EmailAddress, current.EmailAddress, current.EmailAddress)
+	default:
+		d.opts.Logger.Infof("db %s was synced from the Drive of %s; resyncing it from %s", d.dbpath, stored.EmailAddress, current.EmailAddress)
+		if err := d.reinit(); err != nil {
+			return err
+		}
+	}
+	bytes, err := d.encode(current)
+	if err != nil {
+		return err
+	}
+	return d.db.Put(ownerKey(), bytes, nil)
+}
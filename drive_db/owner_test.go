@@ -0,0 +1,46 @@
+package drive_db
+
+import (
+	"testing"
+
+	gdrive "code.google.com/p/google-api-go-client/drive/v2"
+)
+
+func TestCheckOwner(t *testing.T) {
+	fd := newFakeDrive()
+	fd.file("a", "a.txt", "a")
+	d := newTestDB(t, fd, nil)
+	var stored owner
+	if err := d.get(ownerKey(), &stored); err != nil || stored.PermissionId != "me" {
+		t.Fatalf("new db's owner = %+v, %v, want me", stored, err)
+	}
+	if err := d.checkOwner(); err != nil {
+		t.Errorf("checkOwner of the same account: %v", err)
+	}
+
+	// The db of another account is refused, and left alone.
+	fd.mu.Lock()
+	fd.user = gdrive.User{PermissionId: "other", EmailAddress: "other@example.com"}
+	fd.mu.Unlock()
+	if err := d.checkOwner(); err == nil {
+		t.Errorf("checkOwner of another account's db succeeded")
+	}
+	if _, err := d.FileById("a"); err != nil {
+		t.Errorf("after refusing another account's db, FileById(a): %v", err)
+	}
+
+	// Unless mismatches are allowed, when it's emptied, to be resynced.
+	d.opts.AllowAccountMismatch = true
+	if err := d.checkOwner(); err != nil {
+		t.Fatalf("checkOwner with AllowAccountMismatch: %v", err)
+	}
+	if _, err := d.FileById("a"); err == nil {
+		t.Errorf("after switching accounts, the old account's file is still in the db")
+	}
+	if d.lastChangeId() != 0 {
+		t.Errorf("after switching accounts, the checkpoint is at change %d, want 0", d.lastChangeId())
+	}
+	if err := d.get(ownerKey(), &stored); err != nil || stored.PermissionId != "other" {
+		t.Errorf("after switching accounts, owner = %+v, %v, want other", stored, err)
+	}
+}
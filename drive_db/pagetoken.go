@@ -0,0 +1,133 @@
+package drive_db
+
+// Changes are listed from a start page token, when the checkpoint has one,
+// rather than from the change id after the last one applied, which Drive has
+// deprecated. A token is only recorded once every change listed before it
+// has been applied, so that resuming from it can't skip any; changes listed
+// again are skipped by their ids. Dbs synced before tokens were kept fetch
+// one before their next listing, which is no later than the changes it lists.
+// This version of the client neither fetches tokens nor decodes those Drive
+// returns with the last page of changes, so those requests are made directly.
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	gdrive "code.google.com/p/google-api-go-client/drive/v2"
+	"code.google.com/p/google-api-go-client/googleapi"
+)
+
+// tokenPage is a page of changes, with the start page token for future
+// changes Drive returns with the last one.
+type tokenPage struct {
+	gdrive.ChangeList
+	NewStartPageToken string `json:"newStartPageToken"`
+}
+
+// listChanges fetches a page of changes, from pageToken, if it's set, and
+// otherwise from startChangeId, if that's positive.
+func (d *DriveDB) listChanges(startChangeId int64, pageToken string) (*tokenPage, error) {
+	q := url.Values{}
+	q.Set("includeDeleted", "true")
+	q.Set("includeSubscribed", "true")
+	q.Set("maxResults", "1000")
+	if pageToken != "" {
+		q.Set("pageToken", pageToken)
+	} else if startChangeId > 0 {
+		q.Set("startChangeId", strconv.FormatInt(startChangeId, 10))
+	}
+	var page *tokenPage
+	err := d.retry("changes.list", func() error {
+		req, err := http.NewRequest("GET", "https://www.googleapis.com/drive/v2/changes?"+q.Encode(), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := d.api.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if err := googleapi.CheckResponse(resp); err != nil {
+			return err
+		}
+		page = new(tokenPage)
+		return json.NewDecoder(resp.Body).Decode(page)
+	})
+	return page, err
+}
+
+// startPageToken fetches the start page token for changes from now on.
+func (d *DriveDB) startPageToken() (string, error) {
+	var token struct {
+		StartPageToken string `json:"startPageToken"`
+	}
+	err := d.retry("changes.getStartPageToken", func() error {
+		req, err := http.NewRequest("GET", "https://www.googleapis.com/drive/v2/changes/startPageToken", nil)
+		if err != nil {
+			return err
+		}
+		resp, err := d.api.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if err := googleapi.CheckResponse(resp); err != nil {
+			return err
+		}
+		return json.NewDecoder(resp.Body).Decode(&token)
+	})
+	return token.StartPageToken, err
+}
+
+// notePageToken records token, to be saved in the checkpoint once the changes
+// up to change id at have been applied.
+func (d *DriveDB) notePageToken(token string, at int64) {
+	d.Lock()
+	defer d.Unlock()
+	d.pageToken = token
+	d.pageTokenAt = at
+}
+
+// savePageToken saves the token notePageToken recorded in the checkpoint, if
+// the changes before it have been applied. The caller must hold resyncmu, so
+// that the checkpoint isn't meanwhile being advanced.
+func (d *DriveDB) savePageToken() error {
+	d.Lock()
+	token := d.pageToken
+	if token == "" || d.cpt.LastChangeID < d.pageTokenAt {
+		d.Unlock()
+		return nil
+	}
+	d.pageToken = ""
+	if d.cpt.StartPageToken == token {
+		d.Unlock()
+		return nil
+	}
+	d.cpt.StartPageToken = token
+	cpt := d.cpt
+	d.Unlock()
+	return d.putCheckpoint(nil, cpt)
+}
+
+// dropPageToken forgets the checkpoint's start page token, e.g. as Drive
+// refused it, so that changes are listed from the last change id instead.
+func (d *DriveDB) dropPageToken() {
+	d.Lock()
+	defer d.Unlock()
+	d.cpt.StartPageToken = ""
+	d.pageToken = ""
+}
+
+// isInvalidPageToken reports whether err is Drive refusing a page token.
+func isInvalidPageToken(err error) bool {
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) || gerr.Code < 400 || gerr.Code >= 500 || gerr.Code == 401 || gerr.Code == 403 || gerr.Code == 429 {
+		return false
+	}
+	msg := strings.ToLower(gerr.Message + gerr.Body)
+	return strings.Contains(msg, "pagetoken") || strings.Contains(msg, "page token")
+}
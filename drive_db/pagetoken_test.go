@@ -0,0 +1,133 @@
+package drive_db
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// savedPageToken returns the start page token in d's checkpoint in the db.
+func savedPageToken(t *testing.T, d *DriveDB) string {
+	t.Helper()
+	var cpt CheckPoint
+	if err := d.get(internalKey("checkpoint"), &cpt); err != nil {
+		t.Fatal(err)
+	}
+	return cpt.StartPageToken
+}
+
+func TestStartPageToken(t *testing.T) {
+	fd := newFakeDrive()
+	fd.file("a", "a.txt", "a")
+	dir := t.TempDir()
+	d := openTestDB(t, fd, dir, nil)
+
+	// Once synced, the db has the token Drive returned with the last page.
+	waitFor(t, "the start page token to be saved", func() bool {
+		return savedPageToken(t, d) != ""
+	})
+	if got, want := savedPageToken(t, d), strconv.FormatInt(fd.lastId+1, 10); got != want {
+		t.Errorf("start page token %q, want %q", got, want)
+	}
+
+	// Changes are listed from it, after a reopen too.
+	d.Close()
+	var tokens, ids []string
+	fd.setBefore(func(op string, req *http.Request) error {
+		if op == "changes.list" {
+			tokens = append(tokens, req.URL.Query().Get("pageToken"))
+			ids = append(ids, req.URL.Query().Get("startChangeId"))
+		}
+		return nil
+	})
+	fd.file("b", "b.txt", "b")
+	d = openTestDB(t, fd, dir, nil)
+	if _, err := d.FileByPath("/b.txt"); err != nil {
+		t.Errorf("FileByPath(/b.txt) after resuming from the token: %v", err)
+	}
+	fd.mu.Lock()
+	if len(tokens) == 0 || tokens[0] == "" || ids[0] != "" {
+		t.Errorf("changes listed with pageTokens %q and startChangeIds %q, want the saved token first", tokens, ids)
+	}
+	fd.mu.Unlock()
+	if n := fd.count("changes.getStartPageToken"); n != 1 {
+		t.Errorf("%d start page tokens fetched, want 1, by the new db", n)
+	}
+}
+
+func TestStartPageTokenMigration(t *testing.T) {
+	fd := newFakeDrive()
+	fd.file("a", "a.txt", "a")
+	d := newTestDB(t, fd, nil)
+	d.Pause()
+	waitPolled(t, d)
+
+	// A db synced before tokens were kept fetches one before listing.
+	d.dropPageToken()
+	if err := d.writeCheckpoint(nil); err != nil {
+		t.Fatal(err)
+	}
+	fetched := fd.count("changes.getStartPageToken")
+	fd.file("b", "b.txt", "b")
+	resync(t, d, fd)
+	if n := fd.count("changes.getStartPageToken") - fetched; n != 1 {
+		t.Errorf("a db without a token fetched %d, want 1", n)
+	}
+	if got, want := savedPageToken(t, d), strconv.FormatInt(fd.lastId+1, 10); got != want {
+		t.Errorf("start page token %q, want %q", got, want)
+	}
+}
+
+func TestStartPageTokenAfterParallelSync(t *testing.T) {
+	fd := newFakeDrive()
+	d := newTestDB(t, fd, &DriveDBOptions{SyncFetchers: 4})
+	d.Pause()
+	waitPolled(t, d)
+
+	// A backlog long enough to be fetched in parallel, listed from the token
+	// the db already has.
+	for i := 0; i < 1000; i++ {
+		fd.file(fmt.Sprintf("f%d", i), fmt.Sprintf("%d.txt", i), "x")
+	}
+	fd.mu.Lock()
+	fd.lastId += parallelSyncMin
+	fd.mu.Unlock()
+	fd.file("last", "last.txt", "x")
+	resync(t, d, fd)
+	want := strconv.FormatInt(fd.lastId+1, 10)
+	waitFor(t, "the start page token to be saved", func() bool {
+		return savedPageToken(t, d) == want
+	})
+
+	// So the next poll lists from after it, rather than the backlog again.
+	listed := fd.count("changes.list")
+	resync(t, d, fd)
+	if n := fd.count("changes.list") - listed; n != 1 {
+		t.Errorf("polling after a parallel sync listed %d pages of changes, want 1", n)
+	}
+}
+
+func TestStartPageTokenSavedOnceApplied(t *testing.T) {
+	d := newTestDB(t, newFakeDrive(), nil)
+	d.Pause()
+	waitPolled(t, d)
+	saved := savedPageToken(t, d)
+
+	// A token from after changes which aren't yet applied isn't saved, lest
+	// they be skipped.
+	d.notePageToken("later", d.lastChangeId()+1)
+	d.resyncmu.Lock()
+	err := d.savePageToken()
+	d.resyncmu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := savedPageToken(t, d); got != saved {
+		t.Errorf("start page token %q before the changes were applied, want %q", got, saved)
+	}
+	apply(t, d, testFile("a", "a.txt"))
+	if got := savedPageToken(t, d); got != "later" {
+		t.Errorf("start page token %q once the changes were applied, want later", got)
+	}
+}
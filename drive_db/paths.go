@@ -0,0 +1,131 @@
+package drive_db
+
+// With CachePaths set, the paths PathsForInode finds are kept in the db, so
+// that they needn't be walked again, a read per folder, each time. Renaming
+// or moving a file changes the paths of everything under it, so the cached
+// paths of the file and all its descendants are dropped when it does.
+
+import (
+	"sync/atomic"
+
+	gdrive "code.google.com/p/google-api-go-client/drive/v2"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func pathsKey(fileId string) []byte {
+	return []byte("pth:" + fileId)
+}
+
+// cachedPaths returns the cached paths of fileId, if there are any.
+func (d *DriveDB) cachedPaths(fileId string) ([]string, bool) {
+	var paths []string
+	if err := d.get(pathsKey(fileId), &paths); err != nil {
+		return nil, false
+	}
+	return paths, true
+}
+
+// storePaths caches the paths of fileId, found as of generation gen of the
+// path cache. If paths have been invalidated since, they may have been found
+// from files as they were before, so aren't cached.
+func (d *DriveDB) storePaths(fileId string, paths []string, gen int64) {
+	bytes, err := d.encode(paths)
+	if err != nil {
+		return
+	}
+	d.pathmu.Lock()
+	defer d.pathmu.Unlock()
+	if atomic.LoadInt64(&d.pathGen) != gen {
+		return
+	}
+	if err := d.db.Put(pathsKey(fileId), bytes, nil); err != nil {
+		debug.Printf("could not cache the paths of %v: %v", fileId, err)
+	}
+}
+
+// pathGeneration returns the generation of the path cache, which changes
+// whenever paths in it are invalidated.
+func (d *DriveDB) pathGeneration() int64 {
+	return atomic.LoadInt64(&d.pathGen)
+}
+
+// pathsChanged starts a new generation of the path cache, once changes which
+// invalidated paths have been written, so that paths found from the files as
+// they were before aren't cached.
+func (d *DriveDB) pathsChanged() {
+	d.pathmu.Lock()
+	atomic.AddInt64(&d.pathGen, 1)
+	d.pathmu.Unlock()
+}
+
+// invalidatePaths adds to batch the removal of the cached paths of fileId,
+// which is changing from of (nil if it's new) to f (nil if it's being
+// removed), if its title or parents are changing: its own, and if it's a
+// folder, those of every file under it. A new folder's children may have
+// arrived before it, and been cached as orphans.
+func (d *DriveDB) invalidatePaths(batch *leveldb.Batch, of, f *gdrive.File) {
+	if !d.opts.CachePaths || (of != nil && f != nil && !movedOrRenamed(of, f)) {
+		return
+	}
+	switch {
+	case of != nil:
+		d.invalidateTree(batch, of.Id)
+	case f != nil:
+		d.invalidateTree(batch, f.Id)
+	}
+}
+
+// invalidateTree adds to batch the removal of the cached paths of fileId and
+// every file under it.
+func (d *DriveDB) invalidateTree(batch *leveldb.Batch, fileId string) {
+	seen := make(map[string]bool)
+	var invalidate func(fileId string)
+	invalidate = func(fileId string) {
+		if seen[fileId] {
+			return
+		}
+		seen[fileId] = true
+		batch.Delete(pathsKey(fileId))
+		ids, err := d.ChildFileIds(fileId)
+		if err != nil {
+			return
+		}
+		for _, id := range ids {
+			invalidate(id)
+		}
+	}
+	invalidate(fileId)
+	atomic.AddInt64(&d.pathGen, 1)
+}
+
+// movedOrRenamed reports whether a file's title or parents differ between of
+// and f.
+func movedOrRenamed(of, f *gdrive.File) bool {
+	if of.Title != f.Title || len(of.Parents) != len(f.Parents) {
+		return true
+	}
+	parents := make(map[string]bool)
+	for _, pr := range of.Parents {
+		parents[pr.Id] = true
+	}
+	for _, pr := range f.Parents {
+		if !parents[pr.Id] {
+			return true
+		}
+	}
+	return false
+}
+
+// dropCachedPaths removes every cached path, e.g. as CachePaths isn't set, so
+// that none are left to go stale.
+func (d *DriveDB) dropCachedPaths() error {
+	batch := new(leveldb.Batch)
+	err := d.scan("pth:", func(key, value []byte) {
+		batch.Delete(append([]byte(nil), key...))
+	})
+	if err != nil || batch.Len() == 0 {
+		return err
+	}
+	d.pathsChanged()
+	return d.db.Write(batch, nil)
+}
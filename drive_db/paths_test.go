@@ -0,0 +1,70 @@
+package drive_db
+
+import (
+	"testing"
+
+	gdrive "code.google.com/p/google-api-go-client/drive/v2"
+)
+
+// pathOf returns the path of fileId, failing the test if it has none.
+func pathOf(t *testing.T, d *DriveDB, fileId string) string {
+	t.Helper()
+	inode, err := d.InodeForFileId(fileId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := d.PathForInode(inode)
+	if err != nil {
+		t.Fatalf("PathForInode(%v): %v", fileId, err)
+	}
+	return p
+}
+
+func TestCachePaths(t *testing.T) {
+	d := newTestDB(t, newFakeDrive(), &DriveDBOptions{CachePaths: true})
+	apply(t, d,
+		testFolder("a", "a"),
+		testFolder("b", "b", "a"),
+		testFile("c", "c.txt", "b"),
+	)
+	if got := pathOf(t, d, "c"); got != "/a/b/c.txt" {
+		t.Errorf("path of c = %q, want /a/b/c.txt", got)
+	}
+	if _, ok := d.cachedPaths("c"); !ok {
+		t.Errorf("the path of c wasn't cached")
+	}
+
+	// Renaming a folder invalidates the paths under it.
+	apply(t, d, testFolder("a", "A"))
+	if paths, ok := d.cachedPaths("c"); ok {
+		t.Errorf("cached paths of c = %q after renaming its grandparent, want none", paths)
+	}
+	if got := pathOf(t, d, "c"); got != "/A/b/c.txt" {
+		t.Errorf("path of c = %q after renaming its grandparent, want /A/b/c.txt", got)
+	}
+
+	// So does a parent arriving for an orphan, and its children.
+	apply(t, d,
+		testFolder("o", "o", "later"),
+		testFile("k", "k.txt", "o"),
+	)
+	if got, want := pathOf(t, d, "k"), "/"+orphanTitle+"/o/k.txt"; got != want {
+		t.Errorf("path of k = %q, want %q", got, want)
+	}
+	apply(t, d, testFolder("later", "later"))
+	if got := pathOf(t, d, "k"); got != "/later/o/k.txt" {
+		t.Errorf("path of k = %q once its parent's parent arrived, want /later/o/k.txt", got)
+	}
+
+	// And the parent being removed again.
+	id := d.lastChangeId()
+	if err := d.processChange(&gdrive.ChangeList{
+		Items:           []*gdrive.Change{removal(id+1, "later")},
+		LargestChangeId: id + 1,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := pathOf(t, d, "k"), "/"+orphanTitle+"/o/k.txt"; got != want {
+		t.Errorf("path of k = %q once its parent's parent was removed, want %q", got, want)
+	}
+}
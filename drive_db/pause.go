@@ -0,0 +1,51 @@
+package drive_db
+
+// Syncing can be paused, e.g. on a metered connection, and the poll interval
+// has a floor, so a misconfigured one can't hammer the API.
+
+import (
+	"flag"
+	"log"
+	"time"
+)
+
+var minPollInterval = flag.Duration("drivedb.minpollinterval", 10*time.Second, "shortest interval at which Drive may be polled for changes; shorter intervals are raised to it")
+
+// clampPollInterval returns interval, or --drivedb.minpollinterval if that's
+// longer.
+func clampPollInterval(interval time.Duration) time.Duration {
+	if interval < *minPollInterval {
+		log.Printf("poll interval %v is below the minimum, using %v", interval, *minPollInterval)
+		return *minPollInterval
+	}
+	return interval
+}
+
+// Pause stops polling Drive for changes, until Resume is called. A poll under
+// way is finished. Changes notified by a watch channel are ignored meanwhile.
+func (d *DriveDB) Pause() {
+	d.Lock()
+	defer d.Unlock()
+	d.paused = true
+}
+
+// Resume restarts polling Drive for changes after Pause, polling at once.
+func (d *DriveDB) Resume() {
+	d.Lock()
+	wasPaused := d.paused
+	d.paused = false
+	d.Unlock()
+	if wasPaused {
+		select {
+		case d.resumed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// isPaused reports whether polling is paused.
+func (d *DriveDB) isPaused() bool {
+	d.Lock()
+	defer d.Unlock()
+	return d.paused
+}
@@ -0,0 +1,61 @@
+package drive_db
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPause(t *testing.T) {
+	fd := newFakeDrive()
+	d := newTestDB(t, fd, nil)
+	refresh := func() {
+		t.Helper()
+		w := httptest.NewRecorder()
+		d.opts.Mux.ServeHTTP(w, httptest.NewRequest("GET", d.accountPath("/refresh"), nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: %v", d.accountPath("/refresh"), w.Code)
+		}
+	}
+
+	d.Pause()
+	if !d.Stats().Paused {
+		t.Errorf("Stats().Paused is false after Pause")
+	}
+	waitPolled(t, d)
+	calls := fd.total()
+	fd.file("f", "f.txt", "f")
+	for i := 0; i < 3; i++ {
+		refresh()
+		time.Sleep(20 * time.Millisecond)
+	}
+	if n := fd.total() - calls; n != 0 {
+		t.Errorf("paused, asked to poll thrice, the db made %d API calls", n)
+	}
+
+	// Resuming polls at once.
+	d.Resume()
+	if d.Stats().Paused {
+		t.Errorf("Stats().Paused is true after Resume")
+	}
+	fd.mu.Lock()
+	last := fd.lastId
+	fd.mu.Unlock()
+	deadline := time.Now().Add(10 * time.Second)
+	for d.lastChangeId() < last {
+		if time.Now().After(deadline) {
+			t.Fatalf("change made while paused not applied 10s after Resume")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestClampPollInterval(t *testing.T) {
+	if got := clampPollInterval(time.Millisecond); got != *minPollInterval {
+		t.Errorf("clampPollInterval(1ms) = %v, want %v", got, *minPollInterval)
+	}
+	if got := clampPollInterval(time.Hour); got != time.Hour {
+		t.Errorf("clampPollInterval(1h) = %v, want 1h", got)
+	}
+}
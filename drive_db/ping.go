@@ -0,0 +1,29 @@
+package drive_db
+
+// A revoked token is otherwise only noticed when a sync fails, which may be a
+// poll interval away, or never if nothing changes in Drive.
+
+import (
+	"context"
+)
+
+// Ping checks that Drive is reachable and still accepts our credentials, with
+// a single About.Get call, which isn't retried. A failure is returned as a
+// *SyncError, of Kind AuthError if the token has been revoked or has expired
+// and can't be refreshed. Ping returns ctx.Err() if ctx is done first.
+func (d *DriveDB) Ping(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := d.service.About.Get().Do()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return &SyncError{Kind: apiErrorKind(err), Op: "about.get", Err: err}
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,52 @@
+package drive_db
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestPing(t *testing.T) {
+	fd := newFakeDrive()
+	d := newTestDB(t, fd, nil)
+	// Polling fetches the quota with About.Get too.
+	d.Pause()
+	waitPolled(t, d)
+	if err := d.Ping(context.Background()); err != nil {
+		t.Errorf("Ping: %v", err)
+	}
+
+	// A revoked token is an AuthError, and isn't retried.
+	before := fd.count("about.get")
+	fd.failNext("about.get", http.StatusUnauthorized)
+	err := d.Ping(context.Background())
+	var serr *SyncError
+	if !errors.As(err, &serr) || serr.Kind != AuthError {
+		t.Errorf("Ping with a revoked token = %v, want an AuthError", err)
+	}
+	if n := fd.count("about.get") - before; n != 1 {
+		t.Errorf("Ping with a revoked token made %d calls, want 1", n)
+	}
+
+	// Drive failing otherwise isn't.
+	fd.failNext("about.get", http.StatusInternalServerError)
+	if err := d.Ping(context.Background()); !errors.As(err, &serr) || serr.Kind == AuthError {
+		t.Errorf("Ping with Drive failing = %v, want a SyncError other than an AuthError", err)
+	}
+
+	// Ping doesn't wait on a call which hangs once ctx is done.
+	hang := make(chan struct{})
+	defer close(hang)
+	fd.setBefore(func(op string, req *http.Request) error {
+		if op == "about.get" {
+			<-hang
+		}
+		return nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := d.Ping(ctx); err != context.Canceled {
+		t.Errorf("Ping with a canceled context = %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,54 @@
+package drive_db
+
+// Drive's own search, for queries the local indexes can't answer, e.g. by
+// full text or by property. See
+// https://developers.google.com/drive/web/search-parameters for the syntax.
+
+import (
+	gdrive "code.google.com/p/google-api-go-client/drive/v2"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// Query returns the files matching the Drive search query q, e.g.
+// "mimeType = 'application/pdf' and modifiedDate > '2020-01-01'", as Drive
+// has them now, whether or not they're in the db.
+func (d *DriveDB) Query(q string) ([]*gdrive.File, error) {
+	var files []*gdrive.File
+	l := d.service.Files.List().MaxResults(1000).Q(q)
+	for {
+		var fl *gdrive.FileList
+		err := d.retry("files.list", func() (err error) {
+			fl, err = l.Do()
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, fl.Items...)
+		if fl.NextPageToken == "" {
+			return files, nil
+		}
+		l.PageToken(fl.NextPageToken)
+	}
+}
+
+// QueryAndStore is Query, also updating the db with the files found, so that
+// those missing from it, e.g. because a change to them was missed, are
+// mounted. Files the db doesn't keep, e.g. hidden ones or those outside the
+// SyncRoots, are returned but not stored, as are those the db has since had
+// newer versions of.
+func (d *DriveDB) QueryAndStore(q string) ([]*gdrive.File, error) {
+	if d.opts.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	files, err := d.Query(q)
+	if err != nil {
+		return nil, err
+	}
+	d.resyncmu.Lock()
+	defer d.resyncmu.Unlock()
+	if err := d.bulkImport(new(leveldb.Batch), d.newerFiles(files), make(map[string]bool)); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
@@ -0,0 +1,83 @@
+package drive_db
+
+import (
+	"testing"
+
+	gdrive "code.google.com/p/google-api-go-client/drive/v2"
+)
+
+func TestQuery(t *testing.T) {
+	fd := newFakeDrive()
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		fd.file(id, id+".txt", id)
+	}
+	fd.pageSize = 2
+	d := newTestDB(t, fd, nil)
+
+	const q = "fullText contains 'x'"
+	files, err := d.Query(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 5 {
+		t.Errorf("Query(%q) returned %d files, want all 5, from 3 pages", q, len(files))
+	}
+	fd.mu.Lock()
+	queries := append([]string(nil), fd.queries...)
+	fd.mu.Unlock()
+	if len(queries) != 3 {
+		t.Errorf("Query(%q) made %d files.list requests, want 3", q, len(queries))
+	}
+	for _, got := range queries {
+		if got != q {
+			t.Errorf("files.list q = %q, want %q", got, q)
+		}
+	}
+}
+
+func TestQueryAndStore(t *testing.T) {
+	fd := newFakeDrive()
+	fd.file("a", "a.txt", "a")
+	fd.file("b", "b.txt", "b")
+	d := newTestDB(t, fd, nil)
+	changes := d.Subscribe()
+
+	// A file whose change was missed is stored, and published.
+	fd.mu.Lock()
+	fd.files["missed"] = &gdrive.File{Id: "missed", Title: "missed.txt", MimeType: "text/plain", Version: 1,
+		Labels: &gdrive.FileLabels{}, Parents: []*gdrive.ParentReference{{Id: "root"}}}
+	fd.mu.Unlock()
+	// One the db has a newer version of than Drive lists is left as it is.
+	newer := fd.get("b")
+	newer.Title = "newer.txt"
+	newer.Version += 10
+	apply(t, d, newer)
+	for len(changes) > 0 {
+		<-changes
+	}
+
+	if _, err := d.QueryAndStore("title contains 'txt'"); err != nil {
+		t.Fatal(err)
+	}
+	if f, err := d.FileByPath("/missed.txt"); err != nil || f.Id != "missed" {
+		t.Errorf("FileByPath(/missed.txt) = %v, %v, want missed", f, err)
+	}
+	if f, err := d.FileById("b"); err != nil || f.Title != "newer.txt" {
+		t.Errorf("FileById(b) = %v, %v, want the newer version, newer.txt", f, err)
+	}
+	inode, err := d.InodeForFileId("missed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	published := false
+	for len(changes) > 0 {
+		c := <-changes
+		if c.FileId == "b" {
+			t.Errorf("storing no newer version of b published %+v", c)
+		}
+		published = published || c.Inode == inode && c.Kind == Created
+	}
+	if !published {
+		t.Errorf("storing missed published no Created change for it")
+	}
+}
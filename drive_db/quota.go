@@ -0,0 +1,57 @@
+package drive_db
+
+// The user's storage quota, so the mount can report it as its size.
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// quota is the storage used by, and available to, the user, in bytes.
+type quota struct {
+	Used  int64
+	Total int64
+}
+
+func quotaKey() []byte {
+	return internalKey("about")
+}
+
+// refreshQuota fetches the user's storage quota from Drive, and stores it.
+func (d *DriveDB) refreshQuota() error {
+	if d.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	var q quota
+	err := d.retry("about.get", func() error {
+		about, err := d.service.About.Get().Do()
+		if err != nil {
+			return err
+		}
+		q = quota{about.QuotaBytesUsed, about.QuotaBytesTotal}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	bytes, err := d.encode(q)
+	if err != nil {
+		return err
+	}
+	return d.db.Put(quotaKey(), bytes, nil)
+}
+
+// Quota returns the bytes of storage the user has used, and has in total, as
+// of the last poll which found changes. A total of 0 means unlimited.
+func (d *DriveDB) Quota() (used, total int64, err error) {
+	var q quota
+	if err := d.get(quotaKey(), &q); err != nil {
+		return 0, 0, err
+	}
+	return q.Used, q.Total, nil
+}
+
+// haveQuota reports whether the quota has been stored.
+func (d *DriveDB) haveQuota() bool {
+	_, err := d.db.Get(quotaKey(), nil)
+	return err != leveldb.ErrNotFound
+}
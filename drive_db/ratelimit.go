@@ -0,0 +1,102 @@
+package drive_db
+
+// API calls are rate limited, so that bursts of reads from the filesystem on
+// top of the sync don't trip Drive's per-user rate limits.
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// errRateLimited is returned by a call which would have had to wait too long
+// for the rate limiter. It's a net.Error, so it's retried after a backoff.
+type errRateLimited struct{}
+
+func (errRateLimited) Error() string   { return "drive_db: API call rate limited" }
+func (errRateLimited) Timeout() bool   { return false }
+func (errRateLimited) Temporary() bool { return true }
+
+// rateLimiter is a token bucket, holding up to burst calls and refilled at
+// qps calls per second.
+type rateLimiter struct {
+	mu      sync.Mutex
+	qps     float64
+	burst   float64
+	maxWait time.Duration
+	tokens  float64   // guarded by mu
+	last    time.Time // when tokens was last brought up to date; guarded by mu
+}
+
+// newRateLimiter returns a rateLimiter which starts full, or nil if qps isn't
+// positive, which doesn't limit.
+func newRateLimiter(qps float64, burst int, maxWait time.Duration) *rateLimiter {
+	if qps <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		qps:     qps,
+		burst:   float64(burst),
+		maxWait: maxWait,
+		tokens:  float64(burst),
+		last:    time.Now(),
+	}
+}
+
+// delay returns how long a call made now would wait. l.mu must be held.
+func (l *rateLimiter) delay(now time.Time) time.Duration {
+	l.tokens += now.Sub(l.last).Seconds() * l.qps
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	if l.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - l.tokens) / l.qps * float64(time.Second))
+}
+
+// Wait returns how long a call made now would wait.
+func (l *rateLimiter) Wait() time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.delay(time.Now())
+}
+
+// take waits for and takes a call's token, unless that would mean waiting
+// longer than maxWait.
+func (l *rateLimiter) take() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	delay := l.delay(time.Now())
+	if delay > l.maxWait {
+		l.mu.Unlock()
+		return errRateLimited{}
+	}
+	// Taken now, so later calls queue up behind this one.
+	l.tokens--
+	l.mu.Unlock()
+	time.Sleep(delay)
+	return nil
+}
+
+// limitedTransport takes a token from limiter for each request.
+type limitedTransport struct {
+	rt      http.RoundTripper
+	limiter *rateLimiter
+}
+
+func (t *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.limiter.take(); err != nil {
+		return nil, err
+	}
+	return t.rt.RoundTrip(req)
+}
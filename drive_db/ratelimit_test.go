@@ -0,0 +1,86 @@
+package drive_db
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	const qps = 100
+	l := newRateLimiter(qps, 2, time.Second)
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if err := l.take(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d > time.Second/qps {
+		t.Errorf("a burst of 2 took %v", d)
+	}
+	// Then a call every 1/qps.
+	for i := 0; i < 5; i++ {
+		if err := l.take(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d, want := time.Since(start), 5*time.Second/qps; d < want*9/10 {
+		t.Errorf("7 calls, with a burst of 2, took %v, want at least %v", d, want)
+	}
+
+	// A call which would wait too long fails, to be retried.
+	l = newRateLimiter(1, 1, time.Millisecond)
+	if err := l.take(); err != nil {
+		t.Fatal(err)
+	}
+	err := l.take()
+	if _, ok := err.(errRateLimited); !ok {
+		t.Fatalf("a call waiting beyond maxWait: err = %v, want errRateLimited", err)
+	}
+	if c := classifyError(err); c != errRetryable {
+		t.Errorf("classifyError(errRateLimited) = %v, want retryable", c)
+	}
+
+	if l := newRateLimiter(-1, 1, 0); l != nil || l.take() != nil || l.Wait() != 0 {
+		t.Errorf("a limiter without a rate limits")
+	}
+}
+
+func TestAPICallsAreSpaced(t *testing.T) {
+	const qps = 50
+	fd := newFakeDrive()
+	fd.file("f", "f.txt", "f")
+	d := newTestDB(t, fd, &DriveDBOptions{APIQPS: qps, APIBurst: 1, APIMaxWait: time.Minute})
+
+	var mu sync.Mutex
+	var times []time.Time
+	fd.setBefore(func(op string, req *http.Request) error {
+		if op == "files.get" {
+			mu.Lock()
+			times = append(times, time.Now())
+			mu.Unlock()
+		}
+		return nil
+	})
+	// Concurrent calls queue for the limiter, rather than all going at once.
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := d.FreshDownloadUrlContext(d.ctx, "f"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	mu.Lock()
+	defer mu.Unlock()
+	if len(times) != 5 {
+		t.Fatalf("%d files.get calls, want 5", len(times))
+	}
+	if d, want := times[4].Sub(times[0]), 4*time.Second/qps; d < want*9/10 {
+		t.Errorf("5 calls at %d qps were made over %v, want at least %v", qps, d, want)
+	}
+}
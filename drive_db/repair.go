@@ -0,0 +1,171 @@
+package drive_db
+
+// Checking and repairing the consistency of the db's own records, as opposed
+// to leveldb's, which openLevelDB recovers.
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// RepairReport counts the problems Repair found, each of which it fixed.
+type RepairReport struct {
+	Undecodable       int // mappings whose value couldn't be decoded, removed
+	MissingReverse    int // fileId to inode mappings without the reverse, restored
+	MissingForward    int // inode to fileId mappings without the forward, restored
+	Conflicting       int // mappings contradicted by the other direction, removed
+	OrphanedChildRefs int // child refs to or from a file not in the db, removed
+	InodesAbove       int // how far the checkpoint's LastInode was raised, to cover mapped inodes
+}
+
+// Repair makes the fileId to inode and inode to fileId mappings agree with
+// each other, and removes child refs of and to files which aren't in the db.
+// Where the two mappings disagree about an inode, the mapping which both
+// directions agree on is kept, and the other removed; the fileId left without
+// an inode gets a new one when it's next looked up.
+func (d *DriveDB) Repair() (RepairReport, error) {
+	var r RepairReport
+
+	// Hold off inode allocation, which writes both mappings.
+	d.allocmu.Lock()
+	defer d.allocmu.Unlock()
+
+	batch := new(leveldb.Batch)
+	f2i := make(map[string]uint64)
+	err := d.scan("f2i:", func(key, value []byte) {
+		var inode uint64
+		if err := d.decode(value, &inode); err != nil {
+			batch.Delete(key)
+			r.Undecodable++
+			return
+		}
+		f2i[string(key[len("f2i:"):])] = inode
+	})
+	if err != nil {
+		return r, err
+	}
+	i2f := make(map[uint64]string)
+	err = d.scan("i2f:", func(key, value []byte) {
+		var fileId string
+		inode, err := strconv.ParseUint(string(key[len("i2f:"):]), 10, 64)
+		if err == nil {
+			err = d.decode(value, &fileId)
+		}
+		if err != nil {
+			batch.Delete(key)
+			r.Undecodable++
+			return
+		}
+		i2f[inode] = fileId
+	})
+	if err != nil {
+		return r, err
+	}
+
+	var maxInode uint64
+	stale := make(map[uint64]bool) // inodes whose cached *File may be wrong
+	for fileId, inode := range f2i {
+		if inode > maxInode {
+			maxInode = inode
+		}
+		reverse, ok := i2f[inode]
+		switch {
+		case !ok:
+			if err := d.putInodeMapping(batch, fileId, inode); err != nil {
+				return r, err
+			}
+			r.MissingReverse++
+		case reverse != fileId && f2i[reverse] == inode:
+			// The inode belongs to reverse, whose mappings agree.
+			batch.Delete(fileIdToInodeKey(fileId))
+			r.Conflicting++
+		default:
+			continue
+		}
+		stale[inode] = true
+	}
+	for inode, fileId := range i2f {
+		if inode > maxInode {
+			maxInode = inode
+		}
+		forward, ok := f2i[fileId]
+		switch {
+		case !ok:
+			if _, special := d.specialInode(fileId); special {
+				continue
+			}
+			if err := d.putInodeMapping(batch, fileId, inode); err != nil {
+				return r, err
+			}
+			r.MissingForward++
+		case forward != inode && i2f[forward] == fileId:
+			// fileId has moved on to forward.
+			batch.Delete(inodeToFileIdKey(inode))
+			r.Conflicting++
+		default:
+			continue
+		}
+		stale[inode] = true
+	}
+
+	err = d.scan("kid:", func(key, value []byte) {
+		// kid:<parentId>:<childId>. Drive's fileIds contain no colons, but
+		// those of the synthetic folders do, as parent or child, so try
+		// each split.
+		ref := string(key[len("kid:"):])
+		for i := strings.Index(ref, ":"); i >= 0; {
+			if d.hasFile(ref[:i]) && d.hasFile(ref[i+1:]) {
+				return
+			}
+			next := strings.Index(ref[i+1:], ":")
+			if next < 0 {
+				break
+			}
+			i += next + 1
+		}
+		batch.Delete(key)
+		r.OrphanedChildRefs++
+	})
+	if err != nil {
+		return r, err
+	}
+
+	d.Lock()
+	if maxInode > d.cpt.LastInode {
+		r.InodesAbove = int(maxInode - d.cpt.LastInode)
+		d.cpt.LastInode = maxInode
+	}
+	d.Unlock()
+	if err := d.writeCheckpoint(batch); err != nil {
+		return r, err
+	}
+	if err := d.db.Write(batch, nil); err != nil {
+		return r, err
+	}
+	for inode := range stale {
+		d.lruCache.Remove(inode)
+	}
+	return r, nil
+}
+
+// scan calls fn with each key and value beginning with prefix. The slices
+// are only valid during the call.
+func (d *DriveDB) scan(prefix string, fn func(key, value []byte)) error {
+	iter, err := d.newIterator(util.BytesPrefix([]byte(prefix)))
+	if err != nil {
+		return err
+	}
+	for iter.Next() {
+		fn(iter.Key(), iter.Value())
+	}
+	d.releaseIterator(iter)
+	return iter.Error()
+}
+
+func (d *DriveDB) hasFile(fileId string) bool {
+	found, err := d.db.Has(fileKey(fileId), nil)
+	return err == nil && found
+}
@@ -0,0 +1,48 @@
+package drive_db
+
+import (
+	"testing"
+)
+
+func TestRepair(t *testing.T) {
+	fd := newFakeDrive()
+	fd.folder("x", "x")
+	fd.file("a", "a.txt", "a", "x")
+	fd.file("b", "b.txt", "b", "x")
+	d := newTestDB(t, fd, nil)
+	inodes, err := d.InodesForFileIds([]string{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Lose a's reverse mapping and b's forward one, and refer to a child
+	// which isn't in the db.
+	d.db.Delete(inodeToFileIdKey(inodes[0]), nil)
+	d.db.Delete(fileIdToInodeKey("b"), nil)
+	d.db.Put(childKey("x:gone"), nil, nil)
+
+	r, err := d.Repair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (RepairReport{MissingReverse: 1, MissingForward: 1, OrphanedChildRefs: 1}); r != want {
+		t.Errorf("Repair() = %+v, want %+v", r, want)
+	}
+	for i, fileId := range []string{"a", "b"} {
+		var inode uint64
+		if err := d.get(fileIdToInodeKey(fileId), &inode); err != nil || inode != inodes[i] {
+			t.Errorf("f2i:%s = %d, %v, want %d", fileId, inode, err, inodes[i])
+		}
+		if id, err := d.FileIdForInode(inodes[i]); err != nil || id != fileId {
+			t.Errorf("FileIdForInode(%d) = %q, %v, want %s", inodes[i], id, err, fileId)
+		}
+	}
+	if ids, err := d.ChildFileIds("x"); err != nil || len(ids) != 2 {
+		t.Errorf("ChildFileIds(x) = %v, %v, want [a b]", ids, err)
+	}
+
+	// Another pass finds nothing to repair.
+	if r, err := d.Repair(); err != nil || r != (RepairReport{}) {
+		t.Errorf("second Repair() = %+v, %v, want nothing repaired", r, err)
+	}
+}
@@ -0,0 +1,132 @@
+package drive_db
+
+// Streaming a large file over a flaky connection: a read which fails part
+// way is resumed from the byte it stopped at, rather than failing the whole
+// stream.
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// maxResumes is the number of times in a row a resumingReader reopens its
+// file without reading anything before it gives up.
+const maxResumes = 5
+
+// OpenResumable is like OpenRange, but if reading the content fails part
+// way, it's reopened from where it failed, with a fresh download url, without
+// the caller noticing, up to maxResumes times in a row.
+func (d *DriveDB) OpenResumable(f *File, offset, length int64) (io.ReadCloser, error) {
+	rc, err := d.OpenRange(f, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	r := &resumingReader{d: d, f: f, offset: offset, rc: rc}
+	if length > 0 {
+		r.end = offset + length
+	}
+	return r, nil
+}
+
+// resumingReader reads a range of a file, reopening it if reading fails.
+type resumingReader struct {
+	d       *DriveDB
+	f       *File
+	offset  int64 // of the next byte to read
+	end     int64 // just past the last byte to read, or 0 for the end of the file
+	rc      io.ReadCloser
+	err     error // met by the last Read along with data, to resume from
+	resumes int   // since anything was last read
+}
+
+func (r *resumingReader) Read(p []byte) (int, error) {
+	for {
+		var n int
+		var err error
+		if r.err != nil {
+			err, r.err = r.err, nil
+		} else {
+			n, err = r.rc.Read(p)
+			r.offset += int64(n)
+		}
+		if n > 0 {
+			r.resumes = 0
+			if err != nil && err != io.EOF {
+				// Return the data, and resume on the next Read.
+				r.err, err = err, nil
+			}
+			return n, err
+		}
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		if r.offset >= r.limit() {
+			return 0, io.EOF
+		}
+		if r.resumes >= maxResumes {
+			return 0, fmt.Errorf("reading %v at %d failed %d times: %v", r.f.Id, r.offset, r.resumes+1, err)
+		}
+		delay := backoff(r.d.opts.SyncRetryDelay, r.resumes)
+		r.resumes++
+		log.Printf("reading %v at %d failed: %v; resuming in %v", r.f.Id, r.offset, err, delay)
+		time.Sleep(delay)
+		r.reopen()
+	}
+}
+
+// limit returns the offset just past the last byte to read.
+func (r *resumingReader) limit() int64 {
+	if r.end > 0 {
+		return r.end
+	}
+	return r.f.FileSize
+}
+
+// reopen replaces rc with the rest of the range, using a fresh download url,
+// as the failure may have been the old one expiring. If it can't, rc is left
+// failing with the reason, to be retried by Read.
+func (r *resumingReader) reopen() {
+	r.rc.Close()
+	rc, err := r.open()
+	if err != nil {
+		rc = errReader{err}
+	}
+	r.rc = rc
+}
+
+// open opens the rest of the range, or returns io.EOF if there's none left,
+// as Drive refuses a range starting past the end of the file.
+func (r *resumingReader) open() (io.ReadCloser, error) {
+	if r.offset >= r.limit() {
+		return nil, io.EOF
+	}
+	if _, err := r.d.downloadUrl(r.f.Id, true); err != nil {
+		return nil, err
+	}
+	var length int64
+	if r.end > 0 {
+		length = r.end - r.offset
+	}
+	rc, err := r.d.OpenRange(r.f, r.offset, length)
+	if err != nil {
+		if rerr, ok := err.(*ErrRangeIgnored); ok {
+			rerr.Body.Close()
+		}
+		return nil, fmt.Errorf("resuming %v at %d: %v", r.f.Id, r.offset, err)
+	}
+	return rc, nil
+}
+
+func (r *resumingReader) Close() error {
+	return r.rc.Close()
+}
+
+// errReader stands in for a reader which couldn't be reopened.
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
+func (r errReader) Close() error             { return nil }
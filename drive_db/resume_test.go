@@ -0,0 +1,67 @@
+package drive_db
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestOpenResumable(t *testing.T) {
+	content := strings.Repeat("0123456789", 10)
+	fd := newFakeDrive()
+	fd.file("f", "f.txt", content)
+	d := newTestDB(t, fd, nil)
+	inode, err := d.InodeForFileId("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := d.FileByInode(inode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		desc           string
+		offset, length int64
+		cuts           []int
+		downloads      int
+	}{
+		{"uncut", 0, 0, nil, 1},
+		{"cut twice", 0, 0, []int{10, 25}, 3},
+		{"a range cut", 5, 20, []int{7}, 2},
+		// Failing with the last byte needn't be resumed.
+		{"cut at the end", 0, 0, []int{len(content)}, 1},
+		{"a range cut at its end", 50, 20, []int{20}, 1},
+		{"cut after every byte", 90, 0, []int{1, 1, 1, 1, 1, 1, 1, 1, 1, 1}, 10},
+	} {
+		fd.cutNext("download", tc.cuts...)
+		before := fd.count("download")
+		rc, err := d.OpenResumable(f, tc.offset, tc.length)
+		if err != nil {
+			t.Fatalf("%s: OpenResumable: %v", tc.desc, err)
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		want := content[tc.offset:]
+		if tc.length > 0 {
+			want = want[:tc.length]
+		}
+		if err != nil || string(data) != want {
+			t.Errorf("%s: read %q, %v, want %q", tc.desc, data, err, want)
+		}
+		if n := fd.count("download") - before; n != tc.downloads {
+			t.Errorf("%s: made %d downloads, want %d", tc.desc, n, tc.downloads)
+		}
+	}
+
+	// It gives up on a file which keeps failing without reading anything.
+	fd.cutNext("download", 10, 0, 0, 0, 0, 0, 0)
+	rc, err := d.OpenResumable(f, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if data, err := ioutil.ReadAll(rc); err == nil || string(data) != content[:10] {
+		t.Errorf("read of a file which failed after 10 bytes, then at once %d times = %q, %v, want its first 10 bytes, and an error", maxResumes+1, data, err)
+	}
+}
@@ -0,0 +1,210 @@
+package drive_db
+
+// Recovering from a broken change feed, by relisting every file in Drive.
+
+import (
+	"time"
+
+	gdrive "code.google.com/p/google-api-go-client/drive/v2"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// minResyncInterval limits how often sync errors trigger a FullResync, so a
+// persistent fault doesn't have every poll relist the whole Drive.
+const minResyncInterval = time.Hour
+
+// FullResync rebuilds the db's files from a listing of every file in Drive,
+// removing those no longer there, then resumes incremental sync from the
+// change current when the listing began. Changes made during the listing
+// are replayed afterwards. Files keep their inodes, so open handles survive.
+// Changes are not applied while it runs.
+func (d *DriveDB) FullResync() error {
+	d.resyncmu.Lock()
+	defer d.resyncmu.Unlock()
+	d.Lock()
+	d.lastResync = time.Now()
+	d.Unlock()
+
+	var about *gdrive.About
+	err := d.retry("about.get", func() (err error) {
+		about, err = d.service.About.Get().Do()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	// Listing resumes from a token of the same moment, not one from before
+	// whatever broke the change feed. Without one, it's fetched again by the
+	// next listing.
+	token, err := d.startPageToken()
+	if err != nil {
+		d.opts.Logger.Debugf("can't fetch a start page token: %v", err)
+	}
+	d.opts.Logger.Infof("resyncing all files, as of change %d", about.LargestChangeId)
+
+	seen := make(map[string]bool)
+	batch := new(leveldb.Batch)
+	if d.scoped() {
+		// Only the files under the sync roots are listed.
+		if err := d.resyncScope(batch, seen); err != nil {
+			return err
+		}
+		if err := d.db.Write(batch, nil); err != nil {
+			return err
+		}
+		batch.Reset()
+	} else if err := d.resyncAll(batch, seen); err != nil {
+		return err
+	}
+
+	ids, err := d.AllFileIds()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if _, special := d.specialInode(id); special || seen[id] || d.IsTeamDrive(id) {
+			continue
+		}
+		if err := d.RemoveFileById(id, batch); err != nil {
+			return err
+		}
+	}
+	d.Lock()
+	d.cpt.LastChangeID = about.LargestChangeId
+	d.cpt.StartPageToken = token
+	d.pageToken = ""
+	d.Unlock()
+	if err := d.writeCheckpoint(batch); err != nil {
+		return err
+	}
+	if err := d.db.Write(batch, nil); err != nil {
+		return err
+	}
+	d.InvalidateCache()
+	d.opts.Logger.Infof("resynced %d files", len(seen))
+	return nil
+}
+
+// resyncAll adds every file listed in Drive to the db, a page at a time,
+// adding their fileIds to seen.
+func (d *DriveDB) resyncAll(batch *leveldb.Batch, seen map[string]bool) error {
+	l := d.service.Files.List().MaxResults(1000)
+	if d.opts.TrashMode == Drop {
+		l.Q("trashed = false")
+	}
+	for {
+		var fl *gdrive.FileList
+		err := d.retry("files.list", func() (err error) {
+			fl, err = l.Do()
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if err := d.bulkImport(batch, fl.Items, seen); err != nil {
+			return err
+		}
+		if fl.NextPageToken == "" {
+			return nil
+		}
+		l.PageToken(fl.NextPageToken)
+	}
+}
+
+// bulkImportBatch is the number of files BulkImport writes at once. It's a
+// variable so tests can change it.
+var bulkImportBatch = 2000
+
+// BulkImport adds files, e.g. as listed by Files.List, to the db, replacing
+// any already in it, bulkImportBatch at a time. It's much quicker than
+// applying them as changes, but doesn't advance the change the db has synced
+// to, so changes to them since are still applied. Hidden and trashed files
+// are kept or not as they are by the sync, as are those outside the
+// SyncRoots, though only parents earlier in files or in the db count.
+func (d *DriveDB) BulkImport(files []*gdrive.File) error {
+	if d.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	d.resyncmu.Lock()
+	defer d.resyncmu.Unlock()
+	return d.bulkImport(new(leveldb.Batch), files, make(map[string]bool))
+}
+
+// bulkImport is BulkImport, using batch, which it leaves empty, and adding
+// the fileIds of the files kept to seen. The files' inodes are mapped in the
+// batches which store them, and the changes published as each is written.
+func (d *DriveDB) bulkImport(batch *leveldb.Batch, files []*gdrive.File, seen map[string]bool) error {
+	var written []string
+	var updated, olds []*gdrive.File
+	write := func() error {
+		inodes, err := d.writeInodes(batch, written)
+		if err != nil {
+			return err
+		}
+		batch.Reset()
+		d.pathsChanged()
+		var changes []InodeChange
+		for i, id := range written {
+			// UpdateFile flushed them before they were written.
+			d.FlushCachedInodeForFileId(id)
+			changes = append(changes, d.inodeChanges(inodes[i], &gdrive.Change{FileId: id, File: updated[i]}, olds[i], false)...)
+		}
+		d.publish(changes)
+		written, updated, olds = written[:0], updated[:0], olds[:0]
+		return nil
+	}
+	for _, f := range files {
+		if f.Labels != nil && f.Labels.Trashed && d.opts.TrashMode == Drop {
+			continue
+		}
+		if !d.inScope(f, seen) {
+			continue
+		}
+		of, _ := d.FileById(f.Id)
+		ok, err := d.storeListed(batch, f)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		seen[f.Id] = true
+		written = append(written, f.Id)
+		updated = append(updated, f)
+		olds = append(olds, of)
+		if len(written) >= bulkImportBatch {
+			if err := write(); err != nil {
+				return err
+			}
+		}
+	}
+	return write()
+}
+
+// newerFiles returns those of files, e.g. as listed from Drive, which are
+// newer than the versions in the db, so that storing them doesn't undo the
+// changes applied since they were listed.
+func (d *DriveDB) newerFiles(files []*gdrive.File) []*gdrive.File {
+	var newer []*gdrive.File
+	for _, f := range files {
+		if of, err := d.FileById(f.Id); err == nil && of.Version >= f.Version {
+			continue
+		}
+		newer = append(newer, f)
+	}
+	return newer
+}
+
+// resyncAfterError recovers from a failure to list or apply changes with a
+// FullResync, unless there's been one within minResyncInterval.
+func (d *DriveDB) resyncAfterError() {
+	d.Lock()
+	recent := time.Since(d.lastResync) < minResyncInterval
+	d.Unlock()
+	if recent {
+		return
+	}
+	if err := d.FullResync(); err != nil {
+		d.syncError(apiErrorKind(err), "full resync", err)
+	}
+}
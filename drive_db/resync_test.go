@@ -0,0 +1,178 @@
+package drive_db
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"testing"
+
+	gdrive "code.google.com/p/google-api-go-client/drive/v2"
+)
+
+func TestFullResync(t *testing.T) {
+	fd := newFakeDrive()
+	fd.folder("dir", "dir")
+	fd.file("kept", "kept.txt", "k", "dir")
+	fd.file("renamed", "old.txt", "r")
+	fd.file("gone", "gone.txt", "g")
+	d := newTestDB(t, fd, nil)
+	inodes := make(map[string]uint64)
+	for _, id := range []string{"dir", "kept", "renamed"} {
+		inode, err := d.InodeForFileId(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inodes[id] = inode
+	}
+
+	// Drive changes without the changes being listed, as if they'd been
+	// lost.
+	fd.mu.Lock()
+	fd.files["renamed"].Title = "new.txt"
+	delete(fd.files, "gone")
+	fd.files["missed"] = &gdrive.File{
+		Id:       "missed",
+		Title:    "missed.txt",
+		MimeType: "text/plain",
+		Labels:   &gdrive.FileLabels{},
+		Parents:  []*gdrive.ParentReference{{Id: "dir"}},
+	}
+	fd.mu.Unlock()
+
+	if err := d.FullResync(); err != nil {
+		t.Fatal(err)
+	}
+	if f, err := d.FileById("renamed"); err != nil || f.Title != "new.txt" {
+		t.Errorf("after FullResync, FileById(renamed) = %v, %v, want new.txt", f, err)
+	}
+	if _, err := d.FileById("gone"); err == nil {
+		t.Errorf("after FullResync, a file gone from Drive is still in the db")
+	}
+	if _, err := d.FileByPath("/dir/missed.txt"); err != nil {
+		t.Errorf("after FullResync, FileByPath(/dir/missed.txt): %v", err)
+	}
+	// Inodes survive, so open files do.
+	for id, want := range inodes {
+		if inode, err := d.InodeForFileId(id); err != nil || inode != want {
+			t.Errorf("after FullResync, InodeForFileId(%s) = %d, %v, want %d", id, inode, err, want)
+		}
+	}
+	if id := d.lastChangeId(); id != fd.lastId {
+		t.Errorf("after FullResync, last change %d, want %d", id, fd.lastId)
+	}
+
+	// Changes are read incrementally from there.
+	fd.file("later", "later.txt", "l", "dir")
+	resync(t, d, fd)
+	if _, err := d.FileByPath("/dir/later.txt"); err != nil {
+		t.Errorf("after a change following FullResync, FileByPath(/dir/later.txt): %v", err)
+	}
+}
+
+func TestChangeHistoryTooOld(t *testing.T) {
+	fd := newFakeDrive()
+	fd.file("kept", "kept.txt", "k")
+	d := newTestDB(t, fd, nil)
+	errs := d.Errors()
+
+	// Drive forgets the changes made while the db was away.
+	fd.file("missed", "missed.txt", "m")
+	fd.forgetChanges()
+	before := fd.count("files.list")
+	d.readChanges()
+
+	// The failure is reported, and recovered from by a FullResync.
+	var reported bool
+	for len(errs) > 0 {
+		if err := <-errs; errors.Is(err, ErrChangeHistoryTooOld) {
+			reported = true
+		}
+	}
+	if !reported {
+		t.Errorf("listing forgotten changes didn't report ErrChangeHistoryTooOld")
+	}
+	if fd.count("files.list") == before {
+		t.Errorf("listing forgotten changes didn't relist the files")
+	}
+	if _, err := d.FileByPath("/missed.txt"); err != nil {
+		t.Errorf("after listing forgotten changes, FileByPath(/missed.txt): %v", err)
+	}
+	if id := d.lastChangeId(); id != fd.lastId {
+		t.Errorf("after listing forgotten changes, last change %d, want %d", id, fd.lastId)
+	}
+	if got, want := savedPageToken(t, d), strconv.FormatInt(fd.lastId+1, 10); got != want {
+		t.Errorf("after listing forgotten changes, start page token %q, want %q", got, want)
+	}
+
+	// Changes are read incrementally from there.
+	fd.file("later", "later.txt", "l")
+	resync(t, d, fd)
+	if _, err := d.FileByPath("/later.txt"); err != nil {
+		t.Errorf("after a change following the resync, FileByPath(/later.txt): %v", err)
+	}
+}
+
+func TestBulkImport(t *testing.T) {
+	dir := t.TempDir()
+	d := openTestDB(t, newFakeDrive(), dir, nil)
+	changes := d.Subscribe()
+	defer func(old int) { bulkImportBatch = old }(bulkImportBatch)
+	bulkImportBatch = 2
+
+	files := []*gdrive.File{testFolder("dir", "dir"), testFile("a", "a.txt", "dir"), testFile("b", "b.txt", "dir")}
+	if err := d.BulkImport(files); err != nil {
+		t.Fatal(err)
+	}
+	published := make(map[uint64]bool)
+	for len(changes) > 0 {
+		if c := <-changes; c.Kind == Created {
+			published[c.Inode] = true
+		}
+	}
+	inodes := make(map[string]uint64)
+	for _, f := range files {
+		var inode uint64
+		if err := d.get(fileIdToInodeKey(f.Id), &inode); err != nil {
+			t.Fatalf("%v imported without an inode: %v", f.Id, err)
+		}
+		if !published[inode] {
+			t.Errorf("importing %v published no change to its inode, %d", f.Id, inode)
+		}
+		inodes[f.Id] = inode
+	}
+
+	// The inodes, and those allocated, are kept across a reopen.
+	d.Close()
+	d = openTestDB(t, newFakeDrive(), dir, nil)
+	for id, inode := range inodes {
+		if got, err := d.FileByInode(inode); err != nil || got.Id != id {
+			t.Errorf("FileByInode(%d) = %v, %v after reopening, want %v", inode, got, err, id)
+		}
+	}
+	inode, err := d.InodeForFileId("new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, old := range inodes {
+		if inode == old {
+			t.Errorf("a new file was given the inode of %v, %d", id, old)
+		}
+	}
+}
+
+// BenchmarkBulkImport imports 10,000 new files to an empty db, to compare
+// with applying them as changes, in BenchmarkProcessChange.
+func BenchmarkBulkImport(b *testing.B) {
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		d := newTestDB(b, newFakeDrive(), nil)
+		files := make([]*gdrive.File, 10000)
+		for i := range files {
+			files[i] = testFile(fmt.Sprintf("file%05d", i), fmt.Sprintf("file %d.txt", i))
+		}
+		b.StartTimer()
+		if err := d.BulkImport(files); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
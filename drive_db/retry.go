@@ -0,0 +1,167 @@
+package drive_db
+
+// Retrying of Drive API calls which fail transiently.
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"code.google.com/p/goauth2/oauth"
+	"code.google.com/p/google-api-go-client/googleapi"
+)
+
+// maxRetryDelay caps the exponential backoff between retries.
+const maxRetryDelay = time.Minute
+
+// errorClass categorizes the errors returned by Drive API calls.
+type errorClass int
+
+const (
+	errFatal     errorClass = iota // not worth retrying
+	errRetryable                   // likely to succeed if retried later
+	errAuth                        // our credentials were rejected
+)
+
+// classifyError decides whether a failed API call is worth retrying.
+func classifyError(err error) errorClass {
+	switch {
+	case errors.Is(err, ErrAuth):
+		return errAuth
+	case errors.Is(err, ErrRateLimited):
+		return errRetryable
+	}
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		switch {
+		case gerr.Code == 429 || gerr.Code >= 500:
+			return errRetryable
+		case gerr.Code == 403 && isRateLimit(gerr):
+			// Drive reports per-user rate limiting as a 403.
+			return errRetryable
+		case gerr.Code == 401 || gerr.Code == 403 && isAuthReason(gerr):
+			// Other 403s, e.g. of quota or a file's permissions, are
+			// refusals of the request, not of our credentials.
+			return errAuth
+		}
+		return errFatal
+	}
+	if uerr, ok := err.(*url.Error); ok {
+		// The request didn't get a response. It's worth retrying if the
+		// connection failed or timed out, but not if the request was bad,
+		// Drive's certificate was, or the caller gave up on it.
+		var nerr net.Error
+		switch {
+		case isOAuthError(uerr.Err):
+			return errAuth
+		case errors.Is(uerr.Err, context.Canceled) || errors.Is(uerr.Err, context.DeadlineExceeded):
+			return errFatal
+		case uerr.Err == io.EOF || uerr.Err == io.ErrUnexpectedEOF:
+			// The connection was closed before the response.
+			return errRetryable
+		case errors.As(uerr.Err, &nerr):
+			return errRetryable
+		}
+		return classifyError(uerr.Err)
+	}
+	if nerr, ok := err.(net.Error); ok && (nerr.Timeout() || nerr.Temporary()) {
+		return errRetryable
+	}
+	if isOAuthError(err) {
+		return errAuth
+	}
+	return errFatal
+}
+
+// isOAuthError reports whether err is the oauth Transport's, e.g. because the
+// refresh token was revoked so no access token could be had.
+func isOAuthError(err error) bool {
+	switch err.(type) {
+	case oauth.OAuthError, *oauth.OAuthError:
+		return true
+	}
+	return false
+}
+
+func isRateLimit(gerr *googleapi.Error) bool {
+	msg := strings.ToLower(gerr.Message + gerr.Body)
+	return strings.Contains(msg, "ratelimitexceeded") || strings.Contains(msg, "rate limit exceeded")
+}
+
+// isAuthReason reports whether a 403 is of our credentials, e.g. lacking the
+// scope of the request, rather than of what they were used for.
+func isAuthReason(gerr *googleapi.Error) bool {
+	msg := strings.ToLower(gerr.Message + gerr.Body)
+	for _, reason := range []string{"autherror", "insufficientpermissions", "invalidcredentials"} {
+		if strings.Contains(msg, reason) {
+			return true
+		}
+	}
+	return false
+}
+
+// isChangeHistoryTooOld reports whether err is Drive refusing to list
+// changes from a start id it no longer has the history of.
+func isChangeHistoryTooOld(err error) bool {
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) || (gerr.Code != 400 && gerr.Code != 404) {
+		return false
+	}
+	msg := strings.ToLower(gerr.Message + gerr.Body)
+	return strings.Contains(msg, "startchangeid") || strings.Contains(msg, "change id")
+}
+
+// backoff returns how long to wait before the given retry attempt (counting
+// from 0): a random duration up to base * 2^attempt, capped at maxRetryDelay.
+func backoff(base time.Duration, attempt int) time.Duration {
+	max := base << uint(attempt)
+	if max <= 0 || max > maxRetryDelay {
+		max = maxRetryDelay
+	}
+	return time.Duration(rand.Int63n(int64(max))) + 1
+}
+
+// retry calls fn until it succeeds, fails with an error which isn't worth
+// retrying, or has been retried opts.SyncRetries times. Authentication
+// failures are reported to opts.OnAuthError.
+func (d *DriveDB) retry(what string, fn func() error) error {
+	return d.retryContext(context.Background(), what, fn)
+}
+
+// retryContext is retry, giving up once ctx is done.
+func (d *DriveDB) retryContext(ctx context.Context, what string, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		switch classifyError(err) {
+		case errAuth:
+			if d.opts.OnAuthError != nil {
+				d.opts.OnAuthError(err)
+			}
+		case errRetryable:
+			if attempt < d.opts.SyncRetries {
+				delay := backoff(d.opts.SyncRetryDelay, attempt)
+				d.opts.Logger.Warnf("%s failed: %v; retry %d in %v", what, err, attempt+1, delay)
+				select {
+				case <-time.After(delay):
+				case <-d.ctx.Done():
+					return apiError(err)
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				continue
+			}
+		}
+		return apiError(err)
+	}
+}
@@ -0,0 +1,78 @@
+package drive_db
+
+// The earlier revisions Drive keeps of a file's content.
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	gdrive "code.google.com/p/google-api-go-client/drive/v2"
+)
+
+// ErrNoRevisions is returned for files which have no revisions, i.e. folders.
+var ErrNoRevisions = fmt.Errorf("drive_db: file has no revisions")
+
+// Revisions returns the revisions Drive has of fileId's content, oldest
+// first.
+func (d *DriveDB) Revisions(fileId string) ([]*gdrive.Revision, error) {
+	if err := d.checkRevisions(fileId); err != nil {
+		return nil, err
+	}
+	var l *gdrive.RevisionList
+	err := d.retry("revisions.list", func() (err error) {
+		l, err = d.service.Revisions.List(fileId).Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return l.Items, nil
+}
+
+// RevisionContent returns the content of a revision of fileId. Revisions of
+// native Google files are exported, as the default export type for the file's
+// type. The caller must close the content.
+func (d *DriveDB) RevisionContent(fileId, revisionId string) (io.ReadCloser, error) {
+	if err := d.checkRevisions(fileId); err != nil {
+		return nil, err
+	}
+	var rev *gdrive.Revision
+	err := d.retry("revisions.get", func() (err error) {
+		rev, err = d.service.Revisions.Get(fileId, revisionId).Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	url := rev.DownloadUrl
+	if url == "" {
+		url = rev.ExportLinks[d.DefaultExportType(rev.MimeType)]
+	}
+	if url == "" {
+		return nil, fmt.Errorf("revision %v of %v can't be downloaded or exported", revisionId, fileId)
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	debug.Printf("downloading revision %v of %v", revisionId, fileId)
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("client.Do: %v", err)
+	}
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("RevisionContent: for revision %v of %v got HTTP status %v, want 200: %v", revisionId, fileId, resp.StatusCode, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// checkRevisions returns ErrNoRevisions if fileId is known to be a folder,
+// which includes the root and the synthetic folders.
+func (d *DriveDB) checkRevisions(fileId string) error {
+	if f, err := d.FileById(fileId); err == nil && f.MimeType == driveFolderMimeType {
+		return ErrNoRevisions
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package drive_db
+
+import (
+	"io/ioutil"
+	"testing"
+
+	gdrive "code.google.com/p/google-api-go-client/drive/v2"
+)
+
+func TestRevisions(t *testing.T) {
+	fd := newFakeDrive()
+	fd.file("f", "f.txt", "new")
+	fd.doc("doc", "doc", "text")
+	fd.folder("dir", "dir")
+	fd.mu.Lock()
+	fd.content["f-r1"] = []byte("old")
+	fd.revisions["f"] = []*gdrive.Revision{
+		{Id: "r1", MimeType: "text/plain", DownloadUrl: "https://fake.invalid/download/f-r1"},
+		{Id: "r2", MimeType: "text/plain", DownloadUrl: "https://fake.invalid/download/f"},
+	}
+	fd.revisions["doc"] = []*gdrive.Revision{{
+		Id:          "d1",
+		MimeType:    "application/vnd.google-apps.document",
+		ExportLinks: map[string]string{"application/pdf": "https://fake.invalid/export/doc?mimeType=application%2Fpdf"},
+	}}
+	fd.mu.Unlock()
+	d := newTestDB(t, fd, nil)
+
+	revs, err := d.Revisions("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, r := range revs {
+		ids = append(ids, r.Id)
+	}
+	if len(ids) != 2 || ids[0] != "r1" || ids[1] != "r2" {
+		t.Errorf("Revisions(f) = %v, want [r1 r2]", ids)
+	}
+
+	content := func(fileId, revisionId string) (string, error) {
+		rc, err := d.RevisionContent(fileId, revisionId)
+		if err != nil {
+			return "", err
+		}
+		defer rc.Close()
+		data, err := ioutil.ReadAll(rc)
+		return string(data), err
+	}
+	for _, tc := range []struct{ fileId, revisionId, want string }{
+		{"f", "r1", "old"},
+		{"f", "r2", "new"},
+		// Revisions of a Doc are exported as its default type.
+		{"doc", "d1", "application/pdf:text"},
+	} {
+		if got, err := content(tc.fileId, tc.revisionId); err != nil || got != tc.want {
+			t.Errorf("RevisionContent(%s, %s) = %q, %v, want %q", tc.fileId, tc.revisionId, got, err, tc.want)
+		}
+	}
+	if _, err := content("f", "r3"); err == nil {
+		t.Errorf("RevisionContent of a missing revision succeeded")
+	}
+
+	// Folders have none, which is known without asking Drive.
+	calls := fd.total()
+	if _, err := d.Revisions("dir"); err != ErrNoRevisions {
+		t.Errorf("Revisions(dir) = %v, want ErrNoRevisions", err)
+	}
+	if _, err := d.RevisionContent("dir", "r1"); err != ErrNoRevisions {
+		t.Errorf("RevisionContent(dir) = %v, want ErrNoRevisions", err)
+	}
+	if n := fd.total() - calls; n != 0 {
+		t.Errorf("asking for a folder's revisions made %d API calls", n)
+	}
+}
@@ -0,0 +1,107 @@
+package drive_db
+
+// The layout of the db is versioned, so an older db can be upgraded in place
+// when the layout changes, instead of being misread.
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// schemaVersion is the version of the db layout this code reads and writes.
+const schemaVersion = 7
+
+// migrations[v] upgrades a db from schema version v to v+1. To change the
+// layout, bump schemaVersion and append the function which converts a db.
+var migrations = []func(d *DriveDB) error{
+	// Version 0 dbs predate int:schema, but are otherwise laid out as
+	// version 1, so there's nothing to do.
+	0: func(d *DriveDB) error { return nil },
+	// Version 2 adds the md5 index.
+	1: (*DriveDB).reindexAll,
+	// Version 3 adds the index by modification time.
+	2: (*DriveDB).reindexAll,
+	// Version 4 adds the index of title words.
+	3: (*DriveDB).reindexAll,
+	// Version 5 gives files without a parent in the db one in .Orphaned.
+	4: (*DriveDB).adoptAllOrphans,
+	// Version 6 adds the index of starred files.
+	5: (*DriveDB).reindexAll,
+	// Version 7 keys cached download urls by durl:, rather than url:.
+	6: (*DriveDB).moveDownloadUrls,
+}
+
+func init() {
+	if len(migrations) != schemaVersion {
+		panic(fmt.Sprintf("drive_db: %d migrations for schema version %d", len(migrations), schemaVersion))
+	}
+}
+
+func schemaKey() []byte {
+	return internalKey("schema")
+}
+
+// schema is the record of a db's layout: its version, and the codec its
+// values are encoded with. It is always JSON, as it must be read before the
+// codec is known. Dbs which predate codecs recorded only their version, and
+// were written as JSON.
+type schema struct {
+	Version int
+	Codec   string
+}
+
+// readSchema returns the db's schema, and whether it has one recorded. A db
+// without one is version 0, and JSON.
+func (d *DriveDB) readSchema() (schema, bool, error) {
+	s := schema{Codec: JSONCodec.Name()}
+	data, err := d.db.Get(schemaKey(), nil)
+	switch {
+	case err == leveldb.ErrNotFound:
+		return s, false, nil
+	case err != nil:
+		return s, false, err
+	}
+	var rec schema
+	if JSONCodec.Decode(data, &rec) == nil && rec.Codec != "" {
+		return rec, true, nil
+	}
+	// Only a version, which may be unreadable too, making it version 0.
+	JSONCodec.Decode(data, &s.Version)
+	return s, true, nil
+}
+
+// migrate upgrades the db to schemaVersion, one version at a time. The
+// version is recorded after each step, so an interrupted migration resumes
+// where it stopped.
+func (d *DriveDB) migrate() error {
+	s, _, err := d.readSchema()
+	if err != nil {
+		return err
+	}
+	version := s.Version
+	if version > schemaVersion {
+		return fmt.Errorf("db has schema version %d, newer than %d which this version understands", version, schemaVersion)
+	}
+	for ; version < schemaVersion; version++ {
+		log.Printf("migrating db from schema version %d to %d", version, version+1)
+		if err := migrations[version](d); err != nil {
+			return fmt.Errorf("migration from schema version %d: %v", version, err)
+		}
+		if err := d.setSchemaVersion(version + 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setSchemaVersion records the db's schema version, along with its codec,
+// which checkCodec has made sure is d.opts.Codec.
+func (d *DriveDB) setSchemaVersion(version int) error {
+	bytes, err := JSONCodec.Encode(schema{Version: version, Codec: d.opts.Codec.Name()})
+	if err != nil {
+		return err
+	}
+	return d.db.Put(schemaKey(), bytes, nil)
+}
@@ -0,0 +1,85 @@
+package drive_db
+
+import (
+	"testing"
+)
+
+// schemaVersionOf returns the schema version recorded in d.
+func schemaVersionOf(t *testing.T, d *DriveDB) int {
+	t.Helper()
+	s, found, err := d.readSchema()
+	if err != nil || !found {
+		t.Fatalf("reading the schema version: %v, %v", found, err)
+	}
+	return s.Version
+}
+
+func TestMigrate(t *testing.T) {
+	last := migrations[schemaVersion-1]
+	defer func() { migrations[schemaVersion-1] = last }()
+	var ran int
+	migrations[schemaVersion-1] = func(d *DriveDB) error {
+		ran++
+		return d.db.Put([]byte("tst:key"), []byte("rewritten"), nil)
+	}
+
+	// A new db is created at the current version.
+	fd := newFakeDrive()
+	fd.file("a", "a.txt", "a")
+	d := newTestDB(t, fd, nil)
+	if v := schemaVersionOf(t, d); v != schemaVersion {
+		t.Fatalf("new db has schema version %d, want %d", v, schemaVersion)
+	}
+	if ran != 0 {
+		t.Errorf("opening a new db ran %d migrations", ran)
+	}
+
+	// A current db is left alone.
+	if err := d.migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if ran != 0 {
+		t.Errorf("migrating a current db ran %d migrations", ran)
+	}
+
+	// An older one is migrated, and its version recorded.
+	if err := d.setSchemaVersion(schemaVersion - 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if ran != 1 {
+		t.Errorf("migrating from version %d ran the last migration %d times, want once", schemaVersion-1, ran)
+	}
+	if v, err := d.db.Get([]byte("tst:key"), nil); err != nil || string(v) != "rewritten" {
+		t.Errorf("after migrating, tst:key = %q, %v, want rewritten", v, err)
+	}
+	if v := schemaVersionOf(t, d); v != schemaVersion {
+		t.Errorf("after migrating, schema version %d, want %d", v, schemaVersion)
+	}
+
+	// A db without a version is version 0, and is migrated from there
+	// without losing its files.
+	migrations[schemaVersion-1] = last
+	if err := d.db.Delete(schemaKey(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if v := schemaVersionOf(t, d); v != schemaVersion {
+		t.Errorf("after migrating from version 0, schema version %d, want %d", v, schemaVersion)
+	}
+	if ids, err := d.FileIdsByMd5(fd.get("a").Md5Checksum); err != nil || len(ids) != 1 {
+		t.Errorf("after migrating from version 0, FileIdsByMd5 = %v, %v, want [a]", ids, err)
+	}
+
+	// A db newer than the code is refused.
+	if err := d.setSchemaVersion(schemaVersion + 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.migrate(); err == nil {
+		t.Errorf("migrating a db of a newer schema version succeeded")
+	}
+}
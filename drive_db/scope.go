@@ -0,0 +1,288 @@
+package drive_db
+
+// With SyncRoots set, only the folders it lists, and the files under them,
+// are kept in the db. The sync roots are presented as folders in the root.
+//
+// The change feed lists changes to every file, in no particular order of
+// folders and their contents, so a file's scope is decided by its parents: it
+// is in scope if one of them is a sync root or already in the db. When a
+// folder enters the db, by being created in scope, being moved into it, or
+// being a sync root seen for the first time, its contents are listed from
+// Drive, as changes to them may already have been skipped. The folder is
+// marked with a fil: key in the batch adding it, and listed once that's
+// written, without holding resyncmu, so a crash before it's filled leaves it
+// to be filled after the next change. When a file in the db is moved out of
+// scope, it is removed, along with those files under it which have no other
+// parent in scope.
+//
+// Changing SyncRoots takes effect for files as they next change, or for all
+// of them at the next FullResync.
+
+import (
+	"fmt"
+	"time"
+
+	gdrive "code.google.com/p/google-api-go-client/drive/v2"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// scoped reports whether the db is restricted to SyncRoots.
+func (d *DriveDB) scoped() bool {
+	return len(d.opts.SyncRoots) > 0
+}
+
+// isSyncRoot reports whether fileId is one of SyncRoots.
+func (d *DriveDB) isSyncRoot(fileId string) bool {
+	for _, id := range d.opts.SyncRoots {
+		if id == fileId {
+			return true
+		}
+	}
+	return false
+}
+
+// inScope reports whether f is to be kept in the db: always, unless the db is
+// scoped, and otherwise if it's a sync root, or one of its parents is, or is
+// in the db, or in added, the files added by a batch not yet written.
+func (d *DriveDB) inScope(f *gdrive.File, added map[string]bool) bool {
+	if !d.scoped() || d.isSyncRoot(f.Id) {
+		return true
+	}
+	return hasParentIn(f, func(fileId string) bool {
+		if _, special := d.specialInode(fileId); special {
+			return false
+		}
+		return d.isSyncRoot(fileId) || added[fileId] || d.hasFile(fileId)
+	})
+}
+
+// asSyncRoot returns a copy of the sync root f, placed in the root folder in
+// place of its own parents.
+func (d *DriveDB) asSyncRoot(f *gdrive.File) *gdrive.File {
+	r := *f
+	r.Parents = []*gdrive.ParentReference{&gdrive.ParentReference{Id: d.rootId}}
+	return &r
+}
+
+// storeListed adds to batch f, as listed from Drive rather than by a change,
+// unless it isn't kept at all. It reports whether f was added.
+func (d *DriveDB) storeListed(batch *leveldb.Batch, f *gdrive.File) (bool, error) {
+	if d.dropHidden(f) {
+		return false, nil
+	}
+	if f.Labels != nil && f.Labels.Trashed && d.opts.TrashMode == Quarantine {
+		f = inTrash(f)
+	}
+	if d.scoped() && d.isSyncRoot(f.Id) {
+		f = d.asSyncRoot(f)
+	}
+	if _, err := d.UpdateFile(batch, f); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// fillScope adds to batch the files under folderId, listed from Drive, adding
+// their fileIds to added. Folders already in added are taken to have been
+// filled already.
+func (d *DriveDB) fillScope(batch *leveldb.Batch, folderId string, added map[string]bool) error {
+	files, err := d.listFolder(folderId)
+	if err != nil {
+		return err
+	}
+	var folders []string
+	for _, f := range files {
+		if added[f.Id] {
+			continue
+		}
+		ok, err := d.storeListed(batch, f)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		added[f.Id] = true
+		if f.MimeType == driveFolderMimeType {
+			folders = append(folders, f.Id)
+		}
+	}
+	for _, id := range folders {
+		if err := d.fillScope(batch, id, added); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listFolder returns the files in folderId, as listed by Drive.
+func (d *DriveDB) listFolder(folderId string) ([]*gdrive.File, error) {
+	q := fmt.Sprintf("'%s' in parents", folderId)
+	if d.opts.TrashMode == Drop {
+		q += " and trashed = false"
+	}
+	l := d.service.Files.List().MaxResults(1000).Q(q)
+	var files []*gdrive.File
+	for {
+		var fl *gdrive.FileList
+		err := d.retry("files.list", func() (err error) {
+			fl, err = l.Do()
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, fl.Items...)
+		if fl.NextPageToken == "" {
+			return files, nil
+		}
+		l.PageToken(fl.NextPageToken)
+	}
+}
+
+// fillKey is the key marking folderId as having entered the scope, but not
+// yet been filled.
+func fillKey(folderId string) []byte {
+	return []byte("fil:" + folderId)
+}
+
+// findUnfilled notes whether a crash has left folders marked by fillKey, so
+// the db isn't reported synced until they're filled.
+func (d *DriveDB) findUnfilled() error {
+	var found bool
+	err := d.scan("fil:", func(key, value []byte) { found = true })
+	d.Lock()
+	d.unfilled = d.unfilled || found
+	d.Unlock()
+	return err
+}
+
+// fillFolders lists the files under each folder marked by fillKey from
+// Drive, and adds them to the db. The listing is made without holding
+// resyncmu, so neither applying changes nor a FullResync waits on it. The
+// db isn't synced until it's done.
+func (d *DriveDB) fillFolders() error {
+	if !d.scoped() {
+		return nil
+	}
+	var ids []string
+	err := d.scan("fil:", func(key, value []byte) {
+		ids = append(ids, string(key[len("fil:"):]))
+	})
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		d.Lock()
+		resynced := d.lastResync
+		d.Unlock()
+		var files []*gdrive.File
+		if err := d.listSubtree(id, &files, map[string]bool{id: true}); err != nil {
+			return err
+		}
+		d.resyncmu.Lock()
+		err := d.fillFolder(id, files, resynced)
+		d.resyncmu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	d.Lock()
+	d.unfilled = false
+	d.Unlock()
+	return nil
+}
+
+// listSubtree appends the files under folderId, listed from Drive, to files,
+// each folder's before those in it. Folders in seen aren't listed again.
+func (d *DriveDB) listSubtree(folderId string, files *[]*gdrive.File, seen map[string]bool) error {
+	listed, err := d.listFolder(folderId)
+	if err != nil {
+		return err
+	}
+	*files = append(*files, listed...)
+	for _, f := range listed {
+		if f.MimeType != driveFolderMimeType || seen[f.Id] {
+			continue
+		}
+		seen[f.Id] = true
+		if err := d.listSubtree(f.Id, files, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fillFolder adds files, listed from under folderId, to the db, then drops
+// folderId's fillKey. Files changed since they were listed are left as they
+// are, as are all of them if the folder has left the db, or a FullResync,
+// which lists them itself, has begun since resynced. resyncmu must be held.
+func (d *DriveDB) fillFolder(folderId string, files []*gdrive.File, resynced time.Time) error {
+	d.Lock()
+	stale := !d.lastResync.Equal(resynced)
+	d.Unlock()
+	if !stale && d.hasFile(folderId) {
+		if err := d.bulkImport(new(leveldb.Batch), d.newerFiles(files), make(map[string]bool)); err != nil {
+			return err
+		}
+	}
+	return d.db.Delete(fillKey(folderId), nil)
+}
+
+// resyncScope adds to batch each sync root and the files under it, listed
+// from Drive, adding their fileIds to added.
+func (d *DriveDB) resyncScope(batch *leveldb.Batch, added map[string]bool) error {
+	for _, id := range d.opts.SyncRoots {
+		var f *gdrive.File
+		err := d.retry("files.get", func() (err error) {
+			f, err = d.service.Files.Get(id).Do()
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("sync root %v: %v", id, err)
+		}
+		ok, err := d.storeListed(batch, f)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		added[id] = true
+		if err := d.fillScope(batch, id, added); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeSubtree adds to batch the removal of the files under fileId, which
+// is being removed, apart from those with another parent still in the db.
+func (d *DriveDB) removeSubtree(batch *leveldb.Batch, fileId string) error {
+	removed := map[string]bool{fileId: true}
+	var remove func(folderId string) error
+	remove = func(folderId string) error {
+		ids, err := d.ChildFileIds(folderId)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			f, err := d.FileById(id)
+			if err != nil || removed[id] {
+				continue
+			}
+			if hasParentIn(f, func(pId string) bool { return !removed[pId] && d.hasFile(pId) }) {
+				continue
+			}
+			removed[id] = true
+			if err := d.RemoveFileById(id, batch); err != nil {
+				return err
+			}
+			if err := remove(id); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return remove(fileId)
+}
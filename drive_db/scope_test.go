@@ -0,0 +1,106 @@
+package drive_db
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	gdrive "code.google.com/p/google-api-go-client/drive/v2"
+)
+
+func TestSyncRoots(t *testing.T) {
+	fd := newFakeDrive()
+	fd.folder("proj", "proj")
+	fd.folder("sub", "sub", "proj")
+	fd.folder("other", "other")
+	fd.mu.Lock()
+	folders := len(fd.changes)
+	fd.mu.Unlock()
+	fd.file("a", "a.txt", "a", "proj")
+	fd.file("b", "b.txt", "b", "sub")
+	fd.file("c", "c.txt", "c", "other")
+	fd.file("x", "x.txt", "x")
+	// The changes to the files are lost, as if they'd been skipped, so
+	// they're only found by listing their folders.
+	fd.mu.Lock()
+	for i, c := range fd.changes[folders:] {
+		fd.changes[folders+i] = removal(c.Id, "never-synced")
+	}
+	fd.mu.Unlock()
+	d := newTestDB(t, fd, &DriveDBOptions{SyncRoots: []string{"proj"}})
+
+	stored := func(when string, want map[string]bool) {
+		t.Helper()
+		for id, in := range want {
+			if _, err := d.FileById(id); (err == nil) != in {
+				t.Errorf("%s, %s stored = %v, want %v", when, id, err == nil, in)
+			}
+		}
+	}
+	stored("after the initial sync", map[string]bool{
+		"proj": true, "sub": true, "a": true, "b": true,
+		"other": false, "c": false, "x": false,
+	})
+	if f, err := d.FileByPath("/proj/sub/b.txt"); err != nil || f.Id != "b" {
+		t.Errorf("FileByPath(/proj/sub/b.txt) = %v, %v, want b", f, err)
+	}
+
+	// A change to a file outside the roots isn't stored.
+	fd.file("y", "y.txt", "y", "other")
+	resync(t, d, fd)
+	stored("after adding a file outside the roots", map[string]bool{"y": false})
+
+	// A folder moved into scope is listed, without holding up the sync.
+	var held int32
+	fd.setBefore(func(op string, req *http.Request) error {
+		if op == "files.list" {
+			if d.resyncmu.TryLock() {
+				d.resyncmu.Unlock()
+			} else {
+				atomic.StoreInt32(&held, 1)
+			}
+		}
+		return nil
+	})
+	defer fd.setBefore(nil)
+	fd.update("other", func(f *gdrive.File) { f.Parents = []*gdrive.ParentReference{{Id: "proj"}} })
+	resync(t, d, fd)
+	stored("after moving a folder into the roots", map[string]bool{"other": true, "c": true, "y": true})
+	if atomic.LoadInt32(&held) != 0 {
+		t.Errorf("a folder entering the roots was listed while holding resyncmu")
+	}
+	if marked, _ := d.db.Has(fillKey("other"), nil); marked {
+		t.Errorf("a filled folder is still marked to be filled")
+	}
+
+	// One moved out is removed, with its contents.
+	fd.update("sub", func(f *gdrive.File) { f.Parents = []*gdrive.ParentReference{{Id: "root"}} })
+	resync(t, d, fd)
+	stored("after moving a folder out of the roots", map[string]bool{"sub": false, "b": false, "a": true})
+}
+
+func TestFillAfterCrash(t *testing.T) {
+	fd := newFakeDrive()
+	fd.folder("proj", "proj")
+	fd.folder("dir", "dir", "proj")
+	d := newTestDB(t, fd, &DriveDBOptions{SyncRoots: []string{"proj"}})
+
+	// A crash after a folder's added, before it's filled, leaves it
+	// marked, to be filled after the next change.
+	fd.mu.Lock()
+	fd.files["lost"] = &gdrive.File{Id: "lost", Title: "lost.txt", MimeType: "text/plain", Version: 1,
+		Labels: &gdrive.FileLabels{}, Parents: []*gdrive.ParentReference{{Id: "dir"}}}
+	fd.mu.Unlock()
+	if err := d.db.Put(fillKey("dir"), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	// As opening the db after the crash does.
+	if err := d.findUnfilled(); err != nil {
+		t.Fatal(err)
+	}
+	fd.file("next", "next.txt", "n", "proj")
+	resync(t, d, fd)
+	if _, err := d.FileByPath("/proj/dir/lost.txt"); err != nil {
+		t.Errorf("after a change following a crash, FileByPath(/proj/dir/lost.txt): %v", err)
+	}
+}
@@ -0,0 +1,124 @@
+package drive_db
+
+// Drive shortcuts are files pointing at another file, like symlinks. This
+// version of the Drive client doesn't decode a shortcut's shortcutDetails, so
+// its target is fetched separately the first time it's needed, and kept in
+// the db; a shortcut's target can't be changed.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"code.google.com/p/google-api-go-client/googleapi"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+const driveShortcutMimeType = "application/vnd.google-apps.shortcut"
+
+// ErrDanglingShortcut is returned for shortcuts whose target isn't in the db,
+// e.g. because it was deleted or isn't shared with us.
+var ErrDanglingShortcut = fmt.Errorf("drive_db: shortcut target not found")
+
+func shortcutKey(fileId string) []byte {
+	return []byte("sct:" + fileId)
+}
+
+// IsShortcut reports whether f is a Drive shortcut.
+func (f *File) IsShortcut() bool {
+	return f.MimeType == driveShortcutMimeType
+}
+
+// ShortcutTargetId returns the fileId of the target of f, if f is a shortcut
+// whose target is known. Use DriveDB.ShortcutTarget to look it up otherwise.
+func (f *File) ShortcutTargetId() (string, bool) {
+	return f.ShortcutTarget, f.IsShortcut() && f.ShortcutTarget != ""
+}
+
+// ShortcutTarget returns the target of the shortcut f, fetching its fileId
+// from Drive if it isn't known yet. It returns ErrDanglingShortcut if the
+// target isn't in the db.
+func (d *DriveDB) ShortcutTarget(f *File) (*File, error) {
+	if !f.IsShortcut() {
+		return nil, fmt.Errorf("%v is not a shortcut", f.Id)
+	}
+	targetId, ok := f.ShortcutTargetId()
+	if !ok {
+		v, err := d.sf.Do("shortcut:"+f.Id, func() (interface{}, error) {
+			return d.shortcutTargetId(f.Id)
+		})
+		if err != nil {
+			return nil, err
+		}
+		targetId = v.(string)
+	}
+	target, err := d.FileByFileId(targetId)
+	if err != nil {
+		return nil, ErrDanglingShortcut
+	}
+	return target, nil
+}
+
+// shortcutTargetId returns the target fileId of the shortcut fileId, from the
+// db, or else from Drive, storing it in the db.
+func (d *DriveDB) shortcutTargetId(fileId string) (string, error) {
+	var targetId string
+	if err := d.get(shortcutKey(fileId), &targetId); err == nil {
+		return targetId, nil
+	}
+
+	url := fmt.Sprintf("https://www.googleapis.com/drive/v2/files/%s?fields=shortcutDetails%%2FtargetId", fileId)
+	var details struct {
+		ShortcutDetails struct {
+			TargetId string `json:"targetId"`
+		} `json:"shortcutDetails"`
+	}
+	err := d.retry("files.get", func() error {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := d.api.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if err := googleapi.CheckResponse(resp); err != nil {
+			return err
+		}
+		return json.NewDecoder(resp.Body).Decode(&details)
+	})
+	if err != nil {
+		return "", err
+	}
+	targetId = details.ShortcutDetails.TargetId
+	if targetId == "" {
+		return "", ErrDanglingShortcut
+	}
+
+	if !d.opts.ReadOnly {
+		bytes, err := d.encode(targetId)
+		if err != nil {
+			return "", err
+		}
+		batch := new(leveldb.Batch)
+		batch.Put(shortcutKey(fileId), bytes)
+		if err := d.db.Write(batch, nil); err != nil {
+			return "", err
+		}
+		// Cached *Files of the shortcut don't know its target yet.
+		d.FlushCachedInodeForFileId(fileId)
+	}
+	return targetId, nil
+}
+
+// loadFileExtras fills in the fields of file kept under keys of their own,
+// using get to read them.
+func loadFileExtras(get func(key []byte, item interface{}) error, file *File) {
+	if file.IsNative() {
+		get(exportSizeKey(file.Id), &file.ExportSize)
+	}
+	if file.IsShortcut() {
+		get(shortcutKey(file.Id), &file.ShortcutTarget)
+	}
+}
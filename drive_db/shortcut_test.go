@@ -0,0 +1,56 @@
+package drive_db
+
+import (
+	"testing"
+)
+
+func TestShortcutTarget(t *testing.T) {
+	fd := newFakeDrive()
+	fd.folder("dir", "dir")
+	fd.file("target", "target.txt", "t", "dir")
+	fd.shortcut("link", "link", "target")
+	fd.shortcut("dangling", "dangling", "gone")
+	d := newTestDB(t, fd, nil)
+	file := func(id string) *File {
+		t.Helper()
+		inode, err := d.InodeForFileId(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := d.FileByInode(inode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+
+	link := file("link")
+	if !link.IsShortcut() {
+		t.Fatalf("a shortcut isn't IsShortcut")
+	}
+	if _, ok := link.ShortcutTargetId(); ok {
+		t.Errorf("a shortcut's target is known before it's been fetched")
+	}
+	target, err := d.ShortcutTarget(link)
+	if err != nil || target.Id != "target" {
+		t.Fatalf("ShortcutTarget(link) = %v, %v, want target", target, err)
+	}
+	// The target is kept, so needn't be fetched again.
+	calls := fd.total()
+	if id, ok := file("link").ShortcutTargetId(); !ok || id != "target" {
+		t.Errorf("ShortcutTargetId() = %q, %v, want target", id, ok)
+	}
+	if target, err := d.ShortcutTarget(file("link")); err != nil || target.Id != "target" {
+		t.Errorf("ShortcutTarget(link), again = %v, %v, want target", target, err)
+	}
+	if n := fd.total() - calls; n != 0 {
+		t.Errorf("finding a known target made %d API calls", n)
+	}
+
+	if _, err := d.ShortcutTarget(file("dangling")); err != ErrDanglingShortcut {
+		t.Errorf("ShortcutTarget(dangling) = %v, want ErrDanglingShortcut", err)
+	}
+	if _, err := d.ShortcutTarget(file("target")); err == nil {
+		t.Errorf("ShortcutTarget of a file which isn't a shortcut succeeded")
+	}
+}
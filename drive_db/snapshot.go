@@ -0,0 +1,187 @@
+package drive_db
+
+// Snapshots give a consistent view of the db, unaffected by changes committed
+// while it's being read, e.g. for the duration of a directory listing.
+
+import (
+	"fmt"
+	"sync"
+
+	gdrive "code.google.com/p/google-api-go-client/drive/v2"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// DriveDBSnapshot is a read-only view of a DriveDB at a point in time.
+// It must be released, and Close waits until it is.
+type DriveDBSnapshot struct {
+	d    *DriveDB
+	snap *leveldb.Snapshot
+	once sync.Once
+}
+
+// Snapshot returns a view of the db as it is now.
+func (d *DriveDB) Snapshot() (*DriveDBSnapshot, error) {
+	d.Lock()
+	if d.closed {
+		d.Unlock()
+		return nil, ErrClosed
+	}
+	d.iters.Add(1)
+	d.itersOpen++
+	d.Unlock()
+	snap, err := d.db.GetSnapshot()
+	if err != nil {
+		d.iterReleased()
+		return nil, err
+	}
+	if debug {
+		d.Lock()
+		d.trackOpen(snap)
+		d.Unlock()
+	}
+	return &DriveDBSnapshot{d: d, snap: snap}, nil
+}
+
+// Release releases the snapshot. It may be called more than once.
+func (s *DriveDBSnapshot) Release() {
+	s.once.Do(func() {
+		s.snap.Release()
+		if debug {
+			s.d.trackRelease(s.snap)
+		}
+		s.d.iterReleased()
+	})
+}
+
+func (s *DriveDBSnapshot) get(key []byte, item interface{}) error {
+	data, err := s.snap.Get(key, nil)
+	if err != nil {
+		return dbError(err)
+	}
+	return s.d.decode(data, item)
+}
+
+// FileById returns the gdrive.File of fileId, as it was in the snapshot.
+func (s *DriveDBSnapshot) FileById(fileId string) (*gdrive.File, error) {
+	var res gdrive.File
+	err := s.get(fileKey(fileId), &res)
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// ChildFileIds returns the IDs of the children of fileId, as they were in
+// the snapshot.
+func (s *DriveDBSnapshot) ChildFileIds(fileId string) ([]string, error) {
+	if fileId == starredFileId {
+		return s.starredFileIds()
+	}
+	var ids []string
+	iter := s.snap.NewIterator(util.BytesPrefix(childKeyPrefix(fileId)), nil)
+	for iter.Next() {
+		pidcid := deKey(string(iter.Key()))
+		cid := pidcid[len(fileId)+1:]
+		found, err := s.snap.Has(fileKey(cid), nil)
+		if err == nil && found && !(fileId == orphanFileId && s.adopted(cid)) {
+			ids = append(ids, cid)
+		}
+	}
+	iter.Release()
+	return ids, iter.Error()
+}
+
+// starredFileIds is DriveDB.StarredFileIds, as of the snapshot.
+func (s *DriveDBSnapshot) starredFileIds() ([]string, error) {
+	var ids []string
+	prefix := starKey("")
+	iter := s.snap.NewIterator(util.BytesPrefix(prefix), nil)
+	for iter.Next() {
+		ids = append(ids, string(iter.Key()[len(prefix):]))
+	}
+	iter.Release()
+	return ids, iter.Error()
+}
+
+// adopted is DriveDB.adopted, as of the snapshot.
+func (s *DriveDBSnapshot) adopted(fileId string) bool {
+	f, err := s.FileById(fileId)
+	return err == nil && hasParentIn(f, func(id string) bool {
+		found, err := s.snap.Has(fileKey(id), nil)
+		return err == nil && found
+	})
+}
+
+// FileByInode returns the *File of an inode, as it was in the snapshot.
+// Children which had no inode yet are left out.
+func (s *DriveDBSnapshot) FileByInode(inode uint64) (*File, error) {
+	var fileId string
+	if err := s.get(inodeToFileIdKey(inode), &fileId); err != nil {
+		return nil, err
+	}
+	f, err := s.FileById(fileId)
+	if err != nil {
+		return nil, fmt.Errorf("unknown fileId %v: %v", fileId, err)
+	}
+	file := &File{File: f, Inode: inode}
+	loadFileExtras(s.get, file)
+	childFileIds, err := s.ChildFileIds(fileId)
+	if err != nil {
+		return nil, fmt.Errorf("error getting children of fileId %v: %v", fileId, err)
+	}
+	for _, cid := range childFileIds {
+		cInode, err := s.inodeForFileId(cid)
+		if err != nil {
+			continue
+		}
+		file.Children = append(file.Children, cInode)
+	}
+	return file, nil
+}
+
+// inodeForFileId returns the inode of fileId, if it had one in the snapshot.
+func (s *DriveDBSnapshot) inodeForFileId(fileId string) (uint64, error) {
+	if special, ok := s.d.specialInode(fileId); ok {
+		return special, nil
+	}
+	var inode uint64
+	err := s.get(fileIdToInodeKey(fileId), &inode)
+	return inode, err
+}
+
+// ChildrenWithUniqueNames is DriveDB.ChildrenWithUniqueNames, as of the
+// snapshot. Only the children's own records are read, so their Children
+// aren't loaded. Children which had no inode yet are left out.
+func (s *DriveDBSnapshot) ChildrenWithUniqueNames(fileId string) (map[string]*File, error) {
+	childFileIds, err := s.ChildFileIds(fileId)
+	if err != nil {
+		return nil, err
+	}
+	children := make([]*File, 0, len(childFileIds))
+	for _, cid := range childFileIds {
+		cInode, err := s.inodeForFileId(cid)
+		if err != nil {
+			continue
+		}
+		f, err := s.FileById(cid)
+		if err != nil {
+			return nil, err
+		}
+		file := &File{File: f, Inode: cInode}
+		loadFileExtras(s.get, file)
+		children = append(children, file)
+	}
+	return uniqueNames(children, func(f *File) (string, string) {
+		return s.d.nameWithExtension(f, s.exportFormat(f.Id))
+	}), nil
+}
+
+// exportFormat is DriveDB.ExportFormat, as of the snapshot.
+func (s *DriveDBSnapshot) exportFormat(fileId string) string {
+	mimeType, err := s.snap.Get(exportFormatKey(fileId), nil)
+	if err != nil {
+		return ""
+	}
+	return string(mimeType)
+}
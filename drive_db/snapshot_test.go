@@ -0,0 +1,44 @@
+package drive_db
+
+import (
+	"testing"
+)
+
+func TestSnapshotChildrenWithUniqueNames(t *testing.T) {
+	fd := newFakeDrive()
+	fd.folder("x", "x")
+	fd.folder("y", "y", "x")
+	fd.file("a", "a.txt", "a", "x")
+	fd.file("b", "b.txt", "b", "y")
+	d := newTestDB(t, fd, nil)
+	// Give b an inode, so y has a child to load.
+	if _, err := d.InodeForFileId("b"); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := d.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Release()
+	// Changes after the snapshot aren't seen.
+	apply(t, d, testFile("c", "c.txt", "x"))
+
+	children, err := snap.ChildrenWithUniqueNames("x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(children) != 2 || children["a.txt"] == nil || children["y"] == nil {
+		t.Fatalf("ChildrenWithUniqueNames(x) = %v, want a.txt and y", children)
+	}
+	for name, f := range children {
+		inode, err := d.InodeForFileId(f.Id)
+		if err != nil || f.Inode != inode {
+			t.Errorf("%s has inode %d, want %d", name, f.Inode, inode)
+		}
+	}
+	// The grandchildren aren't loaded.
+	if y := children["y"]; len(y.Children) != 0 {
+		t.Errorf("y has Children %v loaded", y.Children)
+	}
+}
@@ -0,0 +1,81 @@
+package drive_db
+
+// Listing a folder's children in an order useful for display.
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	gdrive "code.google.com/p/google-api-go-client/drive/v2"
+)
+
+// SortKey selects the order of ChildFileIdsSorted. Ties are broken by fileId,
+// so the order is always the same for the same children.
+type SortKey int
+
+const (
+	ByFileId   SortKey = iota // by fileId alone
+	ByTitle                   // by title, ignoring case
+	ByModified                // by modification time, oldest first
+)
+
+func (k SortKey) String() string {
+	switch k {
+	case ByFileId:
+		return "fileid"
+	case ByTitle:
+		return "title"
+	case ByModified:
+		return "modified"
+	}
+	return "unknown"
+}
+
+// ChildFileIdsSorted returns the fileIds of the children of fileId, as
+// ChildFileIds does, in the order selected by by.
+func (d *DriveDB) ChildFileIdsSorted(fileId string, by SortKey) ([]string, error) {
+	ids, err := d.ChildFileIds(fileId)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]*gdrive.File, 0, len(ids))
+	for _, id := range ids {
+		f, err := d.FileById(id)
+		if err != nil {
+			continue // removed since
+		}
+		files = append(files, f)
+	}
+	sort.Sort(&sortedFiles{files, by})
+	ids = ids[:0]
+	for _, f := range files {
+		ids = append(ids, f.Id)
+	}
+	return ids, nil
+}
+
+type sortedFiles struct {
+	files []*gdrive.File
+	by    SortKey
+}
+
+func (s *sortedFiles) Len() int      { return len(s.files) }
+func (s *sortedFiles) Swap(i, j int) { s.files[i], s.files[j] = s.files[j], s.files[i] }
+
+func (s *sortedFiles) Less(i, j int) bool {
+	a, b := s.files[i], s.files[j]
+	switch s.by {
+	case ByTitle:
+		if at, bt := strings.ToLower(a.Title), strings.ToLower(b.Title); at != bt {
+			return at < bt
+		}
+	case ByModified:
+		am, _ := time.Parse(time.RFC3339Nano, a.ModifiedDate)
+		bm, _ := time.Parse(time.RFC3339Nano, b.ModifiedDate)
+		if !am.Equal(bm) {
+			return am.Before(bm)
+		}
+	}
+	return a.Id < b.Id
+}
@@ -0,0 +1,38 @@
+package drive_db
+
+import (
+	"reflect"
+	"testing"
+
+	gdrive "code.google.com/p/google-api-go-client/drive/v2"
+)
+
+func TestChildFileIdsSorted(t *testing.T) {
+	d := newTestDB(t, newFakeDrive(), nil)
+	file := func(id, title, modified string) *gdrive.File {
+		f := testFile(id, title, "dir")
+		f.ModifiedDate = modified
+		return f
+	}
+	apply(t, d,
+		testFolder("dir", "dir"),
+		file("a", "Gamma", "2014-01-01T00:00:00.000Z"),
+		file("b", "beta", "2014-01-03T00:00:00.000Z"),
+		file("c", "ALPHA", "2014-01-02T00:00:00.000Z"),
+		// The same time as a's, in another zone.
+		file("d", "alpha", "2014-01-01T01:00:00+01:00"),
+	)
+
+	for _, tc := range []struct {
+		by   SortKey
+		want []string
+	}{
+		{ByFileId, []string{"a", "b", "c", "d"}},
+		{ByTitle, []string{"c", "d", "b", "a"}}, // c and d only differ in case
+		{ByModified, []string{"a", "d", "c", "b"}},
+	} {
+		if got, err := d.ChildFileIdsSorted("dir", tc.by); err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("ChildFileIdsSorted(dir, %v) = %v, %v, want %v", tc.by, got, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+package drive_db
+
+// Writes may be staged in a local copy of a file, rather than streamed to
+// Drive as they're made, so that the file can be written at any offset, and
+// read back, before it's uploaded. The copy is kept in the data cache
+// directory until every writer is done with it and it has been uploaded. Once
+// it's first written, it's recorded in the db until it's uploaded, so writes
+// which never were, e.g. as the process crashed, are uploaded once the db is
+// next opened and synced, unless the file has changed in Drive since. Copies
+// which are only opened are never uploaded.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+
+	gdrive "code.google.com/p/google-api-go-client/drive/v2"
+)
+
+// ErrNotStaged is returned by CommitStaged and ReleaseStaged for an inode
+// with no StageWrite outstanding.
+var ErrNotStaged = fmt.Errorf("drive_db: not staged")
+
+// stage is the staged copy of a file, shared by all its writers.
+type stage struct {
+	sync.Mutex // held while filling and uploading the copy
+	fileId     string
+	path       string
+	writers    int    // StageWrites not yet released; guarded by DriveDB.stagemu
+	ready      bool   // the copy has been filled
+	dirty      bool   // the copy has writes not yet uploaded, as far as we know
+	md5        string // of the content in Drive the copy was filled from or uploaded
+}
+
+// staged is kept in the db under stg:<fileId> while a file's staged copy has
+// writes not yet uploaded.
+type staged struct {
+	Md5 string // of the content in Drive the copy was last filled from or uploaded
+}
+
+func stageKey(fileId string) []byte {
+	return []byte("stg:" + fileId)
+}
+
+// stagePath returns where the staged copy of fileId is kept.
+func (d *DriveDB) stagePath(fileId string) string {
+	return path.Join(d.data, "staging", fileId)
+}
+
+// StageWrite returns the staged copy of the file at inode, open for reading
+// and writing, filling it with the file's content if it isn't staged already.
+// Writers of the same inode share the copy, so see each other's writes. Each
+// change to the copy must be preceded by a DirtyStaged, and the copy is
+// uploaded by CommitStaged if it has changed since it was last uploaded. Each
+// StageWrite must be followed by a ReleaseStaged once its writer is done.
+// Native Google files can't be staged.
+func (d *DriveDB) StageWrite(inode uint64) (*os.File, error) {
+	if d.opts.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	f, err := d.FileByInode(inode)
+	if err != nil {
+		return nil, err
+	}
+	if f.IsDir() || f.IsNative() || f.IsShortcut() {
+		return nil, fmt.Errorf("can't stage writes to %v, of type %v", f.Id, f.MimeType)
+	}
+
+	d.stagemu.Lock()
+	if d.stages == nil {
+		d.stages = make(map[uint64]*stage)
+	}
+	s := d.stages[inode]
+	if s == nil {
+		s = &stage{fileId: f.Id, path: d.stagePath(f.Id)}
+		d.stages[inode] = s
+	}
+	s.writers++
+	d.stagemu.Unlock()
+
+	s.Lock()
+	if !s.ready {
+		err = d.fillStage(s, f)
+		s.ready = err == nil
+	}
+	var sf *os.File
+	if err == nil {
+		sf, err = os.OpenFile(s.path, os.O_RDWR, 0600)
+	}
+	s.Unlock()
+	if err != nil {
+		d.ReleaseStaged(inode)
+		return nil, err
+	}
+	return sf, nil
+}
+
+// fillStage copies the content of f into its staged copy, unless one with
+// writes not yet uploaded was left, e.g. by a crash, from the content f still
+// has in Drive.
+func (d *DriveDB) fillStage(s *stage, f *File) error {
+	var st staged
+	if err := d.get(stageKey(f.Id), &st); err == nil {
+		if _, err := os.Stat(s.path); err == nil {
+			if st.Md5 == f.Md5Checksum {
+				s.dirty = true
+				s.md5 = st.Md5
+				return nil
+			}
+			d.setAsideStage(f.Id)
+		}
+	}
+
+	if err := os.MkdirAll(path.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	tmp, err := os.OpenFile(s.path+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	err = d.copyContent(tmp, f)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("staging %v: %v", f.Id, err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+	s.md5 = f.Md5Checksum
+	return d.db.Delete(stageKey(f.Id), nil)
+}
+
+// copyContent writes the content of f, as Drive has it now, to w.
+func (d *DriveDB) copyContent(w io.Writer, f *File) error {
+	if f.FileSize == 0 {
+		return nil
+	}
+	rc, err := d.OpenRange(f, 0, 0)
+	var rerr *ErrRangeIgnored
+	if errors.As(err, &rerr) {
+		rc, err = rerr.Body, nil // the whole file is what we want anyway
+	}
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = io.Copy(w, rc)
+	return err
+}
+
+// DirtyStaged records that the staged copy of the file at inode is about to
+// be changed, so that CommitStaged uploads it, and so would the db if it were
+// next opened before that. It waits for an upload of the copy in progress.
+func (d *DriveDB) DirtyStaged(inode uint64) error {
+	d.stagemu.Lock()
+	s := d.stages[inode]
+	d.stagemu.Unlock()
+	if s == nil {
+		return ErrNotStaged
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if s.dirty {
+		return nil
+	}
+	if err := d.putStaged(s.fileId, s.md5); err != nil {
+		return err
+	}
+	s.dirty = true
+	return nil
+}
+
+func (d *DriveDB) putStaged(fileId, md5 string) error {
+	bytes, err := d.encode(staged{Md5: md5})
+	if err != nil {
+		return err
+	}
+	return d.db.Put(stageKey(fileId), bytes, nil)
+}
+
+// CommitStaged uploads the staged copy of the file at inode, as it is now,
+// and updates the db with the metadata Drive returns. If the copy hasn't
+// changed since it was last uploaded, or filled, nothing is uploaded, and the
+// file's metadata is returned from the db. If the upload fails, the copy is
+// kept, to be uploaded by a later CommitStaged, or failing that when the db
+// is next opened.
+func (d *DriveDB) CommitStaged(inode uint64) (*gdrive.File, error) {
+	d.stagemu.Lock()
+	s := d.stages[inode]
+	d.stagemu.Unlock()
+	if s == nil {
+		return nil, ErrNotStaged
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if !s.dirty {
+		return d.FileById(s.fileId)
+	}
+	r, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	fi, err := r.Stat()
+	if err != nil {
+		return nil, err
+	}
+	f, err := d.UpdateContents(s.fileId, r, fi.Size())
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			s.dirty = false // there's nothing left to upload it to
+		}
+		return nil, err
+	}
+	s.md5 = f.Md5Checksum
+	if err := d.db.Delete(stageKey(s.fileId), nil); err != nil {
+		return f, err
+	}
+	s.dirty = false
+	return f, nil
+}
+
+// ReleaseStaged ends a StageWrite of the file at inode. Once all have ended,
+// the staged copy is removed, unless it has writes which failed to upload.
+// The *os.File StageWrite returned should be closed by the writer.
+func (d *DriveDB) ReleaseStaged(inode uint64) error {
+	d.stagemu.Lock()
+	defer d.stagemu.Unlock()
+	s := d.stages[inode]
+	if s == nil {
+		return ErrNotStaged
+	}
+	if s.writers--; s.writers > 0 {
+		return nil
+	}
+	delete(d.stages, inode)
+	// No writer is left to fill or upload s, so it needn't be locked.
+	if !s.ready || s.dirty {
+		return nil
+	}
+	return d.removeStage(s.fileId)
+}
+
+// removeStage removes the staged copy of fileId.
+func (d *DriveDB) removeStage(fileId string) error {
+	if err := os.Remove(d.stagePath(fileId)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return d.db.Delete(stageKey(fileId), nil)
+}
+
+// setAsideStage keeps the staged copy of fileId, whose file has changed in
+// Drive since, alongside the others, rather than overwrite the changes with
+// it, or lose the writes it has. Copies set aside earlier are kept too.
+func (d *DriveDB) setAsideStage(fileId string) {
+	p := d.stagePath(fileId)
+	conflict := p + ".conflict"
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(conflict); err != nil {
+			break
+		}
+		conflict = fmt.Sprintf("%s.conflict.%d", p, i)
+	}
+	if err := os.Rename(p, conflict); err != nil {
+		d.opts.Logger.Warnf("could not set aside the staged writes to %v: %v", fileId, err)
+		return
+	}
+	d.db.Delete(stageKey(fileId), nil)
+	d.opts.Logger.Warnf("%v has changed in Drive since writes to it were staged; they are left in %s", fileId, conflict)
+}
+
+// leftStaged returns the fileIds of the staged copies left by a previous run.
+// It's called at open, before this run can stage any.
+func (d *DriveDB) leftStaged() ([]string, error) {
+	var left []string
+	err := d.scan("stg:", func(key, value []byte) {
+		left = append(left, string(key[len("stg:"):]))
+	})
+	return left, err
+}
+
+// recoverStaged is a background goroutine which uploads the staged copies
+// left, by a previous run, once the db has synced, so that it's known whether
+// their files have changed in Drive since.
+func (d *DriveDB) recoverStaged(left []string) {
+	if len(left) == 0 {
+		return
+	}
+	if err := d.WaitUntilSyncedContext(d.ctx); err != nil {
+		return
+	}
+	for _, fileId := range left {
+		if d.ctx.Err() != nil {
+			return
+		}
+		if err := d.recoverStage(fileId); err != nil {
+			d.opts.Logger.Warnf("could not upload the staged writes to %v: %v", fileId, err)
+		}
+	}
+}
+
+func (d *DriveDB) recoverStage(fileId string) error {
+	var st staged
+	if err := d.get(stageKey(fileId), &st); err != nil {
+		return nil // already done, by a writer
+	}
+	f, err := d.FileById(fileId)
+	if err != nil {
+		d.opts.Logger.Warnf("dropping the staged writes to %v, which is no longer in Drive", fileId)
+		return d.removeStage(fileId)
+	}
+	if f.Md5Checksum != st.Md5 {
+		d.setAsideStage(fileId)
+		return nil
+	}
+	inode, err := d.InodeForFileId(fileId)
+	if err != nil {
+		return err
+	}
+	sf, err := d.StageWrite(inode)
+	if err != nil {
+		return err
+	}
+	sf.Close()
+	defer d.ReleaseStaged(inode)
+	_, err = d.CommitStaged(inode)
+	return err
+}
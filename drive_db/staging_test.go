@@ -0,0 +1,167 @@
+package drive_db
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// stageFile returns the inode of fileId and its staged copy, failing the test
+// if it can't be staged.
+func stageFile(t *testing.T, d *DriveDB, fileId string) (uint64, *os.File) {
+	t.Helper()
+	inode, err := d.InodeForFileId(fileId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sf, err := d.StageWrite(inode)
+	if err != nil {
+		t.Fatalf("StageWrite(%v): %v", fileId, err)
+	}
+	return inode, sf
+}
+
+// writeStaged writes s to sf, the staged copy of inode, at off.
+func writeStaged(t *testing.T, d *DriveDB, inode uint64, sf *os.File, s string, off int64) {
+	t.Helper()
+	if err := d.DirtyStaged(inode); err != nil {
+		t.Fatalf("DirtyStaged: %v", err)
+	}
+	if _, err := sf.WriteAt([]byte(s), off); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStageWrite(t *testing.T) {
+	fd := newFakeDrive()
+	fd.file("f", "f.txt", "hello world")
+	d := newTestDB(t, fd, nil)
+
+	// Two writers share the copy, filled from Drive.
+	inode, a := stageFile(t, d, "f")
+	_, b := stageFile(t, d, "f")
+	if got, _ := ioutil.ReadAll(b); string(got) != "hello world" {
+		t.Errorf("staged copy has %q, want hello world", got)
+	}
+
+	// Closing a copy which was only opened uploads nothing, and leaves
+	// nothing to recover.
+	if _, err := d.CommitStaged(inode); err != nil {
+		t.Fatal(err)
+	}
+	if n := fd.count("files.upload"); n != 0 {
+		t.Errorf("committing an unwritten copy made %d uploads, want none", n)
+	}
+	if found, _ := d.db.Has(stageKey("f"), nil); found {
+		t.Errorf("an unwritten copy is recorded to be recovered")
+	}
+
+	writeStaged(t, d, inode, a, "HELLO", 0)
+	if found, _ := d.db.Has(stageKey("f"), nil); !found {
+		t.Errorf("a written copy isn't recorded to be recovered")
+	}
+	got := make([]byte, 11)
+	if _, err := b.ReadAt(got, 0); err != nil || string(got) != "HELLO world" {
+		t.Errorf("the other writer reads %q, %v, want HELLO world", got, err)
+	}
+	f, err := d.CommitStaged(inode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(fd.content["f"]); got != "HELLO world" {
+		t.Errorf("uploaded %q, want HELLO world", got)
+	}
+	if stored, err := d.FileById("f"); err != nil || stored.Md5Checksum != f.Md5Checksum {
+		t.Errorf("stored %v, %v after committing, want md5 %v", stored, err, f.Md5Checksum)
+	}
+
+	// The other writer's close has nothing more to upload.
+	if _, err := d.CommitStaged(inode); err != nil {
+		t.Fatal(err)
+	}
+	if n := fd.count("files.upload"); n != 2 { // start the session, send the content
+		t.Errorf("committing twice made %d upload requests, want 2", n)
+	}
+
+	// Once both are released, the copy's removed.
+	a.Close()
+	b.Close()
+	if err := d.ReleaseStaged(inode); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(d.stagePath("f")); err != nil {
+		t.Errorf("copy removed while a writer remains: %v", err)
+	}
+	if err := d.ReleaseStaged(inode); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(d.stagePath("f")); !os.IsNotExist(err) {
+		t.Errorf("copy left after its writers were released: %v", err)
+	}
+	if err := d.ReleaseStaged(inode); err != ErrNotStaged {
+		t.Errorf("ReleaseStaged of an unstaged inode = %v, want ErrNotStaged", err)
+	}
+}
+
+func TestRecoverStaged(t *testing.T) {
+	fd := newFakeDrive()
+	fd.file("w", "w.txt", "written")
+	fd.file("o", "o.txt", "opened")
+	fd.file("c", "c.txt", "changed")
+	dir := t.TempDir()
+	d := openTestDB(t, fd, dir, nil)
+
+	// The process dies with the copies open: one written, one only
+	// opened, and one written whose file then changes in Drive.
+	wi, w := stageFile(t, d, "w")
+	writeStaged(t, d, wi, w, "WRITTEN", 0)
+	stageFile(t, d, "o")
+	ci, c := stageFile(t, d, "c")
+	writeStaged(t, d, ci, c, "CHANGED", 0)
+	d.Close()
+	fd.setContent("c", []byte("changed in Drive"))
+
+	d = openTestDB(t, fd, dir, nil)
+	conflict := d.stagePath("c") + ".conflict"
+	// Once uploaded, the recovered copy is removed.
+	waitFor(t, "recovering the staged writes", func() bool {
+		fd.mu.Lock()
+		defer fd.mu.Unlock()
+		_, err := os.Stat(conflict)
+		_, werr := os.Stat(d.stagePath("w"))
+		return string(fd.content["w"]) == "WRITTEN" && err == nil && os.IsNotExist(werr)
+	})
+	if got := string(fd.get("o").Md5Checksum); got != fmt.Sprintf("%x", md5.Sum([]byte("opened"))) {
+		t.Errorf("a copy which was only opened was uploaded")
+	}
+	if n := fd.count("files.upload"); n != 2 { // start the session, send the content
+		t.Errorf("recovery made %d upload requests, want 2, for w", n)
+	}
+	// The writes to a file changed in Drive are set aside, rather than
+	// overwrite it.
+	if got := fd.get("c").FileSize; got != int64(len("changed in Drive")) {
+		t.Errorf("a file changed in Drive was overwritten")
+	}
+	if got, err := ioutil.ReadFile(conflict); err != nil || string(got) != "CHANGED" {
+		t.Errorf("c.conflict = %q, %v, want CHANGED", got, err)
+	}
+
+	// Set aside again, the earlier writes are kept.
+	ci, c = stageFile(t, d, "c")
+	writeStaged(t, d, ci, c, "AGAIN", 0)
+	d.Close()
+	fd.setContent("c", []byte("changed in Drive again"))
+	d = openTestDB(t, fd, dir, nil)
+	waitFor(t, "setting aside the staged writes", func() bool {
+		_, err := os.Stat(conflict + ".1")
+		return err == nil
+	})
+	for p, want := range map[string]string{conflict: "CHANGED", conflict + ".1": "AGAINed in Drive"} {
+		if got, err := ioutil.ReadFile(p); err != nil || string(got) != want {
+			t.Errorf("%s = %q, %v, want %q", path.Base(p), got, err, want)
+		}
+	}
+}
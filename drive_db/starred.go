@@ -0,0 +1,109 @@
+package drive_db
+
+// Starred files are indexed, and with ShowStarred listed in a synthetic
+// ".Starred" folder in the root as well as in their own folders. As the
+// folder isn't one of their parents, their paths are unaffected.
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	gdrive "code.google.com/p/google-api-go-client/drive/v2"
+	"code.google.com/p/google-api-go-client/googleapi"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+const (
+	// starredFileId is the fileId of the synthetic starred folder. Like
+	// trashFileId, it contains a colon so can't collide with a real one.
+	starredFileId = "drive_db:starred"
+	starredInode  = 4
+	starredTitle  = ".Starred"
+)
+
+func starKey(fileId string) []byte {
+	return []byte("str:" + fileId)
+}
+
+// starred reports whether Drive has f starred.
+func starred(f *gdrive.File) bool {
+	return f != nil && f.Labels != nil && f.Labels.Starred
+}
+
+// Starred reports whether f is starred.
+func (f *File) Starred() bool {
+	return starred(f.File)
+}
+
+// IsStarredFolder reports whether fileId is the synthetic starred folder.
+func (d *DriveDB) IsStarredFolder(fileId string) bool {
+	return fileId == starredFileId
+}
+
+// StarredFileIds returns the fileIds of the starred files.
+func (d *DriveDB) StarredFileIds() ([]string, error) {
+	return d.indexedFileIds([]byte("str:"))
+}
+
+// SetStarred stars or unstars fileId in Drive, and updates the db to match.
+func (d *DriveDB) SetStarred(fileId string, star bool) error {
+	if d.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	// The client leaves false labels out of a patch, so it can't unstar.
+	body, err := json.Marshal(map[string]interface{}{
+		"labels": map[string]bool{"starred": star},
+	})
+	if err != nil {
+		return err
+	}
+	var f gdrive.File
+	err = d.retry("files.patch", func() error {
+		req, err := http.NewRequest("PATCH", "https://www.googleapis.com/drive/v2/files/"+url.PathEscape(fileId), bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := d.api.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if err := googleapi.CheckResponse(resp); err != nil {
+			return err
+		}
+		return json.NewDecoder(resp.Body).Decode(&f)
+	})
+	if err != nil {
+		return d.writeError(fileId, err)
+	}
+	d.resyncmu.Lock()
+	defer d.resyncmu.Unlock()
+	return d.bulkImport(new(leveldb.Batch), []*gdrive.File{&f}, make(map[string]bool))
+}
+
+// createStarred synthesizes the starred folder in the root if ShowStarred is
+// set, and otherwise removes any left behind from a previous run.
+func (d *DriveDB) createStarred() error {
+	if !d.opts.ShowStarred {
+		if _, err := d.FileById(starredFileId); err != nil {
+			return nil
+		}
+		return d.RemoveFileById(starredFileId, nil)
+	}
+	launch, _ := time.Unix(1335225600, 0).MarshalText()
+	file := &gdrive.File{
+		Id:                 starredFileId,
+		Title:              starredTitle,
+		MimeType:           driveFolderMimeType,
+		LastViewedByMeDate: string(launch),
+		ModifiedDate:       string(launch),
+		CreatedDate:        string(launch),
+		Parents:            []*gdrive.ParentReference{&gdrive.ParentReference{Id: d.rootId}},
+	}
+	_, err := d.UpdateFile(nil, file)
+	return err
+}
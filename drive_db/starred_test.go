@@ -0,0 +1,67 @@
+package drive_db
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestSetStarred(t *testing.T) {
+	fd := newFakeDrive()
+	fd.file("s", "s.txt", "s")
+	// The fileId is escaped in the request's path.
+	fd.file("s t", "st.txt", "st")
+	fd.file("gone", "gone.txt", "gone")
+	d := newTestDB(t, fd, &DriveDBOptions{ShowStarred: true})
+	changes := d.Subscribe()
+
+	for _, id := range []string{"s", "s t"} {
+		if err := d.SetStarred(id, true); err != nil {
+			t.Fatalf("SetStarred(%q, true): %v", id, err)
+		}
+		if !fd.get(id).Labels.Starred {
+			t.Errorf("SetStarred(%q, true) didn't star it in Drive", id)
+		}
+	}
+	if ids, err := d.StarredFileIds(); err != nil || !reflect.DeepEqual(ids, []string{"s", "s t"}) {
+		t.Errorf("StarredFileIds() = %v, %v, want [s s t]", ids, err)
+	}
+	published := false
+	for len(changes) > 0 {
+		c := <-changes
+		published = published || c.Inode == starredInode
+	}
+	if !published {
+		t.Errorf("starring a file published no change to the starred folder")
+	}
+
+	if err := d.SetStarred("s", false); err != nil {
+		t.Fatalf("SetStarred(s, false): %v", err)
+	}
+	if fd.get("s").Labels.Starred {
+		t.Errorf("SetStarred(s, false) didn't unstar it in Drive")
+	}
+	if ids, err := d.StarredFileIds(); err != nil || !reflect.DeepEqual(ids, []string{"s t"}) {
+		t.Errorf("StarredFileIds() = %v, %v after unstarring s, want [s t]", ids, err)
+	}
+	if f, err := d.FileById("s"); err != nil || starred(f) {
+		t.Errorf("FileById(s) = %v, %v after unstarring, want it unstarred", f, err)
+	}
+
+	// A file gone from Drive is removed from the db.
+	fd.mu.Lock()
+	delete(fd.files, "gone")
+	fd.mu.Unlock()
+	if err := d.SetStarred("gone", true); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SetStarred of a file gone from Drive = %v, want ErrNotFound", err)
+	}
+	if _, err := d.FileById("gone"); err == nil {
+		t.Errorf("a file gone from Drive is left in the db")
+	}
+
+	// A transient failure is retried.
+	fd.failNext("files.patch", 503)
+	if err := d.SetStarred("s", true); err != nil {
+		t.Errorf("SetStarred after a 503: %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+package drive_db
+
+// Errors from the sync goroutines are published, so a program embedding
+// DriveDB can tell that sync is failing, and why, instead of only finding it
+// in the log.
+
+import (
+	"fmt"
+)
+
+// syncErrorBuffer is the number of errors Errors may fall behind by before
+// further errors are dropped.
+const syncErrorBuffer = 100
+
+// SyncErrorKind categorizes a SyncError by what's needed to fix it.
+type SyncErrorKind int
+
+const (
+	AuthError    SyncErrorKind = iota // Drive rejected our credentials; re-authenticate
+	NetworkError                      // Drive was unreachable or overloaded; sync retries on the next poll
+	DriveError                        // Drive refused the request for some other reason
+	DBError                           // changes couldn't be applied to the db
+)
+
+func (k SyncErrorKind) String() string {
+	switch k {
+	case AuthError:
+		return "auth"
+	case NetworkError:
+		return "network"
+	case DriveError:
+		return "drive"
+	case DBError:
+		return "db"
+	}
+	return "unknown"
+}
+
+// SyncError is an error which stopped the db syncing with Drive.
+type SyncError struct {
+	Kind SyncErrorKind
+	Op   string // what failed, e.g. "changes.list"
+	Err  error
+}
+
+func (e *SyncError) Error() string {
+	return fmt.Sprintf("sync %s error: %s: %v", e.Kind, e.Op, e.Err)
+}
+
+// Unwrap returns e.Err, so that errors.Is(e, ErrAuth) etc. test the cause.
+func (e *SyncError) Unwrap() error {
+	return e.Err
+}
+
+// apiErrorKind returns the SyncErrorKind of an error from a Drive API call.
+func apiErrorKind(err error) SyncErrorKind {
+	switch classifyError(err) {
+	case errAuth:
+		return AuthError
+	case errRetryable:
+		return NetworkError
+	}
+	return DriveError
+}
+
+// Errors returns the channel on which the *SyncErrors of the sync goroutines
+// are published. Every call returns the same channel. Errors are dropped
+// rather than block the sync if it's not read.
+func (d *DriveDB) Errors() <-chan error {
+	return d.errs
+}
+
+// LastSyncError returns the most recent *SyncError, or nil if the db has
+// synced with Drive since.
+func (d *DriveDB) LastSyncError() error {
+	d.Lock()
+	defer d.Unlock()
+	if d.lastErr == nil {
+		return nil
+	}
+	return d.lastErr
+}
+
+// syncError records and publishes a sync error, and logs it unless
+// --drivedb.logsyncerrors is false.
+func (d *DriveDB) syncError(kind SyncErrorKind, op string, err error) {
+	serr := &SyncError{Kind: kind, Op: op, Err: err}
+	if *logSyncErrors {
+		d.opts.Logger.Errorf("%v", serr)
+	}
+	d.Lock()
+	d.lastErr = serr
+	d.Unlock()
+	select {
+	case d.errs <- serr:
+	default:
+	}
+}
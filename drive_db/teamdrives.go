@@ -0,0 +1,169 @@
+package drive_db
+
+// With TeamDrives set, the files in the Team Drives (Shared Drives) the user
+// can reach are synced too, and each Team Drive is listed as a synthetic
+// folder in the root. A Team Drive's id is that of its root folder, so its
+// files' parent refs lead there. This version of the client can neither ask
+// for Team Drive items nor list the Team Drives, so the parameters are added
+// to every API call by the transport, and the Team Drives listed directly.
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	gdrive "code.google.com/p/google-api-go-client/drive/v2"
+	"code.google.com/p/google-api-go-client/googleapi"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func teamDriveKey(fileId string) []byte {
+	return []byte("tdr:" + fileId)
+}
+
+// teamDrive is a Team Drive, as Drive lists them.
+type teamDrive struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// IsTeamDrive reports whether fileId is the synthetic folder of a Team Drive.
+func (d *DriveDB) IsTeamDrive(fileId string) bool {
+	found, err := d.db.Has(teamDriveKey(fileId), nil)
+	return err == nil && found
+}
+
+// teamDriveClient returns a copy of client whose API calls reach the files in
+// Team Drives.
+func teamDriveClient(client *http.Client) *http.Client {
+	rt := client.Transport
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	c := *client
+	c.Transport = &teamDriveTransport{rt}
+	return &c
+}
+
+// teamDriveTransport adds supportsTeamDrives to the Drive API calls it makes,
+// and includeTeamDriveItems to those listing files or changes.
+type teamDriveTransport struct {
+	rt http.RoundTripper
+}
+
+func (t *teamDriveTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != "www.googleapis.com" {
+		return t.rt.RoundTrip(req)
+	}
+	r := req.Clone(req.Context())
+	q := r.URL.Query()
+	q.Set("supportsTeamDrives", "true")
+	if req.Method == "GET" && (r.URL.Path == "/drive/v2/files" || r.URL.Path == "/drive/v2/changes") {
+		q.Set("includeTeamDriveItems", "true")
+	}
+	r.URL.RawQuery = q.Encode()
+	return t.rt.RoundTrip(r)
+}
+
+// listTeamDrives lists the Team Drives the user can reach.
+func (d *DriveDB) listTeamDrives() ([]teamDrive, error) {
+	var drives []teamDrive
+	q := url.Values{"maxResults": {"100"}}
+	for {
+		var page struct {
+			Items         []teamDrive `json:"items"`
+			NextPageToken string      `json:"nextPageToken"`
+		}
+		err := d.retry("teamdrives.list", func() error {
+			req, err := http.NewRequest("GET", "https://www.googleapis.com/drive/v2/teamdrives?"+q.Encode(), nil)
+			if err != nil {
+				return err
+			}
+			resp, err := d.api.Do(req)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			if err := googleapi.CheckResponse(resp); err != nil {
+				return err
+			}
+			return json.NewDecoder(resp.Body).Decode(&page)
+		})
+		if err != nil {
+			return nil, err
+		}
+		drives = append(drives, page.Items...)
+		if page.NextPageToken == "" {
+			return drives, nil
+		}
+		q.Set("pageToken", page.NextPageToken)
+	}
+}
+
+// syncTeamDrives lists the Team Drives, adding the folders of those new or
+// renamed to the root, and removing those of any the user can no longer
+// reach. Their files are synced as changes.
+func (d *DriveDB) syncTeamDrives() error {
+	drives, err := d.listTeamDrives()
+	if err != nil {
+		return err
+	}
+	d.resyncmu.Lock()
+	defer d.resyncmu.Unlock()
+
+	launch, _ := time.Unix(1335225600, 0).MarshalText()
+	batch := new(leveldb.Batch)
+	current := make(map[string]bool)
+	var files []*gdrive.File
+	for _, td := range drives {
+		current[td.Id] = true
+		if of, err := d.FileById(td.Id); err == nil && of.Title == td.Name && d.IsTeamDrive(td.Id) {
+			continue
+		}
+		batch.Put(teamDriveKey(td.Id), nil)
+		files = append(files, &gdrive.File{
+			Id:                 td.Id,
+			Title:              td.Name,
+			MimeType:           driveFolderMimeType,
+			LastViewedByMeDate: string(launch),
+			ModifiedDate:       string(launch),
+			CreatedDate:        string(launch),
+			Labels:             &gdrive.FileLabels{},
+			Parents:            []*gdrive.ParentReference{&gdrive.ParentReference{Id: d.rootId}},
+		})
+	}
+
+	var gone []string
+	err = d.scan("tdr:", func(key, value []byte) {
+		if id := string(key[len("tdr:"):]); !current[id] {
+			gone = append(gone, id)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	var changes []InodeChange
+	for _, id := range gone {
+		d.opts.Logger.Infof("Team Drive %v is no longer reachable", id)
+		of, err := d.FileById(id)
+		if err != nil {
+			batch.Delete(teamDriveKey(id))
+			continue
+		}
+		inode, err := d.InodeForFileId(id)
+		if err != nil {
+			return err
+		}
+		if err := d.RemoveFileById(id, batch); err != nil {
+			return err
+		}
+		batch.Delete(teamDriveKey(id))
+		changes = append(changes, d.inodeChanges(inode, &gdrive.Change{FileId: id, Deleted: true}, of, true)...)
+	}
+	if err := d.bulkImport(batch, files, make(map[string]bool)); err != nil {
+		return err
+	}
+	d.publish(changes)
+	return nil
+}
@@ -0,0 +1,85 @@
+package drive_db
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestTeamDrives(t *testing.T) {
+	fd := newFakeDrive()
+	fd.file("m", "m.txt", "mine")
+	fd.teamDrive("td", "Team One")
+	fd.file("t", "t.txt", "team", "td")
+	fd.folder("sub", "sub", "td")
+	fd.file("u", "u.txt", "nested", "sub")
+	var mu sync.Mutex
+	var unasked []string
+	fd.setBefore(func(op string, req *http.Request) error {
+		q := req.URL.Query()
+		if (op == "changes.list" || op == "files.list") && !teamDriveItems(q) {
+			mu.Lock()
+			unasked = append(unasked, op)
+			mu.Unlock()
+		}
+		return nil
+	})
+	d := newTestDB(t, fd, &DriveDBOptions{TeamDrives: true})
+
+	if !d.IsTeamDrive("td") || d.IsTeamDrive("sub") {
+		t.Errorf("IsTeamDrive(td), (sub) = %v, %v, want true, false", d.IsTeamDrive("td"), d.IsTeamDrive("sub"))
+	}
+	for id, want := range map[string]string{"m": "/m.txt", "t": "/Team One/t.txt", "u": "/Team One/sub/u.txt"} {
+		if got := pathOf(t, d, id); got != want {
+			t.Errorf("path of %v = %q, want %q", id, got, want)
+		}
+	}
+	mu.Lock()
+	if len(unasked) > 0 {
+		t.Errorf("%v asked for no Team Drive items", unasked)
+	}
+	mu.Unlock()
+
+	// A Team Drive renamed is renamed in the root; one taken away is
+	// removed, with its files.
+	fd.teamDrive("td", "Team 1")
+	resync(t, d, fd)
+	if got := pathOf(t, d, "t"); got != "/Team 1/t.txt" {
+		t.Errorf("path of t = %q after renaming its Team Drive, want /Team 1/t.txt", got)
+	}
+	// Resyncing keeps the Team Drive's folder, which isn't a file in Drive.
+	if err := d.FullResync(); err != nil {
+		t.Fatalf("FullResync: %v", err)
+	}
+	if _, err := d.FileById("td"); err != nil {
+		t.Errorf("FileById(td) = %v after a full resync", err)
+	}
+	fd.removeTeamDrive("td")
+	resync(t, d, fd)
+	for _, id := range []string{"td", "t", "sub", "u"} {
+		if _, err := d.FileById(id); err == nil {
+			t.Errorf("%v is left after its Team Drive was taken away", id)
+		}
+	}
+	if d.IsTeamDrive("td") {
+		t.Errorf("IsTeamDrive(td) after it was taken away")
+	}
+	if _, err := d.FileById("m"); err != nil {
+		t.Errorf("FileById(m) = %v after a Team Drive was taken away", err)
+	}
+}
+
+func TestTeamDrivesOff(t *testing.T) {
+	fd := newFakeDrive()
+	fd.teamDrive("td", "Team One")
+	fd.file("t", "t.txt", "team", "td")
+	d := newTestDB(t, fd, nil)
+	if n := fd.count("teamdrives.list"); n != 0 {
+		t.Errorf("listed the Team Drives %d times without TeamDrives", n)
+	}
+	for _, id := range []string{"td", "t"} {
+		if _, err := d.FileById(id); err == nil {
+			t.Errorf("%v is synced without TeamDrives", id)
+		}
+	}
+}
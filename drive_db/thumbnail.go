@@ -0,0 +1,102 @@
+package drive_db
+
+// Thumbnails of files, for media browsers. Like download urls, thumbnail
+// links expire, so they're cached with the time they were fetched, and
+// refetched when they're stale or refused.
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// thumbnailUrlLifetime is how long a thumbnail link is used before it's
+// refetched. They expire sooner than download urls.
+const thumbnailUrlLifetime = time.Hour
+
+func thumbnailUrlKey(fileId string) []byte {
+	return []byte("thm:" + fileId)
+}
+
+// Thumbnail returns a thumbnail of fileId, and its content type. If the
+// thumbnail link has expired, it is refreshed and the request retried once.
+// The caller must close the thumbnail.
+func (d *DriveDB) Thumbnail(fileId string) (io.ReadCloser, string, error) {
+	for attempt := 0; ; attempt++ {
+		url, err := d.thumbnailUrl(fileId, attempt > 0)
+		if err != nil {
+			return nil, "", err
+		}
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return nil, "", err
+		}
+		debug.Printf("fetching thumbnail of %v", fileId)
+		resp, err := d.client.Do(req)
+		if err != nil {
+			return nil, "", fmt.Errorf("client.Do: %v", err)
+		}
+		switch {
+		case resp.StatusCode == 200:
+			return resp.Body, resp.Header.Get("Content-Type"), nil
+		case resp.StatusCode == 403 && attempt == 0:
+			resp.Body.Close()
+			continue // the link has likely expired
+		}
+		resp.Body.Close()
+		return nil, "", fmt.Errorf("Thumbnail: for %s got HTTP status %v, want 200: %v", fileId, resp.StatusCode, resp.Status)
+	}
+}
+
+// thumbnailUrl returns the thumbnail link of fileId, fetching it from Drive
+// if the cached one is stale or force is set. Concurrent fetches are shared,
+// as for downloadUrl.
+func (d *DriveDB) thumbnailUrl(fileId string, force bool) (string, error) {
+	v, err := d.sf.Do(fmt.Sprintf("thumb:%s:%v", fileId, force), func() (interface{}, error) {
+		return d.thumbnailUrlImpl(fileId, force)
+	})
+	return v.(string), err
+}
+
+func (d *DriveDB) thumbnailUrlImpl(fileId string, force bool) (string, error) {
+	var urldata DownloadURL
+	key := thumbnailUrlKey(fileId)
+	if !force {
+		err := d.get(key, &urldata)
+		if err == nil && time.Since(time.Unix(urldata.When, 0)) < thumbnailUrlLifetime {
+			return urldata.URL, nil
+		}
+	}
+
+	atomic.AddInt64(&d.urlRefreshes, 1)
+	fresh, err := d.service.Files.Get(fileId).Do()
+	if err != nil {
+		return "", err
+	}
+	if fresh.ThumbnailLink == "" {
+		return "", fmt.Errorf("no thumbnail for %v", fileId)
+	}
+	batch := new(leveldb.Batch)
+	if err := d.cacheThumbnailUrl(batch, fileId, fresh.ThumbnailLink); err == nil {
+		d.db.Write(batch, nil) // the caller can use the link regardless
+	}
+	return fresh.ThumbnailLink, nil
+}
+
+// cacheThumbnailUrl adds a freshly fetched thumbnail link for fileId to
+// batch, to be served by thumbnailUrl until it expires.
+func (d *DriveDB) cacheThumbnailUrl(batch *leveldb.Batch, fileId, url string) error {
+	if url == "" {
+		return fmt.Errorf("no thumbnail for %v", fileId)
+	}
+	bytes, err := d.encode(DownloadURL{URL: url, When: time.Now().Unix()})
+	if err != nil {
+		return err
+	}
+	batch.Put(thumbnailUrlKey(fileId), bytes)
+	return nil
+}
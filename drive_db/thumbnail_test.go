@@ -0,0 +1,62 @@
+package drive_db
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestThumbnail(t *testing.T) {
+	fd := newFakeDrive()
+	fd.file("f", "f.jpg", "f")
+	fd.folder("dir", "dir")
+	d := newTestDB(t, fd, nil)
+	// Listing changes hands out fresh links, expiring those cached.
+	d.Pause()
+	waitPolled(t, d)
+
+	thumbnail := func() {
+		t.Helper()
+		r, ctype, err := d.Thumbnail("f")
+		if err != nil {
+			t.Fatalf("Thumbnail(f): %v", err)
+		}
+		defer r.Close()
+		got, err := ioutil.ReadAll(r)
+		if err != nil || string(got) != "thumbnail of f" || ctype != "image/png" {
+			t.Errorf("Thumbnail(f) = %q, %q, %v, want the thumbnail of f", got, ctype, err)
+		}
+	}
+	thumbnail()
+
+	// The link is cached.
+	gets, fetches := fd.count("files.get"), fd.count("thumbnail")
+	thumbnail()
+	if n := fd.count("files.get") - gets; n != 0 {
+		t.Errorf("a cached link was refetched %d times", n)
+	}
+
+	// Once expired, it's refused, refreshed and the thumbnail fetched again.
+	fd.get("f")
+	gets, fetches = fd.count("files.get"), fd.count("thumbnail")
+	thumbnail()
+	if n := fd.count("files.get") - gets; n != 1 {
+		t.Errorf("an expired link was refetched %d times, want 1", n)
+	}
+	if n := fd.count("thumbnail") - fetches; n != 2 {
+		t.Errorf("fetching with an expired link made %d requests, want 2", n)
+	}
+
+	// It's only retried once.
+	fd.failNext("thumbnail", 403, 403)
+	fetches = fd.count("thumbnail")
+	if _, _, err := d.Thumbnail("f"); err == nil {
+		t.Errorf("Thumbnail(f) refused twice succeeded")
+	}
+	if n := fd.count("thumbnail") - fetches; n != 2 {
+		t.Errorf("Thumbnail(f) refused twice made %d requests, want 2", n)
+	}
+
+	if _, _, err := d.Thumbnail("dir"); err == nil {
+		t.Errorf("Thumbnail of a folder succeeded")
+	}
+}
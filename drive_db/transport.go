@@ -0,0 +1,176 @@
+package drive_db
+
+// The http.Client used for API calls is wrapped, to count and rate limit the
+// calls, and bound how long each can take.
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// apiClient returns a copy of client for making API calls, whose requests
+// are counted in calls, rate limited by limiter, unless it's nil, and time
+// out after timeout, unless it isn't positive.
+func apiClient(client *http.Client, timeout time.Duration, limiter *rateLimiter, calls *apiCalls) *http.Client {
+	rt := client.Transport
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	if timeout > 0 {
+		rt = &timeoutTransport{rt, timeout}
+	}
+	if limiter != nil {
+		// Outermost, so waiting for the limiter doesn't count to the timeout.
+		rt = &limitedTransport{rt, limiter}
+	}
+	rt = &countingTransport{rt, calls}
+	c := *client
+	c.Transport = rt
+	return &c
+}
+
+// errTimeout is returned by a timed out request. It's a net.Error, so it's
+// retried.
+type errTimeout struct{}
+
+func (errTimeout) Error() string   { return "drive_db: API call timed out" }
+func (errTimeout) Timeout() bool   { return true }
+func (errTimeout) Temporary() bool { return true }
+
+// timeoutTransport abandons requests whose response, body and all, doesn't
+// arrive within timeout, or before their context is done. The request is
+// cancelled through its context, which oauth.Transport passes on, and by
+// CancelRequest, for transports which predate contexts.
+// http.Client's own Timeout can't be used, as it needs a Transport which can
+// cancel requests, which oauth.Transport can't.
+type timeoutTransport struct {
+	rt      http.RoundTripper
+	timeout time.Duration
+}
+
+type roundTrip struct {
+	resp *http.Response
+	err  error
+}
+
+func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	r := &timedRequest{rt: t.rt, req: req.WithContext(ctx), cancel: cancel}
+	r.timer = time.AfterFunc(t.timeout, r.expire)
+	done := make(chan roundTrip, 1)
+	go func() {
+		resp, err := t.rt.RoundTrip(r.req)
+		done <- roundTrip{resp, err}
+	}()
+	select {
+	case rt := <-done:
+		if rt.err != nil {
+			r.stop()
+			if r.expired() {
+				return nil, errTimeout{}
+			}
+			return nil, rt.err
+		}
+		if !r.setBody(rt.resp.Body) {
+			return nil, errTimeout{}
+		}
+		rt.resp.Body = r
+		return rt.resp, nil
+	case <-ctx.Done():
+	}
+	// The round trip has been cancelled, so should end soon. Don't leak the
+	// connection, if the response arrives after all.
+	go func() {
+		if rt := <-done; rt.resp != nil {
+			rt.resp.Body.Close()
+		}
+	}()
+	r.stop()
+	if !r.expired() {
+		return nil, req.Context().Err()
+	}
+	return nil, errTimeout{}
+}
+
+// A timedRequest is a request of a timeoutTransport, and, once it's had a
+// response, that response's body, until it's read or closed.
+type timedRequest struct {
+	rt     http.RoundTripper
+	req    *http.Request
+	cancel context.CancelFunc
+	timer  *time.Timer
+
+	mu       sync.Mutex
+	body     io.ReadCloser
+	timedOut bool
+	finished bool // the body has been closed, or reads of it have failed
+}
+
+// expire cancels the request, and closes the body of its response, if there
+// is one, so that reading it fails.
+func (r *timedRequest) expire() {
+	r.mu.Lock()
+	if r.finished {
+		r.mu.Unlock()
+		return
+	}
+	r.timedOut = true
+	body := r.body
+	r.mu.Unlock()
+	r.cancel()
+	if c, ok := r.rt.(interface {
+		CancelRequest(*http.Request)
+	}); ok {
+		c.CancelRequest(r.req)
+	}
+	if body != nil {
+		body.Close()
+	}
+}
+
+func (r *timedRequest) expired() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.timedOut
+}
+
+// setBody records the body of the response, returning false, and closing it,
+// if the request has already expired.
+func (r *timedRequest) setBody(body io.ReadCloser) bool {
+	r.mu.Lock()
+	timedOut := r.timedOut
+	r.body = body
+	r.mu.Unlock()
+	if timedOut {
+		body.Close()
+	}
+	return !timedOut
+}
+
+// stop stops the timer, and releases the request's context.
+func (r *timedRequest) stop() {
+	r.mu.Lock()
+	r.finished = true
+	r.mu.Unlock()
+	r.timer.Stop()
+	r.cancel()
+}
+
+func (r *timedRequest) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if err != nil {
+		if r.expired() {
+			err = errTimeout{}
+		}
+		r.stop()
+	}
+	return n, err
+}
+
+func (r *timedRequest) Close() error {
+	r.stop()
+	return r.body.Close()
+}
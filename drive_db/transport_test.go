@@ -0,0 +1,180 @@
+package drive_db
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"code.google.com/p/google-api-go-client/googleapi"
+)
+
+// slowTransport responds to requests after headerDelay, with a body which
+// gives its first byte at once, and the rest after bodyDelay. Like
+// http.Transport, it gives up on requests whose context is done.
+type slowTransport struct {
+	headerDelay, bodyDelay time.Duration
+
+	mu            sync.Mutex
+	calls, active int // round trips and reads of bodies, and those unreturned
+}
+
+// call counts a round trip or read, returning a func to call when it returns.
+func (t *slowTransport) call() func() {
+	t.mu.Lock()
+	t.calls++
+	t.active++
+	t.mu.Unlock()
+	return func() {
+		t.mu.Lock()
+		t.active--
+		t.mu.Unlock()
+	}
+}
+
+func (t *slowTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	defer t.call()()
+	select {
+	case <-time.After(t.headerDelay):
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	body := &slowBody{t: t, ctx: req.Context(), closed: make(chan struct{})}
+	return &http.Response{StatusCode: 200, Body: body, Request: req}, nil
+}
+
+type slowBody struct {
+	t      *slowTransport
+	ctx    context.Context
+	read   bool
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (b *slowBody) Read(p []byte) (int, error) {
+	defer b.t.call()()
+	if !b.read {
+		b.read = true
+		p[0] = 'x'
+		return 1, nil
+	}
+	select {
+	case <-time.After(b.t.bodyDelay):
+		return 0, io.EOF
+	case <-b.ctx.Done():
+		return 0, b.ctx.Err()
+	case <-b.closed:
+		return 0, errors.New("read on closed body")
+	}
+}
+
+func (b *slowBody) Close() error {
+	b.once.Do(func() { close(b.closed) })
+	return nil
+}
+
+// finished waits for the round trips and reads of t to return.
+func (t *slowTransport) finished(tb testing.TB) {
+	tb.Helper()
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		t.mu.Lock()
+		done := t.calls > 0 && t.active == 0
+		t.mu.Unlock()
+		if done {
+			return
+		}
+	}
+	tb.Fatalf("the slow transport's requests weren't abandoned")
+}
+
+func TestTimeoutTransport(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	get := func(st *slowTransport, ctx context.Context) (string, error) {
+		req, _ := http.NewRequest("GET", "https://fake.invalid/", nil)
+		resp, err := (&timeoutTransport{st, timeout}).RoundTrip(req.WithContext(ctx))
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		return string(b), err
+	}
+	isTimeout := func(err error) bool {
+		_, ok := err.(errTimeout)
+		return ok
+	}
+
+	// A quick response is untouched.
+	st := &slowTransport{}
+	if body, err := get(st, context.Background()); err != nil || body != "x" {
+		t.Errorf("quick response = %q, %v, want x", body, err)
+	}
+
+	// Slow headers time out, and the request is abandoned.
+	st = &slowTransport{headerDelay: time.Hour}
+	start := time.Now()
+	if _, err := get(st, context.Background()); !isTimeout(err) {
+		t.Errorf("slow headers: err = %v, want a timeout", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("slow headers took %v to time out", d)
+	}
+	st.finished(t)
+
+	// So does a slow body, though the headers were quick.
+	st = &slowTransport{bodyDelay: time.Hour}
+	if body, err := get(st, context.Background()); !isTimeout(err) || body != "x" {
+		t.Errorf("slow body = %q, %v, want x and a timeout", body, err)
+	}
+	st.finished(t)
+
+	// A request given up on by its caller returns the context's error.
+	st = &slowTransport{headerDelay: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond, cancel)
+	if _, err := get(st, ctx); err != context.Canceled {
+		t.Errorf("cancelled request: err = %v, want %v", err, context.Canceled)
+	}
+	st.finished(t)
+}
+
+func TestClassifyError(t *testing.T) {
+	urlError := func(err error) error {
+		return &url.Error{Op: "Get", URL: "https://www.googleapis.com/drive/v2/about", Err: err}
+	}
+	googleError := func(code int, reason string) error {
+		return &googleapi.Error{Code: code, Body: `{"error": {"errors": [{"reason": "` + reason + `"}]}}`}
+	}
+	for _, c := range []struct {
+		err  error
+		want errorClass
+	}{
+		{urlError(errTimeout{}), errRetryable},
+		{urlError(&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}), errRetryable},
+		{urlError(io.ErrUnexpectedEOF), errRetryable},
+		{urlError(io.EOF), errRetryable},
+		{urlError(context.Canceled), errFatal},
+		{urlError(context.DeadlineExceeded), errFatal},
+		{urlError(errors.New(`unsupported protocol scheme ""`)), errFatal},
+		{urlError(errors.New("x509: certificate signed by unknown authority")), errFatal},
+		{googleError(401, "authError"), errAuth},
+		{googleError(403, "insufficientPermissions"), errAuth},
+		{googleError(403, "userRateLimitExceeded"), errRetryable},
+		{googleError(403, "storageQuotaExceeded"), errFatal},
+		{googleError(403, "insufficientFilePermissions"), errFatal},
+		{googleError(500, "backendError"), errRetryable},
+		{errTimeout{}, errRetryable},
+		{errors.New(strings.Repeat("?", 3)), errFatal},
+	} {
+		if got := classifyError(c.err); got != c.want {
+			t.Errorf("classifyError(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package drive_db
+
+// Trashing files, and optionally keeping trashed files visible, either where
+// they were or in a synthetic ".Trash" folder, so they can be recovered
+// through the filesystem.
+
+import (
+	"fmt"
+	"time"
+
+	gdrive "code.google.com/p/google-api-go-client/drive/v2"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// TrashMode selects how trashed files are represented in the db.
+type TrashMode int
+
+const (
+	Drop       TrashMode = iota // trashed files are removed from the db
+	Keep                        // trashed files stay where they were
+	Quarantine                  // trashed files are moved into the ".Trash" folder
+)
+
+func (m TrashMode) String() string {
+	switch m {
+	case Drop:
+		return "drop"
+	case Keep:
+		return "keep"
+	case Quarantine:
+		return "quarantine"
+	}
+	return "unknown"
+}
+
+// ParseTrashMode returns the TrashMode named s, as returned by its String method.
+func ParseTrashMode(s string) (TrashMode, error) {
+	for _, m := range []TrashMode{Drop, Keep, Quarantine} {
+		if s == m.String() {
+			return m, nil
+		}
+	}
+	return Drop, fmt.Errorf("unknown trash mode %q", s)
+}
+
+// Trashed reports whether f is in the Drive trash. Only files kept by the
+// Keep and Quarantine TrashModes can be.
+func (f *File) Trashed() bool {
+	return f.Labels != nil && f.Labels.Trashed
+}
+
+const (
+	// trashFileId is the fileId of the synthetic trash folder. It can't
+	// collide with a real fileId, which never contains a colon.
+	trashFileId = "drive_db:trash"
+	trashInode  = 2
+	trashTitle  = ".Trash"
+)
+
+// createTrash synthesizes the trash folder in the root in Quarantine mode,
+// and otherwise removes any left behind from a previous run.
+func (d *DriveDB) createTrash() error {
+	if d.opts.TrashMode != Quarantine {
+		if _, err := d.FileById(trashFileId); err != nil {
+			return nil
+		}
+		return d.RemoveFileById(trashFileId, nil)
+	}
+	launch, _ := time.Unix(1335225600, 0).MarshalText()
+	file := &gdrive.File{
+		Id:                 trashFileId,
+		Title:              trashTitle,
+		MimeType:           driveFolderMimeType,
+		LastViewedByMeDate: string(launch),
+		ModifiedDate:       string(launch),
+		CreatedDate:        string(launch),
+		Parents:            []*gdrive.ParentReference{&gdrive.ParentReference{Id: d.rootId}},
+	}
+	_, err := d.UpdateFile(nil, file)
+	return err
+}
+
+// inTrash returns a copy of f, a trashed file, moved into the trash folder.
+func inTrash(f *gdrive.File) *gdrive.File {
+	t := *f
+	t.Parents = []*gdrive.ParentReference{&gdrive.ParentReference{Id: trashFileId}}
+	return &t
+}
+
+// TrashFile moves fileId to the Drive trash, and updates the db according to
+// the TrashMode.
+func (d *DriveDB) TrashFile(fileId string) error {
+	f, err := d.service.Files.Trash(fileId).Do()
+	if err != nil {
+		return d.writeError(fileId, err)
+	}
+	switch d.opts.TrashMode {
+	case Keep:
+		_, err = d.UpdateFile(nil, f)
+	case Quarantine:
+		_, err = d.UpdateFile(nil, inTrash(f))
+	default:
+		err = d.RemoveFileById(fileId, nil)
+	}
+	return err
+}
+
+// UntrashFile restores fileId from the Drive trash, to its original folders.
+// The file gets back the inode it had before it was trashed, as the fileId
+// to inode mapping outlives the file's removal from the db.
+func (d *DriveDB) UntrashFile(fileId string) error {
+	f, err := d.service.Files.Untrash(fileId).Do()
+	if err != nil {
+		return d.writeError(fileId, err)
+	}
+	_, err = d.UpdateFile(nil, f)
+	return err
+}
+
+// EmptyTrash permanently deletes every file in the Drive trash, and removes
+// those the TrashMode kept from the db, returning how many were removed.
+func (d *DriveDB) EmptyTrash() (int, error) {
+	err := d.retry("files.emptyTrash", func() error {
+		return d.service.Files.EmptyTrash().Do()
+	})
+	if err != nil {
+		return 0, err
+	}
+	if d.opts.TrashMode == Drop {
+		return 0, nil // none were kept
+	}
+	var trashed []string
+	err = d.scan("fid:", func(key, value []byte) {
+		var f gdrive.File
+		if err := d.decode(value, &f); err == nil && f.Labels != nil && f.Labels.Trashed {
+			trashed = append(trashed, f.Id)
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	batch := new(leveldb.Batch)
+	for _, id := range trashed {
+		if err := d.RemoveFileById(id, batch); err != nil {
+			return 0, err
+		}
+	}
+	if err := d.db.Write(batch, nil); err != nil {
+		return 0, err
+	}
+	return len(trashed), nil
+}
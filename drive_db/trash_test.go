@@ -0,0 +1,180 @@
+package drive_db
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+
+	gdrive "code.google.com/p/google-api-go-client/drive/v2"
+)
+
+func TestEmptyTrashQuarantined(t *testing.T) {
+	fd := newFakeDrive()
+	fd.folder("old", "old")
+	fd.file("kid", "kid.txt", "k", "old")
+	fd.file("t", "t.txt", "t")
+	fd.folder("dir", "dir")
+	fd.file("keep", "keep.txt", "x", "dir")
+	for _, id := range []string{"old", "kid", "t"} {
+		fd.update(id, func(f *gdrive.File) { f.Labels.Trashed = true })
+	}
+	d := newTestDB(t, fd, &DriveDBOptions{TrashMode: Quarantine})
+
+	trash := func() string {
+		t.Helper()
+		ids, err := d.ChildFileIds(trashFileId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(ids)
+		return strings.Join(ids, " ")
+	}
+	if got := trash(); got != "kid old t" {
+		t.Fatalf("trash holds %q, want kid old t", got)
+	}
+	inode, err := d.InodeForFileId("keep")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := d.EmptyTrash()
+	if err != nil || n != 3 {
+		t.Errorf("EmptyTrash() = %d, %v, want 3", n, err)
+	}
+	if got := trash(); got != "" {
+		t.Errorf("after EmptyTrash, trash holds %q", got)
+	}
+	for _, id := range []string{"old", "kid", "t"} {
+		if _, err := d.FileById(id); err == nil {
+			t.Errorf("after EmptyTrash, %s is still in the db", id)
+		}
+	}
+	if got := orphans(t, d); got != "" {
+		t.Errorf("after EmptyTrash, orphans = %q", got)
+	}
+
+	// Files not in the trash are untouched, then and once Drive's changes
+	// for the purge are applied.
+	check := func(when string) {
+		t.Helper()
+		if p, err := d.PathForInode(inode); err != nil || p != "/dir/keep.txt" {
+			t.Errorf("%s, PathForInode(keep) = %q, %v, want /dir/keep.txt", when, p, err)
+		}
+	}
+	check("after EmptyTrash")
+	resync(t, d, fd)
+	check("after syncing the purge")
+	if got := trash(); got != "" {
+		t.Errorf("after syncing the purge, trash holds %q", got)
+	}
+}
+
+func TestTrashFile(t *testing.T) {
+	for _, mode := range []TrashMode{Drop, Keep, Quarantine} {
+		t.Run(mode.String(), func(t *testing.T) {
+			fd := newFakeDrive()
+			fd.folder("dir", "dir")
+			fd.file("f", "f.txt", "f", "dir")
+			d := newTestDB(t, fd, &DriveDBOptions{TrashMode: mode})
+			inode, err := d.InodeForFileId("f")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := d.TrashFile("f"); err != nil {
+				t.Fatalf("TrashFile(f): %v", err)
+			}
+			if !fd.get("f").Labels.Trashed {
+				t.Errorf("TrashFile(f) didn't trash it in Drive")
+			}
+			want := map[TrashMode]string{Keep: "/dir/f.txt", Quarantine: "/" + trashTitle + "/f.txt"}[mode]
+			if p, err := d.PathForInode(inode); mode == Drop && err == nil || mode != Drop && p != want {
+				t.Errorf("once trashed, PathForInode(f) = %q, %v, want %q", p, err, want)
+			}
+			if f, err := d.FileByInode(inode); mode != Drop && (err != nil || !f.Trashed()) {
+				t.Errorf("once trashed, FileByInode(f) = %v, %v, want it Trashed", f, err)
+			}
+
+			// Untrashed, it's back where it was, at the same inode.
+			untrash := func(when string) {
+				t.Helper()
+				if err := d.UntrashFile("f"); err != nil {
+					t.Fatalf("%s, UntrashFile(f): %v", when, err)
+				}
+				if fd.get("f").Labels.Trashed {
+					t.Errorf("%s, UntrashFile(f) didn't untrash it in Drive", when)
+				}
+				inode, err := d.InodeForFileId("f")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if p, err := d.PathForInode(inode); err != nil || p != "/dir/f.txt" {
+					t.Errorf("%s, PathForInode(f) = %q, %v, want /dir/f.txt", when, p, err)
+				}
+				if f, err := d.FileByInode(inode); err != nil || f.Trashed() {
+					t.Errorf("%s, FileByInode(f) = %v, %v, want it untrashed", when, f, err)
+				}
+			}
+			untrash("untrashed")
+			if again, err := d.InodeForFileId("f"); err != nil || again != inode {
+				t.Errorf("untrashed, f has inode %d, %v, want %d", again, err, inode)
+			}
+
+			// Even once its mapping's gone, it gets one again.
+			if mode == Drop {
+				if err := d.TrashFile("f"); err != nil {
+					t.Fatal(err)
+				}
+				if err := d.db.Delete(fileIdToInodeKey("f"), nil); err != nil {
+					t.Fatal(err)
+				}
+				untrash("untrashed without a mapping")
+			}
+
+			if err := d.TrashFile("gone"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("TrashFile of a file not in Drive = %v, want ErrNotFound", err)
+			}
+		})
+	}
+}
+
+func TestTrashModes(t *testing.T) {
+	for _, tc := range []struct {
+		mode TrashMode
+		path string // of the trashed file, or "" if it's dropped
+	}{
+		{Drop, ""},
+		{Keep, "/dir/f.txt"},
+		{Quarantine, "/" + trashTitle + "/f.txt"},
+	} {
+		t.Run(tc.mode.String(), func(t *testing.T) {
+			d := newTestDB(t, newFakeDrive(), &DriveDBOptions{TrashMode: tc.mode})
+			apply(t, d, testFolder("dir", "dir"), testFile("f", "f.txt", "dir"))
+			inode, err := d.InodeForFileId("f")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			trashed := testFile("f", "f.txt", "dir")
+			trashed.Labels.Trashed = true
+			apply(t, d, trashed)
+			f, err := d.FileByInode(inode)
+			if tc.path == "" {
+				if err == nil {
+					t.Errorf("a trashed file is kept: %v", f)
+				}
+				if ids, err := d.ChildFileIds("dir"); err != nil || len(ids) != 0 {
+					t.Errorf("ChildFileIds(dir) = %v, %v, want none once its child's trashed", ids, err)
+				}
+				return
+			}
+			if err != nil || !f.Trashed() {
+				t.Errorf("FileByInode(f) = %v, %v, want it kept, Trashed", f, err)
+			}
+			if p, err := d.PathForInode(inode); err != nil || p != tc.path {
+				t.Errorf("PathForInode(f) = %q, %v, want %q", p, err, tc.path)
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package drive_db
+
+// Uploading file content with Drive's resumable upload protocol, so that a
+// connection dropped part way through a large upload costs a chunk, rather
+// than the whole upload.
+//
+// The drive/v2 client can only upload in one request, so the protocol is
+// spoken directly: a session is started for the file, then the content is
+// sent to it uploadChunkSize bytes at a time. If sending a chunk fails, Drive
+// is asked how much of it arrived, and the rest is sent again.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	gdrive "code.google.com/p/google-api-go-client/drive/v2"
+	"code.google.com/p/google-api-go-client/googleapi"
+)
+
+// uploadChunkSize is the size of the chunks content is uploaded in, which
+// Drive requires to be a multiple of 256KB. Each is buffered in memory, to be
+// sent again if need be.
+var uploadChunkSize = 8 << 20
+
+// statusResumeIncomplete is the status with which Drive acknowledges a chunk
+// which isn't the last.
+const statusResumeIncomplete = 308
+
+// uploadContent replaces the content of fileId with that read from r, which
+// is size bytes long, or -1 if that isn't known in advance, and returns the
+// file's new metadata.
+func (d *DriveDB) uploadContent(fileId string, r io.Reader, size int64) (*gdrive.File, error) {
+	var session string
+	err := d.retry("files.update", func() (err error) {
+		session, err = d.startUpload(fileId, size)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, uploadChunkSize)
+	var offset int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return nil, err
+		}
+		f, err := d.sendChunk(session, buf[:n], offset, last)
+		if err != nil || last {
+			return f, err
+		}
+		offset += int64(n)
+	}
+}
+
+// startUpload starts a resumable upload of size bytes (-1 if unknown) to
+// fileId, returning the url of its session.
+func (d *DriveDB) startUpload(fileId string, size int64) (string, error) {
+	url := "https://www.googleapis.com/upload/drive/v2/files/" + fileId + "?uploadType=resumable"
+	req, err := http.NewRequest("PUT", url, strings.NewReader("{}"))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	if size >= 0 {
+		req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(size, 10))
+	}
+	resp, err := d.uploads.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return "", err
+	}
+	session := resp.Header.Get("Location")
+	if session == "" {
+		return "", fmt.Errorf("upload of %v started without a session url", fileId)
+	}
+	return session, nil
+}
+
+// sendChunk sends chunk, which starts at offset in the content, to the upload
+// session, and if it's the last, returns the file's new metadata. If sending
+// it fails transiently, it's retried, from the first byte Drive didn't get.
+func (d *DriveDB) sendChunk(session string, chunk []byte, offset int64, last bool) (*gdrive.File, error) {
+	end := offset + int64(len(chunk))
+	total := "*"
+	if last {
+		total = strconv.FormatInt(end, 10)
+	}
+	var f *gdrive.File
+	from := offset // the first byte Drive hasn't got
+	err := d.retry("files.update", func() error {
+		for {
+			sent := from
+			var err error
+			f, from, err = d.putRange(session, chunk[from-offset:], from, total)
+			if err != nil {
+				// Resume from wherever Drive got to.
+				if got, serr := d.uploadStatus(session, total); serr == nil && got >= offset && got <= end {
+					from = got
+				}
+				return err
+			}
+			switch {
+			case from < offset || from > end:
+				return fmt.Errorf("upload session has %d bytes, but %d to %d were sent", from, offset, end)
+			case f != nil || (!last && from == end):
+				return nil
+			case from == sent:
+				return fmt.Errorf("upload session took none of bytes %d to %d", sent, end)
+			}
+			// Drive took part of the chunk: send it the rest.
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// putRange sends data, which starts at offset in content of total bytes
+// ("*" if not yet known), to the upload session. It returns the file's new
+// metadata if that completed the upload, and the number of bytes Drive has.
+func (d *DriveDB) putRange(session string, data []byte, offset int64, total string) (*gdrive.File, int64, error) {
+	req, err := http.NewRequest("PUT", session, bytes.NewReader(data))
+	if err != nil {
+		return nil, offset, err
+	}
+	if len(data) > 0 {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%s", offset, offset+int64(len(data))-1, total))
+	} else {
+		req.Header.Set("Content-Range", "bytes */"+total)
+	}
+	return d.doUpload(req, offset)
+}
+
+// uploadStatus asks the upload session how many bytes it has.
+func (d *DriveDB) uploadStatus(session, total string) (int64, error) {
+	req, err := http.NewRequest("PUT", session, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Range", "bytes */"+total)
+	_, got, err := d.doUpload(req, 0)
+	return got, err
+}
+
+// doUpload makes a request of an upload session, returning the file's
+// metadata if the upload is complete, and otherwise the number of bytes Drive
+// has, or offset if the request failed.
+func (d *DriveDB) doUpload(req *http.Request, offset int64) (*gdrive.File, int64, error) {
+	resp, err := d.uploads.Do(req)
+	if err != nil {
+		return nil, offset, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == statusResumeIncomplete {
+		// The Range received, if any, is "bytes=0-<last byte>".
+		var got int64
+		if r := resp.Header.Get("Range"); r != "" {
+			i := strings.LastIndex(r, "-")
+			last, err := strconv.ParseInt(r[i+1:], 10, 64)
+			if i < 0 || err != nil {
+				return nil, offset, fmt.Errorf("upload session has an unparseable range %q", r)
+			}
+			got = last + 1
+		}
+		return nil, got, nil
+	}
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return nil, offset, err
+	}
+	var f gdrive.File
+	if err := json.NewDecoder(resp.Body).Decode(&f); err != nil {
+		return nil, offset, err
+	}
+	return &f, offset, nil
+}
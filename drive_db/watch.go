@@ -0,0 +1,178 @@
+package drive_db
+
+// Drive can push a notification to a webhook whenever there are changes, so
+// they're read promptly instead of at the next poll. Polling continues, as
+// notifications may be lost, so the poll interval still bounds how stale the
+// db can be.
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	gdrive "code.google.com/p/google-api-go-client/drive/v2"
+)
+
+const (
+	// watchRenewal is how long before a watch channel expires that it's
+	// replaced, leaving time to retry if the replacement can't be made.
+	watchRenewal = 10 * time.Minute
+	// watchLifetime is how long a watch channel is assumed to last if Drive
+	// doesn't say.
+	watchLifetime = time.Hour
+)
+
+// accountPath returns the path of an HTTP handler of this db: base, with
+// /<Account> appended if the db is one of several accounts'.
+func (d *DriveDB) accountPath(base string) string {
+	if d.opts.Account != "" {
+		return base + "/" + d.opts.Account
+	}
+	return base
+}
+
+// handlerKey is a path of a mux.
+type handlerKey struct {
+	mux  *http.ServeMux
+	path string
+}
+
+// accountHandlers are the handlers served at each path by handleAccount.
+// http.ServeMux can't unregister a handler, so each path is registered once
+// on each mux, and served by whichever open db last asked for it.
+var accountHandlers = struct {
+	sync.Mutex
+	m map[handlerKey]*http.HandlerFunc
+}{m: make(map[handlerKey]*http.HandlerFunc)}
+
+// handleAccount serves h at d.accountPath(base) on opts.Mux until d is
+// closed, and returns the path.
+func (d *DriveDB) handleAccount(base string, h http.HandlerFunc) string {
+	mux := d.opts.Mux
+	if mux == nil {
+		mux = http.DefaultServeMux
+	}
+	path := d.accountPath(base)
+	key := handlerKey{mux, path}
+	accountHandlers.Lock()
+	_, registered := accountHandlers.m[key]
+	accountHandlers.m[key] = &h
+	accountHandlers.Unlock()
+	if !registered {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			accountHandlers.Lock()
+			h := accountHandlers.m[key]
+			accountHandlers.Unlock()
+			if h == nil {
+				http.NotFound(w, r)
+				return
+			}
+			(*h)(w, r)
+		})
+	}
+	d.run(func() {
+		<-d.ctx.Done()
+		accountHandlers.Lock()
+		defer accountHandlers.Unlock()
+		if accountHandlers.m[key] == &h {
+			accountHandlers.m[key] = nil
+		}
+	})
+	return path
+}
+
+// randomId returns a random string, usable as a channel id or token.
+func randomId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%x", b)
+}
+
+// watchChanges serves the notifications of a Drive watch channel, calling
+// trigger for each, and keeps the channel alive: channels expire, so a new
+// one is registered watchRenewal before the current one does, after which
+// the current one is stopped. If a channel can't be registered, it's retried
+// after a poll interval, in which time polling picks up the changes.
+func (d *DriveDB) watchChanges(trigger func()) {
+	var mu sync.Mutex
+	var current *gdrive.Channel // guarded by mu
+	notifyPath := d.handleAccount("/notify", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ch := current
+		mu.Unlock()
+		if ch == nil || r.Header.Get("X-Goog-Channel-ID") != ch.Id || r.Header.Get("X-Goog-Channel-Token") != ch.Token {
+			http.Error(w, "unknown channel", http.StatusNotFound)
+			return
+		}
+		// "sync" is sent when the channel is created, not for a change.
+		if r.Header.Get("X-Goog-Resource-State") != "sync" {
+			trigger()
+		}
+	})
+
+	for {
+		ch, err := d.watch(d.opts.WatchURL + notifyPath)
+		if err != nil {
+			d.syncError(apiErrorKind(err), "changes.watch", err)
+			select {
+			case <-time.After(d.pollInterval):
+			case <-d.ctx.Done():
+				return
+			}
+			continue
+		}
+		mu.Lock()
+		old := current
+		current = ch
+		mu.Unlock()
+		if old != nil {
+			if err := d.service.Channels.Stop(old).Do(); err != nil {
+				d.opts.Logger.Warnf("could not stop watch channel %v: %v", old.Id, err)
+			}
+		}
+
+		expires := time.Now().Add(watchLifetime)
+		if ch.Expiration > 0 {
+			expires = time.Unix(0, ch.Expiration*int64(time.Millisecond))
+		}
+		wait := expires.Sub(time.Now()) - watchRenewal
+		if wait < time.Minute {
+			wait = time.Minute
+		}
+		d.opts.Logger.Debugf("watch channel %v expires at %v, renewing in %v", ch.Id, expires, wait)
+		select {
+		case <-time.After(wait):
+		case <-d.ctx.Done():
+			// Drive would otherwise keep notifying us until it expires.
+			if err := d.service.Channels.Stop(ch).Do(); err != nil {
+				d.opts.Logger.Warnf("could not stop watch channel %v: %v", ch.Id, err)
+			}
+			return
+		}
+	}
+}
+
+// watch registers a new watch channel for changes, notifying address.
+func (d *DriveDB) watch(address string) (*gdrive.Channel, error) {
+	req := &gdrive.Channel{
+		Id:      randomId(),
+		Token:   randomId(),
+		Type:    "web_hook",
+		Address: address,
+	}
+	var ch *gdrive.Channel
+	err := d.retry("changes.watch", func() (err error) {
+		ch, err = d.service.Changes.Watch(req).IncludeDeleted(true).IncludeSubscribed(true).Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Notifications are checked against our token, whether or not it's echoed.
+	ch.Token = req.Token
+	return ch, nil
+}
@@ -0,0 +1,150 @@
+package drive_db
+
+// Changes made through the filesystem, applied to Drive and then to the db,
+// so they're visible locally without waiting for the next change poll.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	gdrive "code.google.com/p/google-api-go-client/drive/v2"
+	"code.google.com/p/google-api-go-client/googleapi"
+)
+
+var (
+	// ErrQuotaExceeded is returned when a write fails because the account
+	// has run out of storage.
+	ErrQuotaExceeded = fmt.Errorf("drive_db: storage quota exceeded")
+	// ErrExists is returned when creating a file whose title is already
+	// taken in the parent folder.
+	ErrExists = fmt.Errorf("drive_db: file exists")
+)
+
+// CreateFile creates an empty file in Drive, in the folder parentId, and adds
+// it to the db, so it's immediately listed among the folder's children.
+// Drive allows several files of the same title in a folder, but they can't all
+// be reached by name through the filesystem, so CreateFile refuses to create
+// one, returning ErrExists.
+func (d *DriveDB) CreateFile(parentId, title, mimeType string) (*File, error) {
+	// Otherwise two creates of the same title could both find it free.
+	d.createmu.Lock()
+	defer d.createmu.Unlock()
+	exists, err := d.childExists(parentId, title)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, ErrExists
+	}
+	f := &gdrive.File{
+		Title:    title,
+		MimeType: mimeType,
+		Parents:  []*gdrive.ParentReference{&gdrive.ParentReference{Id: parentId}},
+	}
+	f, err = d.service.Files.Insert(f).Do()
+	if err != nil {
+		// Not writeError: a 404 needn't mean the folder is gone, and if it
+		// is, the sync removes it.
+		return nil, translateWriteError(err)
+	}
+	debug.Printf("Child of %v created in drive: %+v", parentId, f)
+	return d.UpdateFile(nil, f)
+}
+
+// RenameFile retitles fileId, unless newTitle is empty, and moves it into the
+// folders addParents and out of the folders removeParents, then updates the
+// db to match. The file keeps its inode, so open handles remain valid.
+func (d *DriveDB) RenameFile(fileId, newTitle string, addParents, removeParents []string) error {
+	p := d.service.Files.Patch(fileId, &gdrive.File{Title: newTitle})
+	if len(addParents) > 0 {
+		p = p.AddParents(strings.Join(addParents, ","))
+	}
+	if len(removeParents) > 0 {
+		p = p.RemoveParents(strings.Join(removeParents, ","))
+	}
+	f, err := p.Do()
+	if err != nil {
+		return d.writeError(fileId, err)
+	}
+	_, err = d.UpdateFile(nil, f)
+	return err
+}
+
+// childExists reports whether the folder parentId has a child titled title.
+func (d *DriveDB) childExists(parentId, title string) (bool, error) {
+	ids, err := d.ChildFileIds(parentId)
+	if err != nil {
+		return false, err
+	}
+	for _, id := range ids {
+		f, err := d.FileById(id)
+		if err != nil {
+			continue
+		}
+		if f.Title == title {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// UpdateContents replaces the contents of the file with those read from r,
+// which are size bytes long, or -1 if that isn't known in advance. The db is
+// updated with the metadata Drive returns, and the file's cached data is
+// dropped. If the file has been deleted or trashed in the meantime, it is
+// removed from the db and ErrNotFound is returned.
+func (d *DriveDB) UpdateContents(fileId string, r io.Reader, size int64) (*gdrive.File, error) {
+	if size >= 0 {
+		r = io.LimitReader(r, size)
+	}
+	f, err := d.uploadContent(fileId, r, size)
+	if err != nil {
+		return nil, d.writeError(fileId, err)
+	}
+	if size >= 0 && f.FileSize != size {
+		log.Printf("uploaded %d bytes of %v, but Drive reports %d", size, fileId, f.FileSize)
+	}
+	d.clearDataCache(fileId)
+	if _, err := d.UpdateFile(nil, f); err != nil {
+		return f, err
+	}
+	d.FlushCachedInodeForFileId(fileId)
+	return f, nil
+}
+
+// writeError translates the error from a failed write to fileId, as
+// translateWriteError does, and removes fileId from the db if it's gone.
+func (d *DriveDB) writeError(fileId string, err error) error {
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) && gerr.Code == 404 {
+		if rerr := d.RemoveFileById(fileId, nil); rerr != nil {
+			log.Printf("failed to remove %v after it was not found: %v", fileId, rerr)
+		}
+	}
+	return translateWriteError(err)
+}
+
+// translateWriteError translates the error from a failed write: a file that's
+// gone (Drive reports trashed files as not found to writes) is ErrNotFound,
+// and quota errors are distinguished from other failures.
+func translateWriteError(err error) error {
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) {
+		return err
+	}
+	switch {
+	case gerr.Code == 404:
+		return wrapError(ErrNotFound, err)
+	case gerr.Code == 403 && isQuotaExceeded(gerr):
+		return wrapError(ErrQuotaExceeded, err)
+	}
+	return apiError(err)
+}
+
+func isQuotaExceeded(gerr *googleapi.Error) bool {
+	msg := strings.ToLower(gerr.Message + gerr.Body)
+	return strings.Contains(msg, "quotaexceeded") || strings.Contains(msg, "quota has been exceeded")
+}
@@ -0,0 +1,157 @@
+package drive_db
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUpdateContentsResumes(t *testing.T) {
+	defer func(old int) { uploadChunkSize = old }(uploadChunkSize)
+	uploadChunkSize = 4
+
+	fd := newFakeDrive()
+	fd.file("f", "f.txt", "old")
+	d := newTestDB(t, fd, nil)
+
+	// Fail the second chunk, after Drive has the first.
+	var requests []string
+	fd.setBefore(func(op string, req *http.Request) error {
+		if op == "files.upload" {
+			requests = append(requests, req.Header.Get("Content-Range"))
+			if len(requests) == 3 {
+				fd.failNext(op, 503)
+			}
+		}
+		return nil
+	})
+	content := "hello world!"
+	f, err := d.UpdateContents("f", strings.NewReader(content), int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"",             // start the session
+		"bytes 0-3/*",  // hell
+		"bytes 4-7/*",  // o wo, which fails
+		"bytes */*",    // how much did Drive get?
+		"bytes 4-7/*",  // o wo again
+		"bytes 8-11/*", // rld!
+		"bytes */12",   // the end
+	}
+	if strings.Join(requests, ",") != strings.Join(want, ",") {
+		t.Errorf("upload requests had Content-Ranges %q, want %q", requests, want)
+	}
+	if got := string(fd.content["f"]); got != content {
+		t.Errorf("uploaded %q, want %q", got, content)
+	}
+	// The db has the metadata Drive returned.
+	stored, err := d.FileById("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Md5Checksum != f.Md5Checksum || stored.Md5Checksum != fd.get("f").Md5Checksum || stored.FileSize != int64(len(content)) {
+		t.Errorf("stored %+v after uploading, want Drive's %+v", stored, f)
+	}
+}
+
+func TestRenameFileKeepsInode(t *testing.T) {
+	fd := newFakeDrive()
+	fd.folder("x", "x")
+	fd.folder("y", "y")
+	fd.file("f", "f.txt", "f", "x")
+	d := newTestDB(t, fd, nil)
+
+	before, err := d.InodeForFileId("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.RenameFile("f", "g.txt", []string{"y"}, []string{"x"}); err != nil {
+		t.Fatal(err)
+	}
+	after, err := d.InodeForFileId("f")
+	if err != nil || after != before {
+		t.Errorf("after the move, InodeForFileId(f) = %d, %v, want %d", after, err, before)
+	}
+	if f, err := d.FileByPath("y/g.txt"); err != nil || f.Id != "f" {
+		t.Errorf("FileByPath(y/g.txt) = %v, %v, want f", f, err)
+	}
+	if ids, err := d.ChildFileIds("x"); err != nil || len(ids) != 0 {
+		t.Errorf("ChildFileIds(x) = %v, %v, want none", ids, err)
+	}
+}
+
+func TestCreateFile(t *testing.T) {
+	fd := newFakeDrive()
+	fd.folder("dir", "dir")
+	d := newTestDB(t, fd, nil)
+
+	f, err := d.CreateFile("dir", "new.txt", "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids, err := d.ChildFileIds("dir"); err != nil || len(ids) != 1 || ids[0] != f.Id {
+		t.Errorf("ChildFileIds(dir) = %v, %v, want [%v]", ids, err, f.Id)
+	}
+	if got, err := d.FileByPath("/dir/new.txt"); err != nil || got.Id != f.Id {
+		t.Errorf("FileByPath(/dir/new.txt) = %v, %v, want %v", got, err, f.Id)
+	}
+
+	// A title already taken is refused, without asking Drive.
+	inserts := fd.count("files.insert")
+	if _, err := d.CreateFile("dir", "new.txt", "text/plain"); !errors.Is(err, ErrExists) {
+		t.Errorf("creating a title already taken = %v, want ErrExists", err)
+	}
+	if n := fd.count("files.insert") - inserts; n != 0 {
+		t.Errorf("creating a title already taken made %d files.insert calls, want none", n)
+	}
+
+	// Of several creates of the same title at once, only one succeeds,
+	// however long Drive takes to make it.
+	fd.setBefore(func(op string, req *http.Request) error {
+		if op == "files.insert" {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return nil
+	})
+	const n = 8
+	errs := make(chan error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := d.CreateFile("dir", "racy.txt", "text/plain")
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	created := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			created++
+		case !errors.Is(err, ErrExists):
+			t.Errorf("CreateFile: %v", err)
+		}
+	}
+	if created != 1 {
+		t.Errorf("%d concurrent creates of the same title succeeded, want 1", created)
+	}
+	if n := fd.count("files.insert") - inserts; n != 1 {
+		t.Errorf("%d concurrent creates of the same title made %d files.insert calls, want 1", created, n)
+	}
+
+	// A folder Drive says isn't found is left to the sync to remove.
+	fd.failNext("files.insert", 404)
+	if _, err := d.CreateFile("dir", "lost.txt", "text/plain"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("creating in a folder Drive can't find = %v, want ErrNotFound", err)
+	}
+	if _, err := d.FileById("dir"); err != nil {
+		t.Errorf("after a create in it failed with a 404, FileById(dir): %v", err)
+	}
+}
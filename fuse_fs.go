@@ -4,12 +4,16 @@ package main
 // and Google Drive.
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	_ "net/http/pprof"
 	"os"
+	"sort"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"bazil.org/fuse"
@@ -26,6 +30,18 @@ import (
 const driveFolderMimeType string = "application/vnd.google-apps.folder"
 const blockSize uint32 = 4096
 
+// exportXattr is the extended attribute of a native Google file which names
+// the type it's exported as, e.g. "pdf" or "application/pdf".
+const exportXattr = "user.gdrive.export"
+
+// urlXattr is the read only extended attribute of a file which holds the link
+// that opens it in a browser.
+const urlXattr = "user.gdrive.url"
+
+// danglingShortcutPrefix begins the link of a shortcut whose target is gone,
+// followed by the shortcut's fileId.
+const danglingShortcutPrefix = ".missing-shortcut-target/"
+
 // serveConn holds the state about the fuse connection
 type serveConn struct {
 	db         *drive_db.DriveDB
@@ -36,12 +52,24 @@ type serveConn struct {
 	conn       *fuse.Conn
 	handles    []handle              // index is the handleid, inode=0 if free
 	writers    map[int]io.PipeWriter // index matches fh
+	account    uint64                // account number in a multi-account mount, else 0
 	sync.Mutex
 }
 
+// local returns the inode in sc.db of the node the kernel knows as n.
+func (sc *serveConn) local(n fuse.NodeID) uint64 {
+	return uint64(n) &^ (sc.account << accountShift)
+}
+
+// global returns the node the kernel knows the inode in sc.db by.
+func (sc *serveConn) global(inode uint64) fuse.NodeID {
+	return fuse.NodeID(sc.account<<accountShift | inode)
+}
+
 type handle struct {
 	inode    fuse.NodeID
 	writer   *io.PipeWriter
+	staged   *os.File // the staged copy being written, with --stagewrites
 	lastByte int64
 }
 
@@ -78,15 +106,22 @@ func (sc *serveConn) serve(req fuse.Request) {
 
 	case *fuse.StatfsRequest:
 		var numfiles uint64
-		if f, err := sc.db.AllFileIds(); err != nil {
-			numfiles = uint64(len(f))
+		if files, folders, err := sc.db.Counts(); err == nil {
+			numfiles = uint64(files + folders)
+		}
+		resp := &fuse.StatfsResponse{
+			Files: numfiles,
+			Bsize: blockSize,
+		}
+		// Report the quota as the size of the filesystem, if it's limited.
+		if used, total, err := sc.db.Quota(); err == nil && total > 0 {
+			resp.Blocks = uint64(total) / uint64(blockSize)
+			if used < total {
+				resp.Bfree = uint64(total-used) / uint64(blockSize)
+			}
+			resp.Bavail = resp.Bfree
 		}
-		req.Respond(
-			&fuse.StatfsResponse{
-				Files: numfiles,
-				Bsize: blockSize,
-			},
-		)
+		req.Respond(resp)
 
 	case *fuse.GetattrRequest:
 		sc.getattr(req)
@@ -102,16 +137,28 @@ func (sc *serveConn) serve(req fuse.Request) {
 	case *fuse.OpenRequest:
 		sc.open(req)
 
-	// Silently ignore attempts to change permissions
+	// Silently ignore attempts to change permissions, and truncate staged
+	// writes
 	case *fuse.SetattrRequest:
-		inode := uint64(req.Header.Node)
+		inode := sc.local(req.Header.Node)
 		f, err := sc.db.FileByInode(inode)
 		if err != nil {
 			fuse.Debug(fmt.Sprintf("FileByInode(%v): %v", inode, err))
 			req.RespondError(fuse.EIO)
 			return
 		}
-		req.Respond(&fuse.SetattrResponse{Attr: sc.attrFromFile(*f)})
+		attr := sc.attrFromFile(*f)
+		if sf := sc.stagedFile(req.Header.Node); sf != nil {
+			if req.Valid.Size() {
+				if err := sc.truncateStaged(inode, sf, int64(req.Size)); err != nil {
+					debug.Printf("truncating staged %v: %v", f.Id, err)
+					req.RespondError(fuse.EIO)
+					return
+				}
+			}
+			sc.stagedAttr(&attr, sf)
+		}
+		req.Respond(&fuse.SetattrResponse{Attr: attr})
 
 	case *fuse.CreateRequest:
 		// TODO: if allow_other, require uid == invoking uid to allow writes
@@ -146,20 +193,53 @@ func (sc *serveConn) serve(req fuse.Request) {
 
 	// Ack that the kernel has forgotten the metadata about an inode
 	case *fuse.FlushRequest:
-		req.Respond()
+		sc.flush(req)
 
 	// Ack release of the kernel's mapping an inode->fileId
 	case *fuse.ReleaseRequest:
 		sc.release(req)
 
+	// Drive shortcuts are presented as symlinks
+	case *fuse.ReadlinkRequest:
+		sc.readlink(req)
+
+	// The xattrs are exportXattr, of native Google files, and urlXattr
+	case *fuse.GetxattrRequest:
+		sc.getxattr(req)
+
+	case *fuse.ListxattrRequest:
+		sc.listxattr(req)
+
+	case *fuse.SetxattrRequest:
+		sc.setxattr(req)
+
+	case *fuse.RemovexattrRequest:
+		sc.removexattr(req)
+
 	case *fuse.DestroyRequest:
 		req.Respond()
 	}
 }
 
+// invalidate tells the kernel to drop its cached attributes for each inode
+// which changes in Drive, and its cached data too if the content changed,
+// until changes is closed.
+func (sc *serveConn) invalidate(changes <-chan drive_db.InodeChange) {
+	for c := range changes {
+		var size int64 // just the attributes
+		if c.ContentChanged {
+			size = -1 // and all of the data
+		}
+		err := sc.conn.InvalidateNode(sc.global(c.Inode), 0, size)
+		if err != nil && err != fuse.ErrNotCached {
+			debug.Printf("InvalidateNode(%v) after %v of %v: %v", c.Inode, c.Kind, c.FileId, err)
+		}
+	}
+}
+
 // gettattr returns fuse.Attr for the inode described by req.Header.Node
 func (sc *serveConn) getattr(req *fuse.GetattrRequest) {
-	inode := uint64(req.Header.Node)
+	inode := sc.local(req.Header.Node)
 	f, err := sc.db.FileByInode(inode)
 	if err != nil {
 		fuse.Debug(fmt.Sprintf("FileByInode(%v): %v", inode, err))
@@ -167,20 +247,18 @@ func (sc *serveConn) getattr(req *fuse.GetattrRequest) {
 		return
 	}
 
-	/* TODO: getattr during upload must return current file size
-	sc.Lock()
-	sc.Unlock()
-	*/
-
 	resp := &fuse.GetattrResponse{}
 	resp.Attr = sc.attrFromFile(*f)
+	if sf := sc.stagedFile(req.Header.Node); sf != nil {
+		sc.stagedAttr(&resp.Attr, sf) // the size written so far
+	}
 	fuse.Debug(resp)
 	req.Respond(resp)
 }
 
 // Return a Dirent for all children of an inode, or ENOENT
 func (sc *serveConn) lookup(req *fuse.LookupRequest) {
-	inode := uint64(req.Header.Node)
+	inode := sc.local(req.Header.Node)
 	resp := &fuse.LookupResponse{}
 	var err error
 	file, err := sc.db.FileByInode(inode)
@@ -189,28 +267,43 @@ func (sc *serveConn) lookup(req *fuse.LookupRequest) {
 		req.RespondError(fuse.ENOENT)
 		return
 	}
-	for _, cInode := range file.Children {
-		cf, err := sc.db.FileByInode(cInode)
-		if err != nil {
-			fuse.Debug(fmt.Sprintf("FileByInode(%v): %v", cInode, err))
-			req.RespondError(fuse.EIO)
-			return
-		}
-		if cf.Title == req.Name {
-			resp.Node = fuse.NodeID(cInode)
-			resp.EntryValid = *driveMetadataLatency
-			resp.Attr = sc.attrFromFile(*cf)
-			fuse.Debug(fmt.Sprintf("Lookup(%v in %v): %v", req.Name, inode, cInode))
-			req.Respond(resp)
-			return
-		}
+	children, err := sc.db.ChildrenWithUniqueNames(file.Id)
+	if err != nil {
+		fuse.Debug(fmt.Sprintf("ChildrenWithUniqueNames(%v): %v", file.Id, err))
+		req.RespondError(fuse.EIO)
+		return
+	}
+	children = dotHidden(children)
+	if cf, ok := children[req.Name]; ok {
+		resp.Node = sc.global(cf.Inode)
+		resp.EntryValid = *driveMetadataLatency
+		resp.Attr = sc.attrFromFile(*cf)
+		fuse.Debug(fmt.Sprintf("Lookup(%v in %v): %v", req.Name, inode, cf.Inode))
+		req.Respond(resp)
+		return
 	}
 	fuse.Debug(fmt.Sprintf("Lookup(%v in %v): ENOENT", req.Name, inode))
 	req.RespondError(fuse.ENOENT)
 }
 
+// dotHidden renames the hidden files among children, which are only kept with
+// --showhidden, with a leading dot, so they're only listed by ls -a. A file
+// keeps its name if the dotted one is taken.
+func dotHidden(children map[string]*drive_db.File) map[string]*drive_db.File {
+	for name, f := range children {
+		if !f.Hidden() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		if _, taken := children["."+name]; !taken {
+			delete(children, name)
+			children["."+name] = f
+		}
+	}
+	return children
+}
+
 func (sc *serveConn) readDir(req *fuse.ReadRequest) {
-	inode := uint64(req.Header.Node)
+	inode := sc.local(req.Header.Node)
 	resp := &fuse.ReadResponse{make([]byte, 0, req.Size)}
 	var dirs []fuse.Dirent
 	file, err := sc.db.FileByInode(inode)
@@ -220,18 +313,35 @@ func (sc *serveConn) readDir(req *fuse.ReadRequest) {
 		return
 	}
 
-	for _, inode := range file.Children {
-		f, err := sc.db.FileByInode(inode)
-		if err != nil {
-			fuse.Debug(fmt.Sprintf("child: FileByInode(%d): %v", inode, err))
-			req.RespondError(fuse.EIO)
-			return
-		}
+	// List the children as of one moment, not a mixture of before and
+	// after a concurrent change.
+	snap, err := sc.db.Snapshot()
+	if err != nil {
+		fuse.Debug(fmt.Sprintf("Snapshot(): %v", err))
+		req.RespondError(fuse.EIO)
+		return
+	}
+	defer snap.Release()
+	children, err := snap.ChildrenWithUniqueNames(file.Id)
+	if err != nil {
+		fuse.Debug(fmt.Sprintf("ChildrenWithUniqueNames(%v): %v", file.Id, err))
+		req.RespondError(fuse.EIO)
+		return
+	}
+	children = dotHidden(children)
+	// Sorted, so the listing is the same from one read of it to the next.
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := children[name]
 		childType := fuse.DT_File
-		if f.MimeType == driveFolderMimeType {
+		if f.IsDir() {
 			childType = fuse.DT_Dir
 		}
-		dirs = append(dirs, fuse.Dirent{Inode: f.Inode, Name: f.Title, Type: childType})
+		dirs = append(dirs, fuse.Dirent{Inode: uint64(sc.global(f.Inode)), Name: name, Type: childType})
 	}
 	fuse.Debug(fmt.Sprintf("%+v", dirs))
 	var data []byte
@@ -243,7 +353,7 @@ func (sc *serveConn) readDir(req *fuse.ReadRequest) {
 }
 
 func (sc *serveConn) read(req *fuse.ReadRequest) {
-	inode := uint64(req.Header.Node)
+	inode := sc.local(req.Header.Node)
 	resp := &fuse.ReadResponse{}
 	// Lookup which fileId this request refers to
 	f, err := sc.db.FileByInode(inode)
@@ -253,7 +363,29 @@ func (sc *serveConn) read(req *fuse.ReadRequest) {
 		return
 	}
 	debug.Printf("Read(title: %s, offset: %d, size: %d)\n", f.Title, req.Offset, req.Size)
-	resp.Data, err = sc.db.ReadFiledata(f.Id, req.Offset, int64(req.Size), f.FileSize)
+	if sf := sc.stagedFile(req.Header.Node); sf != nil {
+		// Read back what's been written, rather than what's in Drive,
+		// through every handle, as getattr reports the staged size.
+		data := make([]byte, req.Size)
+		n, err := sf.ReadAt(data, req.Offset)
+		switch {
+		case errors.Is(err, os.ErrClosed):
+			// Its handle was released, once its writes were uploaded.
+		case err != nil && err != io.EOF:
+			debug.Printf("reading staged %v: %v", f.Id, err)
+			req.RespondError(fuse.EIO)
+			return
+		default:
+			resp.Data = data[:n]
+			req.Respond(resp)
+			return
+		}
+	}
+	if f.IsNative() {
+		resp.Data, err = sc.db.ReadExport(f, req.Offset, int64(req.Size))
+	} else {
+		resp.Data, err = sc.db.ReadFiledata(f.Id, req.Offset, int64(req.Size), f.FileSize)
+	}
 	if err != nil && err != io.EOF {
 		debug.Printf("driveCache.Read (..%v..): %v", req.Offset, err)
 		req.RespondError(fuse.EIO)
@@ -262,24 +394,219 @@ func (sc *serveConn) read(req *fuse.ReadRequest) {
 	req.Respond(resp)
 }
 
+// exportable returns the native Google file described by h, or responds to
+// req with an error and returns nil.
+func (sc *serveConn) exportable(req fuse.Request, h fuse.Header) *drive_db.File {
+	inode := sc.local(h.Node)
+	f, err := sc.db.FileByInode(inode)
+	if err != nil {
+		debug.Printf("FileByInode(%d): %v", inode, err)
+		req.RespondError(fuse.EIO)
+		return nil
+	}
+	if !f.IsNative() {
+		req.RespondError(fuse.ErrNoXattr)
+		return nil
+	}
+	return f
+}
+
+// readlink responds with the path of a shortcut's target, relative to the
+// shortcut's folder, so it resolves within this mount wherever it's mounted.
+// A shortcut whose target is gone links to a name which doesn't exist, like
+// a dangling symlink.
+func (sc *serveConn) readlink(req *fuse.ReadlinkRequest) {
+	inode := sc.local(req.Header.Node)
+	f, err := sc.db.FileByInode(inode)
+	if err != nil {
+		req.RespondError(fuse.ENOENT)
+		return
+	}
+	if !f.IsShortcut() {
+		req.RespondError(fuse.Errno(syscall.EINVAL))
+		return
+	}
+	target, err := sc.db.ShortcutTarget(f)
+	if err == drive_db.ErrDanglingShortcut {
+		req.Respond(danglingShortcutPrefix + f.Id)
+		return
+	}
+	if err != nil {
+		fuse.Debug(fmt.Sprintf("ShortcutTarget(%v): %v", f.Id, err))
+		req.RespondError(fuse.EIO)
+		return
+	}
+	linkPath, err := sc.displayedPath(f.Id, make(map[string]bool))
+	if err != nil {
+		req.RespondError(fuse.EIO)
+		return
+	}
+	targetPath, err := sc.displayedPath(target.Id, make(map[string]bool))
+	if err != nil {
+		req.Respond(danglingShortcutPrefix + f.Id)
+		return
+	}
+	// One ".." for each folder the shortcut is in, below the root.
+	up := strings.Count(linkPath, "/") - 1
+	req.Respond(strings.Repeat("../", up) + strings.TrimPrefix(targetPath, "/"))
+}
+
+// displayedPath returns the path of fileId from the root by the names it and
+// its folders are listed by, which unlike the titles PathForInode joins are
+// numbered if they're shared, dotted if hidden and given the extensions of
+// their exports. Of several paths, that through the first parent which leads
+// to the root is returned. walking holds the fileIds below fileId, to break
+// cycles.
+func (sc *serveConn) displayedPath(fileId string, walking map[string]bool) (string, error) {
+	if sc.db.IsRoot(fileId) {
+		return "/", nil
+	}
+	if walking[fileId] {
+		return "", drive_db.ErrNotFound
+	}
+	walking[fileId] = true
+	defer delete(walking, fileId)
+
+	parents, err := sc.db.ParentFileIds(fileId)
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(parents)
+	for _, pId := range parents {
+		parentPath, err := sc.displayedPath(pId, walking)
+		if err != nil {
+			continue
+		}
+		children, err := sc.db.ChildrenWithUniqueNames(pId)
+		if err != nil {
+			return "", err
+		}
+		for name, cf := range dotHidden(children) {
+			if cf.Id == fileId {
+				return strings.TrimSuffix(parentPath, "/") + "/" + name, nil
+			}
+		}
+	}
+	return "", drive_db.ErrNotFound
+}
+
+func (sc *serveConn) getxattr(req *fuse.GetxattrRequest) {
+	if req.Name == urlXattr {
+		url, err := sc.db.WebViewURL(sc.local(req.Header.Node))
+		if err != nil {
+			req.RespondError(fuse.ENOENT)
+			return
+		}
+		if url == "" {
+			req.RespondError(fuse.ErrNoXattr)
+			return
+		}
+		req.Respond(&fuse.GetxattrResponse{Xattr: []byte(url)})
+		return
+	}
+	if req.Name != exportXattr {
+		req.RespondError(fuse.ErrNoXattr)
+		return
+	}
+	f := sc.exportable(req, req.Header)
+	if f == nil {
+		return
+	}
+	mimeType := sc.db.ExportFormat(f.Id)
+	if mimeType == "" {
+		mimeType = sc.db.DefaultExportType(f.MimeType)
+	}
+	req.Respond(&fuse.GetxattrResponse{Xattr: []byte(mimeType)})
+}
+
+func (sc *serveConn) listxattr(req *fuse.ListxattrRequest) {
+	resp := &fuse.ListxattrResponse{}
+	inode := sc.local(req.Header.Node)
+	if f, err := sc.db.FileByInode(inode); err == nil {
+		if f.IsNative() {
+			resp.Append(exportXattr)
+		}
+		if f.WebViewURL() != "" {
+			resp.Append(urlXattr)
+		}
+	}
+	req.Respond(resp)
+}
+
+// setxattr chooses the export type of a native Google file, by MIME type or
+// by one of the names in drive_db.ExportTypesByName.
+func (sc *serveConn) setxattr(req *fuse.SetxattrRequest) {
+	if req.Name != exportXattr {
+		req.RespondError(fuse.Errno(syscall.ENOTSUP))
+		return
+	}
+	f := sc.exportable(req, req.Header)
+	if f == nil {
+		return
+	}
+	mimeType := strings.TrimSpace(string(req.Xattr))
+	if t, ok := drive_db.ExportTypesByName[strings.ToLower(mimeType)]; ok {
+		mimeType = t
+	}
+	if _, ok := f.ExportLinks[mimeType]; !ok {
+		debug.Printf("%q cannot be exported as %q", f.Title, mimeType)
+		req.RespondError(fuse.Errno(syscall.EINVAL))
+		return
+	}
+	sc.setExportFormat(req, f, mimeType)
+}
+
+func (sc *serveConn) removexattr(req *fuse.RemovexattrRequest) {
+	if req.Name != exportXattr {
+		req.RespondError(fuse.ErrNoXattr)
+		return
+	}
+	f := sc.exportable(req, req.Header)
+	if f == nil {
+		return
+	}
+	sc.setExportFormat(req, f, "")
+}
+
+// setExportFormat records the export type of f, and has the kernel forget
+// the content of its previous one.
+func (sc *serveConn) setExportFormat(req fuse.Request, f *drive_db.File, mimeType string) {
+	if err := sc.db.SetExportFormat(f.Id, mimeType); err != nil {
+		debug.Printf("SetExportFormat(%v, %q): %v", f.Id, mimeType, err)
+		req.RespondError(fuse.EIO)
+		return
+	}
+	err := sc.conn.InvalidateNode(sc.global(f.Inode), 0, 0)
+	if err != nil && err != fuse.ErrNotCached {
+		debug.Printf("InvalidateNode(%v): %v", f.Inode, err)
+	}
+	switch req := req.(type) {
+	case *fuse.SetxattrRequest:
+		req.Respond()
+	case *fuse.RemovexattrRequest:
+		req.Respond()
+	}
+}
+
 func (sc *serveConn) attrFromFile(file drive_db.File) fuse.Attr {
 	var atime, mtime, crtime time.Time
 	if err := atime.UnmarshalText([]byte(file.LastViewedByMeDate)); err != nil {
 		atime = startup
 	}
-	if err := mtime.UnmarshalText([]byte(file.ModifiedDate)); err != nil {
+	if mtime = file.ModTime(); mtime.IsZero() {
 		mtime = startup
 	}
 	if err := crtime.UnmarshalText([]byte(file.CreatedDate)); err != nil {
 		crtime = startup
 	}
-	blocks := file.FileSize / int64(blockSize)
-	if r := file.FileSize % int64(blockSize); r > 0 {
+	size := file.EstimatedSize()
+	blocks := size / int64(blockSize)
+	if r := size % int64(blockSize); r > 0 {
 		blocks += 1
 	}
 	attr := fuse.Attr{
 	        Valid:  *driveMetadataLatency,
-		Inode:  file.Inode,
+		Inode:  uint64(sc.global(file.Inode)),
 		Atime:  atime,
 		Mtime:  mtime,
 		Ctime:  mtime,
@@ -287,19 +614,26 @@ func (sc *serveConn) attrFromFile(file drive_db.File) fuse.Attr {
 		Uid:    sc.uid,
 		Gid:    sc.gid,
 		Mode:   0755,
-		Size:   uint64(file.FileSize),
+		Size:   uint64(size),
 		Blocks: uint64(blocks),
 	}
-	if file.MimeType == driveFolderMimeType {
+	if file.IsDir() {
 		attr.Mode = os.ModeDir | 0755
 	}
+	if file.IsShortcut() {
+		attr.Mode = os.ModeSymlink | 0777
+		return attr
+	}
+	if !file.Writable() {
+		attr.Mode &^= 0222 // shared with us view only
+	}
 	return attr
 }
 
 // Allocate a file handle, held by the kernel until Release
 func (sc *serveConn) open(req *fuse.OpenRequest) {
 	// This will be cheap, Lookup always preceeds Open, so the cache is warm
-	f, err := sc.db.FileByInode(uint64(req.Header.Node))
+	f, err := sc.db.FileByInode(sc.local(req.Header.Node))
 	if err != nil {
 		req.RespondError(fuse.ENOENT)
 		return
@@ -312,24 +646,60 @@ func (sc *serveConn) open(req *fuse.OpenRequest) {
 			req.RespondError(fuse.EPERM)
 			return
 		}
+		if !f.Writable() {
+			req.RespondError(fuse.Errno(syscall.EACCES))
+			return
+		}
 
-		r, w := io.Pipe() // plumbing between WriteRequest and Drive
-		go sc.updateInDrive(f.File, r)
-		hId = sc.allocHandle(req.Header.Node, w)
+		if *stageWrites && !f.IsNative() {
+			sf, err := sc.db.StageWrite(f.Inode)
+			if err != nil {
+				debug.Printf("StageWrite(%v): %v", f.Id, err)
+				req.RespondError(fuse.EIO)
+				return
+			}
+			if req.Flags&fuse.OpenFlags(os.O_TRUNC) != 0 {
+				if err := sc.truncateStaged(f.Inode, sf, 0); err != nil {
+					debug.Printf("truncating staged %v: %v", f.Id, err)
+					sf.Close()
+					sc.db.ReleaseStaged(f.Inode)
+					req.RespondError(fuse.EIO)
+					return
+				}
+			}
+			hId = sc.addHandle(handle{inode: req.Header.Node, staged: sf})
+		} else {
+			r, w := io.Pipe() // plumbing between WriteRequest and Drive
+			go sc.updateInDrive(f.File, r)
+			hId = sc.allocHandle(req.Header.Node, w)
+		}
 	} else {
 		hId = sc.allocHandle(req.Header.Node, nil)
 	}
 
+	sc.db.RecordAccess(f.Inode)
+
 	resp := fuse.OpenResponse{Handle: fuse.HandleID(hId)}
+	if f.IsNative() {
+		// Native Google files report only an estimate of their size, so
+		// bypass the page cache to let reads of their whole export through.
+		resp.Flags |= fuse.OpenDirectIO
+	}
 	fuse.Debug(fmt.Sprintf("Open Response: %+v", resp))
 	req.Respond(&resp)
 }
 
-// allocate a kernel file handle for the requested inode
+// allocate a kernel file handle for the requested inode, which stays cached
+// until the handle is released.
 func (sc *serveConn) allocHandle(inode fuse.NodeID, w *io.PipeWriter) uint64 {
+	return sc.addHandle(handle{inode: inode, writer: w})
+}
+
+// addHandle allocates a kernel file handle for h.
+func (sc *serveConn) addHandle(h handle) uint64 {
 	var hId uint64
 	var found bool
-	h := handle{inode: inode, writer: w}
+	sc.db.Pin(sc.local(h.inode))
 	sc.Lock()
 	defer sc.Unlock()
 	for i, ch := range sc.handles {
@@ -360,22 +730,93 @@ func (sc *serveConn) handleById(id fuse.HandleID) (handle, error) {
 // Prepare to upload the content of the file.
 // Any insert or update w/ Media() blocks until the Reader closes.
 func (sc *serveConn) updateInDrive(f *drive.File, r *io.PipeReader) {
-	_, err := sc.service.Files.Update(f.Id, f).Media(r).Do()
+	_, err := sc.db.UpdateContents(f.Id, r, -1)
 	if err != nil {
 		log.Printf("failed uploading %v to drive: %v", f.Title, err)
+		r.CloseWithError(err)
+		return
 	}
 	debug.Printf("finished uploading to drive: %v", f.Title)
 }
 
+// stagedFile returns the staged copy of node being written through one of
+// its handles, or nil if there isn't one.
+func (sc *serveConn) stagedFile(node fuse.NodeID) *os.File {
+	sc.Lock()
+	defer sc.Unlock()
+	for _, h := range sc.handles {
+		if h.inode == node && h.staged != nil {
+			return h.staged
+		}
+	}
+	return nil
+}
+
+// truncateStaged truncates sf, the staged copy of inode, to size, marking it
+// to be uploaded if that changes it.
+func (sc *serveConn) truncateStaged(inode uint64, sf *os.File, size int64) error {
+	fi, err := sf.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() == size {
+		return nil
+	}
+	if err := sc.db.DirtyStaged(inode); err != nil {
+		return err
+	}
+	return sf.Truncate(size)
+}
+
+// stagedAttr updates attr with the size of the staged copy sf.
+func (sc *serveConn) stagedAttr(attr *fuse.Attr, sf *os.File) {
+	fi, err := sf.Stat()
+	if err != nil {
+		return
+	}
+	attr.Size = uint64(fi.Size())
+	attr.Blocks = attr.Size / uint64(blockSize)
+	if attr.Size%uint64(blockSize) > 0 {
+		attr.Blocks += 1
+	}
+}
+
+// Upload the staged writes to a file, if it has any not yet uploaded, each
+// time a handle to it is closed, so that a failure is reported to close(2).
+func (sc *serveConn) flush(req *fuse.FlushRequest) {
+	h, err := sc.handleById(req.Handle)
+	if err != nil || h.staged == nil {
+		req.Respond()
+		return
+	}
+	if _, err := sc.db.CommitStaged(sc.local(h.inode)); err != nil {
+		log.Printf("failed uploading staged writes to inode %v: %v", h.inode, err)
+		if errors.Is(err, drive_db.ErrQuotaExceeded) {
+			req.RespondError(fuse.Errno(syscall.ENOSPC))
+			return
+		}
+		req.RespondError(fuse.EIO)
+		return
+	}
+	req.Respond()
+}
+
 // Acknowledge release of file handle by kernel
 func (sc *serveConn) release(req *fuse.ReleaseRequest) {
 	sc.Lock()
 	defer sc.Unlock()
 	h := sc.handles[req.Handle]
+	if h.inode != 0 {
+		sc.db.Unpin(sc.local(h.inode))
+	}
+	if h.staged != nil {
+		h.staged.Close()
+		sc.db.ReleaseStaged(sc.local(h.inode))
+	}
 	if h.writer != nil {
 		h.writer.Close()
 		/*
-			fileId, err := sc.db.FileIdForInode(uint64(h.inode))
+			fileId, err := sc.db.FileIdForInode(sc.local(h.inode))
 			if err != nil {
 				log.Printf("failed to lookup inode for close: %v\n", err)
 				req.RespondError(fuse.EIO)
@@ -391,7 +832,7 @@ func (sc *serveConn) release(req *fuse.ReleaseRequest) {
 			}
 		*/
 	}
-	h.inode = 0
+	sc.handles[req.Handle] = handle{} // free for reuse
 	req.Respond()
 }
 
@@ -402,55 +843,55 @@ func (sc *serveConn) create(req *fuse.CreateRequest) {
 		return
 	}
 
-	pInode := uint64(req.Header.Node)
+	pInode := sc.local(req.Header.Node)
 	parent, err := sc.db.FileByInode(pInode)
 	if err != nil {
 		debug.Printf("failed to get parent file: %v", err)
 		req.RespondError(fuse.EIO)
 		return
 	}
-	p := &drive.ParentReference{Id: parent.Id}
-
-	f := &drive.File{Title: req.Name}
-	f.Parents = []*drive.ParentReference{p}
-	f, err = sc.service.Files.Insert(f).Do()
-	if err != nil {
-		debug.Printf("Files.Insert(f).Do(): %v", err)
-		req.RespondError(fuse.EIO)
+	if !parent.Writable() {
+		req.RespondError(fuse.Errno(syscall.EACCES))
 		return
 	}
-	inode, err := sc.db.InodeForFileId(f.Id)
-	if err != nil {
-		debug.Printf("failed creating inode for %v: %v", req.Name, err)
-		req.RespondError(fuse.EIO)
+	df, err := sc.db.CreateFile(parent.Id, req.Name, "")
+	if err == drive_db.ErrExists {
+		req.RespondError(fuse.EEXIST)
 		return
 	}
-
-	r, w := io.Pipe() // plumbing between WriteRequest and Drive
-	h := sc.allocHandle(fuse.NodeID(inode), w)
-
-	go sc.updateInDrive(f, r)
-
-	// Tell fuse and the OS about the file
-	df, err := sc.db.UpdateFile(nil, f)
 	if err != nil {
-		debug.Printf("failed to update levelDB for %v: %v", f.Id, err)
-		// The write has happened to drive, but we failed to update the kernel.
-		// The Changes API will update Fuse, and when the kernel metadata for
-		// the parent directory expires, the new file will become visible.
+		debug.Printf("CreateFile(%v in %v): %v", req.Name, parent.Title, err)
 		req.RespondError(fuse.EIO)
 		return
 	}
+	inode := df.Inode
+
+	var h uint64
+	var flags fuse.OpenResponseFlags
+	if *stageWrites {
+		sf, err := sc.db.StageWrite(inode)
+		if err != nil {
+			debug.Printf("StageWrite(%v): %v", df.Id, err)
+			req.RespondError(fuse.EIO)
+			return
+		}
+		h = sc.addHandle(handle{inode: sc.global(inode), staged: sf})
+	} else {
+		r, w := io.Pipe() // plumbing between WriteRequest and Drive
+		h = sc.allocHandle(sc.global(inode), w)
+		go sc.updateInDrive(df.File, r)
+		flags = fuse.OpenNonSeekable
+	}
 
 	resp := fuse.CreateResponse{
 		// describes the opened handle
 		OpenResponse: fuse.OpenResponse{
 			Handle: fuse.HandleID(h),
-			Flags:  fuse.OpenNonSeekable,
+			Flags:  flags,
 		},
 		// describes the created file
 		LookupResponse: fuse.LookupResponse{
-			Node:       fuse.NodeID(inode),
+			Node:       sc.global(inode),
 			EntryValid: *driveMetadataLatency,
 			Attr:       sc.attrFromFile(*df),
 		},
@@ -466,7 +907,7 @@ func (sc *serveConn) mkdir(req *fuse.MkdirRequest) {
 		return
 	}
 	// TODO: if allow_other, require uid == invoking uid to allow writes
-	pInode := uint64(req.Header.Node)
+	pInode := sc.local(req.Header.Node)
 	pId, err := sc.db.FileIdForInode(pInode)
 	if err != nil {
 		debug.Printf("failed to get parent fileid: %v", err)
@@ -493,7 +934,7 @@ func (sc *serveConn) mkdir(req *fuse.MkdirRequest) {
 	}
 	sc.db.FlushCachedInode(pInode)
 	resp := &fuse.MkdirResponse{}
-	resp.Node = fuse.NodeID(f.Inode)
+	resp.Node = sc.global(f.Inode)
 	resp.EntryValid = *driveMetadataLatency
 	resp.Attr = sc.attrFromFile(*f)
 	fuse.Debug(fmt.Sprintf("Mkdir(%v): %+v", req.Name, f))
@@ -512,26 +953,55 @@ func (sc *serveConn) remove(req *fuse.RemoveRequest) {
 	}
 	// TODO: if allow_other, require uid == invoking uid to allow writes
 	// TODO: consider disallowing deletion of directories with contents.. but what error?
-	pInode := uint64(req.Header.Node)
+	pInode := sc.local(req.Header.Node)
 	parent, err := sc.db.FileByInode(pInode)
 	if err != nil {
 		debug.Printf("failed to get parent file: %v", err)
 		req.RespondError(fuse.EIO)
 		return
 	}
-	for _, cInode := range parent.Children {
-		child, err := sc.db.FileByInode(cInode)
+	children, err := sc.db.ChildrenWithUniqueNames(parent.Id)
+	if err != nil {
+		debug.Printf("failed to get children of %v: %v", parent.Id, err)
+		req.RespondError(fuse.EIO)
+		return
+	}
+	children = dotHidden(children)
+	child, ok := children[req.Name]
+	if !ok {
+		req.RespondError(fuse.ENOENT)
+		return
+	}
+	if sc.db.IsStarredFolder(parent.Id) {
+		// It's only listed here because it's starred.
+		if err := sc.db.SetStarred(child.Id, false); err != nil {
+			debug.Printf("failed to unstar %v: %v", child.Id, err)
+			req.RespondError(fuse.EIO)
+			return
+		}
+	} else if len(child.Parents) > 1 {
+		// Only unlink it from this directory; it remains in the others.
+		_, err := sc.service.Files.Patch(child.Id, &drive.File{}).RemoveParents(parent.Id).Do()
 		if err != nil {
-			debug.Printf("failed to get child file: %v", err)
+			debug.Printf("failed to remove %v from parent %v: %v", child.Id, parent.Id, err)
+			req.RespondError(fuse.EIO)
+			return
 		}
-		if child.Title == req.Name {
-			sc.service.Files.Delete(child.Id).Do()
-			sc.db.RemoveFileById(child.Id, nil)
-			req.Respond()
+		sc.db.RemoveParentRef(child.Id, parent.Id)
+	} else if *trashMode != drive_db.Drop.String() && !child.Trashed() {
+		// Move it to the trash, from which it can be recovered: it's
+		// listed in .Trash in Quarantine mode, and where it was in Keep
+		// mode. Removing it again deletes it.
+		if err := sc.db.TrashFile(child.Id); err != nil {
+			debug.Printf("failed to trash %v: %v", child.Id, err)
+			req.RespondError(fuse.EIO)
 			return
 		}
+	} else {
+		sc.service.Files.Delete(child.Id).Do()
+		sc.db.RemoveFileById(child.Id, nil)
 	}
-	req.RespondError(fuse.ENOENT)
+	req.Respond()
 }
 
 // rename renames a file or directory, optionally reparenting it
@@ -542,75 +1012,61 @@ func (sc *serveConn) rename(req *fuse.RenameRequest) {
 		return
 	}
 	// TODO: if allow_other, require uid == invoking uid to allow writes
-	oldParent, err := sc.db.FileByInode(uint64(req.Header.Node))
+	oldParent, err := sc.db.FileByInode(sc.local(req.Header.Node))
 	if err != nil {
 		debug.Printf("can't find the referenced inode: %v", req.Header.Node)
 		req.RespondError(fuse.ENOENT)
 		return
 	}
-	var f *drive_db.File
-	for _, i := range oldParent.Children {
-		c, err := sc.db.FileByInode(uint64(i))
-		if err != nil {
-			debug.Printf("error iterating child inodes: %v", err)
-			continue
-		}
-		if c.Title == req.OldName {
-			f = c
-		}
+	children, err := sc.db.ChildrenWithUniqueNames(oldParent.Id)
+	if err != nil {
+		debug.Printf("failed to get children of %v: %v", oldParent.Id, err)
+		req.RespondError(fuse.EIO)
+		return
 	}
-	if f == nil {
+	children = dotHidden(children)
+	f, ok := children[req.OldName]
+	if !ok {
 		debug.Printf("can't find the old file '%v' in '%v'", req.OldName, oldParent.Title)
 		req.RespondError(fuse.ENOENT)
 		return
 	}
 
-	newParent, err := sc.db.FileByInode(uint64(req.NewDir))
+	newParent, err := sc.db.FileByInode(sc.local(req.NewDir))
 	if err != nil {
 		debug.Printf("can't find the new parent by inode: %v", req.NewDir)
 		req.RespondError(fuse.ENOENT)
 		return
 	}
 
-	// did the name change?
+	// did the name change? A hidden file's leading dot isn't in its title, nor
+	// is a native Google file's export extension.
+	var title string
 	if req.OldName != req.NewName {
-		f.Title = req.NewName
-	}
-
-	// did the parent change?
-	var sameParent bool
-	var numParents int
-	var oldParentId string
-	for _, o := range f.Parents {
-		numParents++
-		oldParentId = o.Id
-		if o.Id == newParent.Id {
-			sameParent = true
+		title = sc.db.TitleForName(f, req.NewName)
+		if f.Hidden() && !strings.HasPrefix(f.Title, ".") {
+			title = strings.TrimPrefix(title, ".")
 		}
 	}
-	if !sameParent && numParents > 1 {
-		// TODO: Figure out how to identify which of the multiple parents the
-		// file is being moved from, so we can call RemoveParents() correctly
-		debug.Printf("can't reparent file with multiple parents: %v", req.OldName)
-		req.RespondError(fuse.ENOSYS)
-		return
-	}
 
-	u := sc.service.Files.Update(f.Id, f.File)
-	if !sameParent {
-		debug.Printf("moving from %v to %v", oldParentId, newParent.Id)
-		u = u.AddParents(newParent.Id)
-		u = u.RemoveParents(oldParentId)
-	}
-	r, err := u.Do()
-	if err != nil {
-		debug.Printf("failed to update '%v' in drive: %v", req.OldName, err)
-		req.RespondError(fuse.EIO)
-		return
+	// did the parent change? The file may have other parents too, which are
+	// left alone; only the directory it's being moved out of is detached.
+	var add, remove []string
+	if oldParent.Id != newParent.Id {
+		debug.Printf("moving from %v to %v", oldParent.Id, newParent.Id)
+		remove = []string{oldParent.Id}
+		var hasNewParent bool
+		for _, p := range f.Parents {
+			if p.Id == newParent.Id {
+				hasNewParent = true
+			}
+		}
+		if !hasNewParent {
+			add = []string{newParent.Id}
+		}
 	}
-
-	if _, err := sc.db.UpdateFile(nil, r); err != nil {
-		debug.Printf("failed to update leveldb and cache: ", err)
+	if err := sc.db.RenameFile(f.Id, title, add, remove); err != nil {
+		debug.Printf("failed to rename '%v': %v", req.OldName, err)
 		req.RespondError(fuse.EIO)
 		return
 	}
@@ -632,6 +1088,21 @@ func (sc *serveConn) write(req *fuse.WriteRequest) {
 		req.RespondError(fuse.ESTALE)
 		return
 	}
+	if h.staged != nil {
+		if err := sc.db.DirtyStaged(sc.local(h.inode)); err != nil {
+			debug.Printf("DirtyStaged(%v): %v", h.inode, err)
+			req.RespondError(fuse.EIO)
+			return
+		}
+		n, err := h.staged.WriteAt(req.Data, req.Offset)
+		if err != nil {
+			debug.Printf("writing staged inode %v: %v", h.inode, err)
+			req.RespondError(fuse.EIO)
+			return
+		}
+		req.Respond(&fuse.WriteResponse{Size: n})
+		return
+	}
 	if h.lastByte != req.Offset {
 		fuse.Debug(fmt.Sprintf("non-sequential write: got %v, expected %v", req.Offset, h.lastByte))
 		req.RespondError(fuse.EIO)
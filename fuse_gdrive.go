@@ -5,6 +5,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
@@ -17,6 +18,7 @@ import (
 	"path"
 	"runtime"
 	"strconv"
+	"strings"
 	"time"
 
 	drive "code.google.com/p/google-api-go-client/drive/v2"
@@ -35,6 +37,16 @@ var (
 	driveMetadataLatency = flag.Duration("metadatapoll", time.Minute, "How often to poll Google Drive for metadata updates")
 	dbDir                = flag.String("gdrive.datadir", osDataDir(), "Where to store the drive database")
 	cacheDir             = flag.String("gdrive.cachedir", osCacheDir(), "Where to store the drive data cache")
+	trashMode            = flag.String("trashmode", "drop", "What to show of trashed files: drop (nothing), keep (leave them in place) or quarantine (move them into a .Trash folder).")
+	showHidden           = flag.Bool("showhidden", false, "Show the files Drive marks as hidden, e.g. apps' data, with a leading dot. Otherwise they're dropped.")
+	metrics              = flag.Bool("metrics", false, "Publish metrics of each account's metadata sync as the expvar drivedb (or drivedb_<account>), and at /metrics in the Prometheus text format.")
+	pingInterval         = flag.Duration("pinginterval", 10*time.Minute, "How often to check that Google Drive still accepts each account's credentials, or 0 not to.")
+	showStarred          = flag.Bool("showstarred", false, "List the starred files in a .Starred folder in the root, as well as in their own folders. Removing one from it unstars it.")
+	teamDrives           = flag.Bool("teamdrives", false, "Mount the Team Drives (Shared Drives) you can reach too, each as a folder in the root.")
+	syncRoots            = flag.String("syncroots", "", "Comma separated fileIds of the folders to mount, each in the root. Otherwise the whole Drive is mounted.")
+	stageWrites          = flag.Bool("stagewrites", false, "Stage writes in a local copy of each file, uploaded as it's closed, so that files may be written at any offset and read back, rather than only written from the start. Staged writes which failed to upload are retried at the next mount.")
+	exportPolicy         = flag.String("exportpolicy", "", "Comma separated native=export pairs choosing the type each kind of native Google file is exported as, e.g. document=txt,spreadsheet=csv. Types not listed are exported as by default: Docs, Slides as PDF, Sheets as XLSX and Drawings as PNG.")
+	accountLabels        = flag.String("accounts", "", "Comma separated labels of several Google accounts to mount, each in a directory of that name. Each is authorized in the browser in turn.")
 )
 
 var startup = time.Now()
@@ -133,44 +145,69 @@ func main() {
 	http.HandleFunc("/", RootHandler)
 	go http.ListenAndServe(fmt.Sprintf("localhost:%s", *port), nil)
 
-	var client *http.Client
+	scope := drive.DriveScope
 	if *readOnly {
-		client = getOAuthClient(drive.DriveReadonlyScope)
-	} else {
-		client = getOAuthClient(drive.DriveScope)
+		scope = drive.DriveReadonlyScope
 	}
-
-	driveCache := cache.NewCache("/tmp", client)
-
-	// TODO: move into drivedb, so we don't create a service twice
-	service, _ := drive.New(client)
-	about, err := service.About.Get().Do()
-	if err != nil {
-		log.Fatalf("drive.service.About.Get().Do: %v\n", err)
+	if *serviceAccount != "" && *accountLabels != "" {
+		log.Fatalf("--serviceaccount can not be combined with --accounts")
 	}
-	// fileId of the root of the FS (aka "My Drive")
-	rootId := about.RootFolderId
-	// email address of the mounted google drive account
-	account := about.User.EmailAddress
 
-	// Ensure the token's always fresh
-	// TODO: Remove this once goauth2 changes are accepted upstream
-	// https://code.google.com/p/goauth2/issues/detail?id=47
-	go tokenKicker(client, 59*time.Minute)
+	// Ensure the tokens stay fresh until we exit.
+	kickerDone := make(chan struct{})
+	defer close(kickerDone)
 
-	// Create and start the drive metadata syncer.
-	db, err := drive_db.NewDriveDB(client, *dbDir, *cacheDir, *driveMetadataLatency, rootId)
-	if err != nil {
-		log.Fatalf("could not open leveldb: %v", err)
+	// Without --accounts, the one account is mounted at the mountpoint, as
+	// the unlabelled account "".
+	multi := *accountLabels != ""
+	labels := []string{""}
+	if multi {
+		labels = strings.Split(*accountLabels, ",")
+		if len(labels) >= 1<<accountBits {
+			log.Fatalf("too many accounts: %d", len(labels))
+		}
+	}
+	accounts := make(map[string]*serveConn)
+	volumeName := "GoogleDrive"
+	for i, label := range labels {
+		if _, ok := accounts[label]; ok || (multi && (label == "" || strings.Contains(label, "/"))) {
+			log.Fatalf("invalid or repeated account label %q", label)
+		}
+		sc, email, err := openAccount(label, scope, kickerDone)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer sc.db.Close()
+		if multi {
+			sc.account = uint64(i + 1)
+		} else {
+			volumeName = email
+		}
+		sc.uid = uid
+		sc.gid = gid
+		accounts[label] = sc
+		if *metrics {
+			name := "drivedb"
+			if label != "" {
+				name += "_" + label
+			}
+			sc.db.PublishMetrics(name)
+		}
+	}
+	if *metrics {
+		http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			fmt.Fprint(w, drive_db.MetricTypes)
+			for _, label := range labels {
+				accounts[label].db.WriteMetrics(w)
+			}
+		})
 	}
-	defer db.Close()
-	db.WaitUntilSynced()
-	log.Printf("synced!")
 
 	options := []fuse.MountOption{
 		fuse.FSName("GoogleDrive"),
 		fuse.Subtype("gdrive"),
-		fuse.VolumeName(account),
+		fuse.VolumeName(volumeName),
 	}
 
 	if *allowOther {
@@ -196,15 +233,15 @@ func main() {
 		}
 	}()
 
-	sc := serveConn{db: db,
-		driveCache: driveCache,
-		service:    service,
-		uid:        uid,
-		gid:        gid,
-		writers:    make(map[int]io.PipeWriter),
-		conn:       c,
+	for _, sc := range accounts {
+		sc.conn = c
+		go sc.invalidate(sc.db.Subscribe())
+	}
+	if multi {
+		err = newMultiConn(c, uid, gid, accounts).Serve()
+	} else {
+		err = accounts[""].Serve()
 	}
-	err = sc.Serve()
 	if err != nil {
 		log.Fatalln("fuse server failed: ", err)
 	}
@@ -215,3 +252,109 @@ func main() {
 		log.Fatal(err)
 	}
 }
+
+// openAccount authorizes the account with the given label (empty, for a single
+// account mount) and syncs its metadata, returning a serveConn for it, which
+// has yet to be connected to the kernel, and the account's email address.
+func openAccount(label, scope string, kickerDone <-chan struct{}) (*serveConn, string, error) {
+	var client *http.Client
+	if *serviceAccount != "" {
+		var err error
+		client, err = getServiceAccountClient(*serviceAccount, scope)
+		if err != nil {
+			return nil, "", fmt.Errorf("unable to authenticate as service account: %v", err)
+		}
+	} else {
+		client = getOAuthClient(scope, label)
+	}
+
+	driveCache := cache.NewCache("/tmp", client)
+
+	// TODO: move into drivedb, so we don't create a service twice
+	service, _ := drive.New(client)
+	about, err := service.About.Get().Do()
+	if err != nil {
+		return nil, "", fmt.Errorf("drive.service.About.Get().Do: %v", err)
+	}
+	// fileId of the root of the FS (aka "My Drive")
+	rootId := about.RootFolderId
+	// email address of the mounted google drive account
+	email := about.User.EmailAddress
+
+	// Ensure the token's always fresh
+	// TODO: Remove this once goauth2 changes are accepted upstream
+	// https://code.google.com/p/goauth2/issues/detail?id=47
+	// (Service account tokens are re-asserted as they expire, instead.)
+	if *serviceAccount == "" {
+		go tokenKicker(client, kickerDone)
+	}
+
+	// Create and start the drive metadata syncer.
+	mode, err := drive_db.ParseTrashMode(*trashMode)
+	if err != nil {
+		return nil, "", err
+	}
+	opts := &drive_db.DriveDBOptions{
+		OnAuthError: func(err error) {
+			log.Printf("Google Drive rejected our credentials for %v, restart to re-authorize: %v", email, err)
+		},
+		Account:     label,
+		TrashMode:   mode,
+		KeepHidden:  *showHidden,
+		ShowStarred: *showStarred,
+		TeamDrives:  *teamDrives,
+	}
+	if *syncRoots != "" {
+		opts.SyncRoots = strings.Split(*syncRoots, ",")
+	}
+	if opts.ExportPolicy, err = drive_db.ParseExportPolicy(*exportPolicy); err != nil {
+		return nil, "", err
+	}
+	db, err := drive_db.NewDriveDB(client, *dbDir, *cacheDir, *driveMetadataLatency, rootId, opts)
+	if err != nil {
+		return nil, "", fmt.Errorf("could not open leveldb: %v", err)
+	}
+	go func() {
+		for {
+			time.Sleep(5 * time.Second)
+			processed, total, synced := db.SyncStatus()
+			if synced {
+				return
+			}
+			log.Printf("%v: synced %d/%d changes", email, processed, total)
+		}
+	}()
+	db.WaitUntilSynced()
+	log.Printf("%v synced!", email)
+	if *pingInterval > 0 {
+		go pingDrive(db, email, kickerDone)
+	}
+
+	sc := &serveConn{db: db,
+		driveCache: driveCache,
+		service:    service,
+		writers:    make(map[int]io.PipeWriter),
+	}
+	return sc, email, nil
+}
+
+// pingDrive checks every --pinginterval that Drive still accepts the
+// credentials of db, until done is closed, so a revoked token is reported
+// before a sync happens to fail.
+func pingDrive(db *drive_db.DriveDB, email string, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(*pingInterval):
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err := db.Ping(ctx)
+		cancel()
+		if serr, ok := err.(*drive_db.SyncError); ok && serr.Kind == drive_db.AuthError {
+			log.Printf("Google Drive no longer accepts our credentials for %v, restart to re-authorize: %v", email, err)
+		} else if err != nil {
+			debug.Printf("ping of Google Drive for %v failed: %v", email, err)
+		}
+	}
+}
@@ -33,8 +33,11 @@ type Cache struct {
 	// executed when an entry is purged from the cache.
 	OnEvicted func(key Key, value interface{})
 
-	ll    *list.List
-	cache map[interface{}]*list.Element
+	ll     *list.List
+	cache  map[interface{}]*list.Element
+	pinned map[interface{}]int // keys never evicted, to the number of Pins of each
+
+	hits, misses, evictions int64
 }
 
 // A Key may be any value that is comparable. See http://golang.org/ref/spec#Comparison_operators
@@ -72,7 +75,7 @@ func (c *Cache) Add(key Key, value interface{}) {
 	ele := c.ll.PushFront(&entry{key, value})
 	c.cache[key] = ele
 	if c.MaxEntries != 0 && c.ll.Len() > c.MaxEntries {
-		c.RemoveOldest()
+		c.removeOldest()
 	}
 }
 
@@ -81,12 +84,15 @@ func (c *Cache) Get(key Key) (value interface{}, ok bool) {
 	c.Lock()
 	defer c.Unlock()
 	if c.cache == nil {
+		c.misses++
 		return
 	}
 	if ele, hit := c.cache[key]; hit {
+		c.hits++
 		c.ll.MoveToFront(ele)
 		return ele.Value.(*entry).value, true
 	}
+	c.misses++
 	return
 }
 
@@ -104,11 +110,21 @@ func (c *Cache) Remove(key Key) {
 
 // RemoveOldest removes the oldest item from the cache.
 func (c *Cache) RemoveOldest() {
+	c.Lock()
+	defer c.Unlock()
+	c.removeOldest()
+}
+
+func (c *Cache) removeOldest() {
 	if c.cache == nil {
 		return
 	}
 	ele := c.ll.Back()
+	for ele != nil && c.pinned[ele.Value.(*entry).key] > 0 {
+		ele = ele.Prev()
+	}
 	if ele != nil {
+		c.evictions++
 		c.removeElement(ele)
 	}
 }
@@ -122,6 +138,44 @@ func (c *Cache) removeElement(e *list.Element) {
 	}
 }
 
+// Clear removes all items from the cache, calling OnEvicted for each.
+func (c *Cache) Clear() {
+	c.Lock()
+	defer c.Unlock()
+	if c.OnEvicted != nil {
+		for _, e := range c.cache {
+			kv := e.Value.(*entry)
+			c.OnEvicted(kv.key, kv.value)
+		}
+	}
+	c.ll = nil
+	c.cache = nil
+}
+
+// Pin keeps key, once added, from being evicted to make room for others, until
+// Unpin has been called as many times as Pin. The cache may exceed MaxEntries
+// if too many entries are pinned. Remove and Clear still remove pinned keys,
+// which stay pinned if they're added again.
+func (c *Cache) Pin(key Key) {
+	c.Lock()
+	defer c.Unlock()
+	if c.pinned == nil {
+		c.pinned = make(map[interface{}]int)
+	}
+	c.pinned[key]++
+}
+
+// Unpin reverses a call to Pin.
+func (c *Cache) Unpin(key Key) {
+	c.Lock()
+	defer c.Unlock()
+	if c.pinned[key] <= 1 {
+		delete(c.pinned, key)
+		return
+	}
+	c.pinned[key]--
+}
+
 // Len returns the number of items in the cache.
 func (c *Cache) Len() int {
 	c.Lock()
@@ -131,3 +185,11 @@ func (c *Cache) Len() int {
 	}
 	return c.ll.Len()
 }
+
+// Stats returns the number of Gets which found their key, the number which
+// didn't, and the number of entries evicted to make room for others.
+func (c *Cache) Stats() (hits, misses, evictions int64) {
+	c.Lock()
+	defer c.Unlock()
+	return c.hits, c.misses, c.evictions
+}
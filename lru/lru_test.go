@@ -0,0 +1,114 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lru
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestPin(t *testing.T) {
+	lru := New(2)
+	lru.Pin("a")
+	lru.Pin("a")
+	lru.Add("a", 1)
+	lru.Add("b", 2)
+	lru.Add("c", 3) // evicts b, the oldest which isn't pinned
+	if _, ok := lru.Get("a"); !ok {
+		t.Fatalf("pinned key a was evicted")
+	}
+	if _, ok := lru.Get("b"); ok {
+		t.Fatalf("b wasn't evicted in place of the pinned a")
+	}
+
+	// With every older entry pinned, the newest is the one evicted.
+	lru.Pin("c")
+	lru.Add("d", 4)
+	if _, ok := lru.Get("d"); ok {
+		t.Fatalf("d was kept over pinned entries")
+	}
+	if got := lru.Len(); got != 2 {
+		t.Fatalf("Len() = %d, want 2", got)
+	}
+
+	// a stays pinned until it's been unpinned as often as it was pinned.
+	lru.Unpin("a")
+	lru.Add("e", 5)
+	if _, ok := lru.Get("a"); !ok {
+		t.Fatalf("a was evicted after one of its two Unpins")
+	}
+	lru.Unpin("a")
+	lru.Get("e")
+	lru.Add("f", 6)
+	if _, ok := lru.Get("a"); ok {
+		t.Fatalf("a wasn't evicted once unpinned")
+	}
+
+	// Remove still removes a pinned key, which is pinned again once re-added.
+	lru.Remove("c")
+	if _, ok := lru.Get("c"); ok {
+		t.Fatalf("Remove of pinned key c didn't remove it")
+	}
+	lru.Add("c", 3)
+	lru.Add("g", 7)
+	lru.Add("h", 8)
+	if _, ok := lru.Get("c"); !ok {
+		t.Fatalf("re-added c was evicted, though still pinned")
+	}
+}
+
+func TestClear(t *testing.T) {
+	var evicted []string
+	lru := New(0)
+	lru.OnEvicted = func(key Key, value interface{}) {
+		evicted = append(evicted, key.(string))
+	}
+	lru.Add("a", 1)
+	lru.Add("b", 2)
+	lru.Clear()
+	sort.Strings(evicted)
+	if want := []string{"a", "b"}; !reflect.DeepEqual(evicted, want) {
+		t.Errorf("Clear called OnEvicted for %v, want %v", evicted, want)
+	}
+	if got := lru.Len(); got != 0 {
+		t.Errorf("Len() after Clear = %d, want 0", got)
+	}
+	if _, ok := lru.Get("a"); ok {
+		t.Errorf("a was found after Clear")
+	}
+
+	// The cache is still usable once cleared.
+	lru.Add("c", 3)
+	if v, ok := lru.Get("c"); !ok || v != 3 {
+		t.Errorf("Get(c) after Clear and Add = %v, %v, want 3, true", v, ok)
+	}
+}
+
+func TestStats(t *testing.T) {
+	lru := New(1)
+	lru.Get("a")
+	lru.Add("a", 1)
+	lru.Get("a")
+	lru.Get("a")
+	lru.Add("b", 2) // evicts a
+	lru.Remove("b") // not an eviction
+	lru.Get("a")
+	if hits, misses, evictions := lru.Stats(); hits != 2 || misses != 2 || evictions != 1 {
+		t.Errorf("Stats() = %d, %d, %d, want 2, 2, 1", hits, misses, evictions)
+	}
+}
@@ -8,19 +8,23 @@ package main
 
 import (
 	"encoding/gob"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"hash/fnv"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"code.google.com/p/goauth2/oauth"
+	"code.google.com/p/goauth2/oauth/jwt"
 )
 
 const (
@@ -33,13 +37,21 @@ var (
 	secret     = flag.String("secret", "", "OAuth Client Secret")
 	cacheToken = flag.Bool("cachetoken", true, "cache the OAuth token")
 	httpDebug  = flag.Bool("http.debug", false, "show HTTP traffic")
+
+	serviceAccount = flag.String("serviceaccount", "", "Authenticate as the service account whose JSON key file is at this path, instead of via the browser.")
+	impersonate    = flag.String("impersonate", "", "With --serviceaccount, the user@domain to act as (requires domain-wide delegation).")
 )
 
-func tokenCacheFile(config *oauth.Config) string {
+// tokenCacheFile returns where the token for the given account label is
+// cached. The unlabelled account keeps the name it has always had.
+func tokenCacheFile(config *oauth.Config, account string) string {
 	hash := fnv.New32a()
 	hash.Write([]byte(config.ClientId))
 	hash.Write([]byte(config.ClientSecret))
 	hash.Write([]byte(config.Scope))
+	if account != "" {
+		hash.Write([]byte(account))
+	}
 	fn := fmt.Sprintf("fuse-gdrive-token-%v", hash.Sum32())
 	return filepath.Join(osDataDir(), url.QueryEscape(fn))
 }
@@ -75,24 +87,43 @@ func saveToken(file string, token *oauth.Token) {
 	gob.NewEncoder(f).Encode(token)
 }
 
+// pendingAuths holds a channel for each browser authorization in progress,
+// keyed by its state parameter, to which authHandler delivers the code.
+var (
+	authOnce     sync.Once
+	authMu       sync.Mutex
+	pendingAuths = make(map[string]chan string)
+)
+
+func authHandler(rw http.ResponseWriter, req *http.Request) {
+	authMu.Lock()
+	ch, ok := pendingAuths[req.FormValue("state")]
+	authMu.Unlock()
+	if !ok {
+		log.Printf("State doesn't match: req = %#v", req)
+		http.Error(rw, "", 500)
+		return
+	}
+	if code := req.FormValue("code"); code != "" {
+		authMu.Lock()
+		delete(pendingAuths, req.FormValue("state"))
+		authMu.Unlock()
+		fmt.Fprintf(rw, "<h1>Success</h1>Authorized.")
+		rw.(http.Flusher).Flush()
+		ch <- code
+		return
+	}
+	log.Printf("no code")
+	http.Error(rw, "", 500)
+}
+
 func tokenFromWeb(config *oauth.Config) *oauth.Token {
-	ch := make(chan string)
+	ch := make(chan string, 1)
 	randState := fmt.Sprintf("st%d", time.Now().UnixNano())
-	http.HandleFunc("/auth", func(rw http.ResponseWriter, req *http.Request) {
-		if req.FormValue("state") != randState {
-			log.Printf("State doesn't match: req = %#v", req)
-			http.Error(rw, "", 500)
-			return
-		}
-		if code := req.FormValue("code"); code != "" {
-			fmt.Fprintf(rw, "<h1>Success</h1>Authorized.")
-			rw.(http.Flusher).Flush()
-			ch <- code
-			return
-		}
-		log.Printf("no code")
-		http.Error(rw, "", 500)
-	})
+	authMu.Lock()
+	pendingAuths[randState] = ch
+	authMu.Unlock()
+	authOnce.Do(func() { http.HandleFunc("/auth", authHandler) })
 
 	config.RedirectURL = fmt.Sprintf("http://localhost:%s/auth", *port)
 	authUrl := config.AuthCodeURL(randState)
@@ -123,7 +154,9 @@ func openUrl(url string) {
 	log.Printf("Error opening URL in browser.")
 }
 
-func getOAuthClient(scope string) *http.Client {
+// getOAuthClient returns a client authorized for scope, by the token cached
+// for the given account label or else via the browser.
+func getOAuthClient(scope, account string) *http.Client {
 	// TODO: offer to cache clientid & secret if provided by flag
 	c := defaultClientId
 	s := defaultSecret
@@ -140,9 +173,12 @@ func getOAuthClient(scope string) *http.Client {
 		TokenURL:     "https://accounts.google.com/o/oauth2/token",
 	}
 
-	cacheFile := tokenCacheFile(config)
+	cacheFile := tokenCacheFile(config, account)
 	token, err := tokenFromFile(cacheFile)
 	if err != nil {
+		if account != "" {
+			log.Printf("Sign in to the Google account to mount as %q", account)
+		}
 		token = tokenFromWeb(config)
 		saveToken(cacheFile, token)
 	} else {
@@ -157,20 +193,117 @@ func getOAuthClient(scope string) *http.Client {
 	return t.Client()
 }
 
+// serviceAccountKey holds the fields we need from a service account's JSON key file.
+type serviceAccountKey struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+}
+
+// getServiceAccountClient returns a client authorized as the service account
+// whose JSON key is in keyFile, acting as --impersonate if it is set.
+func getServiceAccountClient(keyFile, scope string) (*http.Client, error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	var key serviceAccountKey
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, fmt.Errorf("parsing %v: %v", keyFile, err)
+	}
+	if key.ClientEmail == "" || key.PrivateKey == "" {
+		return nil, fmt.Errorf("%v is not a service account JSON key file", keyFile)
+	}
+	t := jwt.NewToken(key.ClientEmail, scope, []byte(key.PrivateKey))
+	if *impersonate != "" {
+		t.ClaimSet.Prn = *impersonate
+	}
+	return &http.Client{Transport: &jwtTransport{jwt: t}}, nil
+}
+
+// jwtTransport authorizes requests with an access token obtained by
+// asserting a JWT. Such tokens can't be refreshed, so a new one is asserted
+// whenever the current one expires.
+type jwtTransport struct {
+	sync.Mutex
+	jwt   *jwt.Token
+	token *oauth.Token
+}
+
+func (t *jwtTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.Lock()
+	if t.token == nil || t.token.Expired() {
+		token, err := t.jwt.Assert(&http.Client{})
+		if err != nil {
+			t.Unlock()
+			return nil, fmt.Errorf("service account token assertion failed: %v", err)
+		}
+		t.token = token
+	}
+	accessToken := t.token.AccessToken
+	t.Unlock()
+
+	// A RoundTripper must not modify the request it was given.
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("Authorization", "Bearer "+accessToken)
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+const (
+	// defaultTokenRefresh is how often to refresh a token with no known expiry.
+	defaultTokenRefresh = 59 * time.Minute
+	// minTokenRefresh is the soonest tokenKicker will refresh a token, and
+	// the delay before its first retry after a failure.
+	minTokenRefresh = 10 * time.Second
+	// maxTokenRetry caps the delay between retries of a failed refresh.
+	maxTokenRetry = 5 * time.Minute
+)
+
 // This is a terrible but simple hack.  The better fix is coming.
-func tokenKicker(client *http.Client, interval time.Duration) {
+//
+// tokenKicker refreshes the client's access token once 80% of its remaining
+// lifetime has passed, retrying with backoff on failure, until done is closed.
+func tokenKicker(client *http.Client, done <-chan struct{}) {
 	transport, ok := client.Transport.(*oauth.Transport)
 	if !ok {
 		log.Println("tokenKicker client must be an oauth client!")
 		return
 	}
 	log.Printf("access token expires: %s\n", transport.Token.Expiry)
+	delay := nextTokenRefresh(transport.Token)
+	retry := minTokenRefresh
 	for {
-		time.Sleep(interval)
+		select {
+		case <-done:
+			return
+		case <-time.After(delay):
+		}
 		if err := transport.Refresh(); err != nil {
-			log.Println("access token refresh failure: ", err)
-		} else {
-			log.Printf("access token refreshed!  expires: %s\n", transport.Token.Expiry)
+			delay = retry
+			log.Printf("access token refresh failure, retrying in %v: %v", delay, err)
+			if retry *= 2; retry > maxTokenRetry {
+				retry = maxTokenRetry
+			}
+			continue
 		}
+		log.Printf("access token refreshed!  expires: %s\n", transport.Token.Expiry)
+		delay = nextTokenRefresh(transport.Token)
+		retry = minTokenRefresh
+	}
+}
+
+// nextTokenRefresh returns how long to wait before refreshing token.
+func nextTokenRefresh(token *oauth.Token) time.Duration {
+	if token.Expiry.IsZero() {
+		return defaultTokenRefresh
+	}
+	delay := time.Until(token.Expiry) * 8 / 10
+	if delay < minTokenRefresh {
+		delay = minTokenRefresh
 	}
+	return delay
 }